@@ -2,13 +2,18 @@ package controllers
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/config"
 	"github.com/uc-cdis/cohort-middleware/middlewares"
 	"github.com/uc-cdis/cohort-middleware/models"
 	"github.com/uc-cdis/cohort-middleware/utils"
@@ -59,20 +64,13 @@ func (u CohortDataController) RetrieveHistogramForCohortIdAndConceptId(c *gin.Co
 		return
 	}
 
-	cohortData, err := u.cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortId, histogramConceptId, filterConceptIds, cohortPairs)
+	histogramData, err := u.cohortDataModel.RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(c.Request.Context(), sourceId, cohortId, histogramConceptId, filterConceptIds, cohortPairs)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept details", "error": err.Error()})
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving concept details", "error": err.Error()})
 		c.Abort()
 		return
 	}
 
-	conceptValues := []float64{}
-	for _, personData := range cohortData {
-		conceptValues = append(conceptValues, float64(*personData.ConceptValueAsNumber))
-	}
-
-	histogramData := utils.GenerateHistogramData(conceptValues)
-
 	c.JSON(http.StatusOK, gin.H{"bins": histogramData})
 }
 
@@ -109,18 +107,18 @@ func (u CohortDataController) RetrieveDataBySourceIdAndCohortIdAndVariables(c *g
 	}
 
 	// call model method:
-	cohortData, err := u.cohortDataModel.RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId, cohortId, conceptIds)
+	cohortData, err := u.cohortDataModel.RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(c.Request.Context(), sourceId, cohortId, conceptIds)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept details", "error": err.Error()})
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving concept details", "error": err.Error()})
 		c.Abort()
 		return
 	}
 
 	partialCSV := GeneratePartialCSV(sourceId, cohortData, conceptIds)
 
-	personIdToCSVValues, err := u.RetrievePeopleIdAndCohort(sourceId, cohortId, cohortPairs, cohortData)
+	personIdToCSVValues, err := u.RetrievePeopleIdAndCohort(c.Request.Context(), sourceId, cohortId, cohortPairs, cohortData)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving people ID to csv value map", "error": err.Error()})
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving people ID to csv value map", "error": err.Error()})
 		c.Abort()
 		return
 	}
@@ -270,10 +268,10 @@ func (u CohortDataController) RetrieveCohortOverlapStats(c *gin.Context) {
 		c.Abort()
 		return
 	}
-	overlapStats, err := u.cohortDataModel.RetrieveCohortOverlapStats(sourceId, caseCohortId,
+	overlapStats, err := u.cohortDataModel.RetrieveCohortOverlapStats(c.Request.Context(), sourceId, caseCohortId,
 		controlCohortId, conceptIds, cohortPairs)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving stats", "error": err.Error()})
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving stats", "error": err.Error()})
 		c.Abort()
 		return
 	}
@@ -321,7 +319,7 @@ func getAllPeopleIdInCohortData(cohortData []*models.PersonConceptAndValue) []in
 	return personIds
 }
 
-func (u CohortDataController) RetrievePeopleIdAndCohort(sourceId int, cohortId int, cohortPairs []utils.CustomDichotomousVariableDef, cohortData []*models.PersonConceptAndValue) (map[int64]map[string]string, error) {
+func (u CohortDataController) RetrievePeopleIdAndCohort(ctx context.Context, sourceId int, cohortId int, cohortPairs []utils.CustomDichotomousVariableDef, cohortData []*models.PersonConceptAndValue) (map[int64]map[string]string, error) {
 	peopleIds := getAllPeopleIdInCohortData(cohortData)
 
 	/**
@@ -337,10 +335,10 @@ func (u CohortDataController) RetrievePeopleIdAndCohort(sourceId int, cohortId i
 		secondCohortDefinitionId := cohortPair.CohortDefinitionId2
 		cohortPairKey := utils.GetCohortPairKey(firstCohortDefinitionId, secondCohortDefinitionId)
 
-		firstCohortPeopleData, err1 := u.cohortDataModel.RetrieveDataByOriginalCohortAndNewCohort(sourceId, cohortId, firstCohortDefinitionId)
-		secondCohortPeopleData, err2 := u.cohortDataModel.RetrieveDataByOriginalCohortAndNewCohort(sourceId, cohortId, secondCohortDefinitionId)
+		firstCohortPeopleData, err1 := u.cohortDataModel.RetrieveDataByOriginalCohortAndNewCohort(ctx, sourceId, cohortId, firstCohortDefinitionId)
+		secondCohortPeopleData, err2 := u.cohortDataModel.RetrieveDataByOriginalCohortAndNewCohort(ctx, sourceId, cohortId, secondCohortDefinitionId)
 		if err1 != nil || err2 != nil {
-			return nil, fmt.Errorf("getting cohort people data failed")
+			return nil, fmt.Errorf("getting cohort people data failed: %w", errors.Join(err1, err2))
 		}
 		firstCohortPeopleMap := convertCohortPeopleDataToMap(firstCohortPeopleData)
 		secondCohortPeopleMap := convertCohortPeopleDataToMap(secondCohortPeopleData)
@@ -359,20 +357,390 @@ func (u CohortDataController) RetrievePeopleIdAndCohort(sourceId int, cohortId i
 	return personIdToCSVValues, nil
 }
 
+// the query parameters that make RetrieveDataDictionary return a page of entries instead of the whole data dictionary:
+var dataDictionarySearchParams = []string{"search", "vocabulary-id", "concept-class-id", "value-stored-as", "min-population", "sort", "page", "page-size"}
+
+const defaultDataDictionaryPageSize = 50
+const maxDataDictionaryPageSize = 1000
+
 func (u CohortDataController) RetrieveDataDictionary(c *gin.Context) {
+	format := c.DefaultQuery("format", DataDictionaryFormatJson)
+	if !utils.ContainsString([]string{DataDictionaryFormatJson, DataDictionaryFormatCsv, DataDictionaryFormatXlsx, DataDictionaryFormatCodebook}, format) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": fmt.Sprintf("bad request - unsupported format '%s'", format)})
+		c.Abort()
+		return
+	}
+	for _, param := range dataDictionarySearchParams {
+		if _, ok := c.GetQuery(param); ok {
+			u.searchDataDictionary(c, format)
+			return
+		}
+	}
 
-	var dataDictionary, error = u.dataDictionaryModel.GetDataDictionary()
+	var dataDictionary, error = u.dataDictionaryModel.GetDataDictionary(c.Request.Context())
 
 	if dataDictionary == nil {
-		c.JSON(http.StatusServiceUnavailable, error)
-	} else {
+		c.JSON(getDataDictionaryErrorStatus(error), error)
+	} else if format == DataDictionaryFormatJson {
 		c.JSON(http.StatusOK, dataDictionary)
+	} else {
+		var entries []*models.DataDictionaryResult
+		if err := json.Unmarshal(dataDictionary.Data, &entries); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error parsing data dictionary", "error": err.Error()})
+			c.Abort()
+			return
+		}
+		exportDataDictionary(c, entries, format)
+	}
+
+}
+
+func (u CohortDataController) searchDataDictionary(c *gin.Context, format string) {
+	dataDictionaryQuery, err := parseDataDictionaryQuery(c)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	dataDictionaryPage, err := u.dataDictionaryModel.SearchDataDictionary(c.Request.Context(), *dataDictionaryQuery)
+	if err != nil {
+		c.JSON(getDataDictionaryErrorStatus(err), gin.H{"message": "Error retrieving data dictionary", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	if format == DataDictionaryFormatJson {
+		c.JSON(http.StatusOK, dataDictionaryPage)
+	} else {
+		exportDataDictionary(c, dataDictionaryPage.Data, format)
+	}
+}
+
+// Returns 503 if the data dictionary is not generated yet, or the status of the data source error otherwise.
+func getDataDictionaryErrorStatus(err error) int {
+	if errors.Is(err, models.ErrDataDictionaryNotAvailable) {
+		return http.StatusServiceUnavailable
+	}
+	return getDataSourceErrorStatus(err)
+}
+
+// Writes the given data dictionary entries as a file download in the given (non-json) format.
+func exportDataDictionary(c *gin.Context, entries []*models.DataDictionaryResult, format string) {
+	var b *bytes.Buffer
+	var err error
+	contentType := "text/csv"
+	fileName := "data_dictionary.csv"
+	switch format {
+	case DataDictionaryFormatCsv:
+		b, err = GenerateDataDictionaryCSV(entries)
+	case DataDictionaryFormatCodebook:
+		b, err = GenerateDataDictionaryCodebook(entries)
+		fileName = "data_dictionary_codebook.csv"
+	case DataDictionaryFormatXlsx:
+		b, err = GenerateDataDictionaryXLSX(entries)
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		fileName = "data_dictionary.xlsx"
+	}
+	if err != nil {
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error exporting data dictionary", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
+	c.Data(http.StatusOK, contentType, b.Bytes())
+}
+
+func parseDataDictionaryQuery(c *gin.Context) (*models.DataDictionaryQuery, error) {
+	page, pageSize, err := utils.ParsePaginationArgs(c, defaultDataDictionaryPageSize, maxDataDictionaryPageSize)
+	if err != nil {
+		return nil, err
+	}
+	dataDictionaryQuery := models.DataDictionaryQuery{
+		Search:          c.Query("search"),
+		VocabularyIDs:   utils.ParseListQueryArg(c, "vocabulary-id"),
+		ConceptClassIDs: utils.ParseListQueryArg(c, "concept-class-id"),
+		ValueStoredAs:   c.Query("value-stored-as"),
+		Page:            page,
+		PageSize:        pageSize,
+	}
+	if minPopulation := c.Query("min-population"); minPopulation != "" {
+		dataDictionaryQuery.MinPopulation, err = strconv.ParseInt(minPopulation, 10, 64)
+		if err != nil || dataDictionaryQuery.MinPopulation < 0 {
+			return nil, errors.New("bad request - min-population should be a positive number")
+		}
+	}
+	// sort on a field name, optionally prefixed with "-" for descending order:
+	if sort := c.Query("sort"); sort != "" {
+		dataDictionaryQuery.SortDescending = strings.HasPrefix(sort, "-")
+		dataDictionaryQuery.SortBy = strings.TrimPrefix(sort, "-")
+		if !models.IsValidDataDictionarySortField(dataDictionaryQuery.SortBy) {
+			return nil, fmt.Errorf("bad request - cannot sort on '%s'", dataDictionaryQuery.SortBy)
+		}
+	}
+	return &dataDictionaryQuery, nil
+}
+
+func (u CohortDataController) RetrieveCohortDataDictionary(c *gin.Context) {
+	argErrors := make([]error, 2)
+	var sourceId, cohortId int
+	sourceId, argErrors[0] = utils.ParseNumericArg(c, "sourceid")
+	cohortId, argErrors[1] = utils.ParseNumericArg(c, "cohortid")
+	if utils.ContainsNonNil(argErrors) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
+		c.Abort()
+		return
+	}
+	validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohort(c, cohortId)
+	if !validAccessRequest {
+		log.Printf("Error: invalid request")
+		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
+		c.Abort()
+		return
+	}
+
+	cohortDataDictionary, err := u.dataDictionaryModel.GetCohortDataDictionary(c.Request.Context(), sourceId, cohortId)
+	if errors.Is(err, models.ErrCohortNotGenerated) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "cohort data dictionary not available", "error": err.Error()})
+		c.Abort()
+		return
+	} else if err != nil {
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving cohort data dictionary", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.JSON(http.StatusOK, cohortDataDictionary)
+}
+
+// Streams the subject_id, cohort_start_date and cohort_end_date of each member of the cohort, as JSON (default) or as CSV (format=csv).
+// As for the full data export, the team project of the request should have access to the cohort (see the router for the policy on person level data).
+func (u CohortDataController) RetrieveCohortMembers(c *gin.Context) {
+	errors := make([]error, 2)
+	var sourceId, cohortId int
+	sourceId, errors[0] = utils.ParseNumericArg(c, "sourceid")
+	cohortId, errors[1] = utils.ParseNumericArg(c, "cohortid")
+	if utils.ContainsNonNil(errors) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
+		c.Abort()
+		return
+	}
+	format := c.DefaultQuery("format", CohortMembersFormatJson)
+	if format != CohortMembersFormatJson && format != CohortMembersFormatCsv {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": "bad request - format should be json or csv"})
+		c.Abort()
+		return
+	}
+	validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohort(c, cohortId)
+	if !validAccessRequest {
+		log.Printf("Error: invalid request")
+		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
+		c.Abort()
+		return
+	}
+
+	membersWriter := newCohortMembersWriter(format, c.Writer)
+	// the response is only started when the first member is read, so that query errors can still be reported with a proper status:
+	started := false
+	startResponse := func() error {
+		started = true
+		c.Header("Content-Type", membersWriter.ContentType())
+		if format == CohortMembersFormatCsv {
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=cohort_%d_members.csv", cohortId))
+		}
+		c.Status(http.StatusOK)
+		return membersWriter.WriteHeader()
+	}
+	err := u.cohortDataModel.StreamCohortMembers(c.Request.Context(), sourceId, cohortId, func(member *models.CohortMember) error {
+		if !started {
+			if err := startResponse(); err != nil {
+				return err
+			}
+		}
+		return membersWriter.WriteMember(member)
+	})
+	if err == nil && !started {
+		err = startResponse()
+	}
+	if err == nil {
+		err = membersWriter.Close()
 	}
+	if err != nil && !started {
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving cohort members", "error": err.Error()})
+		c.Abort()
+		return
+	} else if err != nil {
+		// the status was already sent, so all we can do is to stop the response:
+		log.Printf("ERROR: failed to stream the members of cohort %d: %v", cohortId, err)
+		c.Abort()
+		return
+	}
+	c.Writer.Flush()
+}
 
+// Returns the cohort building attrition of the cohort: how many persons are left after each of its Atlas inclusion rules.
+func (u CohortDataController) RetrieveInclusionRuleAttrition(c *gin.Context) {
+	attrition, ok := u.getInclusionRuleAttrition(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"inclusion_rule_attrition": attrition})
+}
+
+// Returns the cohort building attrition of the cohort as CSV, with the same "Cohort" and "Size" columns as the attrition table
+// of ConceptController.RetrieveAttritionTable: one row with the persons that have an entry event, and a row per inclusion rule.
+func (u CohortDataController) RetrieveInclusionRuleAttritionCSV(c *gin.Context) {
+	attrition, ok := u.getInclusionRuleAttrition(c)
+	if !ok {
+		return
+	}
+	headerAndNonFilteredRow := [][]string{
+		{"Cohort", "Size"},
+		{attrition.CohortName, strconv.FormatInt(attrition.BaseCount, 10)},
+	}
+	var inclusionRuleRows [][]string
+	for _, inclusionRule := range attrition.InclusionRules {
+		inclusionRuleRows = append(inclusionRuleRows, []string{inclusionRule.RuleName, strconv.FormatInt(inclusionRule.PersonCount, 10)})
+	}
+	b := GenerateAttritionCSV(headerAndNonFilteredRow, inclusionRuleRows)
+	c.String(http.StatusOK, b.String())
+}
+
+// Parses the source and cohort ids, checks the access to the cohort and gets its inclusion rule attrition.
+// Writes the error response and returns false if any of this fails.
+func (u CohortDataController) getInclusionRuleAttrition(c *gin.Context) (*models.CohortInclusionAttrition, bool) {
+	argErrors := make([]error, 2)
+	var sourceId, cohortId int
+	sourceId, argErrors[0] = utils.ParseNumericArg(c, "sourceid")
+	cohortId, argErrors[1] = utils.ParseNumericArg(c, "cohortid")
+	if utils.ContainsNonNil(argErrors) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
+		c.Abort()
+		return nil, false
+	}
+	validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohort(c, cohortId)
+	if !validAccessRequest {
+		log.Printf("Error: invalid request")
+		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
+		c.Abort()
+		return nil, false
+	}
+	attrition, err := u.cohortDataModel.RetrieveInclusionRuleAttrition(c.Request.Context(), sourceId, cohortId)
+	if errors.Is(err, models.ErrCohortInclusionStatsNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Error retrieving inclusion rule attrition", "error": err.Error()})
+		c.Abort()
+		return nil, false
+	} else if err != nil {
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving inclusion rule attrition", "error": err.Error()})
+		c.Abort()
+		return nil, false
+	}
+	return attrition, true
 }
 
 func (u CohortDataController) GenerateDataDictionary(c *gin.Context) {
 	log.Printf("Generating Data Dictionary...")
-	go u.dataDictionaryModel.GenerateDataDictionary()
-	c.JSON(http.StatusOK, "Data Dictionary Kicked Off")
+	mode, err := models.ParseDataDictionaryGenerationMode(c.Query("mode"))
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	// a full generation replaces the whole data dictionary, so it should not be started by just following a link:
+	if mode == models.DataDictionaryGenerationModeFull && c.Request.Method != http.MethodPost {
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"message": "a full Data Dictionary generation should be requested with POST"})
+		c.Abort()
+		return
+	}
+	generationRun, err := u.dataDictionaryModel.StartDataDictionaryGeneration(mode)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		c.JSON(http.StatusConflict, gin.H{"message": "Data Dictionary generation not started", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Data Dictionary Kicked Off", "generation_run": generationRun})
+}
+
+func (u CohortDataController) RetrieveDataDictionaryGenerationStatus(c *gin.Context) {
+	generationRun := u.dataDictionaryModel.GetDataDictionaryGenerationRun()
+	if generationRun == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "no Data Dictionary generation run found"})
+		c.Abort()
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"generation_run": generationRun})
+}
+
+func (u CohortDataController) RetrieveDataDictionarySnapshots(c *gin.Context) {
+	snapshots, err := u.dataDictionaryModel.GetDataDictionarySnapshots(c.Request.Context())
+	if err != nil {
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving data dictionary snapshots", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"snapshots": snapshots})
+}
+
+// the default relative change in mean or standard deviation above which a diff reports a distribution shift:
+const defaultDataDictionarySnapshotDiffThreshold = 0.1
+
+func (u CohortDataController) DiffDataDictionarySnapshots(c *gin.Context) {
+	argErrors := make([]error, 2)
+	var fromSnapshotId, toSnapshotId int64
+	fromSnapshotId, argErrors[0] = utils.ParseBigNumericArg(c, "fromsnapshotid")
+	toSnapshotId, argErrors[1] = utils.ParseBigNumericArg(c, "tosnapshotid")
+	if utils.ContainsNonNil(argErrors) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
+		c.Abort()
+		return
+	}
+	threshold := defaultDataDictionarySnapshotDiffThreshold
+	if config.GetConfig().IsSet("data_dictionary_snapshot_diff_threshold") {
+		threshold = config.GetConfig().GetFloat64("data_dictionary_snapshot_diff_threshold")
+	}
+	if thresholdArg := c.Query("threshold"); thresholdArg != "" {
+		var err error
+		threshold, err = strconv.ParseFloat(thresholdArg, 64)
+		if err != nil || threshold < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": "bad request - threshold should be a positive number"})
+			c.Abort()
+			return
+		}
+	}
+
+	diff, err := u.dataDictionaryModel.DiffDataDictionarySnapshots(c.Request.Context(), fromSnapshotId, toSnapshotId, threshold)
+	if errors.Is(err, models.ErrDataDictionarySnapshotNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "data dictionary snapshot not found", "error": err.Error()})
+		c.Abort()
+		return
+	} else if err != nil {
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error comparing data dictionary snapshots", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"diff": diff})
+}
+
+func (u CohortDataController) RefreshDataDictionaryConcept(c *gin.Context) {
+	conceptId, err := utils.ParseBigNumericArg(c, "conceptid")
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	dataDictionaryResult, err := u.dataDictionaryModel.RefreshDataDictionaryConcept(c.Request.Context(), conceptId)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		statusCode := getDataSourceErrorStatus(err)
+		if errors.Is(err, models.ErrConceptNotInDataDictionary) {
+			statusCode = http.StatusNotFound
+		} else if errors.Is(err, models.ErrDataDictionaryGenerationInProgress) {
+			statusCode = http.StatusConflict
+		}
+		c.JSON(statusCode, gin.H{"message": "Error refreshing Data Dictionary entry", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data_dictionary_entry": dataDictionaryResult})
 }
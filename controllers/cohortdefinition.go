@@ -1,10 +1,16 @@
 package controllers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/uc-cdis/cohort-middleware/config"
@@ -38,7 +44,7 @@ func (u CohortDefinitionController) RetriveById(c *gin.Context) {
 			c.Abort()
 			return
 		}
-		cohortDefinition, err := u.cohortDefinitionModel.GetCohortDefinitionById(cohortDefinitionId)
+		cohortDefinition, err := u.cohortDefinitionModel.GetCohortDefinitionById(c.Request.Context(), cohortDefinitionId)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving cohortDefinition", "error": err.Error()})
 			c.Abort()
@@ -51,6 +57,231 @@ func (u CohortDefinitionController) RetriveById(c *gin.Context) {
 	c.Abort()
 }
 
+// Returns the Atlas cohort expression of the cohort as a structured object, together with a human readable summary of it.
+func (u CohortDefinitionController) RetrieveExpressionById(c *gin.Context) {
+	cohortDefinitionId, err := utils.ParseNumericArg(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohort(c, cohortDefinitionId)
+	if !validAccessRequest {
+		log.Printf("Error: invalid request")
+		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
+		c.Abort()
+		return
+	}
+	cohortDefinition, err := u.cohortDefinitionModel.GetCohortDefinitionById(c.Request.Context(), cohortDefinitionId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving cohortDefinition", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	if cohortDefinition == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "cohort definition not found"})
+		c.Abort()
+		return
+	}
+	cohortExpression, err := models.ParseCohortExpression(cohortDefinition.Expression)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error parsing cohort expression", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"cohort_expression": cohortExpression, "summary": cohortExpression.Summary()})
+}
+
+// Returns the cohort_generation_info of the cohort for each source it was generated for.
+func (u CohortDefinitionController) RetrieveGenerationInfoById(c *gin.Context) {
+	cohortDefinitionId, err := utils.ParseNumericArg(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohort(c, cohortDefinitionId)
+	if !validAccessRequest {
+		log.Printf("Error: invalid request")
+		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
+		c.Abort()
+		return
+	}
+	cohortGenerationDetails, err := u.cohortDefinitionModel.GetCohortGenerationDetails(c.Request.Context(), cohortDefinitionId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving cohort generation info", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"cohort_generation_info": cohortGenerationDetails})
+}
+
+// The body of the requests that create a new cohort definition, owned by the given team project:
+type newCohortRequest struct {
+	Name        string                   `json:"name"`
+	Description string                   `json:"description"`
+	TeamProject string                   `json:"team_project"`
+	PersonIds   []int64                  `json:"person_ids"`
+	Members     []newCohortMemberRequest `json:"members"`
+	Expression  string                   `json:"expression"`
+}
+
+// A member of a new cohort with the (optional) dates of its cohort era, formatted as yyyy-mm-dd:
+type newCohortMemberRequest struct {
+	PersonId        int64  `json:"person_id"`
+	CohortStartDate string `json:"cohort_start_date"`
+	CohortEndDate   string `json:"cohort_end_date"`
+}
+
+// Creates a new cohort definition, owned by the given team project, with the uploaded persons as its members.
+// The persons are given as "person_ids", or as "members" with a "person_id" and optionally a "cohort_start_date"
+// and "cohort_end_date" (yyyy-mm-dd). The members without dates get the first start date and the last end date
+// of their observation periods as cohort start and end date, and are rejected if they have no observation period.
+func (u CohortDefinitionController) CreateCohortFromPersonIds(c *gin.Context) {
+	sourceId, request, ok := u.parseNewCohortRequest(c)
+	if !ok {
+		return
+	}
+	members, err := getNewCohortMembers(request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error while parsing request", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	cohortDefinition, err := u.cohortDefinitionModel.CreateCohortFromPersonIds(c.Request.Context(), sourceId, request.Name, request.Description, request.TeamProject, members)
+	if err != nil {
+		c.JSON(getCohortCreationErrorStatus(err), gin.H{"message": "Error creating cohort", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"cohort_definition": cohortDefinition})
+}
+
+func getNewCohortMembers(request *newCohortRequest) ([]models.NewCohortMember, error) {
+	var members []models.NewCohortMember
+	for _, personId := range request.PersonIds {
+		members = append(members, models.NewCohortMember{PersonId: personId})
+	}
+	for _, memberRequest := range request.Members {
+		member := models.NewCohortMember{PersonId: memberRequest.PersonId}
+		var err error
+		if memberRequest.CohortStartDate != "" {
+			if member.CohortStartDate, err = time.Parse(time.DateOnly, memberRequest.CohortStartDate); err != nil {
+				return nil, fmt.Errorf("invalid cohort_start_date of person %d: %w", memberRequest.PersonId, err)
+			}
+		}
+		if memberRequest.CohortEndDate != "" {
+			if member.CohortEndDate, err = time.Parse(time.DateOnly, memberRequest.CohortEndDate); err != nil {
+				return nil, fmt.Errorf("invalid cohort_end_date of person %d: %w", memberRequest.PersonId, err)
+			}
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// Creates a new cohort definition, owned by the given team project, with the result of a set expression
+// over existing cohorts as its members, e.g. "(1 & 2) - 3" for the persons in cohorts 1 and 2 that are not in cohort 3.
+func (u CohortDefinitionController) CreateCohortFromSetExpression(c *gin.Context) {
+	sourceId, request, ok := u.parseNewCohortRequest(c)
+	if !ok {
+		return
+	}
+	expression, err := utils.ParseCohortSetExpression(request.Expression)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error while parsing request", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	// the user should have access to all cohorts of the expression:
+	validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohortIdsList(c, expression.CohortDefinitionIds())
+	if !validAccessRequest {
+		log.Printf("Error: invalid request")
+		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
+		c.Abort()
+		return
+	}
+	// and the members of the new cohort should not be taken from cohorts that the team project itself has no access to,
+	// e.g. from the cohorts of another team project of the same user:
+	teamProjectCohortDefinitionIds, err := u.getCohortDefinitionIdsForTeamProjectAndGlobalReaderRole(c.Request.Context(), request.TeamProject)
+	if err != nil {
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving the cohorts of the team project", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	if otherCohortDefinitionIds := utils.Subtract(expression.CohortDefinitionIds(), teamProjectCohortDefinitionIds); len(otherCohortDefinitionIds) > 0 {
+		log.Printf("Error: cohorts %v are not part of team project %s", otherCohortDefinitionIds, request.TeamProject)
+		c.JSON(http.StatusForbidden, gin.H{"message": "access denied",
+			"error": fmt.Sprintf("cohorts %v do not belong to team project %s", otherCohortDefinitionIds, request.TeamProject)})
+		c.Abort()
+		return
+	}
+	cohortDefinition, err := u.cohortDefinitionModel.CreateCohortFromSetExpression(c.Request.Context(), sourceId, request.Name, request.Description, request.TeamProject, expression)
+	if err != nil {
+		c.JSON(getCohortCreationErrorStatus(err), gin.H{"message": "Error creating cohort", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"cohort_definition": cohortDefinition})
+}
+
+// Parses the source id and the request body and checks if the user has access to the team project of the new cohort.
+// Writes the error response and returns false if any of this fails.
+func (u CohortDefinitionController) parseNewCohortRequest(c *gin.Context) (int, *newCohortRequest, bool) {
+	sourceId, err := utils.ParseNumericArg(c, "sourceid")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
+		c.Abort()
+		return -1, nil, false
+	}
+	var request newCohortRequest
+	if c.Request == nil || c.Request.Body == nil {
+		err = errors.New("bad request - no request body")
+	} else {
+		err = json.NewDecoder(c.Request.Body).Decode(&request)
+	}
+	if err == nil && (request.Name == "" || request.TeamProject == "") {
+		err = errors.New("bad request - name and team_project are mandatory")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error while parsing request", "error": err.Error()})
+		c.Abort()
+		return -1, nil, false
+	}
+	validAccessRequest := u.teamProjectAuthz.HasAccessToTeamProject(c, request.TeamProject)
+	if !validAccessRequest {
+		log.Printf("Error: invalid request")
+		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
+		c.Abort()
+		return -1, nil, false
+	}
+	return sourceId, &request, true
+}
+
+// Returns the ids of the cohorts of the team project and of the cohorts shared with the default global reader role.
+func (u CohortDefinitionController) getCohortDefinitionIdsForTeamProjectAndGlobalReaderRole(ctx context.Context, teamProject string) ([]int, error) {
+	cohortDefinitionIds, err := u.cohortDefinitionModel.GetCohortDefinitionIdsForTeamProject(ctx, teamProject)
+	if err != nil {
+		return nil, err
+	}
+	globalCohortDefinitionIds, err := u.cohortDefinitionModel.GetCohortDefinitionIdsForTeamProject(ctx, config.GetConfig().GetString("global_reader_role"))
+	if err != nil {
+		return nil, err
+	}
+	return append(cohortDefinitionIds, globalCohortDefinitionIds...), nil
+}
+
+func getCohortCreationErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, models.ErrCohortNameAlreadyExists):
+		return http.StatusConflict
+	case errors.Is(err, models.ErrTeamProjectNotFound), errors.Is(err, models.ErrPersonIdsNotFound), errors.Is(err, models.ErrEmptyCohort),
+		errors.Is(err, models.ErrCohortNotGenerated), errors.Is(err, models.ErrObservationPeriodNotFound), errors.Is(err, models.ErrInvalidCohortDates):
+		return http.StatusBadRequest
+	}
+	return getDataSourceErrorStatus(err)
+}
+
 func (u CohortDefinitionController) RetriveStatsBySourceIdAndTeamProject(c *gin.Context) {
 	// This method returns ALL cohortdefinition entries for a teamProject with cohort size statistics (for a given source).
 	// If the user has access to the default global reader role, the cohorts that are part of that role are also returned.
@@ -71,9 +302,9 @@ func (u CohortDefinitionController) RetriveStatsBySourceIdAndTeamProject(c *gin.
 	}
 
 	if err1 == nil {
-		cohortDefinitionsAndStats, err := u.cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(sourceId, teamProject)
+		cohortDefinitionsAndStats, err := u.cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(c.Request.Context(), sourceId, teamProject)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving cohortDefinitions for 'team project' role", "error": err.Error()})
+			c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving cohortDefinitions for 'team project' role", "error": err.Error()})
 			c.Abort()
 			return
 		}
@@ -82,9 +313,9 @@ func (u CohortDefinitionController) RetriveStatsBySourceIdAndTeamProject(c *gin.
 		conf := config.GetConfig()
 		globalReaderRole := conf.GetString("global_reader_role")
 		log.Printf("INFO: found %s as global_reader_role", globalReaderRole)
-		globalCohortDefinitionsAndStats, err := u.cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(sourceId, globalReaderRole)
+		globalCohortDefinitionsAndStats, err := u.cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(c.Request.Context(), sourceId, globalReaderRole)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving cohortDefinition for 'global reader' role", "error": err.Error()})
+			c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving cohortDefinition for 'global reader' role", "error": err.Error()})
 			c.Abort()
 			return
 		}
@@ -102,6 +333,79 @@ func (u CohortDefinitionController) RetriveStatsBySourceIdAndTeamProject(c *gin.
 	c.Abort()
 }
 
+const defaultCohortDefinitionPageSize = 50
+const maxCohortDefinitionPageSize = 1000
+
+// Returns a page of the cohort definitions of a teamProject and of the default global reader role, with their
+// size and generation status in the given source. Supports the optional "search", "sort" (size, name or modified,
+// optionally prefixed with "-" for descending order), "page", "page-size" and "include-ungenerated" query parameters.
+func (u CohortDefinitionController) SearchCohortDefinitions(c *gin.Context) {
+	sourceId, err := utils.ParseNumericArg(c, "sourceid")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	teamProject := c.Query("team-project")
+	if teamProject == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error while parsing request", "error": "team-project is a mandatory parameter but was found to be empty!"})
+		c.Abort()
+		return
+	}
+	cohortDefinitionQuery, err := parseCohortDefinitionQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error while parsing request", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	validAccessRequest := u.teamProjectAuthz.HasAccessToTeamProject(c, teamProject)
+	if !validAccessRequest {
+		log.Printf("Error: invalid request")
+		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
+		c.Abort()
+		return
+	}
+	// as in RetriveStatsBySourceIdAndTeamProject, also include the cohorts shared with the default global role:
+	globalReaderRole := config.GetConfig().GetString("global_reader_role")
+	cohortDefinitionQuery.TeamProjects = utils.MakeUnique([]string{teamProject, globalReaderRole})
+	cohortDefinitionPage, err := u.cohortDefinitionModel.SearchCohortDefinitions(c.Request.Context(), sourceId, *cohortDefinitionQuery)
+	if err != nil {
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving cohortDefinitions for 'team project' role", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.JSON(http.StatusOK, cohortDefinitionPage)
+}
+
+func parseCohortDefinitionQuery(c *gin.Context) (*models.CohortDefinitionQuery, error) {
+	page, pageSize, err := utils.ParsePaginationArgs(c, defaultCohortDefinitionPageSize, maxCohortDefinitionPageSize)
+	if err != nil {
+		return nil, err
+	}
+	cohortDefinitionQuery := models.CohortDefinitionQuery{
+		Search:         c.Query("search"),
+		SortBy:         "size",
+		SortDescending: true,
+		Page:           page,
+		PageSize:       pageSize,
+	}
+	if includeUngenerated := c.Query("include-ungenerated"); includeUngenerated != "" {
+		cohortDefinitionQuery.IncludeUngenerated, err = strconv.ParseBool(includeUngenerated)
+		if err != nil {
+			return nil, errors.New("bad request - include-ungenerated should be true or false")
+		}
+	}
+	// sort on a field name, optionally prefixed with "-" for descending order:
+	if sort := c.Query("sort"); sort != "" {
+		cohortDefinitionQuery.SortDescending = strings.HasPrefix(sort, "-")
+		cohortDefinitionQuery.SortBy = strings.TrimPrefix(sort, "-")
+		if !models.IsValidCohortDefinitionSortField(cohortDefinitionQuery.SortBy) {
+			return nil, fmt.Errorf("bad request - cannot sort on '%s'", cohortDefinitionQuery.SortBy)
+		}
+	}
+	return &cohortDefinitionQuery, nil
+}
+
 func MakeUniqueListOfCohortStats(input []*models.CohortDefinitionStats) []*models.CohortDefinitionStats {
 	uniqueMap := make(map[int]bool)
 	var uniqueList []*models.CohortDefinitionStats
@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"github.com/uc-cdis/cohort-middleware/models"
+)
+
+const (
+	CohortMembersFormatJson = "json"
+	CohortMembersFormatCsv  = "csv"
+)
+
+// number of members written between flushes of the response:
+const cohortMembersFlushInterval = 1000
+
+// Writes the members of a cohort to a (streamed) response, one member at a time.
+type cohortMembersWriter interface {
+	ContentType() string
+	WriteHeader() error
+	WriteMember(member *models.CohortMember) error
+	// writes anything left to write, after the last member:
+	Close() error
+}
+
+func newCohortMembersWriter(format string, w io.Writer) cohortMembersWriter {
+	if format == CohortMembersFormatCsv {
+		return &cohortMembersCsvWriter{csvWriter: csv.NewWriter(w)}
+	}
+	return &cohortMembersJsonWriter{w: w}
+}
+
+type cohortMembersCsvWriter struct {
+	csvWriter *csv.Writer
+	count     int
+}
+
+func (u *cohortMembersCsvWriter) ContentType() string {
+	return "text/csv"
+}
+
+func (u *cohortMembersCsvWriter) WriteHeader() error {
+	return u.csvWriter.Write([]string{"subject_id", "cohort_start_date", "cohort_end_date"})
+}
+
+func (u *cohortMembersCsvWriter) WriteMember(member *models.CohortMember) error {
+	err := u.csvWriter.Write([]string{strconv.FormatInt(member.SubjectId, 10),
+		member.CohortStartDate.Format("2006-01-02"), member.CohortEndDate.Format("2006-01-02")})
+	if err != nil {
+		return err
+	}
+	u.count++
+	if u.count%cohortMembersFlushInterval == 0 {
+		u.csvWriter.Flush()
+		return u.csvWriter.Error()
+	}
+	return nil
+}
+
+func (u *cohortMembersCsvWriter) Close() error {
+	u.csvWriter.Flush()
+	return u.csvWriter.Error()
+}
+
+// Writes the members as {"cohort_members": [...]}:
+type cohortMembersJsonWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (u *cohortMembersJsonWriter) ContentType() string {
+	return "application/json; charset=utf-8"
+}
+
+func (u *cohortMembersJsonWriter) WriteHeader() error {
+	_, err := io.WriteString(u.w, `{"cohort_members":[`)
+	return err
+}
+
+func (u *cohortMembersJsonWriter) WriteMember(member *models.CohortMember) error {
+	memberJson, err := json.Marshal(member)
+	if err != nil {
+		return err
+	}
+	if u.count > 0 {
+		memberJson = append([]byte(","), memberJson...)
+	}
+	u.count++
+	_, err = u.w.Write(memberJson)
+	return err
+}
+
+func (u *cohortMembersJsonWriter) Close() error {
+	_, err := io.WriteString(u.w, "]}")
+	return err
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
 	"fmt"
 	"log"
@@ -34,10 +35,10 @@ func (u ConceptController) RetriveAllBySourceId(c *gin.Context) {
 
 	if sourceId != "" {
 		sourceId, _ := strconv.Atoi(sourceId)
-		concepts, err := u.conceptModel.RetriveAllBySourceId(sourceId)
+		concepts, err := u.conceptModel.RetriveAllBySourceId(c.Request.Context(), sourceId)
 		if err != nil {
 			log.Printf("Error: %s", err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept details", "error": err.Error()})
+			c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving concept details", "error": err.Error()})
 			c.Abort()
 			return
 		}
@@ -60,10 +61,10 @@ func (u ConceptController) RetrieveInfoBySourceIdAndConceptIds(c *gin.Context) {
 	}
 
 	// call model method:
-	conceptInfo, err := u.conceptModel.RetrieveInfoBySourceIdAndConceptIds(sourceId, conceptIds)
+	conceptInfo, err := u.conceptModel.RetrieveInfoBySourceIdAndConceptIds(c.Request.Context(), sourceId, conceptIds)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept details", "error": err.Error()})
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving concept details", "error": err.Error()})
 		c.Abort()
 		return
 	}
@@ -81,10 +82,10 @@ func (u ConceptController) RetrieveInfoBySourceIdAndConceptTypes(c *gin.Context)
 	}
 
 	// call model method:
-	conceptInfo, err := u.conceptModel.RetrieveInfoBySourceIdAndConceptTypes(sourceId, conceptTypes)
+	conceptInfo, err := u.conceptModel.RetrieveInfoBySourceIdAndConceptTypes(c.Request.Context(), sourceId, conceptTypes)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept details", "error": err.Error()})
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving concept details", "error": err.Error()})
 		c.Abort()
 		return
 	}
@@ -114,10 +115,10 @@ func (u ConceptController) RetrieveBreakdownStatsBySourceIdAndCohortId(c *gin.Co
 		c.Abort()
 		return
 	}
-	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(sourceId, cohortId, breakdownConceptId)
+	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(c.Request.Context(), sourceId, cohortId, breakdownConceptId)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving stats", "error": err.Error()})
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving stats", "error": err.Error()})
 		c.Abort()
 		return
 	}
@@ -147,10 +148,10 @@ func (u ConceptController) RetrieveBreakdownStatsBySourceIdAndCohortIdAndVariabl
 		c.Abort()
 		return
 	}
-	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortId, conceptIds, cohortPairs, breakdownConceptId)
+	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(c.Request.Context(), sourceId, cohortId, conceptIds, cohortPairs, breakdownConceptId)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving stats", "error": err.Error()})
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving stats", "error": err.Error()})
 		c.Abort()
 		return
 	}
@@ -213,7 +214,7 @@ func (u ConceptController) RetrieveAttritionTable(c *gin.Context) {
 		c.Abort()
 		return
 	}
-	cohortName, err := u.cohortDefinitionModel.GetCohortName(cohortId)
+	cohortName, err := u.cohortDefinitionModel.GetCohortName(c.Request.Context(), cohortId)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving cohort name", "error": err.Error()})
@@ -221,10 +222,10 @@ func (u ConceptController) RetrieveAttritionTable(c *gin.Context) {
 		return
 	}
 
-	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(sourceId, cohortId, breakdownConceptId)
+	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(c.Request.Context(), sourceId, cohortId, breakdownConceptId)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept breakdown for given cohortId", "error": err.Error()})
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving concept breakdown for given cohortId", "error": err.Error()})
 		c.Abort()
 		return
 	}
@@ -238,10 +239,10 @@ func (u ConceptController) RetrieveAttritionTable(c *gin.Context) {
 		c.Abort()
 		return
 	}
-	otherAttritionRows, err := u.GetAttritionRowForConceptIdsAndCohortPairs(sourceId, cohortId, conceptIdsAndCohortPairs, breakdownConceptId, sortedConceptValues)
+	otherAttritionRows, err := u.GetAttritionRowForConceptIdsAndCohortPairs(c.Request.Context(), sourceId, cohortId, conceptIdsAndCohortPairs, breakdownConceptId, sortedConceptValues)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept breakdown rows for filter conceptIds and cohortPairs", "error": err.Error()})
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving concept breakdown rows for filter conceptIds and cohortPairs", "error": err.Error()})
 		c.Abort()
 		return
 	}
@@ -249,13 +250,15 @@ func (u ConceptController) RetrieveAttritionTable(c *gin.Context) {
 	c.String(http.StatusOK, b.String())
 }
 
-func (u ConceptController) GetAttritionRowForConceptIdsAndCohortPairs(sourceId int, cohortId int, conceptIdsAndCohortPairs []interface{}, breakdownConceptId int64, sortedConceptValues []string) ([][]string, error) {
+func (u ConceptController) GetAttritionRowForConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortId int, conceptIdsAndCohortPairs []interface{}, breakdownConceptId int64, sortedConceptValues []string) ([][]string, error) {
 	var otherAttritionRows [][]string
+	// each row adds a filter to the previous one, so its filtered cohort is built from the one of the previous row:
+	defer models.HoldFilteredCohortTables(ctx)()
 	for idx, conceptIdOrCohortPair := range conceptIdsAndCohortPairs {
 		// attrition filter: run each query with an increasingly longer list of filterConceptIdsAndCohortPairs, until the last query is run with them all:
 		filterConceptIdsAndCohortPairs := conceptIdsAndCohortPairs[0 : idx+1]
 
-		attritionRow, err := u.GetAttritionRowForConceptIdOrCohortPair(sourceId, cohortId, conceptIdOrCohortPair, filterConceptIdsAndCohortPairs, breakdownConceptId, sortedConceptValues)
+		attritionRow, err := u.GetAttritionRowForConceptIdOrCohortPair(ctx, sourceId, cohortId, conceptIdOrCohortPair, filterConceptIdsAndCohortPairs, breakdownConceptId, sortedConceptValues)
 		if err != nil {
 			log.Printf("Error: %s", err.Error())
 			return nil, err
@@ -265,19 +268,19 @@ func (u ConceptController) GetAttritionRowForConceptIdsAndCohortPairs(sourceId i
 	return otherAttritionRows, nil
 }
 
-func (u ConceptController) GetAttritionRowForConceptIdOrCohortPair(sourceId int, cohortId int, conceptIdOrCohortPair interface{}, filterConceptIdsAndCohortPairs []interface{}, breakdownConceptId int64, sortedConceptValues []string) ([]string, error) {
+func (u ConceptController) GetAttritionRowForConceptIdOrCohortPair(ctx context.Context, sourceId int, cohortId int, conceptIdOrCohortPair interface{}, filterConceptIdsAndCohortPairs []interface{}, breakdownConceptId int64, sortedConceptValues []string) ([]string, error) {
 	filterConceptIds, filterCohortPairs := utils.GetConceptIdsAndCohortPairsAsSeparateLists(filterConceptIdsAndCohortPairs)
-	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortId, filterConceptIds, filterCohortPairs, breakdownConceptId)
+	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx, sourceId, cohortId, filterConceptIds, filterCohortPairs, breakdownConceptId)
 	if err != nil {
-		return nil, fmt.Errorf("could not retrieve concept Breakdown for concepts %v dichotomous variables %v due to error: %s", filterConceptIds, filterCohortPairs, err.Error())
+		return nil, fmt.Errorf("could not retrieve concept Breakdown for concepts %v dichotomous variables %v due to error: %w", filterConceptIds, filterCohortPairs, err)
 	}
 	conceptValuesToPeopleCount := getConceptValueToPeopleCount(breakdownStats)
 	variableName := ""
 	switch convertedItem := conceptIdOrCohortPair.(type) {
 	case int64:
-		conceptInformation, err := u.conceptModel.RetrieveInfoBySourceIdAndConceptId(sourceId, convertedItem)
+		conceptInformation, err := u.conceptModel.RetrieveInfoBySourceIdAndConceptId(ctx, sourceId, convertedItem)
 		if err != nil {
-			return nil, fmt.Errorf("could not retrieve concept details for %v due to error: %s", convertedItem, err.Error())
+			return nil, fmt.Errorf("could not retrieve concept details for %v due to error: %w", convertedItem, err)
 		}
 		variableName = conceptInformation.ConceptName
 	case utils.CustomDichotomousVariableDef:
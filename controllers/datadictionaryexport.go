@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/uc-cdis/cohort-middleware/models"
+	"github.com/uc-cdis/cohort-middleware/utils"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	DataDictionaryFormatJson     = "json"
+	DataDictionaryFormatCsv      = "csv"
+	DataDictionaryFormatXlsx     = "xlsx"
+	DataDictionaryFormatCodebook = "codebook"
+)
+
+var dataDictionaryVariableHeaders = []string{"vocabularyID", "conceptID", "conceptCode", "conceptName", "conceptClassID",
+	"numberOfPeopleWithVariable", "numberOfPeopleWhereValueIsFilled", "numberOfPeopleWhereValueIsNull", "valueStoredAs",
+	"minValue", "maxValue", "meanValue", "standardDeviation"}
+
+var dataDictionaryValueSummaryHeaders = []string{"conceptID", "conceptName", "valueStoredAs", "valueName", "valueCode",
+	"binStart", "binEnd", "personCount"}
+
+// All variables of the codebook are on a single REDCap form (instrument):
+const codebookFormName = "data_dictionary"
+
+// The columns of a REDCap data dictionary:
+var codebookHeaders = []string{"Variable / Field Name", "Form Name", "Section Header", "Field Type", "Field Label",
+	"Choices, Calculations, OR Slider Labels", "Field Note", "Text Validation Type OR Show Slider Number",
+	"Text Validation Min", "Text Validation Max"}
+
+// Returns the CSV with one row per data dictionary entry, with the value summary as a JSON string in the last column.
+func GenerateDataDictionaryCSV(entries []*models.DataDictionaryResult) (*bytes.Buffer, error) {
+	rows := [][]interface{}{toRow(append(append([]string{}, dataDictionaryVariableHeaders...), "valueSummary"))}
+	for _, entry := range entries {
+		rows = append(rows, append(getDataDictionaryVariableRow(entry), string(entry.ValueSummary)))
+	}
+	return writeCSV(rows)
+}
+
+// Returns an XLSX workbook with a "Variables" sheet with one row per data dictionary entry and
+// a "Value Summaries" sheet with one row per histogram bin or nominal value of each entry.
+func GenerateDataDictionaryXLSX(entries []*models.DataDictionaryResult) (*bytes.Buffer, error) {
+	workbook := excelize.NewFile()
+	defer workbook.Close()
+
+	variablesSheet := "Variables"
+	if err := workbook.SetSheetName("Sheet1", variablesSheet); err != nil {
+		return nil, err
+	}
+	variableRows := [][]interface{}{toRow(dataDictionaryVariableHeaders)}
+	for _, entry := range entries {
+		variableRows = append(variableRows, getDataDictionaryVariableRow(entry))
+	}
+	if err := writeSheetRows(workbook, variablesSheet, variableRows); err != nil {
+		return nil, err
+	}
+
+	valueSummariesSheet := "Value Summaries"
+	if _, err := workbook.NewSheet(valueSummariesSheet); err != nil {
+		return nil, err
+	}
+	valueSummaryRows := [][]interface{}{toRow(dataDictionaryValueSummaryHeaders)}
+	for _, entry := range entries {
+		rows, err := getDataDictionaryValueSummaryRows(entry)
+		if err != nil {
+			return nil, err
+		}
+		valueSummaryRows = append(valueSummaryRows, rows...)
+	}
+	if err := writeSheetRows(workbook, valueSummariesSheet, valueSummaryRows); err != nil {
+		return nil, err
+	}
+	return workbook.WriteToBuffer()
+}
+
+// Returns a codebook in the layout of a REDCap data dictionary CSV. The variable names are the
+// lowercase column headers of the cohort data CSV (e.g. id_2000006885), as REDCap only accepts lowercase
+// names, and the nominal concepts list their values as "code, label" choices, where the code is the value
+// concept id (0 for the people without a value).
+func GenerateDataDictionaryCodebook(entries []*models.DataDictionaryResult) (*bytes.Buffer, error) {
+	rows := [][]interface{}{toRow(codebookHeaders)}
+	for _, entry := range entries {
+		fieldName := strings.ToLower(models.GetPrefixedConceptId(entry.ConceptID))
+		fieldNote := fmt.Sprintf("%s %s (%s)", entry.VocabularyID, entry.ConceptCode, entry.ConceptClassId)
+		if entry.ValueStoredAs == "Number" {
+			rows = append(rows, []interface{}{fieldName, codebookFormName, "", "text", entry.ConceptName,
+				"", fieldNote, "number", entry.MinValue, entry.MaxValue})
+			continue
+		}
+		nominalValues, err := getNominalValues(entry)
+		if err != nil {
+			return nil, err
+		}
+		var choices []string
+		for _, nominalValue := range nominalValues {
+			label := nominalValue.Name
+			if label == "" {
+				label = nominalValue.ValueAsString
+			}
+			if label == "" && nominalValue.ValueAsConceptID == 0 {
+				label = "No value"
+			}
+			// "|" and "," separate the choices and their code in REDCap:
+			label = strings.NewReplacer("|", "/", ",", " ").Replace(label)
+			choices = append(choices, fmt.Sprintf("%d, %s", nominalValue.ValueAsConceptID, label))
+		}
+		rows = append(rows, []interface{}{fieldName, codebookFormName, "", "radio", entry.ConceptName,
+			strings.Join(choices, " | "), fieldNote, "", "", ""})
+	}
+	return writeCSV(rows)
+}
+
+func getDataDictionaryVariableRow(entry *models.DataDictionaryResult) []interface{} {
+	return []interface{}{entry.VocabularyID, entry.ConceptID, entry.ConceptCode, entry.ConceptName, entry.ConceptClassId,
+		entry.NumberOfPeopleWithVariable, entry.NumberOfPeopleWhereValueIsFilled, entry.NumberOfPeopleWhereValueIsNull,
+		entry.ValueStoredAs, entry.MinValue, entry.MaxValue, entry.MeanValue, entry.StandardDeviation}
+}
+
+func getDataDictionaryValueSummaryRows(entry *models.DataDictionaryResult) ([][]interface{}, error) {
+	var rows [][]interface{}
+	if entry.ValueStoredAs == "Number" {
+		var histogram []utils.HistogramColumn
+		if err := unmarshalValueSummary(entry, &histogram); err != nil {
+			return nil, err
+		}
+		for _, bin := range histogram {
+			rows = append(rows, []interface{}{entry.ConceptID, entry.ConceptName, entry.ValueStoredAs, "", "",
+				bin.Start, bin.End, bin.NumberOfPeople})
+		}
+		return rows, nil
+	}
+	nominalValues, err := getNominalValues(entry)
+	if err != nil {
+		return nil, err
+	}
+	for _, nominalValue := range nominalValues {
+		rows = append(rows, []interface{}{entry.ConceptID, entry.ConceptName, entry.ValueStoredAs, nominalValue.Name,
+			nominalValue.ValueAsConceptID, "", "", nominalValue.PersonCount})
+	}
+	return rows, nil
+}
+
+func getNominalValues(entry *models.DataDictionaryResult) ([]*models.NominalGroupData, error) {
+	var nominalValues []*models.NominalGroupData
+	err := unmarshalValueSummary(entry, &nominalValues)
+	return nominalValues, err
+}
+
+func unmarshalValueSummary(entry *models.DataDictionaryResult, valueSummary interface{}) error {
+	if len(entry.ValueSummary) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(entry.ValueSummary, valueSummary); err != nil {
+		return fmt.Errorf("invalid value summary for concept id %d: %w", entry.ConceptID, err)
+	}
+	return nil
+}
+
+// Writes the rows to the sheet, keeping the numeric values as numeric cells.
+func writeSheetRows(workbook *excelize.File, sheet string, rows [][]interface{}) error {
+	for i, row := range rows {
+		cell, err := excelize.CoordinatesToCellName(1, i+1)
+		if err != nil {
+			return err
+		}
+		if err := workbook.SetSheetRow(sheet, cell, &row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCSV(rows [][]interface{}) (*bytes.Buffer, error) {
+	b := new(bytes.Buffer)
+	w := csv.NewWriter(b)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			record[i] = formatCell(value)
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return b, w.Error()
+}
+
+func formatCell(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case int:
+		return strconv.Itoa(value)
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+func toRow(values []string) []interface{} {
+	row := make([]interface{}, len(values))
+	for i, value := range values {
+		row[i] = value
+	}
+	return row
+}
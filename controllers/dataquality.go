@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/models"
+)
+
+type DataQualityController struct {
+	dataQualityModel models.DataQualityI
+}
+
+func NewDataQualityController(dataQualityModel models.DataQualityI) DataQualityController {
+	return DataQualityController{dataQualityModel: dataQualityModel}
+}
+
+// Returns the per rule violation counts and sample ids (person ids, so the endpoint is for admins only) of the last data quality check of the source given in the "source" query parameter.
+func (u DataQualityController) RetrieveReport(c *gin.Context) {
+	sourceId, err := strconv.Atoi(c.Query("source"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": "bad request - source should be a number"})
+		c.Abort()
+		return
+	}
+	report, err := u.dataQualityModel.GetDataQualityReport(c.Request.Context(), sourceId)
+	if errors.Is(err, models.ErrDataQualityReportNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "data quality report not found", "error": err.Error()})
+		c.Abort()
+		return
+	} else if err != nil {
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving data quality report", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"report": report})
+}
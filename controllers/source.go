@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -22,6 +23,11 @@ func (u SourceController) RetriveById(c *gin.Context) {
 			c.Abort()
 			return
 		}
+		if source == nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "source not found"})
+			c.Abort()
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"source": source})
 		return
 	}
@@ -38,6 +44,11 @@ func (u SourceController) RetriveByName(c *gin.Context) {
 			c.Abort()
 			return
 		}
+		if source == nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "source not found"})
+			c.Abort()
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"source": source})
 		return
 	}
@@ -54,3 +65,33 @@ func (u SourceController) RetriveAll(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, gin.H{"sources": source})
 }
+
+// Closes the cached connections to the source, so that they are reopened with the current connection details on the next request.
+func (u SourceController) EvictConnections(c *gin.Context) {
+	sourceId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": "bad request - id should be a number"})
+		c.Abort()
+		return
+	}
+	evictedConnections := sourceModel.EvictDataSource(sourceId)
+	c.JSON(http.StatusOK, gin.H{"evicted_connections": evictedConnections})
+}
+
+// Returns the hits, misses, expirations and invalidations of the cache of the source connection details and schemas.
+func (u SourceController) RetrieveMetadataCacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"source_metadata_cache": sourceModel.GetSourceMetadataCacheStats()})
+}
+
+// Returns the status for an error of a model method that uses a data source: 404 if the source
+// or its schema is not found, 503 if the source database cannot be reached or one of its schema
+// qualifiers is invalid (which makes the source unusable until it is fixed) and 500 otherwise.
+func getDataSourceErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, models.ErrSourceNotFound), errors.Is(err, models.ErrSourceDaimonNotConfigured):
+		return http.StatusNotFound
+	case errors.Is(err, models.ErrSourceConnectionFailed), errors.Is(err, models.ErrSourceSchemaInvalid):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
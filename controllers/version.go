@@ -17,6 +17,11 @@ func (u VersionController) Retrieve(c *gin.Context) {
 }
 
 func (u VersionController) RetrieveSchemaVersion(c *gin.Context) {
-	version := versionModel.GetSchemaVersion()
+	version, err := versionModel.GetSchemaVersion(c.Request.Context())
+	if err != nil {
+		c.JSON(getDataSourceErrorStatus(err), gin.H{"message": "Error retrieving schema version", "error": err.Error()})
+		c.Abort()
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"version": version})
 }
@@ -16,32 +16,48 @@ var atlasDB *utils.DbAndSchema
 func Init() {
 	c := config.GetConfig()
 
-	host := c.GetString("atlas_db.host")
-	user := c.GetString("atlas_db.username")
-	password := c.GetString("atlas_db.password")
-	dbname := c.GetString("atlas_db.db")
-	port := c.GetString("atlas_db.port")
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
-		host,
-		user,
-		password,
-		dbname,
-		port)
+	vendor := c.GetString("atlas_db.vendor")
+	dbSchema, err := utils.ParseIdentifier(c.GetString("atlas_db.schema"))
+	if err != nil {
+		log.Fatalf("invalid atlas_db.schema: %v", err)
+	}
+	gormConfig := &gorm.Config{}
+	var db *gorm.DB
+	if vendor == utils.VendorSqlite {
+		// an embedded db for local development and tests, where atlas_db.db is the path of the main db file:
+		log.Printf("connecting to main 'sqlite' db...")
+		db, _ = gorm.Open(utils.OpenSqlite(c.GetString("atlas_db.db")), gormConfig)
+	} else {
+		host := c.GetString("atlas_db.host")
+		user := c.GetString("atlas_db.username")
+		password := c.GetString("atlas_db.password")
+		dbname := c.GetString("atlas_db.db")
+		port := c.GetString("atlas_db.port")
+		dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
+			host,
+			user,
+			password,
+			dbname,
+			port)
 
-	dbSchema := c.GetString("atlas_db.schema")
-	log.Printf("connecting to main 'postgresql' db...")
-	db, _ := gorm.Open(postgres.New(
-		postgres.Config{
-			DSN:                  dsn,
-			PreferSimpleProtocol: true,
-		}), &gorm.Config{
-		NamingStrategy: schema.NamingStrategy{
-			TablePrefix:   fmt.Sprintf("%s.", dbSchema),
-			SingularTable: true,
-		}})
+		vendor = utils.VendorPostgresql
+		log.Printf("connecting to main 'postgresql' db...")
+		db, _ = gorm.Open(postgres.New(
+			postgres.Config{
+				DSN:                  dsn,
+				PreferSimpleProtocol: true,
+			}), gormConfig)
+	}
+	// the schema is quoted in queries, so it should be the name as it is stored by the database:
+	dbSchema = utils.ResolveSchemaName(db, vendor, dbSchema)
+	db.NamingStrategy = schema.NamingStrategy{
+		TablePrefix:   fmt.Sprintf("%s.", dbSchema),
+		SingularTable: true,
+	}
 	atlasDB = new(utils.DbAndSchema)
 	atlasDB.Db = db
 	atlasDB.Schema = dbSchema
+	atlasDB.Vendor = vendor
 }
 
 func GetAtlasDB() *utils.DbAndSchema {
@@ -0,0 +1,77 @@
+-- Tables of the "misc" schema of the data source (see the Misc source daimon), for sql server.
+-- They are written by the data dictionary generation and the data quality checks. The "data_dictionary"
+-- view that the data dictionary is generated from is specific to each deployment and is not part of this script.
+
+CREATE TABLE misc.DATA_DICTIONARY_RESULT
+(
+    vocabulary_id varchar(20),
+    concept_id integer not null,
+    concept_code varchar(50),
+    concept_name varchar(255),
+    concept_class_id varchar(20),
+    number_of_people_with_variable integer,
+    number_of_people_where_value_is_filled integer,
+    number_of_people_where_value_is_null integer,
+    value_stored_as varchar(20),
+    min_value float,
+    max_value float,
+    mean_value float,
+    standard_deviation float,
+    value_summary varbinary(max)
+);
+ALTER TABLE misc.DATA_DICTIONARY_RESULT  ADD CONSTRAINT xpk_DATA_DICTIONARY_RESULT PRIMARY KEY ( concept_id ) ;
+
+-- row count and value checksum of each concept at the time its data dictionary entry was generated,
+-- used to detect which concepts changed in incremental generation mode:
+CREATE TABLE misc.DATA_DICTIONARY_CONCEPT_FINGERPRINT
+(
+    concept_id integer not null,
+    row_count bigint,
+    person_count bigint,
+    value_checksum float
+);
+ALTER TABLE misc.DATA_DICTIONARY_CONCEPT_FINGERPRINT  ADD CONSTRAINT xpk_DATA_DICTIONARY_CONCEPT_FINGERPRINT PRIMARY KEY ( concept_id ) ;
+
+-- results of the last check of each data quality rule:
+CREATE TABLE misc.DATA_QUALITY_RESULT
+(
+    rule_name varchar(255) not null,
+    rule_type varchar(50),
+    violation_count bigint,
+    sample_ids varchar(4000),
+    error varchar(4000),
+    checked_at datetime2
+);
+ALTER TABLE misc.DATA_QUALITY_RESULT  ADD CONSTRAINT xpk_DATA_QUALITY_RESULT PRIMARY KEY ( rule_name ) ;
+
+-- snapshots of data_dictionary_result, taken after each data dictionary generation run. Only the most
+-- recent ones are kept (see data_dictionary_snapshot_retention in the config):
+CREATE TABLE misc.DATA_DICTIONARY_SNAPSHOT
+(
+    snapshot_id int identity(1,1) not null,
+    generated_at datetime2 not null,
+    data_schema_version integer,
+    generation_mode varchar(20),
+    number_of_concepts integer
+);
+ALTER TABLE misc.DATA_DICTIONARY_SNAPSHOT  ADD CONSTRAINT xpk_DATA_DICTIONARY_SNAPSHOT PRIMARY KEY ( snapshot_id ) ;
+
+CREATE TABLE misc.DATA_DICTIONARY_SNAPSHOT_RESULT
+(
+    snapshot_id integer not null,
+    vocabulary_id varchar(20),
+    concept_id integer not null,
+    concept_code varchar(50),
+    concept_name varchar(255),
+    concept_class_id varchar(20),
+    number_of_people_with_variable integer,
+    number_of_people_where_value_is_filled integer,
+    number_of_people_where_value_is_null integer,
+    value_stored_as varchar(20),
+    min_value float,
+    max_value float,
+    mean_value float,
+    standard_deviation float,
+    value_summary varbinary(max)
+);
+ALTER TABLE misc.DATA_DICTIONARY_SNAPSHOT_RESULT  ADD CONSTRAINT xpk_DATA_DICTIONARY_SNAPSHOT_RESULT PRIMARY KEY ( snapshot_id, concept_id ) ;
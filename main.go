@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 
@@ -8,16 +9,31 @@ import (
 	"github.com/uc-cdis/cohort-middleware/db"
 	"github.com/uc-cdis/cohort-middleware/models"
 	"github.com/uc-cdis/cohort-middleware/server"
-	"github.com/uc-cdis/cohort-middleware/utils"
 )
 
+// Checks the data quality rules (see data_quality.rules and validate.single_observation_for_concept_ids
+// in the config) on all data sources and stores the results for the /data-quality/report endpoint.
 func runDataValidation() {
-	conf := config.GetConfig()
-	observationConceptIdsToCheck, _ := utils.SliceAtoi(conf.GetStringSlice("validate.single_observation_for_concept_ids"))
-	var cohortDataModel = new(models.CohortData)
-	nrIssues, _ := cohortDataModel.ValidateObservationData(observationConceptIdsToCheck)
-	if nrIssues > 0 {
-		log.Printf("WARNING: found %d data issues!", nrIssues)
+	var sourceModel = new(models.Source)
+	sources, err := sourceModel.GetAllSources()
+	if err != nil {
+		log.Printf("ERROR: could not get the data sources to validate: %v", err)
+		return
+	}
+	var dataQualityModel = new(models.DataQuality)
+	for _, source := range sources {
+		report, err := dataQualityModel.RunDataQualityChecks(context.Background(), source.SourceId)
+		if err != nil {
+			log.Printf("ERROR: data quality check failed for data source %d: %v", source.SourceId, err)
+			continue
+		}
+		nrIssues := int64(0)
+		for _, result := range report.Results {
+			nrIssues += result.ViolationCount
+		}
+		if nrIssues > 0 {
+			log.Printf("WARNING: found %d data issues in data source %d!", nrIssues, source.SourceId)
+		}
 	}
 }
 
@@ -26,6 +42,8 @@ func main() {
 	flag.Parse()
 	config.Init(*environment)
 	db.Init()
+	models.SetDataSourceCloseDelay()
+	models.StartDataSourceHealthChecks()
 	runDataValidation()
 	server.Init()
 }
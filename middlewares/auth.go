@@ -44,6 +44,50 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+const defaultAdminResourcePath = "/cohort-middleware/admin"
+
+// Only lets the request through if the user has access to the admin resource of cohort-middleware in Arborist, which is
+// the resource given in admin_resource_path (default /cohort-middleware/admin). To be used after AuthMiddleware, on the
+// endpoints that manage the service or that return person level data.
+func AdminAuthMiddleware(httpClient HttpClientI) gin.HandlerFunc {
+
+	c := config.GetConfig()
+
+	// used in local DEV mode:
+	if c.GetString("arborist_endpoint") == "NONE" {
+		return func(ctx *gin.Context) {
+			ctx.Next()
+		}
+	}
+	adminResourcePath := c.GetString("admin_resource_path")
+	if adminResourcePath == "" {
+		adminResourcePath = defaultAdminResourcePath
+	}
+
+	return func(ctx *gin.Context) {
+		req, err := PrepareNewArboristRequestForResourceAndService(ctx, adminResourcePath, "cohort-middleware")
+		if err != nil {
+			ctx.AbortWithStatus(500)
+			log.Printf("Error while preparing Arborist request: %s", err.Error())
+			return
+		}
+		// send the request to Arborist:
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			ctx.AbortWithStatus(500)
+			log.Printf("Error while consulting Arborist: %s", err.Error())
+			return
+		}
+		if resp.StatusCode != 200 {
+			log.Printf("Got response status %d from Arborist for the admin resource. Aborting this cohort-middleware request with 403...", resp.StatusCode)
+			ctx.AbortWithStatus(403)
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
 // this function will take the request from the given ctx, validated it for the presence of an "Authorization / Bearer" token
 // and then return the URL that can be used to consult Arborist regarding cohort-middleware access permissions. This function
 // returns an error if "Authorization / Bearer" token is missing in ctx
@@ -0,0 +1,30 @@
+package middlewares
+
+import (
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/models"
+)
+
+// In the "temp-table" cohort_filter_mode, gives each request a session in which the models materialize the
+// filtered cohorts of the request in temp tables. The temp tables are dropped as soon as the queries of the request
+// that use them are done, and at the latest when the request is done.
+func FilteredCohortSession() gin.HandlerFunc {
+	mode, err := models.GetCohortFilterMode()
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if mode != models.CohortFilterModeTempTable {
+		return func(ctx *gin.Context) {
+			ctx.Next()
+		}
+	}
+
+	return func(ctx *gin.Context) {
+		requestContext, session := models.NewFilteredCohortSession(ctx.Request.Context())
+		defer session.Close()
+		ctx.Request = ctx.Request.WithContext(requestContext)
+		ctx.Next()
+	}
+}
@@ -0,0 +1,48 @@
+package middlewares
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/config"
+)
+
+// The endpoint classes that can be given their own query timeout in the
+// query_timeout_seconds section of the config.
+type QueryClass string
+
+const (
+	MetadataQueries QueryClass = "metadata"
+	StatsQueries    QueryClass = "stats"
+	ExportQueries   QueryClass = "export"
+)
+
+var defaultQueryTimeoutSeconds = map[QueryClass]int{
+	MetadataQueries: 180,
+	StatsQueries:    180,
+	ExportQueries:   600,
+}
+
+// Returns the configured query timeout of the given endpoint class, e.g.
+// query_timeout_seconds.export, or its default if it is not configured.
+func GetQueryTimeout(class QueryClass) time.Duration {
+	seconds := config.GetConfig().GetInt("query_timeout_seconds." + string(class))
+	if seconds <= 0 {
+		seconds = defaultQueryTimeoutSeconds[class]
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Sets the query timeout of the given endpoint class as the deadline of the request context.
+// The models run their queries with the request context, so the queries are cancelled when
+// this timeout is reached or when the client disconnects.
+func QueryTimeout(class QueryClass) gin.HandlerFunc {
+	timeout := GetQueryTimeout(class)
+	return func(ctx *gin.Context) {
+		requestContext, cancel := context.WithTimeout(ctx.Request.Context(), timeout)
+		defer cancel()
+		ctx.Request = ctx.Request.WithContext(requestContext)
+		ctx.Next()
+	}
+}
@@ -98,7 +98,7 @@ func (u TeamProjectAuthz) TeamProjectValidationForCohortIdsList(ctx *gin.Context
 	}
 	conf := config.GetConfig()
 	globalReaderRole := conf.GetString("global_reader_role")
-	globalCohortDefinitionIds, _ := u.cohortDefinitionModel.GetCohortDefinitionIdsForTeamProject(globalReaderRole)
+	globalCohortDefinitionIds, _ := u.cohortDefinitionModel.GetCohortDefinitionIdsForTeamProject(ctx.Request.Context(), globalReaderRole)
 	// check overlap:
 	overlapWithGlobal := utils.Intersect(uniqueCohortDefinitionIdsList, globalCohortDefinitionIds)
 	// and for the following checks, filter out the cohorts associated with 'global reader role':
@@ -112,7 +112,7 @@ func (u TeamProjectAuthz) TeamProjectValidationForCohortIdsList(ctx *gin.Context
 		}
 	}
 	// proceed with the checks on the remaining list of cohortDefinitionIds:
-	teamProjects, _ := u.cohortDefinitionModel.GetTeamProjectsThatMatchAllCohortDefinitionIds(cohortDefinitionIdsToCheck)
+	teamProjects, _ := u.cohortDefinitionModel.GetTeamProjectsThatMatchAllCohortDefinitionIds(ctx.Request.Context(), cohortDefinitionIdsToCheck)
 	if len(teamProjects) == 0 {
 		log.Printf("Invalid request error: could not find a 'team project' that is associated to ALL the cohorts present in this request")
 		return false
@@ -0,0 +1,388 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"time"
+
+	"github.com/uc-cdis/cohort-middleware/db"
+	"github.com/uc-cdis/cohort-middleware/utils"
+	"gorm.io/gorm"
+)
+
+// A cohort definition to create, together with the "team project" (sec_role) that gets access to it:
+type NewCohortDefinition struct {
+	Name        string
+	Description string
+	TeamProject string
+	Expression  string
+}
+
+var ErrCohortNameAlreadyExists = errors.New("a cohort definition with this name already exists")
+var ErrTeamProjectNotFound = errors.New("team project not found")
+var ErrPersonIdsNotFound = errors.New("person ids not found")
+var ErrEmptyCohort = errors.New("a cohort should have at least one member")
+var ErrObservationPeriodNotFound = errors.New("no cohort dates given and no observation period found for person ids")
+var ErrInvalidCohortDates = errors.New("the cohort end date should not be before the cohort start date")
+
+// A person to add to a new cohort, with the optional start and end date of its cohort era:
+type NewCohortMember struct {
+	PersonId        int64
+	CohortStartDate time.Time
+	CohortEndDate   time.Time
+}
+
+func (m NewCohortMember) hasDates() bool {
+	return !m.CohortStartDate.IsZero() && !m.CohortEndDate.IsZero()
+}
+
+// the cohort_generation_info status of a completed generation:
+const cohortGenerationStatusComplete = 2
+
+// the time that the deletes that undo a failed cohort creation get, also when the request was cancelled:
+const cohortCreationCleanupTimeout = 60 * time.Second
+
+// number of ids used per "in" list or per batch insert:
+const cohortCreationBatchSize = 1000
+
+// the expression of cohort definitions that were created by cohort-middleware instead of by Atlas:
+const uploadedPersonIdsCohortExpression = `{"cohortMiddleware":{"type":"person id upload"}}`
+
+type cohortRow struct {
+	CohortDefinitionId int
+	SubjectId          int64
+	CohortStartDate    time.Time
+	CohortEndDate      time.Time
+}
+
+// Creates a cohort definition with the given persons as members. All person ids should be found in the person table.
+// The members without start and end date get the first start date and the last end date of the observation
+// periods of the person, so persons without dates that have no observation period are not accepted.
+func (h CohortDefinition) CreateCohortFromPersonIds(ctx context.Context, sourceId int, name string, description string, teamProject string, members []NewCohortMember) (*CohortDefinition, error) {
+	members = utils.MakeUnique(members)
+	if len(members) == 0 {
+		return nil, ErrEmptyCohort
+	}
+	var personIds []int64
+	var personIdsWithoutDates []int64
+	for _, member := range members {
+		if member.CohortStartDate.IsZero() != member.CohortEndDate.IsZero() || member.CohortEndDate.Before(member.CohortStartDate) {
+			return nil, fmt.Errorf("%w: person %d", ErrInvalidCohortDates, member.PersonId)
+		}
+		personIds = append(personIds, member.PersonId)
+		if !member.hasDates() {
+			personIdsWithoutDates = append(personIdsWithoutDates, member.PersonId)
+		}
+	}
+	personIds = utils.MakeUnique(personIds)
+	missingPersonIds, err := getMissingPersonIds(ctx, sourceId, personIds)
+	if err != nil {
+		return nil, err
+	} else if len(missingPersonIds) > 0 {
+		return nil, fmt.Errorf("%w: %v", ErrPersonIdsNotFound, missingPersonIds[:min(len(missingPersonIds), 10)])
+	}
+	observationPeriods, err := getObservationPeriodBounds(ctx, sourceId, utils.MakeUnique(personIdsWithoutDates))
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]cohortRow, 0, len(members))
+	var personIdsWithoutObservationPeriod []int64
+	for _, member := range members {
+		row := cohortRow{SubjectId: member.PersonId, CohortStartDate: member.CohortStartDate, CohortEndDate: member.CohortEndDate}
+		if !member.hasDates() {
+			bounds, ok := observationPeriods[member.PersonId]
+			if !ok {
+				personIdsWithoutObservationPeriod = append(personIdsWithoutObservationPeriod, member.PersonId)
+				continue
+			}
+			row.CohortStartDate, row.CohortEndDate = bounds.ObservationPeriodStartDate, bounds.ObservationPeriodEndDate
+		}
+		rows = append(rows, row)
+	}
+	if len(personIdsWithoutObservationPeriod) > 0 {
+		return nil, fmt.Errorf("%w: %v", ErrObservationPeriodNotFound, personIdsWithoutObservationPeriod[:min(len(personIdsWithoutObservationPeriod), 10)])
+	}
+	newCohortDefinition := NewCohortDefinition{Name: name, Description: description, TeamProject: teamProject,
+		Expression: uploadedPersonIdsCohortExpression}
+	return createCohortDefinition(ctx, sourceId, newCohortDefinition, func(resultsTx *gorm.DB, resultsDataSource *utils.DbAndSchema, cohortDefinitionId int) (int64, error) {
+		for i := range rows {
+			rows[i].CohortDefinitionId = cohortDefinitionId
+		}
+		result := resultsTx.Table(resultsDataSource.UnquotedTable("cohort")).CreateInBatches(rows, cohortCreationBatchSize)
+		return result.RowsAffected, result.Error
+	})
+}
+
+// Creates a cohort definition with the persons that result from the given set expression over existing cohorts
+// as its members, with the cohort dates of the persons in those cohorts (see GetCohortSetExpressionSQL). All cohorts
+// in the expression should have a valid generation for the source.
+func (h CohortDefinition) CreateCohortFromSetExpression(ctx context.Context, sourceId int, name string, description string, teamProject string, expression *utils.CohortSetExpression) (*CohortDefinition, error) {
+	for _, cohortDefinitionId := range expression.CohortDefinitionIds() {
+		cohortGenerationInfo, err := h.GetCohortGenerationInfo(ctx, cohortDefinitionId, sourceId)
+		if err != nil {
+			return nil, err
+		} else if cohortGenerationInfo == nil {
+			return nil, fmt.Errorf("%w: cohort %d", ErrCohortNotGenerated, cohortDefinitionId)
+		}
+	}
+	cohortExpression, _ := json.Marshal(map[string]interface{}{
+		"cohortMiddleware": map[string]string{"type": "cohort set expression", "expression": expression.String()},
+	})
+	newCohortDefinition := NewCohortDefinition{Name: name, Description: description, TeamProject: teamProject,
+		Expression: string(cohortExpression)}
+	var dataSourceModel = new(Source)
+	resultsDataSource, err := dataSourceModel.GetDataSource(sourceId, Results)
+	if err != nil {
+		return nil, err
+	}
+	return createCohortDefinition(ctx, sourceId, newCohortDefinition, func(resultsTx *gorm.DB, _ *utils.DbAndSchema, cohortDefinitionId int) (int64, error) {
+		membersSQL, membersSQLParams := GetCohortSetExpressionSQL(expression, resultsDataSource)
+		result := resultsTx.Exec("INSERT INTO "+resultsDataSource.Table("cohort")+" (cohort_definition_id, subject_id, cohort_start_date, cohort_end_date) "+
+			"SELECT ?, members.subject_id, members.cohort_start_date, members.cohort_end_date FROM ("+membersSQL+") as members",
+			append([]interface{}{cohortDefinitionId}, membersSQLParams...)...)
+		return result.RowsAffected, result.Error
+	})
+}
+
+// Returns the ids that are not found in the person table.
+func getMissingPersonIds(ctx context.Context, sourceId int, personIds []int64) ([]int64, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
+	foundPersonIds := make(map[int64]bool)
+	for start := 0; start < len(personIds); start += cohortCreationBatchSize {
+		var batchPersonIds []int64
+		query := omopDataSource.Db.Table(omopDataSource.Table("person")+" as person").
+			Select("person_id").
+			Where("person_id in (?)", personIds[start:min(start+cohortCreationBatchSize, len(personIds))])
+		query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+		meta_result := query.Scan(&batchPersonIds)
+		cancel()
+		if meta_result.Error != nil {
+			return nil, meta_result.Error
+		}
+		for _, personId := range batchPersonIds {
+			foundPersonIds[personId] = true
+		}
+	}
+	var missingPersonIds []int64
+	for _, personId := range personIds {
+		if !foundPersonIds[personId] {
+			missingPersonIds = append(missingPersonIds, personId)
+		}
+	}
+	return missingPersonIds, nil
+}
+
+type observationPeriod struct {
+	PersonId                   int64
+	ObservationPeriodStartDate time.Time
+	ObservationPeriodEndDate   time.Time
+}
+
+// Returns, for each of the given persons that has at least one observation period, a period from the first
+// start date to the last end date of its observation periods.
+func getObservationPeriodBounds(ctx context.Context, sourceId int, personIds []int64) (map[int64]*observationPeriod, error) {
+	observationPeriodsByPersonId := make(map[int64]*observationPeriod)
+	if len(personIds) == 0 {
+		return observationPeriodsByPersonId, nil
+	}
+	var dataSourceModel = new(Source)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(personIds); start += cohortCreationBatchSize {
+		// the periods are combined here instead of with min and max in SQL, as sqlite returns those as text instead of dates:
+		var batchObservationPeriods []*observationPeriod
+		query := omopDataSource.Db.Table(omopDataSource.Table("observation_period")+" as observation_period").
+			Select("person_id, observation_period_start_date, observation_period_end_date").
+			Where("person_id in (?)", personIds[start:min(start+cohortCreationBatchSize, len(personIds))])
+		query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+		meta_result := query.Scan(&batchObservationPeriods)
+		cancel()
+		if meta_result.Error != nil {
+			return nil, meta_result.Error
+		}
+		for _, period := range batchObservationPeriods {
+			bounds, ok := observationPeriodsByPersonId[period.PersonId]
+			if !ok {
+				observationPeriodsByPersonId[period.PersonId] = period
+				continue
+			}
+			if period.ObservationPeriodStartDate.Before(bounds.ObservationPeriodStartDate) {
+				bounds.ObservationPeriodStartDate = period.ObservationPeriodStartDate
+			}
+			if period.ObservationPeriodEndDate.After(bounds.ObservationPeriodEndDate) {
+				bounds.ObservationPeriodEndDate = period.ObservationPeriodEndDate
+			}
+		}
+	}
+	return observationPeriodsByPersonId, nil
+}
+
+// Creates the cohort definition in Atlas, gives the team project access to it, writes its members with insertMembers
+// and finally registers a completed generation for the source. The Atlas and results databases are not necessarily
+// the same database, so if writing the members or the generation info fails, the cohort definition is deleted again.
+func createCohortDefinition(ctx context.Context, sourceId int, newCohortDefinition NewCohortDefinition,
+	insertMembers func(resultsTx *gorm.DB, resultsDataSource *utils.DbAndSchema, cohortDefinitionId int) (int64, error)) (*CohortDefinition, error) {
+
+	// resolve the results source first, so that no cohort definition is created if it is not available:
+	var dataSourceModel = new(Source)
+	resultsDataSource, err := dataSourceModel.GetDataSource(sourceId, Results)
+	if err != nil {
+		return nil, err
+	}
+
+	startTime := time.Now()
+	cohortDefinitionId, err := insertCohortDefinition(ctx, newCohortDefinition, startTime)
+	if err != nil {
+		return nil, err
+	}
+	var personCount int64
+	err = resultsDataSource.Db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		personCount, err = insertMembers(tx, resultsDataSource, cohortDefinitionId)
+		if err == nil && personCount == 0 {
+			err = ErrEmptyCohort
+		}
+		return err
+	})
+	if err == nil {
+		err = insertCompletedCohortGenerationInfo(ctx, cohortDefinitionId, sourceId, startTime, personCount)
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to create the members of cohort %d, deleting the cohort definition: %v", cohortDefinitionId, err)
+		// the cleanup should also run when the failure is a cancelled request:
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cohortCreationCleanupTimeout)
+		defer cancel()
+		if personCount > 0 {
+			deleteCohortMembers(cleanupCtx, resultsDataSource, cohortDefinitionId)
+		}
+		deleteCohortDefinition(cleanupCtx, cohortDefinitionId)
+		return nil, err
+	}
+	log.Printf("INFO: created cohort %d with %d members for team project %s", cohortDefinitionId, personCount, newCohortDefinition.TeamProject)
+	return &CohortDefinition{Id: cohortDefinitionId, Name: newCohortDefinition.Name, Description: newCohortDefinition.Description,
+		Expression: newCohortDefinition.Expression}, nil
+}
+
+// Inserts the cohort_definition, cohort_definition_details, sec_permission and sec_role_permission
+// records and returns the id of the new cohort definition. Fails with ErrCohortNameAlreadyExists if
+// a cohort definition with the same name exists. Atlas has no unique constraint on the name, so the
+// transaction first takes a lock on the name, which makes concurrent creations with the same name wait
+// for each other. Cohort definitions that Atlas itself creates in the meantime are not covered by this lock.
+func insertCohortDefinition(ctx context.Context, newCohortDefinition NewCohortDefinition, createdDate time.Time) (int, error) {
+	atlasDb := db.GetAtlasDB()
+	var cohortDefinitionId int
+	err := atlasDb.Db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if lockQuery := atlasDb.Dialect().TransactionLockQuery(); lockQuery != "" {
+			// a hash keeps the key within the 255 characters that sql server allows:
+			nameHash := fnv.New64a()
+			nameHash.Write([]byte(newCohortDefinition.Name))
+			if err := tx.Exec(lockQuery, fmt.Sprintf("cohort_definition.name:%x", nameHash.Sum64())).Error; err != nil {
+				return err
+			}
+		}
+		var nrCohortDefinitionsWithName int64
+		if err := tx.Table(atlasDb.Table("cohort_definition")+" as cohort_definition").Where("name = ?", newCohortDefinition.Name).
+			Count(&nrCohortDefinitionsWithName).Error; err != nil {
+			return err
+		} else if nrCohortDefinitionsWithName > 0 {
+			return ErrCohortNameAlreadyExists
+		}
+		var roleIds []int
+		if err := tx.Table(atlasDb.Table("sec_role")+" as sec_role").Select("id").Where("name = ?", newCohortDefinition.TeamProject).Scan(&roleIds).Error; err != nil {
+			return err
+		} else if len(roleIds) == 0 {
+			return ErrTeamProjectNotFound
+		}
+		var err error
+		if cohortDefinitionId, err = getNextId(tx, atlasDb, "cohort_definition_sequence", "cohort_definition"); err != nil {
+			return err
+		}
+		if err := tx.Exec("INSERT INTO "+atlasDb.Table("cohort_definition")+" (id, name, description, expression_type, created_date, modified_date) "+
+			"VALUES (?, ?, ?, ?, ?, ?)", cohortDefinitionId, newCohortDefinition.Name, newCohortDefinition.Description,
+			"SIMPLE_EXPRESSION", createdDate, createdDate).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("INSERT INTO "+atlasDb.Table("cohort_definition_details")+" (id, expression) VALUES (?, ?)",
+			cohortDefinitionId, newCohortDefinition.Expression).Error; err != nil {
+			return err
+		}
+		// the cohort_definition_sec_role view derives the team project access from this permission:
+		permissionId, err := getNextId(tx, atlasDb, "sec_permission_id_seq", "sec_permission")
+		if err != nil {
+			return err
+		}
+		if err := tx.Exec("INSERT INTO "+atlasDb.Table("sec_permission")+" (id, value, description) VALUES (?, ?, ?)",
+			permissionId, fmt.Sprintf("cohortdefinition:%d:get", cohortDefinitionId), "Get Cohort Definition by ID").Error; err != nil {
+			return err
+		}
+		rolePermissionId, err := getNextId(tx, atlasDb, "sec_role_permission_sequence", "sec_role_permission")
+		if err != nil {
+			return err
+		}
+		return tx.Exec("INSERT INTO "+atlasDb.Table("sec_role_permission")+" (id, role_id, permission_id) VALUES (?, ?, ?)",
+			rolePermissionId, roleIds[0], permissionId).Error
+	})
+	return cohortDefinitionId, err
+}
+
+func insertCompletedCohortGenerationInfo(ctx context.Context, cohortDefinitionId int, sourceId int, startTime time.Time, personCount int64) error {
+	atlasDb := db.GetAtlasDB()
+	return atlasDb.Db.WithContext(ctx).Exec("INSERT INTO "+atlasDb.Table("cohort_generation_info")+" "+
+		"(id, source_id, start_time, execution_duration, status, is_valid, is_canceled, person_count, record_count) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", cohortDefinitionId, sourceId, startTime, time.Since(startTime).Milliseconds(),
+		cohortGenerationStatusComplete, true, false, personCount, personCount).Error
+}
+
+func deleteCohortMembers(ctx context.Context, resultsDataSource *utils.DbAndSchema, cohortDefinitionId int) {
+	err := resultsDataSource.Db.WithContext(ctx).Exec("DELETE FROM "+resultsDataSource.Table("cohort")+" WHERE cohort_definition_id = ?", cohortDefinitionId).Error
+	if err != nil {
+		log.Printf("ERROR: failed to delete the members of cohort %d: %v", cohortDefinitionId, err)
+	}
+}
+
+func deleteCohortDefinition(ctx context.Context, cohortDefinitionId int) {
+	atlasDb := db.GetAtlasDB()
+	err := atlasDb.Db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		permissions := tx.Table(atlasDb.Table("sec_permission")+" as sec_permission").Select("id").
+			Where("value like ?", fmt.Sprintf("cohortdefinition:%d:%%", cohortDefinitionId))
+		if err := tx.Exec("DELETE FROM "+atlasDb.Table("sec_role_permission")+" WHERE permission_id in (?)", permissions).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM "+atlasDb.Table("sec_permission")+" WHERE value like ?",
+			fmt.Sprintf("cohortdefinition:%d:%%", cohortDefinitionId)).Error; err != nil {
+			return err
+		}
+		for _, table := range []utils.Identifier{"cohort_generation_info", "cohort_definition_details", "cohort_definition"} {
+			if err := tx.Exec("DELETE FROM "+atlasDb.Table(table)+" WHERE id = ?", cohortDefinitionId).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: failed to delete cohort definition %d: %v", cohortDefinitionId, err)
+	}
+}
+
+// Returns the next id of the Atlas table from the sequence that Atlas itself uses for that table, so that the ids
+// given out by Atlas and by cohort-middleware do not collide. Without sequences (sqlite) the next id is based on the
+// current maximum, where concurrent inserts fail on the primary key instead of creating duplicates.
+func getNextId(tx *gorm.DB, atlasDb *utils.DbAndSchema, sequence utils.Identifier, table utils.Identifier) (int, error) {
+	var nextId int
+	nextValueQuery := atlasDb.Dialect().NextSequenceValueQuery(atlasDb.Table(sequence))
+	if nextValueQuery == "" {
+		nextValueQuery = "SELECT coalesce(max(id), 0) + 1 FROM " + atlasDb.Table(table)
+	}
+	err := tx.Raw(nextValueQuery).Scan(&nextId).Error
+	return nextId, err
+}
@@ -1,19 +1,25 @@
 package models
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/uc-cdis/cohort-middleware/utils"
+	"gorm.io/gorm"
 )
 
 type CohortDataI interface {
-	RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId int, cohortDefinitionId int, conceptIds []int64) ([]*PersonConceptAndValue, error)
-	RetrieveCohortOverlapStats(sourceId int, caseCohortId int, controlCohortId int, otherFilterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) (CohortOverlapStats, error)
-	RetrieveDataByOriginalCohortAndNewCohort(sourceId int, originalCohortDefinitionId int, cohortDefinitionId int) ([]*PersonIdAndCohort, error)
-	RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]*PersonConceptAndValue, error)
-	RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds(sourceId int, conceptId int64) ([]*NominalGroupData, error)
-	RetrieveHistogramDataBySourceIdAndConceptId(sourceId int, histogramConceptId int64) ([]*PersonConceptAndValue, error)
+	RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(ctx context.Context, sourceId int, cohortDefinitionId int, conceptIds []int64) ([]*PersonConceptAndValue, error)
+	RetrieveCohortOverlapStats(ctx context.Context, sourceId int, caseCohortId int, controlCohortId int, otherFilterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) (CohortOverlapStats, error)
+	RetrieveDataByOriginalCohortAndNewCohort(ctx context.Context, sourceId int, originalCohortDefinitionId int, cohortDefinitionId int) ([]*PersonIdAndCohort, error)
+	RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]*PersonConceptAndValue, error)
+	RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]utils.HistogramColumn, error)
+	RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds(ctx context.Context, sourceId int, conceptId int64) ([]*NominalGroupData, error)
+	RetrieveHistogramDataBySourceIdAndConceptId(ctx context.Context, sourceId int, histogramConceptId int64) ([]*PersonConceptAndValue, error)
+	StreamCohortMembers(ctx context.Context, sourceId int, cohortDefinitionId int, onMember func(member *CohortMember) error) error
+	RetrieveInclusionRuleAttrition(ctx context.Context, sourceId int, cohortDefinitionId int) (*CohortInclusionAttrition, error)
 }
 
 type CohortData struct{}
@@ -42,6 +48,12 @@ type PersonIdAndCohort struct {
 	CohortId int64
 }
 
+type CohortMember struct {
+	SubjectId       int64     `json:"subject_id"`
+	CohortStartDate time.Time `json:"cohort_start_date"`
+	CohortEndDate   time.Time `json:"cohort_end_date"`
+}
+
 type Person struct {
 	PersonId int64
 }
@@ -55,17 +67,20 @@ type NominalGroupData struct {
 
 // This function returns the subjects that belong to both cohorts (the intersection of both cohorts)
 // TODO - name this function as such
-func (h CohortData) RetrieveDataByOriginalCohortAndNewCohort(sourceId int, originalCohortDefinitionId int, cohortDefinitionId int) ([]*PersonIdAndCohort, error) {
+func (h CohortData) RetrieveDataByOriginalCohortAndNewCohort(ctx context.Context, sourceId int, originalCohortDefinitionId int, cohortDefinitionId int) ([]*PersonIdAndCohort, error) {
 	var dataSourceModel = new(Source)
-	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+	resultsDataSource, err := dataSourceModel.GetDataSource(sourceId, Results)
+	if err != nil {
+		return nil, err
+	}
 	var personData []*PersonIdAndCohort
 
 	query := resultsDataSource.Db.Model(&Cohort{}).
 		Select("cohort.subject_id as person_id, cohort.cohort_definition_id as cohort_id").
-		Joins("INNER JOIN "+resultsDataSource.Schema+".cohort as original_cohort ON cohort.subject_id = original_cohort.subject_id").
+		Joins("INNER JOIN "+resultsDataSource.Table("cohort")+" as original_cohort ON cohort.subject_id = original_cohort.subject_id").
 		Where("cohort.cohort_definition_id = ?", cohortDefinitionId).
 		Where("original_cohort.cohort_definition_id = ?", originalCohortDefinitionId)
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&personData)
 	return personData, meta_result.Error
@@ -74,104 +89,164 @@ func (h CohortData) RetrieveDataByOriginalCohortAndNewCohort(sourceId int, origi
 // Retrieves observation data.
 // Assumption is that both OMOP and RESULTS schemas
 // are on same DB.
-func (h CohortData) RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId int, cohortDefinitionId int, conceptIds []int64) ([]*PersonConceptAndValue, error) {
+func (h CohortData) RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(ctx context.Context, sourceId int, cohortDefinitionId int, conceptIds []int64) ([]*PersonConceptAndValue, error) {
 	log.Printf(">> Using inner join impl. for large cohorts")
 	var dataSourceModel = new(Source)
-	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
 
-	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+	resultsDataSource, err := dataSourceModel.GetDataSource(sourceId, Results)
+	if err != nil {
+		return nil, err
+	}
 
 	// get the observations for the subjects and the concepts, to build up the data rows to return:
 	var cohortData []*PersonConceptAndValue
-	query := omopDataSource.Db.Table(omopDataSource.Schema+".observation_continuous as observation"+omopDataSource.GetViewDirective()).
+	query := omopDataSource.Db.Table(omopDataSource.Table("observation_continuous")+" as observation"+omopDataSource.Dialect().ViewHint()).
 		Select("observation.person_id, observation.observation_concept_id as concept_id, concept.concept_class_id, value_as_concept.concept_name as observation_value_as_concept_name, observation.value_as_number as concept_value_as_number, observation.value_as_concept_id as concept_value_as_concept_id").
-		Joins("INNER JOIN "+resultsDataSource.Schema+".cohort as cohort ON cohort.subject_id = observation.person_id").
-		Joins("INNER JOIN "+omopDataSource.Schema+".concept as concept ON concept.concept_id = observation.observation_concept_id").
-		Joins("LEFT JOIN "+omopDataSource.Schema+".concept as value_as_concept ON value_as_concept.concept_id = observation.value_as_concept_id").
+		Joins("INNER JOIN "+resultsDataSource.Table("cohort")+" as cohort ON cohort.subject_id = observation.person_id").
+		Joins("INNER JOIN "+omopDataSource.Table("concept")+" as concept ON concept.concept_id = observation.observation_concept_id").
+		Joins("LEFT JOIN "+omopDataSource.Table("concept")+" as value_as_concept ON value_as_concept.concept_id = observation.value_as_concept_id").
 		Where("cohort.cohort_definition_id = ?", cohortDefinitionId).
 		Where("observation.observation_concept_id in (?)", conceptIds).
 		Order("observation.person_id asc") // this order is important!
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&cohortData)
 	return cohortData, meta_result.Error
 }
 
-func (h CohortData) RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]*PersonConceptAndValue, error) {
+func (h CohortData) RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]*PersonConceptAndValue, error) {
 	var dataSourceModel = new(Source)
-	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
-	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
+	resultsDataSource, err := dataSourceModel.GetDataSource(sourceId, Results)
+	if err != nil {
+		return nil, err
+	}
 
 	// get the observations for the subjects and the concepts, to build up the data rows to return:
 	var cohortData []*PersonConceptAndValue
-	query := QueryFilterByCohortPairsHelper(filterCohortPairs, resultsDataSource, cohortDefinitionId, "unionAndIntersect").
-		Select("distinct(observation.person_id), observation.observation_concept_id as concept_id, observation.value_as_number as concept_value_as_number").
-		Joins("INNER JOIN "+omopDataSource.Schema+".observation_continuous as observation"+omopDataSource.GetViewDirective()+" ON unionAndIntersect.subject_id = observation.person_id").
+	query, release, err := queryFilteredCohort(ctx, sourceId, cohortDefinitionId, filterConceptIds, filterCohortPairs, omopDataSource, resultsDataSource, "unionAndIntersect")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	query = query.Select("distinct(observation.person_id), observation.observation_concept_id as concept_id, observation.value_as_number as concept_value_as_number").
+		Joins("INNER JOIN "+omopDataSource.Table("observation_continuous")+" as observation"+omopDataSource.Dialect().ViewHint()+" ON unionAndIntersect.subject_id = observation.person_id").
 		Where("observation.observation_concept_id = ?", histogramConceptId).
 		Where("observation.value_as_number is not null")
-
-	query = QueryFilterByConceptIdsHelper(query, sourceId, filterConceptIds, omopDataSource, resultsDataSource.Schema, "unionAndIntersect.subject_id")
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&cohortData)
 	return cohortData, meta_result.Error
 }
 
-func (h CohortData) RetrieveHistogramDataBySourceIdAndConceptId(sourceId int, histogramConceptId int64) ([]*PersonConceptAndValue, error) {
+// Returns the histogram bins of the values returned by RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs.
+// Unlike these values, the bins are aggregated data, so they are what the result cache stores.
+func (h CohortData) RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]utils.HistogramColumn, error) {
+	cohortData, err := h.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx, sourceId, cohortDefinitionId, histogramConceptId, filterConceptIds, filterCohortPairs)
+	if err != nil {
+		return nil, err
+	}
+	conceptValues := []float64{}
+	for _, personData := range cohortData {
+		conceptValues = append(conceptValues, float64(*personData.ConceptValueAsNumber))
+	}
+	return utils.GenerateHistogramData(conceptValues), nil
+}
+
+func (h CohortData) RetrieveHistogramDataBySourceIdAndConceptId(ctx context.Context, sourceId int, histogramConceptId int64) ([]*PersonConceptAndValue, error) {
+	return h.retrieveHistogramDataWithContext(ctx, sourceId, allPersons, histogramConceptId)
+}
+
+// Gets the distinct person values of the given concept, restricted to the members of the given cohort
+// unless cohortDefinitionId is allPersons.
+func (h CohortData) retrieveHistogramDataWithContext(ctx context.Context, sourceId int, cohortDefinitionId int, histogramConceptId int64) ([]*PersonConceptAndValue, error) {
 	var dataSourceModel = new(Source)
-	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
 	var cohortData []*PersonConceptAndValue
 
 	// get the observations for the subjects and the concepts, to build up the data rows to return:
-	query := omopDataSource.Db.Table(omopDataSource.Schema+".observation as observation").
+	query := omopDataSource.Db.Table(omopDataSource.Table("observation")+" as observation").
 		Select("distinct(observation.person_id), observation.observation_concept_id as concept_id, observation.value_as_number as concept_value_as_number").
 		Where("observation.observation_concept_id = ?", histogramConceptId).
 		Where("observation.value_as_number is not null")
+	query, err = filterObservationsByCohort(query, sourceId, cohortDefinitionId)
+	if err != nil {
+		return nil, err
+	}
 
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&cohortData)
 	return cohortData, meta_result.Error
 }
 
-func (h CohortData) RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds(sourceId int, conceptId int64) ([]*NominalGroupData, error) {
+func (h CohortData) RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds(ctx context.Context, sourceId int, conceptId int64) ([]*NominalGroupData, error) {
+	return h.retrieveBarGraphDataWithContext(ctx, sourceId, allPersons, conceptId)
+}
+
+// Gets the number of persons per value of the given concept, restricted to the members of the given cohort
+// unless cohortDefinitionId is allPersons.
+func (h CohortData) retrieveBarGraphDataWithContext(ctx context.Context, sourceId int, cohortDefinitionId int, conceptId int64) ([]*NominalGroupData, error) {
 	var dataSourceModel = new(Source)
-	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
 
 	// get the observations for the subjects and the concepts, to build up the data rows to return:
 	var cohortData []*NominalGroupData
 
-	query := omopDataSource.Db.Table(omopDataSource.Schema+".observation as observation").
+	query := omopDataSource.Db.Table(omopDataSource.Table("observation")+" as observation").
 		Select("c1.concept_name as name, count(distinct person_id) as person_count,observation.value_as_string as value_as_string, value_as_concept_id as value_as_concept_id").
-		Joins("INNER JOIN "+omopDataSource.Schema+".concept as c ON c.concept_id = observation.observation_concept_id").
-		Joins("LEFT JOIN "+omopDataSource.Schema+".concept as c1 ON c1.concept_id = observation.value_as_concept_id").
+		Joins("INNER JOIN "+omopDataSource.Table("concept")+" as c ON c.concept_id = observation.observation_concept_id").
+		Joins("LEFT JOIN "+omopDataSource.Table("concept")+" as c1 ON c1.concept_id = observation.value_as_concept_id").
 		Where("c.concept_id = ?", conceptId).
 		Group("observation.observation_concept_id, observation.value_as_string, observation.value_as_concept_id, c1.concept_name")
+	query, err = filterObservationsByCohort(query, sourceId, cohortDefinitionId)
+	if err != nil {
+		return nil, err
+	}
 
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&cohortData)
 	return cohortData, meta_result.Error
 }
 
 // Basically the same as the method above, but without the extra filtering on filterConceptId and filterConceptValue:
-func (h CohortData) RetrieveCohortOverlapStats(sourceId int, caseCohortId int, controlCohortId int,
+func (h CohortData) RetrieveCohortOverlapStats(ctx context.Context, sourceId int, caseCohortId int, controlCohortId int,
 	filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) (CohortOverlapStats, error) {
 
 	var dataSourceModel = new(Source)
-	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
-	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return CohortOverlapStats{}, err
+	}
+	resultsDataSource, err := dataSourceModel.GetDataSource(sourceId, Results)
+	if err != nil {
+		return CohortOverlapStats{}, err
+	}
 
 	var cohortOverlapStats CohortOverlapStats
-	query := QueryFilterByCohortPairsHelper(filterCohortPairs, resultsDataSource, caseCohortId, "case_cohort_unionedAndIntersectedWithFilters").
-		Select("count(distinct(case_cohort_unionedAndIntersectedWithFilters.subject_id)) as case_control_overlap").
-		Joins("INNER JOIN " + resultsDataSource.Schema + ".cohort as control_cohort ON control_cohort.subject_id = case_cohort_unionedAndIntersectedWithFilters.subject_id") // this one allows for the intersection between case and control and the assessment of the overlap
-
-	if len(filterConceptIds) > 0 {
-		query = QueryFilterByConceptIdsHelper(query, sourceId, filterConceptIds, omopDataSource, resultsDataSource.Schema, "control_cohort.subject_id")
+	query, release, err := queryFilteredCohort(ctx, sourceId, caseCohortId, filterConceptIds, filterCohortPairs, omopDataSource, resultsDataSource, "case_cohort_unionedAndIntersectedWithFilters")
+	if err != nil {
+		return CohortOverlapStats{}, err
 	}
-	query = query.Where("control_cohort.cohort_definition_id = ?", controlCohortId)
-	query, cancel := utils.AddTimeoutToQuery(query)
+	defer release()
+	query = query.Select("count(distinct(case_cohort_unionedAndIntersectedWithFilters.subject_id)) as case_control_overlap").
+		Joins("INNER JOIN "+resultsDataSource.Table("cohort")+" as control_cohort ON control_cohort.subject_id = case_cohort_unionedAndIntersectedWithFilters.subject_id"). // this one allows for the intersection between case and control and the assessment of the overlap
+		Where("control_cohort.cohort_definition_id = ?", controlCohortId)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&cohortOverlapStats)
 	return cohortOverlapStats, meta_result.Error
@@ -182,6 +257,38 @@ func (p *PersonConceptAndCount) String() string {
 		p.PersonId, p.ConceptId, p.Count)
 }
 
+// Reads the members of the given cohort ordered by subject id and passes them one by one to onMember,
+// so that large cohorts do not need to be loaded in memory. Stops at the first error returned by onMember.
+func (h CohortData) StreamCohortMembers(ctx context.Context, sourceId int, cohortDefinitionId int, onMember func(member *CohortMember) error) error {
+	var dataSourceModel = new(Source)
+	resultsDataSource, err := dataSourceModel.GetDataSource(sourceId, Results)
+	if err != nil {
+		return err
+	}
+
+	query := resultsDataSource.Db.Table(resultsDataSource.Table("cohort")+" as cohort").
+		Select("cohort.subject_id, cohort.cohort_start_date, cohort.cohort_end_date").
+		Where("cohort.cohort_definition_id = ?", cohortDefinitionId).
+		Order("cohort.subject_id, cohort.cohort_start_date")
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var member CohortMember
+		if err := query.ScanRows(rows, &member); err != nil {
+			return err
+		}
+		if err := onMember(&member); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
 // Some observations are only expected once for each person. This code implements a validation that
 // checks if any person has a duplicated entry for any of these observations and prints out WARNINGS
 // to the log if this is the case.
@@ -191,35 +298,45 @@ func (h CohortData) ValidateObservationData(observationConceptIdsToCheck []int64
 		return -1, nil
 	}
 	var sourceModel = new(Source)
-	sources, _ := sourceModel.GetAllSources()
+	sources, err := sourceModel.GetAllSources()
+	if err != nil {
+		return -1, err
+	}
 	// run this validation on all available data sources:
 	countIssues := 0
 	for _, source := range sources {
-		var dataSourceModel = new(Source)
-		omopDataSource := dataSourceModel.GetDataSource(source.SourceId, Omop)
-
 		log.Printf("INFO: checking if no duplicate data is found for concept ids %v in `observation` table of data source %d...",
 			observationConceptIdsToCheck, source.SourceId)
-		var personConceptAndCount []*PersonConceptAndCount
-		query := omopDataSource.Db.Table(omopDataSource.Schema+".observation_continuous as observation"+omopDataSource.GetViewDirective()).
-			Select("observation.person_id, observation.observation_concept_id as concept_id, count(*)").
-			Where("observation.observation_concept_id in (?)", observationConceptIdsToCheck).
-			Group("observation.person_id, observation.observation_concept_id").
-			Having("count(*) > 1")
-
-		query, cancel := utils.AddTimeoutToQuery(query)
-		defer cancel()
-		meta_result := query.Scan(&personConceptAndCount)
-		if meta_result.Error != nil {
-			return -1, meta_result.Error
-		} else if len(personConceptAndCount) == 0 {
+		rule := DataQualityRule{Name: "single_observation_for_concept_ids", Type: DataQualityRuleUniquePerPerson, ConceptIds: observationConceptIdsToCheck}
+		result, err := runDataQualityRule(context.Background(), source.SourceId, rule, defaultDataQualitySampleSize)
+		if err != nil {
+			return -1, err
+		} else if result.ViolationCount == 0 {
 			log.Printf("INFO: no issues found in observation table of data source %d.", source.SourceId)
 		} else {
 			log.Printf("WARNING: !!! found a total of %d `person` records with duplicated `observation` entries for one or more concepts "+
 				"where this is not expected (in data source=%d).",
-				len(personConceptAndCount), source.SourceId)
-			countIssues += len(personConceptAndCount)
+				result.ViolationCount, source.SourceId)
+			countIssues += int(result.ViolationCount)
 		}
 	}
 	return countIssues, nil
 }
+
+// cohortDefinitionId value for queries over all persons, instead of the members of a cohort:
+const allPersons = 0
+
+// Restricts the given query on observation to the observations of the members of the given cohort.
+// A semi-join is used, so that persons with more than one cohort entry are not counted more than once.
+func filterObservationsByCohort(query *gorm.DB, sourceId int, cohortDefinitionId int) (*gorm.DB, error) {
+	if cohortDefinitionId == allPersons {
+		return query, nil
+	}
+	var dataSourceModel = new(Source)
+	resultsDataSource, err := dataSourceModel.GetDataSource(sourceId, Results)
+	if err != nil {
+		return nil, err
+	}
+	return query.Where("observation.person_id in (select cohort.subject_id from "+resultsDataSource.Table("cohort")+" as cohort "+
+		"where cohort.cohort_definition_id = ?)", cohortDefinitionId), nil
+}
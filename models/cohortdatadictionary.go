@@ -0,0 +1,223 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+	"github.com/uc-cdis/cohort-middleware/utils"
+	"golang.org/x/sync/singleflight"
+)
+
+// The data dictionary restricted to the members of a cohort:
+type CohortDataDictionaryModel struct {
+	SourceId           int                     `json:"sourceId"`
+	CohortDefinitionId int                     `json:"cohortDefinitionId"`
+	Total              int64                   `json:"total"`
+	CohortGeneratedAt  time.Time               `json:"cohortGeneratedAt"`
+	Data               []*DataDictionaryResult `json:"data"`
+}
+
+var ErrCohortNotGenerated = errors.New("cohort has no valid generation for this source")
+
+type cohortDataDictionaryCacheKey struct {
+	sourceId           int
+	cohortDefinitionId int
+}
+
+const defaultCohortDataDictionaryCacheTtl = time.Hour
+
+var cohortDataDictionaryCacheInstance *utils.TtlCache[cohortDataDictionaryCacheKey, *CohortDataDictionaryModel]
+var cohortDataDictionaryCacheOnce sync.Once
+
+// Makes sure that concurrent requests for the same cohort generation share a single generation:
+var cohortDataDictionaryGenerations singleflight.Group
+
+// Returns the cache of the cohort data dictionaries by source and cohort, of which the entries expire after
+// cohort_data_dictionary_cache_ttl_seconds (default 1 hour). An entry is not used anymore once the cohort is
+// regenerated (see cohort_generation_info).
+func cohortDataDictionaryCache() *utils.TtlCache[cohortDataDictionaryCacheKey, *CohortDataDictionaryModel] {
+	cohortDataDictionaryCacheOnce.Do(func() {
+		ttl := defaultCohortDataDictionaryCacheTtl
+		if seconds := config.GetConfig().GetInt("cohort_data_dictionary_cache_ttl_seconds"); seconds > 0 {
+			ttl = time.Duration(seconds) * time.Second
+		}
+		cohortDataDictionaryCacheInstance = utils.NewTtlCache[cohortDataDictionaryCacheKey, *CohortDataDictionaryModel](ttl)
+	})
+	return cohortDataDictionaryCacheInstance
+}
+
+// Per concept counts and moments of the observations of the members of a cohort:
+type cohortConceptStats struct {
+	ConceptId                               int64
+	NumberOfPeopleWithVariable              int64
+	NumberOfPeopleWhereValueIsFilledNumber  int64
+	NumberOfPeopleWhereValueIsFilledConcept int64
+	NumberOfPeopleWhereValueIsNullNumber    int64
+	NumberOfPeopleWhereValueIsNullConcept   int64
+	MinValue                                *float64
+	MaxValue                                *float64
+	MeanValue                               *float64
+	StandardDeviation                       *float64
+}
+
+// Returns the data dictionary of the given source restricted to the members of the given cohort. Only the
+// variables observed for at least one cohort member are returned. The result is cached until the cohort is regenerated,
+// and concurrent requests for the same cohort generation wait for the same generation.
+func (u DataDictionary) GetCohortDataDictionary(ctx context.Context, sourceId int, cohortDefinitionId int) (*CohortDataDictionaryModel, error) {
+	var cohortDefinitionModel = new(CohortDefinition)
+	cohortGenerationInfo, err := cohortDefinitionModel.GetCohortGenerationInfo(ctx, cohortDefinitionId, sourceId)
+	if err != nil {
+		return nil, err
+	} else if cohortGenerationInfo == nil {
+		return nil, ErrCohortNotGenerated
+	}
+
+	cacheKey := cohortDataDictionaryCacheKey{sourceId: sourceId, cohortDefinitionId: cohortDefinitionId}
+	cachedDataDictionary, ok := cohortDataDictionaryCache().Get(cacheKey)
+	if ok && cachedDataDictionary.CohortGeneratedAt.Equal(cohortGenerationInfo.StartTime) &&
+		cachedDataDictionary.Total == cohortGenerationInfo.PersonCount {
+		return cachedDataDictionary, nil
+	}
+
+	// the generation is shared by all requests for this cohort generation, so it is not cancelled when
+	// the request that started it is, but it keeps the query timeout of that request:
+	generationKey := fmt.Sprintf("%d/%d/%d", sourceId, cohortDefinitionId, cohortGenerationInfo.StartTime.UnixNano())
+	generation := cohortDataDictionaryGenerations.DoChan(generationKey, func() (interface{}, error) {
+		generationCtx, cancel := context.Background(), context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			generationCtx, cancel = context.WithDeadline(context.Background(), deadline)
+		}
+		defer cancel()
+		log.Printf("INFO: generating data dictionary for cohort %d in source %d", cohortDefinitionId, sourceId)
+		results, err := u.generateCohortDataDictionaryResults(generationCtx, sourceId, cohortDefinitionId)
+		if err != nil {
+			return nil, err
+		}
+		cohortDataDictionary := &CohortDataDictionaryModel{
+			SourceId:           sourceId,
+			CohortDefinitionId: cohortDefinitionId,
+			Total:              cohortGenerationInfo.PersonCount,
+			CohortGeneratedAt:  cohortGenerationInfo.StartTime,
+			Data:               results,
+		}
+		cohortDataDictionaryCache().Set(cacheKey, cohortDataDictionary)
+		return cohortDataDictionary, nil
+	})
+	select {
+	case result := <-generation:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.(*CohortDataDictionaryModel), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (u DataDictionary) generateCohortDataDictionaryResults(ctx context.Context, sourceId int, cohortDefinitionId int) ([]*DataDictionaryResult, error) {
+	var dataSourceModel = new(Source)
+	miscDataSource, err := dataSourceModel.GetDataSource(sourceId, Misc)
+	if err != nil {
+		return nil, err
+	}
+	dataDictionaryEntries, err := u.getDataDictionaryEntries(ctx, miscDataSource, nil)
+	if err != nil {
+		return nil, err
+	}
+	conceptStats, err := getCohortConceptStats(ctx, sourceId, cohortDefinitionId, getConceptIdsOfEntries(dataDictionaryEntries))
+	if err != nil {
+		return nil, err
+	}
+
+	// replace the population counts and moments by the ones of the cohort:
+	var cohortEntries []*DataDictionaryEntry
+	for _, dataDictionaryEntry := range dataDictionaryEntries {
+		stats, ok := conceptStats[dataDictionaryEntry.ConceptID]
+		if !ok {
+			continue
+		}
+		cohortEntry := *dataDictionaryEntry
+		cohortEntry.NumberOfPeopleWithVariable = stats.NumberOfPeopleWithVariable
+		if cohortEntry.ValueStoredAs == "Number" {
+			cohortEntry.NumberOfPeopleWhereValueIsFilled = stats.NumberOfPeopleWhereValueIsFilledNumber
+			cohortEntry.NumberOfPeopleWhereValueIsNull = stats.NumberOfPeopleWhereValueIsNullNumber
+		} else {
+			cohortEntry.NumberOfPeopleWhereValueIsFilled = stats.NumberOfPeopleWhereValueIsFilledConcept
+			cohortEntry.NumberOfPeopleWhereValueIsNull = stats.NumberOfPeopleWhereValueIsNullConcept
+		}
+		cohortEntry.MinValue = valueOrZero(stats.MinValue)
+		cohortEntry.MaxValue = valueOrZero(stats.MaxValue)
+		cohortEntry.MeanValue = valueOrZero(stats.MeanValue)
+		cohortEntry.StandardDeviation = valueOrZero(stats.StandardDeviation)
+		cohortEntries = append(cohortEntries, &cohortEntry)
+	}
+
+	results := []*DataDictionaryResult{}
+	var generationErr error
+	err = utils.RunWorkerPool(ctx, cohortEntries, getDataDictionaryWorkerPoolConfig(),
+		func(ctx context.Context, entry *DataDictionaryEntry) (*DataDictionaryResult, error) {
+			return generateData(ctx, entry, sourceId, cohortDefinitionId)
+		},
+		func(entry *DataDictionaryEntry, err error) {
+			if err != nil && generationErr == nil {
+				generationErr = err
+			}
+		},
+		func(resultDataList []*DataDictionaryResult) error {
+			results = append(results, resultDataList...)
+			return generationErr
+		})
+	if err == nil {
+		err = generationErr
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to generate data dictionary for cohort %d: %v", cohortDefinitionId, err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// Computes the same counts and moments as the data_dictionary view, but only over the observations of the cohort members.
+func getCohortConceptStats(ctx context.Context, sourceId int, cohortDefinitionId int, conceptIds []int64) (map[int64]*cohortConceptStats, error) {
+	conceptStatsMap := make(map[int64]*cohortConceptStats)
+	if len(conceptIds) == 0 {
+		return conceptStatsMap, nil
+	}
+	var dataSourceModel = new(Source)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
+	var conceptStats []*cohortConceptStats
+	query := omopDataSource.Db.Table(omopDataSource.Table("observation")+" as observation").
+		Select("observation.observation_concept_id as concept_id, "+
+			"count(distinct observation.person_id) as number_of_people_with_variable, "+
+			"count(distinct case when observation.value_as_number is not null then observation.person_id end) as number_of_people_where_value_is_filled_number, "+
+			"count(distinct case when observation.value_as_concept_id is not null and observation.value_as_concept_id > 0 then observation.person_id end) as number_of_people_where_value_is_filled_concept, "+
+			"count(distinct case when observation.value_as_number is null then observation.person_id end) as number_of_people_where_value_is_null_number, "+
+			"count(distinct case when observation.value_as_concept_id is null or observation.value_as_concept_id = 0 then observation.person_id end) as number_of_people_where_value_is_null_concept, "+
+			"min(observation.value_as_number) as min_value, max(observation.value_as_number) as max_value, "+
+			"avg(observation.value_as_number) as mean_value, "+omopDataSource.Dialect().StandardDeviation("observation.value_as_number")+" as standard_deviation").
+		Where("observation.observation_concept_id in (?)", conceptIds).
+		Group("observation.observation_concept_id")
+	query, err = filterObservationsByCohort(query, sourceId, cohortDefinitionId)
+	if err != nil {
+		return nil, err
+	}
+
+	query, cancel := utils.AddSpecificTimeoutToQueryWithContext(ctx, query, 600*time.Second)
+	defer cancel()
+	meta_result := query.Scan(&conceptStats)
+	if meta_result.Error != nil {
+		return nil, meta_result.Error
+	}
+	for _, stats := range conceptStats {
+		conceptStatsMap[stats.ConceptId] = stats
+	}
+	return conceptStatsMap, nil
+}
@@ -1,22 +1,30 @@
 package models
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"log"
 
 	"github.com/uc-cdis/cohort-middleware/db"
 	"github.com/uc-cdis/cohort-middleware/utils"
+	"gorm.io/gorm"
 )
 
 type CohortDefinitionI interface {
-	GetCohortDefinitionById(id int) (*CohortDefinition, error)
-	GetCohortDefinitionByName(name string) (*CohortDefinition, error)
-	GetAllCohortDefinitions() ([]*CohortDefinition, error)
-	GetAllCohortDefinitionsAndStatsOrderBySizeDesc(sourceId int, teamProject string) ([]*CohortDefinitionStats, error)
-	GetCohortName(cohortId int) (string, error)
-	GetCohortDefinitionIdsForTeamProject(teamProject string) ([]int, error)
-	GetTeamProjectsThatMatchAllCohortDefinitionIds(uniqueCohortDefinitionIdsList []int) ([]string, error)
+	GetCohortDefinitionById(ctx context.Context, id int) (*CohortDefinition, error)
+	GetCohortDefinitionByName(ctx context.Context, name string) (*CohortDefinition, error)
+	GetAllCohortDefinitions(ctx context.Context) ([]*CohortDefinition, error)
+	GetAllCohortDefinitionsAndStatsOrderBySizeDesc(ctx context.Context, sourceId int, teamProject string) ([]*CohortDefinitionStats, error)
+	SearchCohortDefinitions(ctx context.Context, sourceId int, cohortDefinitionQuery CohortDefinitionQuery) (*CohortDefinitionPage, error)
+	GetCohortName(ctx context.Context, cohortId int) (string, error)
+	GetCohortDefinitionIdsForTeamProject(ctx context.Context, teamProject string) ([]int, error)
+	GetTeamProjectsThatMatchAllCohortDefinitionIds(ctx context.Context, uniqueCohortDefinitionIdsList []int) ([]string, error)
+	GetCohortGenerationInfo(ctx context.Context, cohortDefinitionId int, sourceId int) (*CohortGenerationInfo, error)
+	GetCohortGenerationDetails(ctx context.Context, cohortDefinitionId int) ([]*CohortGenerationDetails, error)
+	CreateCohortFromPersonIds(ctx context.Context, sourceId int, name string, description string, teamProject string, members []NewCohortMember) (*CohortDefinition, error)
+	CreateCohortFromSetExpression(ctx context.Context, sourceId int, name string, description string, teamProject string, expression *utils.CohortSetExpression) (*CohortDefinition, error)
 }
 
 type CohortDefinition struct {
@@ -35,39 +43,114 @@ type CohortDefinitionStats struct {
 	CohortSize int    `json:"size"`
 }
 
-func (h CohortDefinition) GetCohortDefinitionById(id int) (*CohortDefinition, error) {
+// Search, sort and pagination options for browsing the cohort definitions of one or more team projects:
+type CohortDefinitionQuery struct {
+	TeamProjects []string
+	// case insensitive text to search for in the cohort name and description:
+	Search string
+	// one of "size", "name" or "modified":
+	SortBy         string
+	SortDescending bool
+	// also return the cohorts that are empty or have no valid generation in the source:
+	IncludeUngenerated bool
+	// 1-based page number:
+	Page     int
+	PageSize int
+}
+
+// The generation status of a cohort in a source, see CohortDefinitionListEntry:
+const (
+	CohortGenerationStatusNotGenerated = "not_generated"
+	CohortGenerationStatusRunning      = "running"
+	CohortGenerationStatusCanceled     = "canceled"
+	CohortGenerationStatusFailed       = "failed"
+	CohortGenerationStatusEmpty        = "empty"
+	CohortGenerationStatusComplete     = "complete"
+)
+
+type CohortDefinitionListEntry struct {
+	Id               int        `json:"cohort_definition_id"`
+	Name             string     `json:"cohort_name"`
+	Description      string     `json:"cohort_description"`
+	CohortSize       int64      `json:"size"`
+	ModifiedDate     *time.Time `json:"modified_date,omitempty"`
+	GenerationStatus string     `json:"generation_status"`
+}
+
+type CohortDefinitionPage struct {
+	TotalEntries int64                        `json:"total_entries"`
+	Page         int                          `json:"page"`
+	PageSize     int                          `json:"page_size"`
+	Data         []*CohortDefinitionListEntry `json:"cohort_definitions"`
+}
+
+// The fields the cohort definitions can be sorted on, mapped to their SQL expression:
+var cohortDefinitionSortColumns = map[string]string{
+	"size":     "cohort_size",
+	"name":     "cohort_definition.name",
+	"modified": "coalesce(cohort_definition.modified_date, cohort_definition.created_date)",
+}
+
+func IsValidCohortDefinitionSortField(field string) bool {
+	_, ok := cohortDefinitionSortColumns[field]
+	return ok
+}
+
+type CohortGenerationInfo struct {
+	Id          int       `json:"cohort_definition_id"`
+	SourceId    int       `json:"source_id"`
+	StartTime   time.Time `json:"start_time"`
+	PersonCount int64     `json:"person_count"`
+	RecordCount int64     `json:"record_count"`
+}
+
+// The cohort_generation_info of a cohort in one source, including failed and canceled generations:
+type CohortGenerationDetails struct {
+	SourceId  int       `json:"source_id"`
+	StartTime time.Time `json:"start_time"`
+	// in milliseconds:
+	ExecutionDuration int64  `json:"execution_duration"`
+	Status            int    `json:"status"`
+	IsValid           bool   `json:"is_valid"`
+	IsCanceled        bool   `json:"is_canceled"`
+	FailMessage       string `json:"fail_message,omitempty"`
+	PersonCount       int64  `json:"person_count"`
+	RecordCount       int64  `json:"record_count"`
+}
+
+func (h CohortDefinition) GetCohortDefinitionById(ctx context.Context, id int) (*CohortDefinition, error) {
 	atlasDb := db.GetAtlasDB()
-	db2 := db.GetAtlasDB().Db
+	db2 := db.GetAtlasDB().Db.WithContext(ctx)
 	var cohortDefinition *CohortDefinition
 	query := db2.Model(&CohortDefinition{}).
 		Select("cohort_definition.id, cohort_definition.name, cohort_definition.description, cohort_definition_details.expression").
 		Where("cohort_definition.id = ?", id).
-		Joins("INNER JOIN " + atlasDb.Schema + ".cohort_definition_details ON cohort_definition.id = cohort_definition_details.id")
+		Joins("INNER JOIN " + atlasDb.Table("cohort_definition_details") + " ON cohort_definition.id = cohort_definition_details.id")
 
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&cohortDefinition)
 	return cohortDefinition, meta_result.Error
 }
 
-func (h CohortDefinition) GetCohortDefinitionByName(name string) (*CohortDefinition, error) {
-	db2 := db.GetAtlasDB().Db
+func (h CohortDefinition) GetCohortDefinitionByName(ctx context.Context, name string) (*CohortDefinition, error) {
+	db2 := db.GetAtlasDB().Db.WithContext(ctx)
 	var cohortDefinition *CohortDefinition
 	query := db2.Model(&CohortDefinition{}).
 		Select("id, name, description").
 		Where("name = ?", name)
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&cohortDefinition)
 	return cohortDefinition, meta_result.Error
 }
 
-func (h CohortDefinition) GetAllCohortDefinitions() ([]*CohortDefinition, error) {
-	db2 := db.GetAtlasDB().Db
+func (h CohortDefinition) GetAllCohortDefinitions(ctx context.Context) ([]*CohortDefinition, error) {
+	db2 := db.GetAtlasDB().Db.WithContext(ctx)
 	var cohortDefinition []*CohortDefinition
 	query := db2.Model(&CohortDefinition{}).
 		Select("id, name, description")
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&cohortDefinition)
 	return cohortDefinition, meta_result.Error
@@ -75,13 +158,13 @@ func (h CohortDefinition) GetAllCohortDefinitions() ([]*CohortDefinition, error)
 
 // Returns any "team project" entries that are matched to _each and every one_ of the
 // cohort definition ids found in uniqueCohortDefinitionIdsList.
-func (h CohortDefinition) GetTeamProjectsThatMatchAllCohortDefinitionIds(uniqueCohortDefinitionIdsList []int) ([]string, error) {
+func (h CohortDefinition) GetTeamProjectsThatMatchAllCohortDefinitionIds(ctx context.Context, uniqueCohortDefinitionIdsList []int) ([]string, error) {
 
-	db2 := db.GetAtlasDB().Db
+	db2 := db.GetAtlasDB().Db.WithContext(ctx)
 	var teamProjects []string
 	// Find any roles that are paired to each and every one of the cohort_definition_id values.
 	// Roles that ony match part of the values are filtered out by the having(count) clause:
-	query := db2.Table(db.GetAtlasDB().Schema+".cohort_definition_sec_role").
+	query := db2.Table(db.GetAtlasDB().Table("cohort_definition_sec_role")+" as cohort_definition_sec_role").
 		Select("sec_role_name").
 		Where("cohort_definition_id in (?)", uniqueCohortDefinitionIdsList).
 		Group("sec_role_name").
@@ -92,20 +175,20 @@ func (h CohortDefinition) GetTeamProjectsThatMatchAllCohortDefinitionIds(uniqueC
 
 // Get the list of cohort_definition ids for a given "team project" (where "team project" is basically
 // a security role name of one of the roles in Atlas/WebAPI database).
-func (h CohortDefinition) GetCohortDefinitionIdsForTeamProject(teamProject string) ([]int, error) {
-	db2 := db.GetAtlasDB().Db
+func (h CohortDefinition) GetCohortDefinitionIdsForTeamProject(ctx context.Context, teamProject string) ([]int, error) {
+	db2 := db.GetAtlasDB().Db.WithContext(ctx)
 	var cohortDefinitionIds []int
-	query := db2.Table(db.GetAtlasDB().Schema+".cohort_definition_sec_role").
+	query := db2.Table(db.GetAtlasDB().Table("cohort_definition_sec_role")+" as cohort_definition_sec_role").
 		Select("cohort_definition_id").
 		Where("sec_role_name = ?", teamProject).
 		Scan(&cohortDefinitionIds)
 	return cohortDefinitionIds, query.Error
 }
 
-func (h CohortDefinition) GetAllCohortDefinitionsAndStatsOrderBySizeDesc(sourceId int, teamProject string) ([]*CohortDefinitionStats, error) {
+func (h CohortDefinition) GetAllCohortDefinitionsAndStatsOrderBySizeDesc(ctx context.Context, sourceId int, teamProject string) ([]*CohortDefinitionStats, error) {
 
 	// get the list of cohort_definition_ids that are allowed for the given teamProject:
-	allowedCohortDefinitionIds, _ := h.GetCohortDefinitionIdsForTeamProject(teamProject)
+	allowedCohortDefinitionIds, _ := h.GetCohortDefinitionIdsForTeamProject(ctx, teamProject)
 	log.Printf("INFO: found %d cohorts for this team project", len(allowedCohortDefinitionIds))
 
 	// Gather stats:
@@ -113,22 +196,120 @@ func (h CohortDefinition) GetAllCohortDefinitionsAndStatsOrderBySizeDesc(sourceI
 	var cohortDefinitionStats []*CohortDefinitionStats
 	query := atlasDb.Model(&CohortDefinition{}).
 		Select("cohort_definition.id, cohort_definition.name, cohort_generation_info.person_count as cohort_size").
-		Joins("INNER JOIN "+db.GetAtlasDB().Schema+".cohort_generation_info ON cohort_definition.id = cohort_generation_info.id").
+		Joins("INNER JOIN "+db.GetAtlasDB().Table("cohort_generation_info")+" ON cohort_definition.id = cohort_generation_info.id").
 		Where("cohort_generation_info.source_id = ?", sourceId).
 		Where("cohort_generation_info.is_valid = true").
 		Where("cohort_generation_info.is_canceled = false").
 		Where("cohort_definition.id in (?)", allowedCohortDefinitionIds).
 		Where("cohort_generation_info.person_count > 0").
 		Order("cohort_generation_info.person_count desc")
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&cohortDefinitionStats)
 
 	return cohortDefinitionStats, meta_result.Error
 }
 
-func (h CohortDefinition) GetCohortName(cohortId int) (string, error) {
-	cohortDefinition, err := h.GetCohortDefinitionById(cohortId)
+// Returns the page of cohort definitions of the given team projects that match the given query, with their
+// size and generation status in the given source. Unlike GetAllCohortDefinitionsAndStatsOrderBySizeDesc,
+// this can also return the cohorts that are empty or were not (successfully) generated in the source.
+func (h CohortDefinition) SearchCohortDefinitions(ctx context.Context, sourceId int, cohortDefinitionQuery CohortDefinitionQuery) (*CohortDefinitionPage, error) {
+	atlasDb := db.GetAtlasDB()
+	query := atlasDb.Db.Model(&CohortDefinition{}).
+		Joins("LEFT JOIN "+atlasDb.Table("cohort_generation_info")+" ON cohort_definition.id = cohort_generation_info.id "+
+			"AND cohort_generation_info.source_id = ?", sourceId).
+		Where("cohort_definition.id in (SELECT cohort_definition_id FROM "+atlasDb.Table("cohort_definition_sec_role")+" WHERE sec_role_name in (?))",
+			cohortDefinitionQuery.TeamProjects)
+	if !cohortDefinitionQuery.IncludeUngenerated {
+		query = query.Where("cohort_generation_info.is_valid = true").
+			Where("cohort_generation_info.is_canceled = false").
+			Where("cohort_generation_info.person_count > 0")
+	}
+	if cohortDefinitionQuery.Search != "" {
+		searchPattern := utils.ContainsLikePattern(cohortDefinitionQuery.Search)
+		query = query.Where("lower(cohort_definition.name) like ?"+utils.LikeEscapeClause+
+			" or lower(coalesce(cohort_definition.description, '')) like ?"+utils.LikeEscapeClause, searchPattern, searchPattern)
+	}
+
+	page := CohortDefinitionPage{
+		Page:     cohortDefinitionQuery.Page,
+		PageSize: cohortDefinitionQuery.PageSize,
+	}
+	countQuery, cancel := utils.AddTimeoutToQueryWithContext(ctx, query.Session(&gorm.Session{}))
+	defer cancel()
+	meta_result := countQuery.Count(&page.TotalEntries)
+	if meta_result.Error != nil {
+		log.Printf("ERROR: Failed to count cohort definitions: %v", meta_result.Error)
+		return nil, meta_result.Error
+	}
+
+	sortColumn, ok := cohortDefinitionSortColumns[cohortDefinitionQuery.SortBy]
+	if !ok {
+		sortColumn = cohortDefinitionSortColumns["size"]
+	}
+	if cohortDefinitionQuery.SortDescending {
+		sortColumn += " desc"
+	}
+	// sort on the id as well, to make the pagination deterministic:
+	query = query.Select("cohort_definition.id, cohort_definition.name, coalesce(cohort_definition.description, '') as description, "+
+		"coalesce(cohort_generation_info.person_count, 0) as cohort_size, "+
+		"coalesce(cohort_definition.modified_date, cohort_definition.created_date) as modified_date, "+
+		"CASE WHEN cohort_generation_info.id IS NULL THEN ? "+
+		"WHEN cohort_generation_info.is_canceled = true THEN ? "+
+		"WHEN cohort_generation_info.status <> ? THEN ? "+
+		"WHEN cohort_generation_info.is_valid = false THEN ? "+
+		"WHEN coalesce(cohort_generation_info.person_count, 0) = 0 THEN ? "+
+		"ELSE ? END as generation_status",
+		CohortGenerationStatusNotGenerated, CohortGenerationStatusCanceled, cohortGenerationStatusComplete, CohortGenerationStatusRunning,
+		CohortGenerationStatusFailed, CohortGenerationStatusEmpty, CohortGenerationStatusComplete).
+		Order(sortColumn).Order("cohort_definition.id").
+		Offset((cohortDefinitionQuery.Page - 1) * cohortDefinitionQuery.PageSize).
+		Limit(cohortDefinitionQuery.PageSize)
+	query, cancel = utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	page.Data = []*CohortDefinitionListEntry{}
+	meta_result = query.Scan(&page.Data)
+	if meta_result.Error != nil {
+		log.Printf("ERROR: Failed to get cohort definitions: %v", meta_result.Error)
+		return nil, meta_result.Error
+	}
+	return &page, nil
+}
+
+// Returns the valid generation info of the given cohort in the given source, or nil
+// if the cohort was not (successfully) generated for that source.
+func (h CohortDefinition) GetCohortGenerationInfo(ctx context.Context, cohortDefinitionId int, sourceId int) (*CohortGenerationInfo, error) {
+	atlasDb := db.GetAtlasDB()
+	var cohortGenerationInfo *CohortGenerationInfo
+	query := atlasDb.Db.Table(atlasDb.Table("cohort_generation_info")+" as cohort_generation_info").
+		Select("id, source_id, start_time, coalesce(person_count, 0) as person_count, coalesce(record_count, 0) as record_count").
+		Where("id = ?", cohortDefinitionId).
+		Where("source_id = ?", sourceId).
+		Where("is_valid = true").
+		Where("is_canceled = false")
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result := query.Scan(&cohortGenerationInfo)
+	return cohortGenerationInfo, meta_result.Error
+}
+
+// Returns the generation info of the given cohort for each source it was generated for, ordered by source id.
+func (h CohortDefinition) GetCohortGenerationDetails(ctx context.Context, cohortDefinitionId int) ([]*CohortGenerationDetails, error) {
+	atlasDb := db.GetAtlasDB()
+	var cohortGenerationDetails []*CohortGenerationDetails
+	query := atlasDb.Db.Table(atlasDb.Table("cohort_generation_info")+" as cohort_generation_info").
+		Select("source_id, start_time, coalesce(execution_duration, 0) as execution_duration, status, is_valid, is_canceled, "+
+			"coalesce(fail_message, '') as fail_message, coalesce(person_count, 0) as person_count, coalesce(record_count, 0) as record_count").
+		Where("id = ?", cohortDefinitionId).
+		Order("source_id")
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result := query.Scan(&cohortGenerationDetails)
+	return cohortGenerationDetails, meta_result.Error
+}
+
+func (h CohortDefinition) GetCohortName(ctx context.Context, cohortId int) (string, error) {
+	cohortDefinition, err := h.GetCohortDefinitionById(ctx, cohortId)
 	if err != nil || cohortDefinition == nil {
 		return "", fmt.Errorf("could not retrieve cohort name for cohortId=%d", cohortId)
 	}
@@ -0,0 +1,580 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A typed model of the Atlas (Circe) cohort expression that is stored as JSON in cohort_definition_details.
+// Only the parts that are needed to describe a cohort are typed. All other fields, including the ones added by
+// newer Atlas versions, are kept in the UnknownFields of each type, so that they are returned as they were stored.
+// The typed fields are written as they were stored as well, i.e. also when they are empty or null, and not at all
+// when they were absent (see storedFields).
+type CohortExpression struct {
+	Title             string                        `json:"Title"`
+	ConceptSets       []*CohortExpressionConceptSet `json:"ConceptSets"`
+	PrimaryCriteria   *CohortExpressionPrimary      `json:"PrimaryCriteria"`
+	QualifiedLimit    *CohortExpressionLimit        `json:"QualifiedLimit"`
+	ExpressionLimit   *CohortExpressionLimit        `json:"ExpressionLimit"`
+	InclusionRules    []*CohortExpressionInclusion  `json:"InclusionRules"`
+	EndStrategy       *CohortExpressionEndStrategy  `json:"EndStrategy"`
+	CensoringCriteria []*CohortExpressionCriteria   `json:"CensoringCriteria"`
+	UnknownFields     map[string]json.RawMessage    `json:"-"`
+	storedFields      storedFields
+}
+
+type CohortExpressionConceptSet struct {
+	Id            int                                   `json:"id"`
+	Name          string                                `json:"name"`
+	Expression    *CohortExpressionConceptSetExpression `json:"expression"`
+	UnknownFields map[string]json.RawMessage            `json:"-"`
+	storedFields  storedFields
+}
+
+type CohortExpressionConceptSetExpression struct {
+	Items         []*CohortExpressionConceptSetItem `json:"items"`
+	UnknownFields map[string]json.RawMessage        `json:"-"`
+	storedFields  storedFields
+}
+
+type CohortExpressionConceptSetItem struct {
+	Concept            *CohortExpressionConcept   `json:"concept"`
+	IsExcluded         bool                       `json:"isExcluded"`
+	IncludeDescendants bool                       `json:"includeDescendants"`
+	IncludeMapped      bool                       `json:"includeMapped"`
+	UnknownFields      map[string]json.RawMessage `json:"-"`
+	storedFields       storedFields
+}
+
+type CohortExpressionConcept struct {
+	ConceptId     int64                      `json:"CONCEPT_ID"`
+	ConceptName   string                     `json:"CONCEPT_NAME"`
+	ConceptCode   string                     `json:"CONCEPT_CODE"`
+	DomainId      string                     `json:"DOMAIN_ID"`
+	VocabularyId  string                     `json:"VOCABULARY_ID"`
+	UnknownFields map[string]json.RawMessage `json:"-"`
+	storedFields  storedFields
+}
+
+// The entry events of the cohort:
+type CohortExpressionPrimary struct {
+	CriteriaList         []*CohortExpressionCriteria `json:"CriteriaList"`
+	ObservationWindow    *CohortExpressionWindow     `json:"ObservationWindow"`
+	PrimaryCriteriaLimit *CohortExpressionLimit      `json:"PrimaryCriteriaLimit"`
+	UnknownFields        map[string]json.RawMessage  `json:"-"`
+	storedFields         storedFields
+}
+
+// The days of continuous observation required before and after an entry event:
+type CohortExpressionWindow struct {
+	PriorDays     int                        `json:"PriorDays"`
+	PostDays      int                        `json:"PostDays"`
+	UnknownFields map[string]json.RawMessage `json:"-"`
+	storedFields  storedFields
+}
+
+// Which events are kept per person, i.e. "First", "Last" or "All":
+type CohortExpressionLimit struct {
+	Type          string                     `json:"Type"`
+	UnknownFields map[string]json.RawMessage `json:"-"`
+	storedFields  storedFields
+}
+
+type CohortExpressionInclusion struct {
+	Name          string                     `json:"name"`
+	Description   string                     `json:"description"`
+	Expression    *CohortExpressionGroup     `json:"expression"`
+	UnknownFields map[string]json.RawMessage `json:"-"`
+	storedFields  storedFields
+}
+
+// A group of criteria of which "ALL", "ANY", "AT_LEAST" Count or "AT_MOST" Count should hold:
+type CohortExpressionGroup struct {
+	Type         string                                `json:"Type"`
+	Count        *int                                  `json:"Count"`
+	CriteriaList []*CohortExpressionCorrelatedCriteria `json:"CriteriaList"`
+	// e.g. [{"Age": {"Value": 18, "Op": "gte"}}]:
+	DemographicCriteriaList []map[string]json.RawMessage `json:"DemographicCriteriaList"`
+	Groups                  []*CohortExpressionGroup     `json:"Groups"`
+	UnknownFields           map[string]json.RawMessage   `json:"-"`
+	storedFields            storedFields
+}
+
+// A criteria that is evaluated relative to the entry event, e.g. "at least 1 occurrence in the 365 days before":
+type CohortExpressionCorrelatedCriteria struct {
+	Criteria      *CohortExpressionCriteria   `json:"Criteria"`
+	Occurrence    *CohortExpressionOccurrence `json:"Occurrence"`
+	UnknownFields map[string]json.RawMessage  `json:"-"`
+	storedFields  storedFields
+}
+
+// The number of occurrences of a correlated criteria, where Type 0 is "exactly", 1 "at most" and 2 "at least":
+type CohortExpressionOccurrence struct {
+	Type          int                        `json:"Type"`
+	Count         int                        `json:"Count"`
+	UnknownFields map[string]json.RawMessage `json:"-"`
+	storedFields  storedFields
+}
+
+// A criteria on the events of one domain, stored by Atlas as an object with the domain as its only key,
+// e.g. {"ConditionOccurrence": {"CodesetId": 1}}. The filters of the criteria are kept in Attributes.
+type CohortExpressionCriteria struct {
+	Domain     string
+	CodesetId  *int
+	Attributes map[string]json.RawMessage
+}
+
+// Ends the cohort a fixed number of days after the start or end of the entry event, or at the end of a drug era.
+// Without an EndStrategy, the cohort ends at the end of the continuous observation of the person.
+type CohortExpressionEndStrategy struct {
+	DateOffset    *CohortExpressionDateOffset `json:"DateOffset"`
+	CustomEra     *CohortExpressionCustomEra  `json:"CustomEra"`
+	UnknownFields map[string]json.RawMessage  `json:"-"`
+	storedFields  storedFields
+}
+
+type CohortExpressionDateOffset struct {
+	DateField     string                     `json:"DateField"`
+	Offset        int                        `json:"Offset"`
+	UnknownFields map[string]json.RawMessage `json:"-"`
+	storedFields  storedFields
+}
+
+type CohortExpressionCustomEra struct {
+	DrugCodesetId *int                       `json:"DrugCodesetId"`
+	GapDays       int                        `json:"GapDays"`
+	Offset        int                        `json:"Offset"`
+	UnknownFields map[string]json.RawMessage `json:"-"`
+	storedFields  storedFields
+}
+
+func ParseCohortExpression(expression string) (*CohortExpression, error) {
+	var cohortExpression CohortExpression
+	if err := json.Unmarshal([]byte(expression), &cohortExpression); err != nil {
+		return nil, fmt.Errorf("invalid cohort expression: %w", err)
+	}
+	return &cohortExpression, nil
+}
+
+// Returns a human readable description of the cohort expression, one line per concept set,
+// entry event criteria, inclusion rule and exit criteria.
+func (e *CohortExpression) Summary() []string {
+	// e.g. the cohorts created by CreateCohortFromPersonIds:
+	if e.PrimaryCriteria == nil && len(e.ConceptSets) == 0 {
+		return []string{"The cohort is not defined by Atlas cohort criteria"}
+	}
+	var summary []string
+	for _, conceptSet := range e.ConceptSets {
+		summary = append(summary, "Concept set "+conceptSet.describe())
+	}
+	if e.PrimaryCriteria != nil {
+		summary = append(summary, "Entry events: "+e.PrimaryCriteria.describe(e.ConceptSets))
+	}
+	for i, inclusionRule := range e.InclusionRules {
+		line := fmt.Sprintf("Inclusion rule %d: %s", i+1, inclusionRule.Name)
+		if inclusionRule.Description != "" {
+			line += " (" + inclusionRule.Description + ")"
+		}
+		if inclusionRule.Expression != nil {
+			line += ": " + inclusionRule.Expression.describe(e.ConceptSets)
+		}
+		summary = append(summary, line)
+	}
+	summary = append(summary, "Cohort exit: "+e.EndStrategy.describe(e.ConceptSets))
+	if len(e.CensoringCriteria) > 0 {
+		summary = append(summary, "Censoring events: "+describeCriteriaList(e.CensoringCriteria, e.ConceptSets))
+	}
+	return summary
+}
+
+func (s *CohortExpressionConceptSet) describe() string {
+	var conceptNames []string
+	if s.Expression != nil {
+		for _, item := range s.Expression.Items {
+			if item.Concept == nil {
+				continue
+			}
+			conceptName := fmt.Sprintf("%s (%d)", item.Concept.ConceptName, item.Concept.ConceptId)
+			if item.IncludeDescendants {
+				conceptName += " and descendants"
+			}
+			if item.IsExcluded {
+				conceptName = "excluding " + conceptName
+			}
+			conceptNames = append(conceptNames, conceptName)
+		}
+	}
+	return fmt.Sprintf("%d '%s': %s", s.Id, s.Name, strings.Join(conceptNames, ", "))
+}
+
+func (p *CohortExpressionPrimary) describe(conceptSets []*CohortExpressionConceptSet) string {
+	description := describeCriteriaList(p.CriteriaList, conceptSets)
+	if p.ObservationWindow != nil {
+		description += fmt.Sprintf(", with %d days of observation before and %d days after the event",
+			p.ObservationWindow.PriorDays, p.ObservationWindow.PostDays)
+	}
+	if p.PrimaryCriteriaLimit != nil {
+		description += fmt.Sprintf("; limited to %s", describeLimit(p.PrimaryCriteriaLimit))
+	}
+	return description
+}
+
+func (g *CohortExpressionGroup) describe(conceptSets []*CohortExpressionConceptSet) string {
+	var descriptions []string
+	for _, correlatedCriteria := range g.CriteriaList {
+		descriptions = append(descriptions, correlatedCriteria.describe(conceptSets))
+	}
+	for _, demographicCriteria := range g.DemographicCriteriaList {
+		var attributes []string
+		for attribute := range demographicCriteria {
+			attributes = append(attributes, attribute)
+		}
+		sort.Strings(attributes)
+		descriptions = append(descriptions, "demographic criteria on "+strings.Join(attributes, " and "))
+	}
+	for _, group := range g.Groups {
+		descriptions = append(descriptions, "("+group.describe(conceptSets)+")")
+	}
+	groupType := strings.ToLower(strings.ReplaceAll(g.Type, "_", " "))
+	if g.Count != nil {
+		groupType += fmt.Sprintf(" %d", *g.Count)
+	}
+	return fmt.Sprintf("%s of %s", groupType, strings.Join(descriptions, "; "))
+}
+
+func (c *CohortExpressionCorrelatedCriteria) describe(conceptSets []*CohortExpressionConceptSet) string {
+	description := ""
+	if c.Occurrence != nil {
+		occurrenceTypes := map[int]string{0: "exactly", 1: "at most", 2: "at least"}
+		description = fmt.Sprintf("%s %d of ", occurrenceTypes[c.Occurrence.Type], c.Occurrence.Count)
+	}
+	if c.Criteria != nil {
+		description += c.Criteria.describe(conceptSets)
+	}
+	return description
+}
+
+func (c *CohortExpressionCriteria) describe(conceptSets []*CohortExpressionConceptSet) string {
+	description := c.Domain
+	if c.CodesetId != nil {
+		description += " of " + describeConceptSetReference(*c.CodesetId, conceptSets)
+	}
+	return description
+}
+
+func (s *CohortExpressionEndStrategy) describe(conceptSets []*CohortExpressionConceptSet) string {
+	switch {
+	case s != nil && s.DateOffset != nil:
+		return fmt.Sprintf("%d days after the %s of the entry event", s.DateOffset.Offset, describeDateField(s.DateOffset.DateField))
+	case s != nil && s.CustomEra != nil:
+		description := fmt.Sprintf("end of continuous drug exposure, allowing %d days between exposures", s.CustomEra.GapDays)
+		if s.CustomEra.DrugCodesetId != nil {
+			description += " of " + describeConceptSetReference(*s.CustomEra.DrugCodesetId, conceptSets)
+		}
+		return description + fmt.Sprintf(", plus %d days", s.CustomEra.Offset)
+	}
+	return "end of continuous observation"
+}
+
+func describeCriteriaList(criteriaList []*CohortExpressionCriteria, conceptSets []*CohortExpressionConceptSet) string {
+	var descriptions []string
+	for _, criteria := range criteriaList {
+		descriptions = append(descriptions, criteria.describe(conceptSets))
+	}
+	return strings.Join(descriptions, " or ")
+}
+
+func describeConceptSetReference(codesetId int, conceptSets []*CohortExpressionConceptSet) string {
+	for _, conceptSet := range conceptSets {
+		if conceptSet.Id == codesetId {
+			return fmt.Sprintf("concept set '%s'", conceptSet.Name)
+		}
+	}
+	return fmt.Sprintf("unknown concept set %d", codesetId)
+}
+
+func describeLimit(limit *CohortExpressionLimit) string {
+	switch strings.ToLower(limit.Type) {
+	case "first":
+		return "the earliest event per person"
+	case "last":
+		return "the latest event per person"
+	}
+	return "all events per person"
+}
+
+func describeDateField(dateField string) string {
+	if dateField == "EndDate" {
+		return "end date"
+	}
+	return "start date"
+}
+
+func (c *CohortExpressionCriteria) UnmarshalJSON(data []byte) error {
+	var domains map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &domains); err != nil {
+		return err
+	}
+	if len(domains) != 1 {
+		return fmt.Errorf("expected a criteria on exactly one domain, found %d", len(domains))
+	}
+	for domain, attributes := range domains {
+		c.Domain = domain
+		c.Attributes = attributes
+		// a "CodesetId": null is kept in the Attributes, so that it is written back as it was stored:
+		if codesetId, ok := attributes["CodesetId"]; ok && string(codesetId) != "null" {
+			delete(c.Attributes, "CodesetId")
+			if err := json.Unmarshal(codesetId, &c.CodesetId); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c CohortExpressionCriteria) MarshalJSON() ([]byte, error) {
+	attributes := map[string]interface{}{}
+	for name, value := range c.Attributes {
+		attributes[name] = value
+	}
+	if c.CodesetId != nil {
+		attributes["CodesetId"] = *c.CodesetId
+	}
+	return json.Marshal(map[string]interface{}{c.Domain: attributes})
+}
+
+// The UnmarshalJSON and MarshalJSON methods below convert each type to a "plain" type without these
+// methods, to (un)marshal the typed fields with the default encoding, and add the UnknownFields.
+
+func (e *CohortExpression) UnmarshalJSON(data []byte) error {
+	type plain CohortExpression
+	return unmarshalKeepingUnknownFields(data, (*plain)(e), &e.UnknownFields, &e.storedFields)
+}
+
+func (e CohortExpression) MarshalJSON() ([]byte, error) {
+	type plain CohortExpression
+	return marshalWithUnknownFields(plain(e), e.UnknownFields, e.storedFields)
+}
+
+func (s *CohortExpressionConceptSet) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionConceptSet
+	return unmarshalKeepingUnknownFields(data, (*plain)(s), &s.UnknownFields, &s.storedFields)
+}
+
+func (s CohortExpressionConceptSet) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionConceptSet
+	return marshalWithUnknownFields(plain(s), s.UnknownFields, s.storedFields)
+}
+
+func (e *CohortExpressionConceptSetExpression) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionConceptSetExpression
+	return unmarshalKeepingUnknownFields(data, (*plain)(e), &e.UnknownFields, &e.storedFields)
+}
+
+func (e CohortExpressionConceptSetExpression) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionConceptSetExpression
+	return marshalWithUnknownFields(plain(e), e.UnknownFields, e.storedFields)
+}
+
+func (i *CohortExpressionConceptSetItem) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionConceptSetItem
+	return unmarshalKeepingUnknownFields(data, (*plain)(i), &i.UnknownFields, &i.storedFields)
+}
+
+func (i CohortExpressionConceptSetItem) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionConceptSetItem
+	return marshalWithUnknownFields(plain(i), i.UnknownFields, i.storedFields)
+}
+
+func (c *CohortExpressionConcept) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionConcept
+	return unmarshalKeepingUnknownFields(data, (*plain)(c), &c.UnknownFields, &c.storedFields)
+}
+
+func (c CohortExpressionConcept) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionConcept
+	return marshalWithUnknownFields(plain(c), c.UnknownFields, c.storedFields)
+}
+
+func (p *CohortExpressionPrimary) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionPrimary
+	return unmarshalKeepingUnknownFields(data, (*plain)(p), &p.UnknownFields, &p.storedFields)
+}
+
+func (p CohortExpressionPrimary) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionPrimary
+	return marshalWithUnknownFields(plain(p), p.UnknownFields, p.storedFields)
+}
+
+func (w *CohortExpressionWindow) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionWindow
+	return unmarshalKeepingUnknownFields(data, (*plain)(w), &w.UnknownFields, &w.storedFields)
+}
+
+func (w CohortExpressionWindow) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionWindow
+	return marshalWithUnknownFields(plain(w), w.UnknownFields, w.storedFields)
+}
+
+func (l *CohortExpressionLimit) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionLimit
+	return unmarshalKeepingUnknownFields(data, (*plain)(l), &l.UnknownFields, &l.storedFields)
+}
+
+func (l CohortExpressionLimit) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionLimit
+	return marshalWithUnknownFields(plain(l), l.UnknownFields, l.storedFields)
+}
+
+func (r *CohortExpressionInclusion) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionInclusion
+	return unmarshalKeepingUnknownFields(data, (*plain)(r), &r.UnknownFields, &r.storedFields)
+}
+
+func (r CohortExpressionInclusion) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionInclusion
+	return marshalWithUnknownFields(plain(r), r.UnknownFields, r.storedFields)
+}
+
+func (g *CohortExpressionGroup) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionGroup
+	return unmarshalKeepingUnknownFields(data, (*plain)(g), &g.UnknownFields, &g.storedFields)
+}
+
+func (g CohortExpressionGroup) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionGroup
+	return marshalWithUnknownFields(plain(g), g.UnknownFields, g.storedFields)
+}
+
+func (c *CohortExpressionCorrelatedCriteria) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionCorrelatedCriteria
+	return unmarshalKeepingUnknownFields(data, (*plain)(c), &c.UnknownFields, &c.storedFields)
+}
+
+func (c CohortExpressionCorrelatedCriteria) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionCorrelatedCriteria
+	return marshalWithUnknownFields(plain(c), c.UnknownFields, c.storedFields)
+}
+
+func (o *CohortExpressionOccurrence) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionOccurrence
+	return unmarshalKeepingUnknownFields(data, (*plain)(o), &o.UnknownFields, &o.storedFields)
+}
+
+func (o CohortExpressionOccurrence) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionOccurrence
+	return marshalWithUnknownFields(plain(o), o.UnknownFields, o.storedFields)
+}
+
+func (s *CohortExpressionEndStrategy) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionEndStrategy
+	return unmarshalKeepingUnknownFields(data, (*plain)(s), &s.UnknownFields, &s.storedFields)
+}
+
+func (s CohortExpressionEndStrategy) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionEndStrategy
+	return marshalWithUnknownFields(plain(s), s.UnknownFields, s.storedFields)
+}
+
+func (o *CohortExpressionDateOffset) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionDateOffset
+	return unmarshalKeepingUnknownFields(data, (*plain)(o), &o.UnknownFields, &o.storedFields)
+}
+
+func (o CohortExpressionDateOffset) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionDateOffset
+	return marshalWithUnknownFields(plain(o), o.UnknownFields, o.storedFields)
+}
+
+func (e *CohortExpressionCustomEra) UnmarshalJSON(data []byte) error {
+	type plain CohortExpressionCustomEra
+	return unmarshalKeepingUnknownFields(data, (*plain)(e), &e.UnknownFields, &e.storedFields)
+}
+
+func (e CohortExpressionCustomEra) MarshalJSON() ([]byte, error) {
+	type plain CohortExpressionCustomEra
+	return marshalWithUnknownFields(plain(e), e.UnknownFields, e.storedFields)
+}
+
+// The typed fields that were absent or null in the stored JSON object, which would otherwise
+// be written as the zero value of their type:
+type storedFields struct {
+	absent []string
+	null   []string
+}
+
+// Unmarshals the JSON object into target (a pointer to a struct) and stores the
+// fields that do not match any of the json tags of the struct in unknownFields,
+// and the json tags of the struct that are absent or null in the JSON object in stored.
+func unmarshalKeepingUnknownFields(data []byte, target interface{}, unknownFields *map[string]json.RawMessage, stored *storedFields) error {
+	if err := json.Unmarshal(data, target); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	knownFields := getJsonFieldNames(reflect.TypeOf(target).Elem())
+	*stored = storedFields{}
+	for _, knownField := range knownFields {
+		isPresent := false
+		for name, value := range fields {
+			// encoding/json matches the field names case insensitively, so do the same here:
+			if strings.EqualFold(name, knownField) {
+				if string(value) == "null" {
+					stored.null = append(stored.null, knownField)
+				}
+				delete(fields, name)
+				isPresent = true
+			}
+		}
+		if !isPresent {
+			stored.absent = append(stored.absent, knownField)
+		}
+	}
+	*unknownFields = nil
+	if len(fields) > 0 {
+		*unknownFields = fields
+	}
+	return nil
+}
+
+// Marshals the struct, writes the stored fields as they were stored and adds the unknownFields to
+// the resulting JSON object.
+func marshalWithUnknownFields(source interface{}, unknownFields map[string]json.RawMessage, stored storedFields) ([]byte, error) {
+	data, err := json.Marshal(source)
+	if err != nil || (len(unknownFields) == 0 && len(stored.absent) == 0 && len(stored.null) == 0) {
+		return data, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for _, name := range stored.absent {
+		delete(fields, name)
+	}
+	for _, name := range stored.null {
+		fields[name] = json.RawMessage("null")
+	}
+	for name, value := range unknownFields {
+		fields[name] = value
+	}
+	return json.Marshal(fields)
+}
+
+func getJsonFieldNames(structType reflect.Type) []string {
+	var names []string
+	for i := 0; i < structType.NumField(); i++ {
+		name := strings.Split(structType.Field(i).Tag.Get("json"), ",")[0]
+		if name != "-" && structType.Field(i).IsExported() {
+			if name == "" {
+				name = structType.Field(i).Name
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/uc-cdis/cohort-middleware/utils"
+)
+
+var ErrCohortInclusionStatsNotFound = errors.New("no inclusion rule statistics found for this cohort")
+
+// The mode_id of the Atlas inclusion statistics that are counted per person (mode_id 0 counts the entry events):
+const cohortInclusionStatsModePerson = 1
+
+// The cohort building attrition of a cohort: the number of persons with an entry event (BaseCount),
+// and the persons remaining after applying each inclusion rule in order, ending with FinalCount.
+type CohortInclusionAttrition struct {
+	CohortName     string                          `json:"cohort_name"`
+	BaseCount      int64                           `json:"base_count"`
+	FinalCount     int64                           `json:"final_count"`
+	InclusionRules []*CohortInclusionRuleAttrition `json:"inclusion_rules"`
+}
+
+type CohortInclusionRuleAttrition struct {
+	RuleSequence int    `json:"rule_sequence"`
+	RuleName     string `json:"rule_name"`
+	// persons that satisfy this rule and all rules before it:
+	PersonCount int64 `json:"person_count"`
+	// persons that satisfy the rules before this rule, but not this rule:
+	PersonsRemoved int64 `json:"persons_removed"`
+	// persons that satisfy this rule, regardless of the other rules:
+	RulePersonCount int64 `json:"rule_person_count"`
+}
+
+type cohortInclusionResult struct {
+	InclusionRuleMask int64
+	PersonCount       int64
+}
+
+type cohortInclusionStats struct {
+	RuleSequence int
+	PersonCount  int64
+}
+
+// Returns the inclusion rule attrition of the cohort, based on the statistics Atlas writes to the
+// results schema when generating the cohort. The rule names are taken from the cohort expression.
+func (h CohortData) RetrieveInclusionRuleAttrition(ctx context.Context, sourceId int, cohortDefinitionId int) (*CohortInclusionAttrition, error) {
+	var dataSourceModel = new(Source)
+	resultsDataSource, err := dataSourceModel.GetDataSource(sourceId, Results)
+	if err != nil {
+		return nil, err
+	}
+
+	var summaryStats []*struct {
+		BaseCount  int64
+		FinalCount int64
+	}
+	query := resultsDataSource.Db.Table(resultsDataSource.Table("cohort_summary_stats")+" as cohort_summary_stats").
+		Select("base_count, final_count").
+		Where("cohort_definition_id = ?", cohortDefinitionId).
+		Where("mode_id = ?", cohortInclusionStatsModePerson)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result := query.Scan(&summaryStats)
+	if meta_result.Error != nil {
+		log.Printf("ERROR: Failed to get cohort summary stats: %v", meta_result.Error)
+		return nil, meta_result.Error
+	}
+	if len(summaryStats) == 0 {
+		return nil, ErrCohortInclusionStatsNotFound
+	}
+
+	var inclusionResults []*cohortInclusionResult
+	query = resultsDataSource.Db.Table(resultsDataSource.Table("cohort_inclusion_result")+" as cohort_inclusion_result").
+		Select("inclusion_rule_mask, person_count").
+		Where("cohort_definition_id = ?", cohortDefinitionId).
+		Where("mode_id = ?", cohortInclusionStatsModePerson)
+	query, cancel = utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result = query.Scan(&inclusionResults)
+	if meta_result.Error != nil {
+		log.Printf("ERROR: Failed to get cohort inclusion results: %v", meta_result.Error)
+		return nil, meta_result.Error
+	}
+
+	var inclusionStats []*cohortInclusionStats
+	query = resultsDataSource.Db.Table(resultsDataSource.Table("cohort_inclusion_stats")+" as cohort_inclusion_stats").
+		Select("rule_sequence, person_count").
+		Where("cohort_definition_id = ?", cohortDefinitionId).
+		Where("mode_id = ?", cohortInclusionStatsModePerson).
+		Order("rule_sequence")
+	query, cancel = utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result = query.Scan(&inclusionStats)
+	if meta_result.Error != nil {
+		log.Printf("ERROR: Failed to get cohort inclusion stats: %v", meta_result.Error)
+		return nil, meta_result.Error
+	}
+
+	cohortDefinition, err := CohortDefinition{}.GetCohortDefinitionById(ctx, cohortDefinitionId)
+	if err != nil {
+		return nil, err
+	}
+	attrition := CohortInclusionAttrition{
+		BaseCount:  summaryStats[0].BaseCount,
+		FinalCount: summaryStats[0].FinalCount,
+	}
+	var ruleNames []string
+	if cohortDefinition != nil {
+		attrition.CohortName = cohortDefinition.Name
+		ruleNames = getInclusionRuleNames(cohortDefinition.Expression)
+	}
+	attrition.InclusionRules = getInclusionRuleAttrition(attrition.BaseCount, inclusionResults, inclusionStats, ruleNames)
+	return &attrition, nil
+}
+
+// Returns the names of the inclusion rules in the cohort expression, or nil if the expression cannot be parsed.
+func getInclusionRuleNames(expression string) []string {
+	cohortExpression, err := ParseCohortExpression(expression)
+	if err != nil {
+		log.Printf("WARNING: could not get the inclusion rule names: %v", err)
+		return nil
+	}
+	var ruleNames []string
+	for _, inclusionRule := range cohortExpression.InclusionRules {
+		ruleNames = append(ruleNames, inclusionRule.Name)
+	}
+	return ruleNames
+}
+
+// Calculates the attrition of each rule from the inclusion results. Each inclusion result has the number of persons
+// that satisfy exactly the rules in its inclusion_rule_mask, where bit i is set if rule i (the rule_sequence) is satisfied.
+func getInclusionRuleAttrition(baseCount int64, inclusionResults []*cohortInclusionResult, inclusionStats []*cohortInclusionStats,
+	ruleNames []string) []*CohortInclusionRuleAttrition {
+
+	rulesAttrition := []*CohortInclusionRuleAttrition{}
+	previousPersonCount := baseCount
+	for _, ruleStats := range inclusionStats {
+		// the mask of this rule and all rules before it:
+		mask := int64(1)<<(ruleStats.RuleSequence+1) - 1
+		var personCount int64
+		for _, inclusionResult := range inclusionResults {
+			if inclusionResult.InclusionRuleMask&mask == mask {
+				personCount += inclusionResult.PersonCount
+			}
+		}
+		ruleName := fmt.Sprintf("Inclusion rule %d", ruleStats.RuleSequence+1)
+		if ruleStats.RuleSequence < len(ruleNames) && ruleNames[ruleStats.RuleSequence] != "" {
+			ruleName = ruleNames[ruleStats.RuleSequence]
+		}
+		rulesAttrition = append(rulesAttrition, &CohortInclusionRuleAttrition{
+			RuleSequence:    ruleStats.RuleSequence,
+			RuleName:        ruleName,
+			PersonCount:     personCount,
+			PersonsRemoved:  previousPersonCount - personCount,
+			RulePersonCount: ruleStats.PersonCount,
+		})
+		previousPersonCount = personCount
+	}
+	return rulesAttrition
+}
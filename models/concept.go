@@ -1,18 +1,19 @@
 package models
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/uc-cdis/cohort-middleware/utils"
 )
 
 type ConceptI interface {
-	RetriveAllBySourceId(sourceId int) ([]*Concept, error)
-	RetrieveInfoBySourceIdAndConceptId(sourceId int, conceptId int64) (*ConceptSimple, error)
-	RetrieveInfoBySourceIdAndConceptIds(sourceId int, conceptIds []int64) ([]*ConceptSimple, error)
-	RetrieveInfoBySourceIdAndConceptTypes(sourceId int, conceptTypes []string) ([]*ConceptSimple, error)
-	RetrieveBreakdownStatsBySourceIdAndCohortId(sourceId int, cohortDefinitionId int, breakdownConceptId int64) ([]*ConceptBreakdown, error)
-	RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, breakdownConceptId int64) ([]*ConceptBreakdown, error)
+	RetriveAllBySourceId(ctx context.Context, sourceId int) ([]*Concept, error)
+	RetrieveInfoBySourceIdAndConceptId(ctx context.Context, sourceId int, conceptId int64) (*ConceptSimple, error)
+	RetrieveInfoBySourceIdAndConceptIds(ctx context.Context, sourceId int, conceptIds []int64) ([]*ConceptSimple, error)
+	RetrieveInfoBySourceIdAndConceptTypes(ctx context.Context, sourceId int, conceptTypes []string) ([]*ConceptSimple, error)
+	RetrieveBreakdownStatsBySourceIdAndCohortId(ctx context.Context, sourceId int, cohortDefinitionId int, breakdownConceptId int64) ([]*ConceptBreakdown, error)
+	RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, breakdownConceptId int64) ([]*ConceptBreakdown, error)
 }
 type Concept struct {
 	ConceptId   int64  `json:"concept_id"`
@@ -39,15 +40,18 @@ type Observation struct {
 	ObservationId int64
 }
 
-func (h Concept) RetriveAllBySourceId(sourceId int) ([]*Concept, error) {
+func (h Concept) RetriveAllBySourceId(ctx context.Context, sourceId int) ([]*Concept, error) {
 	var dataSourceModel = new(Source)
-	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
 
 	var concepts []*Concept
 	query := omopDataSource.Db.Model(&Concept{}).
 		Select("concept_id, concept_name, concept_class_id as concept_type").
 		Order("concept_name")
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&concepts)
 	return concepts, meta_result.Error
@@ -55,9 +59,9 @@ func (h Concept) RetriveAllBySourceId(sourceId int) ([]*Concept, error) {
 
 // Retrieve just a simple concept info for a given conceptId.
 // Raises an error if concept is not found.
-func (h Concept) RetrieveInfoBySourceIdAndConceptId(sourceId int, conceptId int64) (*ConceptSimple, error) {
+func (h Concept) RetrieveInfoBySourceIdAndConceptId(ctx context.Context, sourceId int, conceptId int64) (*ConceptSimple, error) {
 	conceptIds := []int64{conceptId}
-	result, err := h.RetrieveInfoBySourceIdAndConceptIds(sourceId, conceptIds)
+	result, err := h.RetrieveInfoBySourceIdAndConceptIds(ctx, sourceId, conceptIds)
 	if err != nil {
 		return nil, err
 	} else if len(result) == 0 {
@@ -69,16 +73,19 @@ func (h Concept) RetrieveInfoBySourceIdAndConceptId(sourceId int, conceptId int6
 
 // Retrieve just a simple list of concept names and type info for given list of conceptIds.
 // Raises an error if any of the concepts is not found.
-func (h Concept) RetrieveInfoBySourceIdAndConceptIds(sourceId int, conceptIds []int64) ([]*ConceptSimple, error) {
+func (h Concept) RetrieveInfoBySourceIdAndConceptIds(ctx context.Context, sourceId int, conceptIds []int64) ([]*ConceptSimple, error) {
 	var dataSourceModel = new(Source)
-	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
 
 	var conceptItems []*ConceptSimple
 	query := omopDataSource.Db.Model(&Concept{}).
 		Select("concept_id, concept_name, concept_code, concept_class_id as concept_type").
 		Where("concept_id in (?)", conceptIds).
 		Order("concept_name")
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&conceptItems)
 	if meta_result.Error != nil {
@@ -94,9 +101,12 @@ func (h Concept) RetrieveInfoBySourceIdAndConceptIds(sourceId int, conceptIds []
 	return conceptItems, nil
 }
 
-func (h Concept) RetrieveInfoBySourceIdAndConceptTypes(sourceId int, conceptTypes []string) ([]*ConceptSimple, error) {
+func (h Concept) RetrieveInfoBySourceIdAndConceptTypes(ctx context.Context, sourceId int, conceptTypes []string) ([]*ConceptSimple, error) {
 	var dataSourceModel = new(Source)
-	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
 
 	var conceptItems []*ConceptSimple
 	query := omopDataSource.Db.Model(&Concept{}).
@@ -104,7 +114,7 @@ func (h Concept) RetrieveInfoBySourceIdAndConceptTypes(sourceId int, conceptType
 		Where("concept_class_id in (?)", conceptTypes).
 		Order("concept_name")
 
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&conceptItems)
 	if meta_result.Error != nil {
@@ -124,11 +134,11 @@ func (h Concept) RetrieveInfoBySourceIdAndConceptTypes(sourceId int, conceptType
 // then it will return something like:
 //  {ConceptValue: "A", NPersonsInCohortWithValue: M},
 //  {ConceptValue: "B", NPersonsInCohortWithValue: N-M},
-func (h Concept) RetrieveBreakdownStatsBySourceIdAndCohortId(sourceId int, cohortDefinitionId int, breakdownConceptId int64) ([]*ConceptBreakdown, error) {
+func (h Concept) RetrieveBreakdownStatsBySourceIdAndCohortId(ctx context.Context, sourceId int, cohortDefinitionId int, breakdownConceptId int64) ([]*ConceptBreakdown, error) {
 	// this is identical to the result of the function below if called with empty filterConceptIds[] and empty filterCohortPairs... so call that:
 	filterConceptIds := []int64{}
 	filterCohortPairs := []utils.CustomDichotomousVariableDef{}
-	return h.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortDefinitionId, filterConceptIds, filterCohortPairs, breakdownConceptId)
+	return h.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx, sourceId, cohortDefinitionId, filterConceptIds, filterCohortPairs, breakdownConceptId)
 }
 
 // Basically same goal as described in function above, but only count persons that have a non-null value for each
@@ -137,30 +147,43 @@ func (h Concept) RetrieveBreakdownStatsBySourceIdAndCohortId(sourceId int, cohor
 //  {ConceptValue: "A", NPersonsInCohortWithValue: M-X},
 //  {ConceptValue: "B", NPersonsInCohortWithValue: N-M-X},
 // where X is the number of persons that have NO value or just a "null" value for one or more of the ids in the given filterConceptIds.
-func (h Concept) RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, breakdownConceptId int64) ([]*ConceptBreakdown, error) {
+func (h Concept) RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, breakdownConceptId int64) ([]*ConceptBreakdown, error) {
 
 	var dataSourceModel = new(Source)
-	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
-	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
+	resultsDataSource, err := dataSourceModel.GetDataSource(sourceId, Results)
+	if err != nil {
+		return nil, err
+	}
 
 	// count persons, grouping by concept value:
 	var conceptBreakdownList []*ConceptBreakdown
-	query := QueryFilterByCohortPairsHelper(filterCohortPairs, resultsDataSource, cohortDefinitionId, "unionAndIntersect").
-		Select("observation.value_as_concept_id, count(distinct(observation.person_id)) as npersons_in_cohort_with_value").
-		Joins("INNER JOIN "+omopDataSource.Schema+".observation_continuous as observation"+omopDataSource.GetViewDirective()+" ON unionAndIntersect.subject_id = observation.person_id").
+	notNullCheck, err := GetConceptValueNotNullCheckBasedOnConceptType(ctx, "observation", sourceId, breakdownConceptId)
+	if err != nil {
+		return nil, err
+	}
+	query, release, err := queryFilteredCohort(ctx, sourceId, cohortDefinitionId, filterConceptIds, filterCohortPairs, omopDataSource, resultsDataSource, "unionAndIntersect")
+	if err != nil {
+		return nil, err
+	}
+	query = query.Select("observation.value_as_concept_id, count(distinct(observation.person_id)) as npersons_in_cohort_with_value").
+		Joins("INNER JOIN "+omopDataSource.Table("observation_continuous")+" as observation"+omopDataSource.Dialect().ViewHint()+" ON unionAndIntersect.subject_id = observation.person_id").
 		Where("observation.observation_concept_id = ?", breakdownConceptId).
-		Where(GetConceptValueNotNullCheckBasedOnConceptType("observation", sourceId, breakdownConceptId))
-
-	query = QueryFilterByConceptIdsHelper(query, sourceId, filterConceptIds, omopDataSource, resultsDataSource.Schema, "unionAndIntersect.subject_id")
+		Where(notNullCheck)
 
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Group("observation.value_as_concept_id").
 		Scan(&conceptBreakdownList)
+	// the concept info queries below do not use the filtered cohort:
+	release()
 
 	// Add concept value (coded value) and concept name for each of the value_as_concept_id values:
 	for _, conceptBreakdownItem := range conceptBreakdownList {
-		conceptInfo, error := h.RetrieveInfoBySourceIdAndConceptId(sourceId, conceptBreakdownItem.ValueAsConceptId)
+		conceptInfo, error := h.RetrieveInfoBySourceIdAndConceptId(ctx, sourceId, conceptBreakdownItem.ValueAsConceptId)
 		if error != nil {
 			return nil, error
 		}
@@ -1,19 +1,30 @@
 package models
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"math"
 	"sync"
 	"time"
 
 	"github.com/uc-cdis/cohort-middleware/config"
 	"github.com/uc-cdis/cohort-middleware/utils"
+	"gorm.io/gorm"
 )
 
 type DataDictionaryI interface {
-	GenerateDataDictionary()
-	GetDataDictionary() (*DataDictionaryModel, error)
+	GenerateDataDictionary(mode DataDictionaryGenerationMode) error
+	StartDataDictionaryGeneration(mode DataDictionaryGenerationMode) (*DataDictionaryGenerationRun, error)
+	GetDataDictionaryGenerationRun() *DataDictionaryGenerationRun
+	RefreshDataDictionaryConcept(ctx context.Context, conceptId int64) (*DataDictionaryResult, error)
+	GetDataDictionary(ctx context.Context) (*DataDictionaryModel, error)
+	SearchDataDictionary(ctx context.Context, query DataDictionaryQuery) (*DataDictionaryPage, error)
+	GetCohortDataDictionary(ctx context.Context, sourceId int, cohortDefinitionId int) (*CohortDataDictionaryModel, error)
+	GetDataDictionarySnapshots(ctx context.Context) ([]*DataDictionarySnapshot, error)
+	DiffDataDictionarySnapshots(ctx context.Context, fromSnapshotId int64, toSnapshotId int64, threshold float64) (*DataDictionarySnapshotDiff, error)
 }
 
 type DataDictionary struct {
@@ -58,153 +69,755 @@ type DataDictionaryResult struct {
 	ValueSummary                     json.RawMessage `json:"valueSummary"`
 }
 
-var ResultCache *DataDictionaryModel = nil
+// Search, filter, sort and pagination options for the data dictionary entries:
+type DataDictionaryQuery struct {
+	// case insensitive text to search for in the concept name and concept code:
+	Search          string
+	VocabularyIDs   []string
+	ConceptClassIDs []string
+	ValueStoredAs   string
+	// minimum number of people with the variable:
+	MinPopulation int64
+	// json name of the field to sort on, e.g. "conceptName":
+	SortBy         string
+	SortDescending bool
+	// 1-based page number:
+	Page     int
+	PageSize int
+}
+
+type DataDictionaryPage struct {
+	Total        int64                   `json:"total"`
+	TotalEntries int64                   `json:"totalEntries"`
+	Page         int                     `json:"page"`
+	PageSize     int                     `json:"pageSize"`
+	Data         []*DataDictionaryResult `json:"data"`
+}
+
+// The fields the data dictionary entries can be sorted on, mapped to their column in data_dictionary_result:
+var dataDictionarySortColumns = map[string]string{
+	"vocabularyID":                     "vocabulary_id",
+	"conceptID":                        "concept_id",
+	"conceptCode":                      "concept_code",
+	"conceptName":                      "concept_name",
+	"conceptClassID":                   "concept_class_id",
+	"numberOfPeopleWithVariable":       "number_of_people_with_variable",
+	"numberOfPeopleWhereValueIsFilled": "number_of_people_where_value_is_filled",
+	"numberOfPeopleWhereValueIsNull":   "number_of_people_where_value_is_null",
+	"valueStoredAs":                    "value_stored_as",
+}
+
+func IsValidDataDictionarySortField(field string) bool {
+	_, ok := dataDictionarySortColumns[field]
+	return ok
+}
+
+type DataDictionaryGenerationMode string
+
+const (
+	// only generates the data dictionary if data_dictionary_result is still empty:
+	DataDictionaryGenerationModeFillEmpty DataDictionaryGenerationMode = "fill-empty"
+	// only regenerates the concepts whose source data changed since the last generation:
+	DataDictionaryGenerationModeIncremental DataDictionaryGenerationMode = "incremental"
+	// regenerates all concepts and swaps the new results into data_dictionary_result in one transaction:
+	DataDictionaryGenerationModeFull DataDictionaryGenerationMode = "full"
+	// the run of RefreshDataDictionaryConcept, which regenerates a single concept. It is not a mode of the generation endpoint:
+	DataDictionaryGenerationModeConcept DataDictionaryGenerationMode = "concept"
+)
+
+func ParseDataDictionaryGenerationMode(mode string) (DataDictionaryGenerationMode, error) {
+	switch DataDictionaryGenerationMode(mode) {
+	case "", DataDictionaryGenerationModeFillEmpty:
+		return DataDictionaryGenerationModeFillEmpty, nil
+	case DataDictionaryGenerationModeIncremental, DataDictionaryGenerationModeFull:
+		return DataDictionaryGenerationMode(mode), nil
+	}
+	return "", fmt.Errorf("invalid data dictionary generation mode '%s'", mode)
+}
+
+// Summary of the source data of a concept in the observation table. Used to
+// detect which concepts need to be regenerated in incremental mode.
+type DataDictionaryConceptFingerprint struct {
+	ConceptID     int64
+	RowCount      int64
+	PersonCount   int64
+	ValueChecksum float64
+}
+
+func (f DataDictionaryConceptFingerprint) Equals(other DataDictionaryConceptFingerprint) bool {
+	return f.ConceptID == other.ConceptID &&
+		f.RowCount == other.RowCount &&
+		f.PersonCount == other.PersonCount &&
+		// the checksum is a sum of floats, so allow for some rounding differences:
+		math.Abs(f.ValueChecksum-other.ValueChecksum) <= 1e-9*math.Max(1, math.Abs(f.ValueChecksum))
+}
+
+type DataDictionaryGenerationStatus string
+
+const (
+	DataDictionaryGenerationQueued    DataDictionaryGenerationStatus = "queued"
+	DataDictionaryGenerationRunning   DataDictionaryGenerationStatus = "running"
+	DataDictionaryGenerationFailed    DataDictionaryGenerationStatus = "failed"
+	DataDictionaryGenerationCompleted DataDictionaryGenerationStatus = "completed"
+)
+
+type DataDictionaryConceptError struct {
+	ConceptID int64  `json:"conceptID"`
+	Error     string `json:"error"`
+}
+
+// Tracks the progress of a data dictionary generation run. Only one run
+// can be queued or running at any given time.
+type DataDictionaryGenerationRun struct {
+	RunID             int64                          `json:"runID"`
+	Mode              DataDictionaryGenerationMode   `json:"mode"`
+	Generator         DataDictionaryGenerator        `json:"generator,omitempty"`
+	Status            DataDictionaryGenerationStatus `json:"status"`
+	QueuedAt          time.Time                      `json:"queuedAt"`
+	StartedAt         *time.Time                     `json:"startedAt,omitempty"`
+	FinishedAt        *time.Time                     `json:"finishedAt,omitempty"`
+	TotalConcepts     int                            `json:"totalConcepts"`
+	ProcessedConcepts int                            `json:"processedConcepts"`
+	ConceptErrors     []DataDictionaryConceptError   `json:"conceptErrors"`
+	Error             string                         `json:"error,omitempty"`
+	// the snapshot taken of the results of this run, if anything changed:
+	SnapshotID int64 `json:"snapshotID,omitempty"`
+}
+
+var ErrDataDictionaryGenerationInProgress = errors.New("data dictionary generation is already in progress")
+var ErrConceptNotInDataDictionary = errors.New("concept not found in data dictionary view")
+var ErrDataDictionaryNotAvailable = errors.New("data dictionary is not available yet")
+
+// The data dictionary read by GetDataDictionary, guarded by dataDictionaryCacheMutex. The generation is incremented
+// each time data_dictionary_result changes, so that a GetDataDictionary that read the table before the change does
+// not cache what it read.
+var dataDictionaryCacheMutex sync.Mutex
+var dataDictionaryCache *DataDictionaryModel
+var dataDictionaryCacheGeneration int64
+
+// the latest generation run, guarded by generationRunMutex:
+var generationRunMutex sync.Mutex
+var generationRun *DataDictionaryGenerationRun
+var lastGenerationRunID int64
+
+func getCachedDataDictionary() (*DataDictionaryModel, int64) {
+	dataDictionaryCacheMutex.Lock()
+	defer dataDictionaryCacheMutex.Unlock()
+	return dataDictionaryCache, dataDictionaryCacheGeneration
+}
 
-func (u DataDictionary) GetDataDictionary() (*DataDictionaryModel, error) {
+// Caches the data dictionary, unless data_dictionary_result changed since the given generation.
+func cacheDataDictionary(dataDictionary *DataDictionaryModel, generation int64) {
+	dataDictionaryCacheMutex.Lock()
+	defer dataDictionaryCacheMutex.Unlock()
+	if generation == dataDictionaryCacheGeneration {
+		dataDictionaryCache = dataDictionary
+	}
+}
+
+// Should be called after each change of data_dictionary_result.
+func invalidateDataDictionaryCache() {
+	dataDictionaryCacheMutex.Lock()
+	defer dataDictionaryCacheMutex.Unlock()
+	dataDictionaryCache = nil
+	dataDictionaryCacheGeneration++
+}
+
+func (u DataDictionary) GetDataDictionary(ctx context.Context) (*DataDictionaryModel, error) {
 	//Read from cache
-	if ResultCache != nil {
-		return ResultCache, nil
+	cachedDataDictionary, cacheGeneration := getCachedDataDictionary()
+	if cachedDataDictionary != nil {
+		return cachedDataDictionary, nil
 	} else {
 		//Read from DB
-		var source = new(Source)
-		sources, _ := source.GetAllSources()
-		if len(sources) < 1 {
-			panic("Error: No data source found")
-		} else if len(sources) > 1 {
-			panic("More than one data source! Exiting")
+		sourceId, err := getSingleSourceId()
+		if err != nil {
+			return nil, err
 		}
 		var dataSourceModel = new(Source)
-		omopDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, Omop)
-		miscDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, Misc)
+		omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+		if err != nil {
+			return nil, err
+		}
+		miscDataSource, err := dataSourceModel.GetDataSource(sourceId, Misc)
+		if err != nil {
+			return nil, err
+		}
 
-		if u.CheckIfDataDictionaryIsFilled(miscDataSource) {
+		filled, err := u.CheckIfDataDictionaryIsFilled(ctx, miscDataSource)
+		if err != nil {
+			return nil, err
+		}
+		if filled {
 			var newDataDictionary DataDictionaryModel
 			var dataDictionaryEntries []*DataDictionaryResult
 			//Get total number of person ids
-			query := omopDataSource.Db.Table(omopDataSource.Schema + ".observation as observation").
+			query := omopDataSource.Db.Table(omopDataSource.Table("observation") + " as observation").
 				Select("count(distinct observation.person_id) as total, null as data")
 
-			query, cancel := utils.AddSpecificTimeoutToQuery(query, 600*time.Second)
+			query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 			defer cancel()
 			meta_result := query.Scan(&newDataDictionary)
 
 			if meta_result.Error != nil {
 				log.Printf("ERROR: Failed to get number of person_ids")
-				return nil, errors.New("data dictionary is not available yet")
+				return nil, fmt.Errorf("%w: %w", ErrDataDictionaryNotAvailable, meta_result.Error)
 			} else {
 				log.Printf("INFO: Total number of person_ids from observation view is %v.", newDataDictionary.Total)
 			}
 
 			//get data dictionary entires saved in table
-			query = miscDataSource.Db.Table(miscDataSource.Schema + ".data_dictionary_result")
-			query, cancel = utils.AddSpecificTimeoutToQuery(query, 600*time.Second)
+			query = miscDataSource.Db.Table(miscDataSource.Table("data_dictionary_result") + " as data_dictionary_result")
+			query, cancel = utils.AddTimeoutToQueryWithContext(ctx, query)
 			defer cancel()
 			meta_result = query.Scan(&dataDictionaryEntries)
 
 			if meta_result.Error != nil {
 				log.Printf("ERROR: Failed to get data entries")
-				return nil, errors.New("data dictionary is not available yet")
+				return nil, fmt.Errorf("%w: %w", ErrDataDictionaryNotAvailable, meta_result.Error)
 			} else {
 				log.Printf("INFO: Got data entries")
 			}
 
 			newDataDictionary.Data, _ = json.Marshal(dataDictionaryEntries)
 			//set in cache
-			ResultCache = &newDataDictionary
+			cacheDataDictionary(&newDataDictionary, cacheGeneration)
 			return &newDataDictionary, nil
 		} else {
-			return nil, errors.New("data dictionary is not available yet")
+			return nil, ErrDataDictionaryNotAvailable
 		}
 	}
 }
 
-// Generate Data Dictionary Json
-func (u DataDictionary) GenerateDataDictionary() {
-	conf := config.GetConfig()
-	var maxWorkerSize int = conf.GetInt("worker_pool_size")
-	log.Printf("maxWorkerSize is %v", maxWorkerSize)
-	var batchSize int = conf.GetInt("batch_size")
-	log.Printf("Batch Size is %v", batchSize)
+// Returns the page of data dictionary entries matching the given query. The entries are
+// filtered, sorted and paginated by the database, instead of returning the whole dictionary.
+func (u DataDictionary) SearchDataDictionary(ctx context.Context, dataDictionaryQuery DataDictionaryQuery) (*DataDictionaryPage, error) {
+	// the total number of persons is part of the (cached) full data dictionary:
+	dataDictionary, err := u.GetDataDictionary(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sourceId, err := getSingleSourceId()
+	if err != nil {
+		return nil, err
+	}
+	var dataSourceModel = new(Source)
+	miscDataSource, err := dataSourceModel.GetDataSource(sourceId, Misc)
+	if err != nil {
+		return nil, err
+	}
+
+	query := miscDataSource.Db.Table(miscDataSource.Table("data_dictionary_result") + " as data_dictionary_result")
+	if dataDictionaryQuery.Search != "" {
+		searchPattern := utils.ContainsLikePattern(dataDictionaryQuery.Search)
+		query = query.Where("lower(concept_name) like ?"+utils.LikeEscapeClause+" or lower(concept_code) like ?"+utils.LikeEscapeClause, searchPattern, searchPattern)
+	}
+	if len(dataDictionaryQuery.VocabularyIDs) > 0 {
+		query = query.Where("vocabulary_id in (?)", dataDictionaryQuery.VocabularyIDs)
+	}
+	if len(dataDictionaryQuery.ConceptClassIDs) > 0 {
+		query = query.Where("concept_class_id in (?)", dataDictionaryQuery.ConceptClassIDs)
+	}
+	if dataDictionaryQuery.ValueStoredAs != "" {
+		query = query.Where("value_stored_as = ?", dataDictionaryQuery.ValueStoredAs)
+	}
+	if dataDictionaryQuery.MinPopulation > 0 {
+		query = query.Where("number_of_people_with_variable >= ?", dataDictionaryQuery.MinPopulation)
+	}
 
-	entryCh := make(chan *DataDictionaryResult, maxWorkerSize)
+	page := DataDictionaryPage{
+		Total:    dataDictionary.Total,
+		Page:     dataDictionaryQuery.Page,
+		PageSize: dataDictionaryQuery.PageSize,
+	}
+	countQuery, cancel := utils.AddTimeoutToQueryWithContext(ctx, query.Session(&gorm.Session{}))
+	defer cancel()
+	meta_result := countQuery.Count(&page.TotalEntries)
+	if meta_result.Error != nil {
+		log.Printf("ERROR: Failed to count data dictionary entries: %v", meta_result.Error)
+		return nil, meta_result.Error
+	}
 
-	var source = new(Source)
-	sources, _ := source.GetAllSources()
-	if len(sources) < 1 {
-		panic("Error: No data source found")
-	} else if len(sources) > 1 {
-		panic("More than one data source! Exiting")
+	sortColumn, ok := dataDictionarySortColumns[dataDictionaryQuery.SortBy]
+	if !ok {
+		sortColumn = "concept_name"
+	}
+	if dataDictionaryQuery.SortDescending {
+		sortColumn += " desc"
 	}
+	// sort on concept_id as well, to make the pagination deterministic:
+	query = query.Order(sortColumn).Order("concept_id").
+		Offset((dataDictionaryQuery.Page - 1) * dataDictionaryQuery.PageSize).
+		Limit(dataDictionaryQuery.PageSize)
+	query, cancel = utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	page.Data = []*DataDictionaryResult{}
+	meta_result = query.Scan(&page.Data)
+	if meta_result.Error != nil {
+		log.Printf("ERROR: Failed to get data dictionary entries: %v", meta_result.Error)
+		return nil, meta_result.Error
+	}
+	return &page, nil
+}
+
+// Returns a copy of the latest data dictionary generation run, or nil if
+// no generation was started since this service was started.
+func (u DataDictionary) GetDataDictionaryGenerationRun() *DataDictionaryGenerationRun {
+	generationRunMutex.Lock()
+	defer generationRunMutex.Unlock()
+	if generationRun == nil {
+		return nil
+	}
+	runCopy := *generationRun
+	runCopy.ConceptErrors = append([]DataDictionaryConceptError{}, generationRun.ConceptErrors...)
+	return &runCopy
+}
+
+// Queues a new data dictionary generation run and starts it in the background.
+// Returns ErrDataDictionaryGenerationInProgress if another run is still queued or running.
+func (u DataDictionary) StartDataDictionaryGeneration(mode DataDictionaryGenerationMode) (*DataDictionaryGenerationRun, error) {
+	run, err := queueGenerationRun(mode)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		// the run continues after the request that started it, so its queries do not get the request context:
+		_ = runDataDictionaryGeneration(run, func(run *DataDictionaryGenerationRun) error {
+			return u.generateDataDictionary(context.Background(), run)
+		})
+	}()
+	return u.GetDataDictionaryGenerationRun(), nil
+}
+
+// Generate Data Dictionary Json. Runs synchronously, but is tracked in the same way
+// as the runs started by StartDataDictionaryGeneration.
+func (u DataDictionary) GenerateDataDictionary(mode DataDictionaryGenerationMode) error {
+	run, err := queueGenerationRun(mode)
+	if err != nil {
+		return err
+	}
+	return runDataDictionaryGeneration(run, func(run *DataDictionaryGenerationRun) error {
+		return u.generateDataDictionary(context.Background(), run)
+	})
+}
+
+func queueGenerationRun(mode DataDictionaryGenerationMode) (*DataDictionaryGenerationRun, error) {
+	generationRunMutex.Lock()
+	defer generationRunMutex.Unlock()
+	if isGenerationRunActive() {
+		log.Printf("WARNING: data dictionary generation run %d is still %s", generationRun.RunID, generationRun.Status)
+		return nil, ErrDataDictionaryGenerationInProgress
+	}
+	lastGenerationRunID++
+	generationRun = &DataDictionaryGenerationRun{
+		RunID:         lastGenerationRunID,
+		Mode:          mode,
+		Status:        DataDictionaryGenerationQueued,
+		QueuedAt:      time.Now(),
+		ConceptErrors: []DataDictionaryConceptError{},
+	}
+	return generationRun, nil
+}
+
+// should only be called while holding generationRunMutex:
+func isGenerationRunActive() bool {
+	return generationRun != nil &&
+		(generationRun.Status == DataDictionaryGenerationQueued || generationRun.Status == DataDictionaryGenerationRunning)
+}
+
+// Applies the given update to the run while holding the run lock:
+func updateGenerationRun(run *DataDictionaryGenerationRun, update func(run *DataDictionaryGenerationRun)) {
+	generationRunMutex.Lock()
+	defer generationRunMutex.Unlock()
+	update(run)
+}
+
+// Runs generate for the queued run, tracking its status.
+func runDataDictionaryGeneration(run *DataDictionaryGenerationRun, generate func(run *DataDictionaryGenerationRun) error) error {
+	updateGenerationRun(run, func(run *DataDictionaryGenerationRun) {
+		startedAt := time.Now()
+		run.StartedAt = &startedAt
+		run.Status = DataDictionaryGenerationRunning
+	})
+	err := generate(run)
+	updateGenerationRun(run, func(run *DataDictionaryGenerationRun) {
+		finishedAt := time.Now()
+		run.FinishedAt = &finishedAt
+		if err != nil {
+			run.Status = DataDictionaryGenerationFailed
+			run.Error = err.Error()
+		} else {
+			run.Status = DataDictionaryGenerationCompleted
+		}
+	})
+	if err != nil {
+		log.Printf("ERROR: data dictionary generation run %d failed: %v", run.RunID, err)
+	}
+	return err
+}
+
+func (u DataDictionary) generateDataDictionary(ctx context.Context, run *DataDictionaryGenerationRun) error {
+	sourceId, err := getSingleSourceId()
+	if err != nil {
+		return err
+	}
+	generator, err := GetDataDictionaryGenerator()
+	if err != nil {
+		return err
+	}
+	updateGenerationRun(run, func(run *DataDictionaryGenerationRun) {
+		run.Generator = generator
+	})
 	var dataSourceModel = new(Source)
-	miscDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, Misc)
+	miscDataSource, err := dataSourceModel.GetDataSource(sourceId, Misc)
+	if err != nil {
+		return err
+	}
+
+	if run.Mode == DataDictionaryGenerationModeFillEmpty {
+		filled, err := u.CheckIfDataDictionaryIsFilled(ctx, miscDataSource)
+		if err != nil {
+			return err
+		}
+		if filled {
+			log.Print("Data Dictionary Result already filled. Skipping generation.")
+			return nil
+		}
+	}
+
+	dataDictionaryEntries, err := u.getDataDictionaryEntries(ctx, miscDataSource, nil)
+	if err != nil {
+		return err
+	}
+	fingerprints, err := u.getConceptFingerprints(ctx, sourceId, getConceptIdsOfEntries(dataDictionaryEntries))
+	if err != nil {
+		return err
+	}
+
+	var conceptIdsToRemove []int64
+	if run.Mode == DataDictionaryGenerationModeIncremental {
+		dataDictionaryEntries, conceptIdsToRemove, err = u.getChangedDataDictionaryEntries(ctx, miscDataSource, dataDictionaryEntries, fingerprints)
+		if err != nil {
+			return err
+		}
+		log.Printf("INFO: %d concepts changed and %d concepts were removed since last generation.",
+			len(dataDictionaryEntries), len(conceptIdsToRemove))
+	}
 
-	if u.CheckIfDataDictionaryIsFilled(miscDataSource) {
-		log.Print("Data Dictionary Result already filled. Skipping generation.")
-		return
+	updateGenerationRun(run, func(run *DataDictionaryGenerationRun) {
+		run.TotalConcepts = len(dataDictionaryEntries)
+	})
+
+	if run.Mode == DataDictionaryGenerationModeFillEmpty {
+		// write results as they come in:
+		results, err := u.generateDataDictionaryResults(ctx, run, generator, sourceId, dataDictionaryEntries, func(resultDataList []*DataDictionaryResult) error {
+			return u.WriteResultToDB(miscDataSource, resultDataList)
+		})
+		if err != nil {
+			return err
+		}
+		err = u.replaceDataDictionaryResults(miscDataSource, nil, nil, fingerprints, getConceptIdsOfResults(results))
+		if err != nil {
+			return err
+		}
 	} else {
-		var dataDictionaryEntries []*DataDictionaryEntry
-		//see ddl_results_and_cdm.sql Data_Dictionary view
-		query := miscDataSource.Db.Table(miscDataSource.Schema + ".data_dictionary")
-
-		query, cancel := utils.AddSpecificTimeoutToQuery(query, 600*time.Second)
-		defer cancel()
-		meta_result := query.Scan(&dataDictionaryEntries)
-		if meta_result.Error != nil {
-			log.Printf("Error: db read error: %v", meta_result.Error)
-			return
-		} else if len(dataDictionaryEntries) == 0 {
-			log.Printf("INFO: no data dictionary view entry found")
+		// collect all results, then swap them in in a single transaction:
+		var allResults []*DataDictionaryResult
+		_, err := u.generateDataDictionaryResults(ctx, run, generator, sourceId, dataDictionaryEntries, func(resultDataList []*DataDictionaryResult) error {
+			allResults = append(allResults, resultDataList...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if run.Mode == DataDictionaryGenerationModeFull {
+			err = u.replaceAllDataDictionaryResults(miscDataSource, allResults, fingerprints)
 		} else {
-			log.Printf("INFO: Data dictionary view entries found.")
+			// concepts that failed to generate keep their old entry:
+			err = u.replaceDataDictionaryResults(miscDataSource, allResults, conceptIdsToRemove, fingerprints, getConceptIdsOfResults(allResults))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(dataDictionaryEntries) > 0 || len(conceptIdsToRemove) > 0 {
+		snapshot, err := u.createDataDictionarySnapshot(ctx, miscDataSource, sourceId, run.Mode)
+		if err != nil {
+			return err
 		}
+		updateGenerationRun(run, func(run *DataDictionaryGenerationRun) {
+			run.SnapshotID = snapshot.SnapshotID
+		})
+	}
+	log.Printf("INFO: Data dictionary generation complete")
+	return nil
+}
 
-		log.Printf("Get all histogram/bar graph data")
-		var partialDataList []*DataDictionaryEntry
-		var resultDataList []*DataDictionaryResult = []*DataDictionaryResult{}
-		for len(dataDictionaryEntries) > 0 {
-			wg := sync.WaitGroup{}
-			partialResultList := []*DataDictionaryResult{}
-			if len(dataDictionaryEntries) < maxWorkerSize {
-				partialDataList = dataDictionaryEntries
-				dataDictionaryEntries = []*DataDictionaryEntry{}
-			} else {
-				partialDataList = dataDictionaryEntries[:maxWorkerSize-1]
-				dataDictionaryEntries = dataDictionaryEntries[maxWorkerSize-1:]
-			}
+// Regenerates the data dictionary entry of a single concept and replaces it in data_dictionary_result. The refresh
+// is tracked as a generation run, so that it does not overlap with the other runs that write data_dictionary_result.
+func (u DataDictionary) RefreshDataDictionaryConcept(ctx context.Context, conceptId int64) (*DataDictionaryResult, error) {
+	run, err := queueGenerationRun(DataDictionaryGenerationModeConcept)
+	if err != nil {
+		return nil, err
+	}
+	var result *DataDictionaryResult
+	err = runDataDictionaryGeneration(run, func(run *DataDictionaryGenerationRun) error {
+		var err error
+		result, err = u.refreshDataDictionaryConcept(ctx, run, conceptId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
 
-			for _, d := range partialDataList {
-				wg.Add(1)
-				go GenerateData(d, sources[0].SourceId, &wg, entryCh)
-				resultEntry := <-entryCh
-				partialResultList = append(partialResultList, resultEntry)
-			}
-			wg.Wait()
-			resultDataList = append(resultDataList, partialResultList...)
-			if len(resultDataList) >= batchSize {
-				log.Printf("%v row of results reached, flush to db.", batchSize)
-				u.WriteResultToDB(miscDataSource, resultDataList)
-				resultDataList = []*DataDictionaryResult{}
+func (u DataDictionary) refreshDataDictionaryConcept(ctx context.Context, run *DataDictionaryGenerationRun, conceptId int64) (*DataDictionaryResult, error) {
+	sourceId, err := getSingleSourceId()
+	if err != nil {
+		return nil, err
+	}
+	var dataSourceModel = new(Source)
+	miscDataSource, err := dataSourceModel.GetDataSource(sourceId, Misc)
+	if err != nil {
+		return nil, err
+	}
+
+	dataDictionaryEntries, err := u.getDataDictionaryEntries(ctx, miscDataSource, []int64{conceptId})
+	if err != nil {
+		return nil, err
+	} else if len(dataDictionaryEntries) == 0 {
+		return nil, ErrConceptNotInDataDictionary
+	}
+	fingerprints, err := u.getConceptFingerprints(ctx, sourceId, []int64{conceptId})
+	if err != nil {
+		return nil, err
+	}
+	generator, err := GetDataDictionaryGenerator()
+	if err != nil {
+		return nil, err
+	}
+	updateGenerationRun(run, func(run *DataDictionaryGenerationRun) {
+		run.Generator = generator
+		run.TotalConcepts = 1
+	})
+	generateData := getGenerateDataFunc(generator)
+	var result *DataDictionaryResult
+	var generationErr error
+	err = utils.RunWorkerPool(ctx, dataDictionaryEntries, getDataDictionaryWorkerPoolConfig(),
+		func(ctx context.Context, entry *DataDictionaryEntry) (*DataDictionaryResult, error) {
+			return generateData(ctx, entry, sourceId)
+		},
+		func(entry *DataDictionaryEntry, err error) {
+			if err != nil && generationErr == nil {
+				generationErr = err
 			}
+			updateGenerationRun(run, func(run *DataDictionaryGenerationRun) {
+				run.ProcessedConcepts++
+			})
+		},
+		func(resultDataList []*DataDictionaryResult) error {
+			result = resultDataList[0]
+			return nil
+		})
+	if err == nil {
+		err = generationErr
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to refresh data dictionary entry for concept id %v: %v", conceptId, err)
+		return nil, err
+	} else if result == nil {
+		return nil, fmt.Errorf("no data dictionary entry was generated for concept id %v", conceptId)
+	}
+	err = u.replaceDataDictionaryResults(miscDataSource, []*DataDictionaryResult{result}, nil, fingerprints, []int64{conceptId})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("INFO: Data dictionary entry for concept id %v refreshed", conceptId)
+	return result, nil
+}
+
+// Gets the entries from the data_dictionary view, optionally filtered by concept id.
+func (u DataDictionary) getDataDictionaryEntries(ctx context.Context, miscDataSource *utils.DbAndSchema, conceptIds []int64) ([]*DataDictionaryEntry, error) {
+	var dataDictionaryEntries []*DataDictionaryEntry
+	//see ddl_results_and_cdm.sql Data_Dictionary view
+	query := miscDataSource.Db.Table(miscDataSource.Table("data_dictionary") + " as data_dictionary")
+	if len(conceptIds) > 0 {
+		query = query.Where("concept_id in (?)", conceptIds)
+	}
+
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result := query.Scan(&dataDictionaryEntries)
+	if meta_result.Error != nil {
+		log.Printf("Error: db read error: %v", meta_result.Error)
+		return nil, meta_result.Error
+	} else if len(dataDictionaryEntries) == 0 {
+		log.Printf("INFO: no data dictionary view entry found")
+	} else {
+		log.Printf("INFO: Data dictionary view entries found.")
+	}
+	return dataDictionaryEntries, nil
+}
+
+// Computes a row count and a checksum of the values of each of the given concepts in the observation table.
+func (u DataDictionary) getConceptFingerprints(ctx context.Context, sourceId int, conceptIds []int64) (map[int64]DataDictionaryConceptFingerprint, error) {
+	fingerprintsMap := make(map[int64]DataDictionaryConceptFingerprint)
+	if len(conceptIds) == 0 {
+		return fingerprintsMap, nil
+	}
+	var dataSourceModel = new(Source)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
+
+	var fingerprints []*DataDictionaryConceptFingerprint
+	query := omopDataSource.Db.Table(omopDataSource.Table("observation")+" as observation").
+		Select("observation.observation_concept_id as concept_id, count(*) as row_count, count(distinct observation.person_id) as person_count, "+
+			"coalesce(sum(observation.value_as_number), 0) + coalesce(sum(cast(observation.value_as_concept_id as bigint)), 0) as value_checksum").
+		Where("observation.observation_concept_id in (?)", conceptIds).
+		Group("observation.observation_concept_id")
+
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result := query.Scan(&fingerprints)
+	if meta_result.Error != nil {
+		log.Printf("ERROR: Failed to get concept fingerprints: %v", meta_result.Error)
+		return nil, meta_result.Error
+	}
+	for _, fingerprint := range fingerprints {
+		fingerprintsMap[fingerprint.ConceptID] = *fingerprint
+	}
+	// concepts without any observations still get a (zero) fingerprint:
+	for _, conceptId := range conceptIds {
+		if _, found := fingerprintsMap[conceptId]; !found {
+			fingerprintsMap[conceptId] = DataDictionaryConceptFingerprint{ConceptID: conceptId}
 		}
+	}
+	return fingerprintsMap, nil
+}
 
-		if len(resultDataList) > 0 {
-			u.WriteResultToDB(miscDataSource, resultDataList)
+// Returns the entries that are new or whose fingerprint changed since the last generation,
+// and the ids of the concepts that are in data_dictionary_result but no longer in the data_dictionary view.
+func (u DataDictionary) getChangedDataDictionaryEntries(ctx context.Context, miscDataSource *utils.DbAndSchema, dataDictionaryEntries []*DataDictionaryEntry,
+	fingerprints map[int64]DataDictionaryConceptFingerprint) ([]*DataDictionaryEntry, []int64, error) {
+
+	var storedFingerprints []*DataDictionaryConceptFingerprint
+	query := miscDataSource.Db.Table(miscDataSource.Table("data_dictionary_concept_fingerprint") + " as data_dictionary_concept_fingerprint")
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result := query.Scan(&storedFingerprints)
+	if meta_result.Error != nil {
+		log.Printf("ERROR: Failed to get stored concept fingerprints: %v", meta_result.Error)
+		return nil, nil, meta_result.Error
+	}
+	storedFingerprintsMap := make(map[int64]DataDictionaryConceptFingerprint)
+	for _, storedFingerprint := range storedFingerprints {
+		storedFingerprintsMap[storedFingerprint.ConceptID] = *storedFingerprint
+	}
+
+	var storedConceptIds []int64
+	query = miscDataSource.Db.Table(miscDataSource.Table("data_dictionary_result") + " as data_dictionary_result").Select("concept_id")
+	query, cancel = utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result = query.Scan(&storedConceptIds)
+	if meta_result.Error != nil {
+		log.Printf("ERROR: Failed to get data dictionary result concept ids: %v", meta_result.Error)
+		return nil, nil, meta_result.Error
+	}
+	storedConceptIdsMap := make(map[int64]bool)
+	for _, storedConceptId := range storedConceptIds {
+		storedConceptIdsMap[storedConceptId] = true
+	}
+
+	changedEntries := []*DataDictionaryEntry{}
+	currentConceptIdsMap := make(map[int64]bool)
+	for _, entry := range dataDictionaryEntries {
+		currentConceptIdsMap[entry.ConceptID] = true
+		storedFingerprint, found := storedFingerprintsMap[entry.ConceptID]
+		if !found || !storedConceptIdsMap[entry.ConceptID] || !storedFingerprint.Equals(fingerprints[entry.ConceptID]) {
+			changedEntries = append(changedEntries, entry)
+		}
+	}
+	removedConceptIds := []int64{}
+	for _, storedConceptId := range storedConceptIds {
+		if !currentConceptIdsMap[storedConceptId] {
+			removedConceptIds = append(removedConceptIds, storedConceptId)
 		}
+	}
+	return changedEntries, removedConceptIds, nil
+}
+
+// Generates the results for the given entries with a pool of worker_pool_size workers, calling flush
+// with each batch of batch_size results. Returns the successfully generated results.
+func (u DataDictionary) generateDataDictionaryResults(ctx context.Context, run *DataDictionaryGenerationRun, generator DataDictionaryGenerator, sourceId int,
+	dataDictionaryEntries []*DataDictionaryEntry, flush func(resultDataList []*DataDictionaryResult) error) ([]*DataDictionaryResult, error) {
+
+	generateData := getGenerateDataFunc(generator)
+	poolConfig := getDataDictionaryWorkerPoolConfig()
+	log.Printf("Get all histogram/bar graph data")
+	var allResults []*DataDictionaryResult
+	err := utils.RunWorkerPool(ctx, dataDictionaryEntries, poolConfig,
+		func(ctx context.Context, entry *DataDictionaryEntry) (*DataDictionaryResult, error) {
+			return generateData(ctx, entry, sourceId)
+		},
+		func(entry *DataDictionaryEntry, err error) {
+			if err != nil {
+				log.Printf("ERROR: failed to generate data dictionary entry for concept id %v: %v", entry.ConceptID, err)
+			}
+			updateGenerationRun(run, func(run *DataDictionaryGenerationRun) {
+				run.ProcessedConcepts++
+				if err != nil {
+					run.ConceptErrors = append(run.ConceptErrors, DataDictionaryConceptError{
+						ConceptID: entry.ConceptID,
+						Error:     err.Error(),
+					})
+				}
+			})
+		},
+		func(resultDataList []*DataDictionaryResult) error {
+			log.Printf("%v row of results reached, flush to db.", len(resultDataList))
+			allResults = append(allResults, resultDataList...)
+			return flush(resultDataList)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return allResults, nil
+}
 
-		log.Printf("INFO: Data dictionary generation complete")
-		return
+func getDataDictionaryWorkerPoolConfig() utils.WorkerPoolConfig {
+	conf := config.GetConfig()
+	poolConfig := utils.WorkerPoolConfig{
+		Workers:    conf.GetInt("worker_pool_size"),
+		BatchSize:  conf.GetInt("batch_size"),
+		Timeout:    time.Duration(conf.GetInt("data_dictionary_concept_timeout_seconds")) * time.Second,
+		MaxRetries: conf.GetInt("data_dictionary_concept_max_retries"),
 	}
+	log.Printf("maxWorkerSize is %v", poolConfig.Workers)
+	log.Printf("Batch Size is %v", poolConfig.BatchSize)
+	return poolConfig
+}
+
+// Generates the histogram (for numeric concepts) or bar graph (for concept id concepts)
+// value summary of the given data dictionary entry.
+func GenerateData(ctx context.Context, data *DataDictionaryEntry, sourceId int) (*DataDictionaryResult, error) {
+	return generateData(ctx, data, sourceId, allPersons)
 }
 
-func GenerateData(data *DataDictionaryEntry, sourceId int, wg *sync.WaitGroup, ch chan *DataDictionaryResult) {
+// Same as GenerateData, but restricted to the members of the given cohort unless cohortDefinitionId is allPersons.
+func generateData(ctx context.Context, data *DataDictionaryEntry, sourceId int, cohortDefinitionId int) (*DataDictionaryResult, error) {
 	var c = new(CohortData)
+	result := DataDictionaryResult(*data)
 
 	if data.ValueStoredAs == "Number" {
 		//If histogram concept classes
-		log.Printf("Generate histogram for Concept id %v.", data.ConceptClassId)
-		var cohortData []*PersonConceptAndValue
-
-		cohortData, _ = c.RetrieveHistogramDataBySourceIdAndConceptId(sourceId, data.ConceptID)
+		log.Printf("Generate histogram for Concept id %v.", data.ConceptID)
+		cohortData, err := c.retrieveHistogramDataWithContext(ctx, sourceId, cohortDefinitionId, data.ConceptID)
+		if err != nil {
+			return nil, err
+		}
 
 		conceptValues := []float64{}
 		for _, personData := range cohortData {
@@ -212,46 +825,137 @@ func GenerateData(data *DataDictionaryEntry, sourceId int, wg *sync.WaitGroup, c
 		}
 		log.Printf("INFO: concept id %v data size is %v", data.ConceptID, len(conceptValues))
 		histogramData := utils.GenerateHistogramData(conceptValues)
-		data.ValueSummary, _ = json.Marshal(histogramData)
+		result.ValueSummary, _ = json.Marshal(histogramData)
 	} else if data.ValueStoredAs == "Concept Id" {
 		//If bar graph concept classes
-		log.Printf("Generate bar graph for Concept id %v.", data.ConceptClassId)
-		nominalValueData, _ := c.RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds(sourceId, data.ConceptID)
-		data.ValueSummary, _ = json.Marshal(nominalValueData)
+		log.Printf("Generate bar graph for Concept id %v.", data.ConceptID)
+		nominalValueData, err := c.retrieveBarGraphDataWithContext(ctx, sourceId, cohortDefinitionId, data.ConceptID)
+		if err != nil {
+			return nil, err
+		}
+		result.ValueSummary, _ = json.Marshal(nominalValueData)
 	}
-	result := DataDictionaryResult(*data)
-
-	//send result to channel
-	ch <- &result
-	wg.Done()
+	return &result, nil
 }
 
-func (u DataDictionary) WriteResultToDB(dbSource *utils.DbAndSchema, resultDataList []*DataDictionaryResult) bool {
+func (u DataDictionary) WriteResultToDB(dbSource *utils.DbAndSchema, resultDataList []*DataDictionaryResult) error {
 
 	result := dbSource.Db.Create(resultDataList)
 	if result.Error != nil {
-		log.Printf("ERROR: Failed to insert data into table")
-		panic("")
+		log.Printf("ERROR: Failed to insert data into table: %v", result.Error)
+		return result.Error
 	}
 	log.Printf("Write to DB succeeded.")
-	return true
+	return nil
+}
+
+// Replaces the results of the given concepts and removes the results of conceptIdsToRemove in a single
+// transaction, so readers see either the old or the new version of these concepts. The fingerprints of
+// fingerprintConceptIds are replaced as well.
+func (u DataDictionary) replaceDataDictionaryResults(dbSource *utils.DbAndSchema, resultDataList []*DataDictionaryResult, conceptIdsToRemove []int64,
+	fingerprints map[int64]DataDictionaryConceptFingerprint, fingerprintConceptIds []int64) error {
+
+	batchSize := config.GetConfig().GetInt("batch_size")
+	conceptIdsToDelete := append(getConceptIdsOfResults(resultDataList), conceptIdsToRemove...)
+	err := dbSource.Db.Transaction(func(tx *gorm.DB) error {
+		if len(conceptIdsToDelete) > 0 {
+			if err := tx.Where("concept_id in (?)", conceptIdsToDelete).Delete(&DataDictionaryResult{}).Error; err != nil {
+				return err
+			}
+		}
+		fingerprintConceptIdsToDelete := append(fingerprintConceptIds, conceptIdsToRemove...)
+		if len(fingerprintConceptIdsToDelete) > 0 {
+			if err := tx.Where("concept_id in (?)", fingerprintConceptIdsToDelete).Delete(&DataDictionaryConceptFingerprint{}).Error; err != nil {
+				return err
+			}
+		}
+		if len(resultDataList) > 0 {
+			if err := tx.CreateInBatches(resultDataList, batchSize).Error; err != nil {
+				return err
+			}
+		}
+		return writeFingerprints(tx, fingerprintConceptIds, fingerprints, batchSize)
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to replace data dictionary results: %v", err)
+		return err
+	}
+	invalidateDataDictionaryCache()
+	return nil
+}
+
+// Swaps the full contents of data_dictionary_result for the given results in a single transaction,
+// so readers never see a partially filled table.
+func (u DataDictionary) replaceAllDataDictionaryResults(dbSource *utils.DbAndSchema, resultDataList []*DataDictionaryResult,
+	fingerprints map[int64]DataDictionaryConceptFingerprint) error {
+
+	batchSize := config.GetConfig().GetInt("batch_size")
+	err := dbSource.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&DataDictionaryResult{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("1 = 1").Delete(&DataDictionaryConceptFingerprint{}).Error; err != nil {
+			return err
+		}
+		if len(resultDataList) > 0 {
+			if err := tx.CreateInBatches(resultDataList, batchSize).Error; err != nil {
+				return err
+			}
+		}
+		return writeFingerprints(tx, getConceptIdsOfResults(resultDataList), fingerprints, batchSize)
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to swap data dictionary results: %v", err)
+		return err
+	}
+	invalidateDataDictionaryCache()
+	return nil
+}
+
+func writeFingerprints(tx *gorm.DB, conceptIds []int64, fingerprints map[int64]DataDictionaryConceptFingerprint, batchSize int) error {
+	fingerprintList := []*DataDictionaryConceptFingerprint{}
+	for _, conceptId := range conceptIds {
+		if fingerprint, found := fingerprints[conceptId]; found {
+			fingerprintList = append(fingerprintList, &fingerprint)
+		}
+	}
+	if len(fingerprintList) == 0 {
+		return nil
+	}
+	return tx.CreateInBatches(fingerprintList, batchSize).Error
+}
+
+func getConceptIdsOfEntries(dataDictionaryEntries []*DataDictionaryEntry) []int64 {
+	conceptIds := []int64{}
+	for _, entry := range dataDictionaryEntries {
+		conceptIds = append(conceptIds, entry.ConceptID)
+	}
+	return conceptIds
+}
+
+func getConceptIdsOfResults(resultDataList []*DataDictionaryResult) []int64 {
+	conceptIds := []int64{}
+	for _, result := range resultDataList {
+		conceptIds = append(conceptIds, result.ConceptID)
+	}
+	return conceptIds
 }
 
-func (u DataDictionary) CheckIfDataDictionaryIsFilled(dbSource *utils.DbAndSchema) bool {
+func (u DataDictionary) CheckIfDataDictionaryIsFilled(ctx context.Context, dbSource *utils.DbAndSchema) (bool, error) {
 	var dataDictionaryResult []*DataDictionaryResult
-	query := dbSource.Db.Table(dbSource.Schema + ".data_dictionary_result")
+	query := dbSource.Db.Table(dbSource.Table("data_dictionary_result") + " as data_dictionary_result")
 
-	query, cancel := utils.AddSpecificTimeoutToQuery(query, 600*time.Second)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&dataDictionaryResult)
 	if meta_result.Error != nil {
 		log.Printf("ERROR: Failed to get data dictionary result")
-		panic("")
+		return false, meta_result.Error
 	} else if len(dataDictionaryResult) > 0 {
 		log.Printf("INFO: Data Dictionary Result Table is filled.")
-		return true
+		return true, nil
 	} else {
 		log.Printf("INFO: Data Dictionary Result Table is empty.")
-		return false
+		return false, nil
 	}
 }
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+	"github.com/uc-cdis/cohort-middleware/utils"
+	"gorm.io/gorm"
+)
+
+// Determines how the value summaries of the data dictionary entries are computed:
+type DataDictionaryGenerator string
+
+const (
+	// loads the values of each numeric concept and builds the histogram in memory:
+	DataDictionaryGeneratorInMemory DataDictionaryGenerator = "in-memory"
+	// computes moments, quartiles and histogram bins with grouped SQL, so that only aggregates leave the database:
+	DataDictionaryGeneratorSql DataDictionaryGenerator = "sql"
+)
+
+// Returns the generator configured in data_dictionary_generator, defaulting to in-memory.
+func GetDataDictionaryGenerator() (DataDictionaryGenerator, error) {
+	generator := DataDictionaryGenerator(config.GetConfig().GetString("data_dictionary_generator"))
+	switch generator {
+	case "", DataDictionaryGeneratorInMemory:
+		return DataDictionaryGeneratorInMemory, nil
+	case DataDictionaryGeneratorSql:
+		return generator, nil
+	}
+	return "", fmt.Errorf("invalid data dictionary generator '%s'", generator)
+}
+
+func getGenerateDataFunc(generator DataDictionaryGenerator) func(ctx context.Context, data *DataDictionaryEntry, sourceId int) (*DataDictionaryResult, error) {
+	if generator == DataDictionaryGeneratorSql {
+		return GenerateDataWithSqlAggregation
+	}
+	return GenerateData
+}
+
+type numericConceptStats struct {
+	NumberOfPeopleWithVariable       int64
+	NumberOfPeopleWhereValueIsFilled int64
+	NumberOfPeopleWhereValueIsNull   int64
+	MinValue                         *float64
+	MaxValue                         *float64
+	MeanValue                        *float64
+	StandardDeviation                *float64
+}
+
+type numericConceptQuartiles struct {
+	ValueCount    int
+	FirstQuartile float64
+	ThirdQuartile float64
+	MinValue      float64
+	MaxValue      float64
+}
+
+type histogramBinCount struct {
+	BinIndex    int
+	PersonCount int
+}
+
+// Same as GenerateData, but computes the person counts, statistics and histogram of numeric concepts
+// with grouped queries, instead of taking the counts and statistics from the data_dictionary view. Note that the quartiles (and therefore the histogram bin width) are computed
+// by the database with linear interpolation, which can differ slightly from the in-memory generator.
+func GenerateDataWithSqlAggregation(ctx context.Context, data *DataDictionaryEntry, sourceId int) (*DataDictionaryResult, error) {
+	if data.ValueStoredAs != "Number" {
+		// the bar graph data is already aggregated by the database:
+		return GenerateData(ctx, data, sourceId)
+	}
+	var dataSourceModel = new(Source)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, err
+	}
+	result := DataDictionaryResult(*data)
+
+	log.Printf("Generate histogram with sql aggregation for Concept id %v.", data.ConceptID)
+	stats, err := getNumericConceptStats(ctx, omopDataSource, data.ConceptID)
+	if err != nil {
+		return nil, err
+	}
+	result.NumberOfPeopleWithVariable = stats.NumberOfPeopleWithVariable
+	result.NumberOfPeopleWhereValueIsFilled = stats.NumberOfPeopleWhereValueIsFilled
+	result.NumberOfPeopleWhereValueIsNull = stats.NumberOfPeopleWhereValueIsNull
+	result.MinValue = valueOrZero(stats.MinValue)
+	result.MaxValue = valueOrZero(stats.MaxValue)
+	result.MeanValue = valueOrZero(stats.MeanValue)
+	result.StandardDeviation = valueOrZero(stats.StandardDeviation)
+
+	quartiles, err := getNumericConceptQuartiles(ctx, omopDataSource, data.ConceptID)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("INFO: concept id %v data size is %v", data.ConceptID, quartiles.ValueCount)
+	if quartiles.ValueCount == 0 {
+		result.ValueSummary, _ = json.Marshal([]utils.HistogramColumn(nil))
+		return &result, nil
+	}
+	numBins, width := utils.GetBinsAndWidth(quartiles.ValueCount, quartiles.MinValue, quartiles.MaxValue,
+		quartiles.ThirdQuartile-quartiles.FirstQuartile)
+	binCounts, err := getNumericConceptBinCounts(ctx, omopDataSource, data.ConceptID, quartiles.MinValue, width)
+	if err != nil {
+		return nil, err
+	}
+	binIndexToPersonCount := make(map[int]int)
+	for _, binCount := range binCounts {
+		binIndexToPersonCount[binCount.BinIndex] = binCount.PersonCount
+	}
+	histogramData := utils.GenerateHistogramDataFromBinCounts(quartiles.MinValue, width, numBins, binIndexToPersonCount)
+	result.ValueSummary, _ = json.Marshal(histogramData)
+	return &result, nil
+}
+
+// Computes the person counts and the min, max, mean and standard deviation over all observations of the
+// concept in a single query, like the data_dictionary view does for numeric concepts.
+func getNumericConceptStats(ctx context.Context, omopDataSource *utils.DbAndSchema, conceptId int64) (*numericConceptStats, error) {
+	var stats numericConceptStats
+	query := omopDataSource.Db.Table(omopDataSource.Table("observation")+" as observation").
+		Select("count(distinct observation.person_id) as number_of_people_with_variable, "+
+			"count(distinct case when observation.value_as_number is not null then observation.person_id end) as number_of_people_where_value_is_filled, "+
+			"count(distinct case when observation.value_as_number is null then observation.person_id end) as number_of_people_where_value_is_null, "+
+			"min(observation.value_as_number) as min_value, max(observation.value_as_number) as max_value, "+
+			"avg(observation.value_as_number) as mean_value, "+omopDataSource.Dialect().StandardDeviation("observation.value_as_number")+" as standard_deviation").
+		Where("observation.observation_concept_id = ?", conceptId)
+
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result := query.Scan(&stats)
+	return &stats, meta_result.Error
+}
+
+// Computes the number of distinct person values of the concept (the values the histogram is built from)
+// together with their range and their first and third quartiles.
+func getNumericConceptQuartiles(ctx context.Context, omopDataSource *utils.DbAndSchema, conceptId int64) (*numericConceptQuartiles, error) {
+	var quartiles numericConceptQuartiles
+	personValues := getDistinctPersonValuesQuery(omopDataSource, conceptId)
+	query := omopDataSource.Db.Raw(omopDataSource.Dialect().PercentilesQuery("?", "person_value", []utils.NamedPercentile{
+		{Name: "first_quartile", Fraction: 0.25},
+		{Name: "third_quartile", Fraction: 0.75},
+	}), personValues)
+
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result := query.Scan(&quartiles)
+	return &quartiles, meta_result.Error
+}
+
+// Counts the distinct person values of the concept per histogram bin index.
+func getNumericConceptBinCounts(ctx context.Context, omopDataSource *utils.DbAndSchema, conceptId int64, startValue float64, width float64) ([]*histogramBinCount, error) {
+	var binCounts []*histogramBinCount
+	binnedValues := omopDataSource.Db.Table("(?) as person_values", getDistinctPersonValuesQuery(omopDataSource, conceptId)).
+		Select("cast(floor((person_values.person_value - ?) / ?) as int) as bin_index", startValue, width)
+	query := omopDataSource.Db.Table("(?) as binned_values", binnedValues).
+		Select("binned_values.bin_index, count(*) as person_count").
+		Group("binned_values.bin_index")
+
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result := query.Scan(&binCounts)
+	return binCounts, meta_result.Error
+}
+
+// Same selection of values as retrieveHistogramDataWithContext:
+func getDistinctPersonValuesQuery(omopDataSource *utils.DbAndSchema, conceptId int64) *gorm.DB {
+	return omopDataSource.Db.Table(omopDataSource.Table("observation")+" as observation").
+		Select("distinct observation.person_id, observation.value_as_number as person_value").
+		Where("observation.observation_concept_id = ?", conceptId).
+		Where("observation.value_as_number is not null")
+}
+
+func valueOrZero(value *float64) float64 {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
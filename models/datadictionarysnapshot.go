@@ -0,0 +1,279 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+	"github.com/uc-cdis/cohort-middleware/utils"
+	"gorm.io/gorm"
+)
+
+// A copy of data_dictionary_result, taken after a data dictionary generation run:
+type DataDictionarySnapshot struct {
+	SnapshotID        int64                        `json:"snapshotID" gorm:"primaryKey"`
+	GeneratedAt       time.Time                    `json:"generatedAt"`
+	DataSchemaVersion int                          `json:"dataSchemaVersion"`
+	GenerationMode    DataDictionaryGenerationMode `json:"generationMode"`
+	NumberOfConcepts  int                          `json:"numberOfConcepts"`
+}
+
+// A change of one of the fields of a concept between two snapshots:
+type DataDictionaryConceptChange struct {
+	ConceptID   int64   `json:"conceptID"`
+	ConceptName string  `json:"conceptName"`
+	Field       string  `json:"field"`
+	From        float64 `json:"from"`
+	To          float64 `json:"to"`
+	// the change relative to the "from" value, or null if "from" is 0 and "to" is not:
+	RelativeChange *float64 `json:"relativeChange"`
+}
+
+type DataDictionarySnapshotConcept struct {
+	ConceptID   int64  `json:"conceptID"`
+	ConceptName string `json:"conceptName"`
+}
+
+type DataDictionarySnapshotDiff struct {
+	FromSnapshot    *DataDictionarySnapshot         `json:"fromSnapshot"`
+	ToSnapshot      *DataDictionarySnapshot         `json:"toSnapshot"`
+	Threshold       float64                         `json:"threshold"`
+	AddedConcepts   []DataDictionarySnapshotConcept `json:"addedConcepts"`
+	RemovedConcepts []DataDictionarySnapshotConcept `json:"removedConcepts"`
+	// all changes in the number of people with the variable, or where the value is filled or null:
+	PeopleCountChanges []DataDictionaryConceptChange `json:"peopleCountChanges"`
+	// the changes in mean and standard deviation with a relative change larger than the threshold:
+	DistributionShifts []DataDictionaryConceptChange `json:"distributionShifts"`
+}
+
+var ErrDataDictionarySnapshotNotFound = errors.New("data dictionary snapshot not found")
+
+// the data_dictionary_result columns that are copied to data_dictionary_snapshot_result:
+const dataDictionaryResultColumns = "vocabulary_id, concept_id, concept_code, concept_name, concept_class_id, " +
+	"number_of_people_with_variable, number_of_people_where_value_is_filled, number_of_people_where_value_is_null, " +
+	"value_stored_as, min_value, max_value, mean_value, standard_deviation, value_summary"
+
+// the number of snapshots that are kept if data_dictionary_snapshot_retention is not set:
+const defaultDataDictionarySnapshotRetention = 10
+
+func getDataDictionarySnapshotRetention() int {
+	retention := config.GetConfig().GetInt("data_dictionary_snapshot_retention")
+	if retention <= 0 {
+		return defaultDataDictionarySnapshotRetention
+	}
+	return retention
+}
+
+// Copies the current contents of data_dictionary_result to a new snapshot, tagged with the
+// current time and the data schema version of the source. Only the most recent snapshots
+// are kept (see data_dictionary_snapshot_retention in the config), the older ones are
+// removed in the same transaction.
+func (u DataDictionary) createDataDictionarySnapshot(ctx context.Context, miscDataSource *utils.DbAndSchema, sourceId int, mode DataDictionaryGenerationMode) (*DataDictionarySnapshot, error) {
+	dataSchemaVersion, err := getDataSchemaVersion(ctx, sourceId)
+	if err != nil {
+		log.Printf("WARNING: could not get the data schema version for the data dictionary snapshot: %v", err)
+	}
+	snapshot := DataDictionarySnapshot{
+		GeneratedAt:       time.Now(),
+		DataSchemaVersion: dataSchemaVersion,
+		GenerationMode:    mode,
+	}
+	err = miscDataSource.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&DataDictionaryResult{}).Select("count(*)").Scan(&snapshot.NumberOfConcepts).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&snapshot).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("INSERT INTO "+miscDataSource.Table("data_dictionary_snapshot_result")+" (snapshot_id, "+dataDictionaryResultColumns+") "+
+			"SELECT ?, "+dataDictionaryResultColumns+" FROM "+miscDataSource.Table("data_dictionary_result")+" as data_dictionary_result", snapshot.SnapshotID).Error; err != nil {
+			return err
+		}
+		return pruneDataDictionarySnapshots(tx, miscDataSource, getDataDictionarySnapshotRetention())
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to create data dictionary snapshot: %v", err)
+		return nil, err
+	}
+	log.Printf("INFO: Created data dictionary snapshot %d with %d concepts", snapshot.SnapshotID, snapshot.NumberOfConcepts)
+	return &snapshot, nil
+}
+
+// Removes all but the given number of most recent snapshots.
+func pruneDataDictionarySnapshots(tx *gorm.DB, miscDataSource *utils.DbAndSchema, retention int) error {
+	var snapshotIds []int64
+	if err := tx.Model(&DataDictionarySnapshot{}).Order("snapshot_id desc").Pluck("snapshot_id", &snapshotIds).Error; err != nil {
+		return err
+	}
+	if len(snapshotIds) <= retention {
+		return nil
+	}
+	snapshotIdsToRemove := snapshotIds[retention:]
+	if err := tx.Exec("DELETE FROM "+miscDataSource.Table("data_dictionary_snapshot_result")+" WHERE snapshot_id in (?)", snapshotIdsToRemove).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("snapshot_id in (?)", snapshotIdsToRemove).Delete(&DataDictionarySnapshot{}).Error; err != nil {
+		return err
+	}
+	log.Printf("INFO: Removed %d data dictionary snapshots, keeping the %d most recent ones", len(snapshotIdsToRemove), retention)
+	return nil
+}
+
+// Returns all data dictionary snapshots, the most recent one first.
+func (u DataDictionary) GetDataDictionarySnapshots(ctx context.Context) ([]*DataDictionarySnapshot, error) {
+	sourceId, err := getSingleSourceId()
+	if err != nil {
+		return nil, err
+	}
+	var dataSourceModel = new(Source)
+	miscDataSource, err := dataSourceModel.GetDataSource(sourceId, Misc)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []*DataDictionarySnapshot{}
+	query := miscDataSource.Db.Model(&DataDictionarySnapshot{}).
+		Order("snapshot_id desc")
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result := query.Scan(&snapshots)
+	return snapshots, meta_result.Error
+}
+
+// Compares the two given snapshots. Concepts that are only in one of them are reported as added or removed,
+// all changes in people counts are reported and the changes in mean and standard deviation are reported if
+// their relative change is larger than the given threshold.
+func (u DataDictionary) DiffDataDictionarySnapshots(ctx context.Context, fromSnapshotId int64, toSnapshotId int64, threshold float64) (*DataDictionarySnapshotDiff, error) {
+	sourceId, err := getSingleSourceId()
+	if err != nil {
+		return nil, err
+	}
+	var dataSourceModel = new(Source)
+	miscDataSource, err := dataSourceModel.GetDataSource(sourceId, Misc)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := DataDictionarySnapshotDiff{
+		Threshold:          threshold,
+		AddedConcepts:      []DataDictionarySnapshotConcept{},
+		RemovedConcepts:    []DataDictionarySnapshotConcept{},
+		PeopleCountChanges: []DataDictionaryConceptChange{},
+		DistributionShifts: []DataDictionaryConceptChange{},
+	}
+	if diff.FromSnapshot, err = getDataDictionarySnapshot(ctx, miscDataSource, fromSnapshotId); err != nil {
+		return nil, err
+	}
+	if diff.ToSnapshot, err = getDataDictionarySnapshot(ctx, miscDataSource, toSnapshotId); err != nil {
+		return nil, err
+	}
+	fromResults, err := getDataDictionarySnapshotResults(ctx, miscDataSource, fromSnapshotId)
+	if err != nil {
+		return nil, err
+	}
+	toResults, err := getDataDictionarySnapshotResults(ctx, miscDataSource, toSnapshotId)
+	if err != nil {
+		return nil, err
+	}
+
+	fromResultsByConceptId := make(map[int64]*DataDictionaryResult)
+	for _, fromResult := range fromResults {
+		fromResultsByConceptId[fromResult.ConceptID] = fromResult
+	}
+	for _, toResult := range toResults {
+		fromResult, ok := fromResultsByConceptId[toResult.ConceptID]
+		if !ok {
+			diff.AddedConcepts = append(diff.AddedConcepts, DataDictionarySnapshotConcept{ConceptID: toResult.ConceptID, ConceptName: toResult.ConceptName})
+			continue
+		}
+		delete(fromResultsByConceptId, toResult.ConceptID)
+
+		peopleCounts := []struct {
+			field    string
+			from, to int64
+		}{
+			{"numberOfPeopleWithVariable", fromResult.NumberOfPeopleWithVariable, toResult.NumberOfPeopleWithVariable},
+			{"numberOfPeopleWhereValueIsFilled", fromResult.NumberOfPeopleWhereValueIsFilled, toResult.NumberOfPeopleWhereValueIsFilled},
+			{"numberOfPeopleWhereValueIsNull", fromResult.NumberOfPeopleWhereValueIsNull, toResult.NumberOfPeopleWhereValueIsNull},
+		}
+		for _, peopleCount := range peopleCounts {
+			if peopleCount.from != peopleCount.to {
+				diff.PeopleCountChanges = append(diff.PeopleCountChanges,
+					newDataDictionaryConceptChange(toResult, peopleCount.field, float64(peopleCount.from), float64(peopleCount.to)))
+			}
+		}
+		distributions := []struct {
+			field    string
+			from, to float64
+		}{
+			{"meanValue", fromResult.MeanValue, toResult.MeanValue},
+			{"standardDeviation", fromResult.StandardDeviation, toResult.StandardDeviation},
+		}
+		for _, distribution := range distributions {
+			change := newDataDictionaryConceptChange(toResult, distribution.field, distribution.from, distribution.to)
+			// a change from 0 has no relative size, so it is always reported:
+			if change.RelativeChange == nil || math.Abs(*change.RelativeChange) > threshold {
+				diff.DistributionShifts = append(diff.DistributionShifts, change)
+			}
+		}
+	}
+	// the concepts that are left were not found in the "to" snapshot:
+	for _, fromResult := range fromResultsByConceptId {
+		diff.RemovedConcepts = append(diff.RemovedConcepts, DataDictionarySnapshotConcept{ConceptID: fromResult.ConceptID, ConceptName: fromResult.ConceptName})
+	}
+	sort.Slice(diff.RemovedConcepts, func(i, j int) bool {
+		return diff.RemovedConcepts[i].ConceptID < diff.RemovedConcepts[j].ConceptID
+	})
+	return &diff, nil
+}
+
+func newDataDictionaryConceptChange(result *DataDictionaryResult, field string, from float64, to float64) DataDictionaryConceptChange {
+	change := DataDictionaryConceptChange{
+		ConceptID:   result.ConceptID,
+		ConceptName: result.ConceptName,
+		Field:       field,
+		From:        from,
+		To:          to,
+	}
+	if from != 0 {
+		relativeChange := (to - from) / math.Abs(from)
+		change.RelativeChange = &relativeChange
+	} else if to == 0 {
+		relativeChange := 0.0
+		change.RelativeChange = &relativeChange
+	}
+	return change
+}
+
+func getDataDictionarySnapshot(ctx context.Context, miscDataSource *utils.DbAndSchema, snapshotId int64) (*DataDictionarySnapshot, error) {
+	var snapshot *DataDictionarySnapshot
+	query := miscDataSource.Db.Model(&DataDictionarySnapshot{}).
+		Where("snapshot_id = ?", snapshotId)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result := query.Scan(&snapshot)
+	if meta_result.Error != nil {
+		return nil, meta_result.Error
+	} else if snapshot == nil {
+		return nil, ErrDataDictionarySnapshotNotFound
+	}
+	return snapshot, nil
+}
+
+// Returns the results of the given snapshot ordered by concept id, without their value summary.
+func getDataDictionarySnapshotResults(ctx context.Context, miscDataSource *utils.DbAndSchema, snapshotId int64) ([]*DataDictionaryResult, error) {
+	var results []*DataDictionaryResult
+	query := miscDataSource.Db.Table(miscDataSource.Table("data_dictionary_snapshot_result")+" as data_dictionary_snapshot_result").
+		Select("concept_id, concept_name, number_of_people_with_variable, number_of_people_where_value_is_filled, "+
+			"number_of_people_where_value_is_null, coalesce(mean_value, 0) as mean_value, coalesce(standard_deviation, 0) as standard_deviation").
+		Where("snapshot_id = ?", snapshotId).
+		Order("concept_id")
+	query, cancel := utils.AddSpecificTimeoutToQueryWithContext(ctx, query, 600*time.Second)
+	defer cancel()
+	meta_result := query.Scan(&results)
+	return results, meta_result.Error
+}
@@ -0,0 +1,348 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+	"github.com/uc-cdis/cohort-middleware/utils"
+	"gorm.io/gorm"
+)
+
+type DataQualityI interface {
+	RunDataQualityChecks(ctx context.Context, sourceId int) (*DataQualityReport, error)
+	GetDataQualityReport(ctx context.Context, sourceId int) (*DataQualityReport, error)
+}
+
+type DataQuality struct{}
+
+type DataQualityRuleType string
+
+const (
+	// a person should have at most one observation for each of the concepts:
+	DataQualityRuleUniquePerPerson DataQualityRuleType = "unique_per_person"
+	// the value_as_number of the observations of the (continuous) concepts should be between min and max:
+	DataQualityRuleValueRange DataQualityRuleType = "value_range"
+	// the value_as_concept_id of the observations of the (nominal) concepts should be one of the allowed values:
+	DataQualityRuleAllowedValues DataQualityRuleType = "allowed_values"
+	// every cohort subject should be found in the person table:
+	DataQualityRuleCohortSubjectInPerson DataQualityRuleType = "cohort_subject_in_person"
+	// every observation concept should be found in the concept table:
+	DataQualityRuleObservationConceptInConcept DataQualityRuleType = "observation_concept_in_concept"
+)
+
+// A data quality rule, as configured in data_quality.rules:
+type DataQualityRule struct {
+	Name                   string              `json:"name" mapstructure:"name"`
+	Type                   DataQualityRuleType `json:"type" mapstructure:"type"`
+	ConceptIds             []int64             `json:"conceptIds,omitempty" mapstructure:"concept_ids"`
+	Min                    *float64            `json:"min,omitempty" mapstructure:"min"`
+	Max                    *float64            `json:"max,omitempty" mapstructure:"max"`
+	AllowedValueConceptIds []int64             `json:"allowedValueConceptIds,omitempty" mapstructure:"allowed_value_concept_ids"`
+}
+
+type DataQualityRuleResult struct {
+	RuleName       string              `json:"ruleName"`
+	RuleType       DataQualityRuleType `json:"ruleType"`
+	ViolationCount int64               `json:"violationCount"`
+	// some of the ids involved in the violations (person ids, observation ids, subject ids or concept ids, depending on the rule type):
+	SampleIds []int64 `json:"sampleIds"`
+	// set if the rule could not be checked:
+	Error string `json:"error,omitempty"`
+}
+
+type DataQualityReport struct {
+	SourceId  int                      `json:"sourceId"`
+	CheckedAt time.Time                `json:"checkedAt"`
+	Results   []*DataQualityRuleResult `json:"results"`
+}
+
+// A row of the data_quality_result table. The sample ids are stored as a comma separated list:
+type DataQualityResult struct {
+	RuleName       string
+	RuleType       DataQualityRuleType
+	ViolationCount int64
+	SampleIds      string
+	Error          string
+	CheckedAt      time.Time
+}
+
+var ErrDataQualityReportNotFound = errors.New("no data quality report found for this source")
+
+// Returns the query that selects the id of each violation of the rule, together with the
+// name of that id column. Rule types can be added by adding an entry to this map:
+var dataQualityRuleQueries = map[DataQualityRuleType]func(sourceId int, rule DataQualityRule) (*gorm.DB, string, error){
+	DataQualityRuleUniquePerPerson:             getUniquePerPersonViolationsQuery,
+	DataQualityRuleValueRange:                  getValueRangeViolationsQuery,
+	DataQualityRuleAllowedValues:               getAllowedValuesViolationsQuery,
+	DataQualityRuleCohortSubjectInPerson:       getCohortSubjectInPersonViolationsQuery,
+	DataQualityRuleObservationConceptInConcept: getObservationConceptInConceptViolationsQuery,
+}
+
+const defaultDataQualitySampleSize = 10
+
+// Returns the rules configured in data_quality.rules. For backwards compatibility, the concepts in
+// validate.single_observation_for_concept_ids are added as a unique_per_person rule.
+func GetDataQualityRules() ([]DataQualityRule, error) {
+	conf := config.GetConfig()
+	var rules []DataQualityRule
+	if err := conf.UnmarshalKey("data_quality.rules", &rules); err != nil {
+		return nil, fmt.Errorf("invalid data_quality.rules config: %w", err)
+	}
+	singleObservationConceptIds, err := utils.SliceAtoi(conf.GetStringSlice("validate.single_observation_for_concept_ids"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid validate.single_observation_for_concept_ids config: %w", err)
+	}
+	if len(singleObservationConceptIds) > 0 {
+		rules = append(rules, DataQualityRule{Name: "single_observation_for_concept_ids", Type: DataQualityRuleUniquePerPerson,
+			ConceptIds: singleObservationConceptIds})
+	}
+	ruleNames := make(map[string]bool)
+	for i := range rules {
+		if rules[i].Name == "" {
+			rules[i].Name = string(rules[i].Type)
+		}
+		if err := validateDataQualityRule(rules[i]); err != nil {
+			return nil, err
+		}
+		// the results are stored by rule name:
+		if ruleNames[rules[i].Name] {
+			return nil, fmt.Errorf("duplicate data quality rule name '%s'", rules[i].Name)
+		}
+		ruleNames[rules[i].Name] = true
+	}
+	return rules, nil
+}
+
+func validateDataQualityRule(rule DataQualityRule) error {
+	if _, ok := dataQualityRuleQueries[rule.Type]; !ok {
+		return fmt.Errorf("data quality rule '%s' has an invalid type '%s'", rule.Name, rule.Type)
+	}
+	switch rule.Type {
+	case DataQualityRuleUniquePerPerson, DataQualityRuleValueRange, DataQualityRuleAllowedValues:
+		if len(rule.ConceptIds) == 0 {
+			return fmt.Errorf("data quality rule '%s' should have concept_ids", rule.Name)
+		}
+	}
+	if rule.Type == DataQualityRuleValueRange && rule.Min == nil && rule.Max == nil {
+		return fmt.Errorf("data quality rule '%s' should have a min and/or a max", rule.Name)
+	}
+	if rule.Type == DataQualityRuleAllowedValues && len(rule.AllowedValueConceptIds) == 0 {
+		return fmt.Errorf("data quality rule '%s' should have allowed_value_concept_ids", rule.Name)
+	}
+	return nil
+}
+
+// Checks all configured rules on the given source and stores the results, replacing the results of the previous check.
+// A rule that fails to run is reported with its error, so that it does not prevent the other rules from being checked.
+func (u DataQuality) RunDataQualityChecks(ctx context.Context, sourceId int) (*DataQualityReport, error) {
+	rules, err := GetDataQualityRules()
+	if err != nil {
+		return nil, err
+	}
+	report := DataQualityReport{SourceId: sourceId, CheckedAt: time.Now(), Results: []*DataQualityRuleResult{}}
+	for _, rule := range rules {
+		result, err := runDataQualityRule(ctx, sourceId, rule, getDataQualitySampleSize())
+		if err != nil {
+			log.Printf("ERROR: failed to check data quality rule '%s' on data source %d: %v", rule.Name, sourceId, err)
+			result = &DataQualityRuleResult{RuleName: rule.Name, RuleType: rule.Type, SampleIds: []int64{}, Error: err.Error()}
+		} else if result.ViolationCount > 0 {
+			log.Printf("WARNING: data quality rule '%s' has %d violations in data source %d, e.g. for ids %v",
+				rule.Name, result.ViolationCount, sourceId, result.SampleIds)
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	var dataSourceModel = new(Source)
+	miscDataSource, err := dataSourceModel.GetDataSource(sourceId, Misc)
+	if err != nil {
+		return nil, err
+	}
+	err = miscDataSource.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&DataQualityResult{}).Error; err != nil {
+			return err
+		}
+		for _, result := range report.Results {
+			row := DataQualityResult{RuleName: result.RuleName, RuleType: result.RuleType, ViolationCount: result.ViolationCount,
+				SampleIds: joinIds(result.SampleIds), Error: result.Error, CheckedAt: report.CheckedAt}
+			if err := tx.Create(&row).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: failed to store data quality results of data source %d: %v", sourceId, err)
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Returns the results of the last data quality check of the given source.
+func (u DataQuality) GetDataQualityReport(ctx context.Context, sourceId int) (*DataQualityReport, error) {
+	var dataSourceModel = new(Source)
+	miscDataSource, err := dataSourceModel.GetDataSource(sourceId, Misc)
+	if err != nil {
+		return nil, err
+	}
+	var rows []*DataQualityResult
+	query := miscDataSource.Db.Model(&DataQualityResult{}).
+		Order("rule_name")
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	meta_result := query.Scan(&rows)
+	if meta_result.Error != nil {
+		return nil, meta_result.Error
+	} else if len(rows) == 0 {
+		return nil, ErrDataQualityReportNotFound
+	}
+	report := DataQualityReport{SourceId: sourceId, CheckedAt: rows[0].CheckedAt, Results: []*DataQualityRuleResult{}}
+	for _, row := range rows {
+		report.Results = append(report.Results, &DataQualityRuleResult{RuleName: row.RuleName, RuleType: row.RuleType,
+			ViolationCount: row.ViolationCount, SampleIds: splitIds(row.SampleIds), Error: row.Error})
+	}
+	return &report, nil
+}
+
+// Counts the violations of the rule and returns up to sampleSize of their ids.
+func runDataQualityRule(ctx context.Context, sourceId int, rule DataQualityRule, sampleSize int) (*DataQualityRuleResult, error) {
+	getViolationsQuery, ok := dataQualityRuleQueries[rule.Type]
+	if !ok {
+		return nil, fmt.Errorf("invalid data quality rule type '%s'", rule.Type)
+	}
+	result := DataQualityRuleResult{RuleName: rule.Name, RuleType: rule.Type, SampleIds: []int64{}}
+
+	violations, idColumn, err := getViolationsQuery(sourceId, rule)
+	if err != nil {
+		return nil, err
+	}
+	query := violations.Session(&gorm.Session{NewDB: true}).Table("(?) as violations", violations).
+		Select("count(*)")
+	query, cancel := utils.AddSpecificTimeoutToQueryWithContext(ctx, query, 600*time.Second)
+	defer cancel()
+	if err := query.Scan(&result.ViolationCount).Error; err != nil {
+		return nil, err
+	}
+	if result.ViolationCount == 0 {
+		return &result, nil
+	}
+	query = violations.Session(&gorm.Session{NewDB: true}).Table("(?) as violations", violations).
+		Select("violations." + idColumn).
+		Order("violations." + idColumn).
+		Limit(sampleSize)
+	query, cancel = utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	if err := query.Scan(&result.SampleIds).Error; err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// One row per person that has more than one observation of one of the concepts.
+func getUniquePerPersonViolationsQuery(sourceId int, rule DataQualityRule) (*gorm.DB, string, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, "", err
+	}
+	duplicates := omopDataSource.Db.Table(omopDataSource.Table("observation_continuous")+" as observation"+omopDataSource.Dialect().ViewHint()).
+		Select("observation.person_id, observation.observation_concept_id").
+		Where("observation.observation_concept_id in (?)", rule.ConceptIds).
+		Group("observation.person_id, observation.observation_concept_id").
+		Having("count(*) > 1")
+	return omopDataSource.Db.Table("(?) as duplicates", duplicates).
+		Select("distinct duplicates.person_id"), "person_id", nil
+}
+
+// One row per observation with a value_as_number outside of the min and max.
+func getValueRangeViolationsQuery(sourceId int, rule DataQualityRule) (*gorm.DB, string, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, "", err
+	}
+	query := omopDataSource.Db.Table(omopDataSource.Table("observation")+" as observation").
+		Select("observation.observation_id").
+		Where("observation.observation_concept_id in (?)", rule.ConceptIds)
+	if rule.Min != nil && rule.Max != nil {
+		query = query.Where("(observation.value_as_number < ? or observation.value_as_number > ?)", *rule.Min, *rule.Max)
+	} else if rule.Min != nil {
+		query = query.Where("observation.value_as_number < ?", *rule.Min)
+	} else {
+		query = query.Where("observation.value_as_number > ?", *rule.Max)
+	}
+	return query, "observation_id", nil
+}
+
+// One row per observation with a value_as_concept_id that is not in the allowed values.
+// Observations without a value are not considered violations.
+func getAllowedValuesViolationsQuery(sourceId int, rule DataQualityRule) (*gorm.DB, string, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, "", err
+	}
+	return omopDataSource.Db.Table(omopDataSource.Table("observation")+" as observation").
+		Select("observation.observation_id").
+		Where("observation.observation_concept_id in (?)", rule.ConceptIds).
+		Where("observation.value_as_concept_id is not null and observation.value_as_concept_id <> 0").
+		Where("observation.value_as_concept_id not in (?)", rule.AllowedValueConceptIds), "observation_id", nil
+}
+
+// One row per cohort subject that is not found in the person table.
+func getCohortSubjectInPersonViolationsQuery(sourceId int, rule DataQualityRule) (*gorm.DB, string, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, "", err
+	}
+	resultsDataSource, err := dataSourceModel.GetDataSource(sourceId, Results)
+	if err != nil {
+		return nil, "", err
+	}
+	return resultsDataSource.Db.Table(resultsDataSource.Table("cohort") + " as cohort").
+		Select("distinct cohort.subject_id").
+		Where("not exists (select 1 from " + omopDataSource.Table("person") + " as person where person.person_id = cohort.subject_id)"), "subject_id", nil
+}
+
+// One row per observation concept that is not found in the concept table.
+func getObservationConceptInConceptViolationsQuery(sourceId int, rule DataQualityRule) (*gorm.DB, string, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource, err := dataSourceModel.GetDataSource(sourceId, Omop)
+	if err != nil {
+		return nil, "", err
+	}
+	return omopDataSource.Db.Table(omopDataSource.Table("observation") + " as observation").
+		Select("distinct observation.observation_concept_id").
+		Where("not exists (select 1 from " + omopDataSource.Table("concept") + " as concept where concept.concept_id = observation.observation_concept_id)"), "observation_concept_id", nil
+}
+
+func getDataQualitySampleSize() int {
+	if sampleSize := config.GetConfig().GetInt("data_quality.sample_size"); sampleSize > 0 {
+		return sampleSize
+	}
+	return defaultDataQualitySampleSize
+}
+
+func joinIds(ids []int64) string {
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(values, ",")
+}
+
+func splitIds(ids string) []int64 {
+	result := []int64{}
+	for _, value := range strings.Split(ids, ",") {
+		if value != "" {
+			result = append(result, utils.ParseInt64(value))
+		}
+	}
+	return result
+}
@@ -0,0 +1,329 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+	"github.com/uc-cdis/cohort-middleware/utils"
+	"gorm.io/gorm"
+)
+
+// Determines how the filters (concept ids and cohort pairs) on the cohort of the breakdown, histogram and export queries are executed:
+type CohortFilterMode string
+
+const (
+	// each query selects from the INTERSECT/EXCEPT subquery of the cohort pairs, joined with the observations of the filter concepts:
+	CohortFilterModeInline CohortFilterMode = "inline"
+	// the filtered cohort is materialized in a temp table, and the queries of the request select from that table while it is in use:
+	CohortFilterModeTempTable CohortFilterMode = "temp-table"
+)
+
+// Returns the mode configured in cohort_filter_mode, defaulting to inline.
+func GetCohortFilterMode() (CohortFilterMode, error) {
+	mode := CohortFilterMode(config.GetConfig().GetString("cohort_filter_mode"))
+	switch mode {
+	case "", CohortFilterModeInline:
+		return CohortFilterModeInline, nil
+	case CohortFilterModeTempTable:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid cohort filter mode '%s'", mode)
+}
+
+// The filtered cohorts materialized in temp tables during a request. A temp table only exists in the database
+// session that created it, so the session reserves a connection per data source when it materializes its first
+// table there, and drops the tables and returns the connections to their pools when no query uses them anymore.
+type FilteredCohortSession struct {
+	mutex       sync.Mutex
+	connections map[int]*filteredCohortConnection
+	// the number of running queries and holds (see HoldFilteredCohortTables) that use the temp tables:
+	users int
+}
+
+type filteredCohortConnection struct {
+	conn    *sql.Conn
+	db      *gorm.DB
+	dialect utils.Dialect
+	tables  []*filteredCohortTable
+}
+
+type filteredCohortTable struct {
+	name               string
+	cohortDefinitionId int
+	filterConceptIds   []int64
+	filterCohortPairs  []utils.CustomDichotomousVariableDef
+	// closed when creating the table is done:
+	ready chan struct{}
+	err   error
+}
+
+type filteredCohortSessionKey struct{}
+
+// The temp table names are unique over all requests, as a connection could be returned
+// to its pool with the temp tables of a request if dropping them failed.
+var lastFilteredCohortTableId atomic.Int64
+
+// Returns a context with a new FilteredCohortSession, which the queries of the models that get this
+// context use to materialize their filtered cohorts. The session must be closed at the end of the request.
+func NewFilteredCohortSession(ctx context.Context) (context.Context, *FilteredCohortSession) {
+	session := &FilteredCohortSession{connections: map[int]*filteredCohortConnection{}}
+	return context.WithValue(ctx, filteredCohortSessionKey{}, session), session
+}
+
+// Keeps the temp tables materialized by the queries made with the given context until the returned function is called,
+// so that a sequence of queries on the same cohort, like the rows of an attrition table, reuses them. Returns a no-op
+// function if the context has no FilteredCohortSession.
+func HoldFilteredCohortTables(ctx context.Context) func() {
+	session, ok := ctx.Value(filteredCohortSessionKey{}).(*FilteredCohortSession)
+	if !ok {
+		return func() {}
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.users++
+	return sync.OnceFunc(session.release)
+}
+
+// Ends a use of the temp tables, dropping them if it was the last one.
+func (s *FilteredCohortSession) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.users--
+	if s.users == 0 {
+		s.closeConnections()
+	}
+}
+
+// Drops the temp tables the session still has, e.g. because a query panicked before its release,
+// and returns its connections to their pools.
+func (s *FilteredCohortSession) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closeConnections()
+}
+
+func (s *FilteredCohortSession) closeConnections() {
+	for sourceId, connection := range s.connections {
+		if err := connection.dropTables(); err != nil {
+			log.Printf("ERROR: failed to drop the filtered cohort temp tables of source %d, discarding the connection: %v", sourceId, err)
+			// makes database/sql close the connection instead of putting it back in the pool:
+			connection.conn.Raw(func(driverConn any) error { return driver.ErrBadConn })
+		}
+		connection.conn.Close()
+	}
+	s.connections = map[int]*filteredCohortConnection{}
+}
+
+func (c *filteredCohortConnection) dropTables() error {
+	// the request context may already be cancelled, so drop the tables with a context of their own:
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	for _, table := range c.tables {
+		if err := c.db.WithContext(ctx).Exec("DROP TABLE " + c.dialect.TempTableName(table.name)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the connection of the session to the database of the results data source, reserving it on first use.
+// Must only be called to materialize a temp table, so that no connection is reserved for nothing.
+func (s *FilteredCohortSession) getConnection(ctx context.Context, sourceId int, resultsDataSource *utils.DbAndSchema) (*filteredCohortConnection, error) {
+	if connection, ok := s.connections[sourceId]; ok {
+		return connection, nil
+	}
+	sqlDB, err := resultsDataSource.Db.DB()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// all queries made with this db run on the reserved connection:
+	db := resultsDataSource.Db.Session(&gorm.Session{NewDB: true, Context: context.Background()})
+	db.Statement.ConnPool = conn
+	connection := &filteredCohortConnection{conn: conn, db: db, dialect: resultsDataSource.Dialect()}
+	s.connections[sourceId] = connection
+	return connection, nil
+}
+
+// Returns the number of filters of the table that are not filters of the other table, or -1 if the
+// table has a filter that the other table does not have.
+func (t *filteredCohortTable) nrFiltersMissingFrom(other *filteredCohortTable) int {
+	for _, filterConceptId := range t.filterConceptIds {
+		if !slices.Contains(other.filterConceptIds, filterConceptId) {
+			return -1
+		}
+	}
+	for _, filterCohortPair := range t.filterCohortPairs {
+		if !slices.ContainsFunc(other.filterCohortPairs, filterCohortPair.SameCohorts) {
+			return -1
+		}
+	}
+	return len(other.filterConceptIds) - len(t.filterConceptIds) + len(other.filterCohortPairs) - len(t.filterCohortPairs)
+}
+
+// Returns the db of the reserved connection and the name of the temp table with the subjects of the given cohort that
+// match all the given filters, creating the temp table if the tables in use do not include it. The caller uses the
+// table until it calls release. As the filters only restrict the cohort further, the temp table is built from the temp
+// table of the same cohort with the most filters in common, if there is one, so that e.g. each step of the attrition
+// table only applies one extra filter. The table is only reserved while holding the session lock and is created after
+// releasing it, so that the other queries of the request do not wait for it unless they need the same table.
+func (s *FilteredCohortSession) getFilteredCohortTable(ctx context.Context, sourceId int, cohortDefinitionId int, filterConceptIds []int64,
+	filterCohortPairs []utils.CustomDichotomousVariableDef, omopDataSource *utils.DbAndSchema, resultsDataSource *utils.DbAndSchema) (*gorm.DB, string, error) {
+
+	s.mutex.Lock()
+	connection, table, baseTable, isNew, err := s.reserveFilteredCohortTable(ctx, sourceId, cohortDefinitionId, filterConceptIds, filterCohortPairs, resultsDataSource)
+	if err != nil {
+		// returns the connection if it was only reserved for the table that could not be created:
+		if s.users == 0 {
+			s.closeConnections()
+		}
+		s.mutex.Unlock()
+		return nil, "", err
+	}
+	s.users++
+	s.mutex.Unlock()
+
+	if isNew {
+		err = s.createFilteredCohortTable(ctx, sourceId, connection, table, baseTable, omopDataSource, resultsDataSource)
+		if err != nil {
+			s.mutex.Lock()
+			// only created tables are kept, so that a failed one is created again by the next query that needs it:
+			connection.tables = slices.DeleteFunc(connection.tables, func(other *filteredCohortTable) bool { return other == table })
+			s.mutex.Unlock()
+		}
+		table.err = err
+		close(table.ready)
+	} else {
+		// wait for the query that is creating the table, if any:
+		select {
+		case <-table.ready:
+			err = table.err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		s.release()
+		return nil, "", err
+	}
+	return connection.db, resultsDataSource.Dialect().TempTableName(table.name), nil
+}
+
+// Returns the table of the session with exactly the given filters, or reserves the name of a new one, together with the
+// table it should be built from, if any. Should only be called while holding the session lock.
+func (s *FilteredCohortSession) reserveFilteredCohortTable(ctx context.Context, sourceId int, cohortDefinitionId int, filterConceptIds []int64,
+	filterCohortPairs []utils.CustomDichotomousVariableDef, resultsDataSource *utils.DbAndSchema) (*filteredCohortConnection, *filteredCohortTable, *filteredCohortTable, bool, error) {
+
+	var tables []*filteredCohortTable
+	connection, ok := s.connections[sourceId]
+	if ok {
+		tables = connection.tables
+	}
+	newTable := &filteredCohortTable{cohortDefinitionId: cohortDefinitionId, filterConceptIds: filterConceptIds, filterCohortPairs: filterCohortPairs}
+	var baseTable *filteredCohortTable
+	nrMissingFilters := 0
+	for _, table := range tables {
+		if table.cohortDefinitionId != cohortDefinitionId {
+			continue
+		}
+		nrFilters := table.nrFiltersMissingFrom(newTable)
+		if nrFilters == 0 {
+			return connection, table, nil, false, nil
+		} else if nrFilters > 0 && (baseTable == nil || nrFilters < nrMissingFilters) {
+			baseTable, nrMissingFilters = table, nrFilters
+		}
+	}
+
+	connection, err := s.getConnection(ctx, sourceId, resultsDataSource)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	newTable.name = fmt.Sprintf("filtered_cohort_%d", lastFilteredCohortTableId.Add(1))
+	newTable.ready = make(chan struct{})
+	connection.tables = append(connection.tables, newTable)
+	return connection, newTable, baseTable, true, nil
+}
+
+// Creates the given (reserved) table, from the given base table if it was created successfully.
+func (s *FilteredCohortSession) createFilteredCohortTable(ctx context.Context, sourceId int, connection *filteredCohortConnection, table *filteredCohortTable,
+	baseTable *filteredCohortTable, omopDataSource *utils.DbAndSchema, resultsDataSource *utils.DbAndSchema) error {
+
+	if baseTable != nil {
+		select {
+		case <-baseTable.ready:
+			if baseTable.err != nil {
+				baseTable = nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	dialect := resultsDataSource.Dialect()
+	subjectsSQL := "SELECT subject_id FROM " + resultsDataSource.Table("cohort") + " WHERE cohort_definition_id=?"
+	subjectsVars := []interface{}{table.cohortDefinitionId}
+	remainingConceptIds, remainingCohortPairs := table.filterConceptIds, table.filterCohortPairs
+	if baseTable != nil {
+		subjectsSQL, subjectsVars = "SELECT subject_id FROM "+dialect.TempTableName(baseTable.name), nil
+		remainingConceptIds, remainingCohortPairs = nil, nil
+		for _, filterConceptId := range table.filterConceptIds {
+			if !slices.Contains(baseTable.filterConceptIds, filterConceptId) {
+				remainingConceptIds = append(remainingConceptIds, filterConceptId)
+			}
+		}
+		for _, filterCohortPair := range table.filterCohortPairs {
+			if !slices.ContainsFunc(baseTable.filterCohortPairs, filterCohortPair.SameCohorts) {
+				remainingCohortPairs = append(remainingCohortPairs, filterCohortPair)
+			}
+		}
+	}
+	// the ids in the query are all numbers, so it can be rendered with its parameters:
+	var filterErr error
+	selectSQL := resultsDataSource.Db.ToSQL(func(tx *gorm.DB) *gorm.DB {
+		query := queryFilterByCohortPairs(tx, resultsDataSource, subjectsSQL, subjectsVars, remainingCohortPairs, "unionAndIntersect")
+		query, filterErr = QueryFilterByConceptIdsHelper(ctx, query, sourceId, remainingConceptIds, omopDataSource, resultsDataSource.Schema, "unionAndIntersect.subject_id")
+		if filterErr != nil {
+			return tx
+		}
+		return query.Select("distinct unionAndIntersect.subject_id").Find(&[]Person{})
+	})
+	if filterErr != nil {
+		return filterErr
+	}
+
+	log.Printf("INFO: materializing the filtered cohort %d of source %d in temp table %s", table.cohortDefinitionId, sourceId, table.name)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, connection.db)
+	defer cancel()
+	return query.Exec(dialect.CreateTempTableAs(table.name, selectSQL)).Error
+}
+
+// Returns the query that selects from the subjects of the given cohort that match all the given filters, with the given
+// alias, and the function to call once the query has run. When the context has a FilteredCohortSession and there are
+// filters, the subjects are read from a temp table of the session, which is dropped by the last of these calls, otherwise
+// the filters are added to the query with QueryFilterByCohortPairsHelper and QueryFilterByConceptIdsHelper.
+func queryFilteredCohort(ctx context.Context, sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef,
+	omopDataSource *utils.DbAndSchema, resultsDataSource *utils.DbAndSchema, alias string) (*gorm.DB, func(), error) {
+
+	session, ok := ctx.Value(filteredCohortSessionKey{}).(*FilteredCohortSession)
+	// without filters, the cohort table itself is read, so there is nothing to materialize:
+	if !ok || (len(filterConceptIds) == 0 && len(filterCohortPairs) == 0) {
+		query := QueryFilterByCohortPairsHelper(filterCohortPairs, resultsDataSource, cohortDefinitionId, alias)
+		query, err := QueryFilterByConceptIdsHelper(ctx, query, sourceId, filterConceptIds, omopDataSource, resultsDataSource.Schema, alias+".subject_id")
+		return query, func() {}, err
+	}
+	db, table, err := session.getFilteredCohortTable(ctx, sourceId, cohortDefinitionId, filterConceptIds, filterCohortPairs, omopDataSource, resultsDataSource)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db.Table(table + " as " + alias), sync.OnceFunc(session.release), nil
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 
@@ -8,21 +10,27 @@ import (
 	"gorm.io/gorm"
 )
 
+var ErrConceptTypeNotSupported = errors.New("concept type not supported")
+
 // Helper function that adds extra filter clauses to the query, joining on the right set of tables.
 //   - It was added here to make it reusable, given these filters need to be added to many of the queries that take in
 //     a list of filters in the form of concept ids.
-func QueryFilterByConceptIdsHelper(query *gorm.DB, sourceId int, filterConceptIds []int64,
-	omopDataSource *utils.DbAndSchema, resultSchemaName string, personIdFieldForObservationJoin string) *gorm.DB {
+func QueryFilterByConceptIdsHelper(ctx context.Context, query *gorm.DB, sourceId int, filterConceptIds []int64,
+	omopDataSource *utils.DbAndSchema, resultSchemaName utils.Identifier, personIdFieldForObservationJoin string) (*gorm.DB, error) {
 	// iterate over the filterConceptIds, adding a new INNER JOIN and filters for each, so that the resulting set is the
 	// set of persons that have a non-null value for each and every one of the concepts:
 	for i, filterConceptId := range filterConceptIds {
 		observationTableAlias := fmt.Sprintf("observation_filter_%d", i)
+		notNullCheck, err := GetConceptValueNotNullCheckBasedOnConceptType(ctx, observationTableAlias, sourceId, filterConceptId)
+		if err != nil {
+			return nil, err
+		}
 		log.Printf("Adding extra INNER JOIN with alias %s", observationTableAlias)
-		query = query.Joins("INNER JOIN "+omopDataSource.Schema+".observation_continuous as "+observationTableAlias+omopDataSource.GetViewDirective()+" ON "+observationTableAlias+".person_id = "+personIdFieldForObservationJoin).
+		query = query.Joins("INNER JOIN "+omopDataSource.Table("observation_continuous")+" as "+observationTableAlias+omopDataSource.Dialect().ViewHint()+" ON "+observationTableAlias+".person_id = "+personIdFieldForObservationJoin).
 			Where(observationTableAlias+".observation_concept_id = ?", filterConceptId).
-			Where(GetConceptValueNotNullCheckBasedOnConceptType(observationTableAlias, sourceId, filterConceptId))
+			Where(notNullCheck)
 	}
-	return query
+	return query, nil
 }
 
 // Helper function that adds extra filter clauses to the query, for the given filterCohortPairs, intersecting on the
@@ -31,50 +39,82 @@ func QueryFilterByConceptIdsHelper(query *gorm.DB, sourceId int, filterConceptId
 // set of persons that are part of the intersections of cohortDefinitionId and of one of the cohorts in the filterCohortPairs. The EXCEPT
 // clauses exclude the persons that are found in both cohorts of a filterCohortPair.
 func QueryFilterByCohortPairsHelper(filterCohortPairs []utils.CustomDichotomousVariableDef, resultsDataSource *utils.DbAndSchema, cohortDefinitionId int, unionAndIntersectSQLAlias string) *gorm.DB {
-	unionAndIntersectSQL := "(" +
-		"SELECT subject_id FROM " + resultsDataSource.Schema + ".cohort WHERE cohort_definition_id=? "
+	cohortSQL := "SELECT subject_id FROM " + resultsDataSource.Table("cohort") + " WHERE cohort_definition_id=?"
+	return queryFilterByCohortPairs(resultsDataSource.Db, resultsDataSource, cohortSQL, []interface{}{cohortDefinitionId}, filterCohortPairs, unionAndIntersectSQLAlias)
+}
+
+// Same as QueryFilterByCohortPairsHelper, but starts from the subjects selected by subjectsSQL instead of the
+// members of a cohort, and builds the query on the given db.
+func queryFilterByCohortPairs(db *gorm.DB, resultsDataSource *utils.DbAndSchema, subjectsSQL string, subjectsVars []interface{},
+	filterCohortPairs []utils.CustomDichotomousVariableDef, unionAndIntersectSQLAlias string) *gorm.DB {
+	dialect := resultsDataSource.Dialect()
+	cohortSQL := "SELECT subject_id FROM " + resultsDataSource.Table("cohort") + " WHERE cohort_definition_id=?"
+	unionAndIntersectSQL := subjectsSQL
 	var idsList []interface{}
-	idsList = append(idsList, cohortDefinitionId)
-	if len(filterCohortPairs) > 0 {
-		// INTERSECT UNIONs section:
-		for _, filterCohortPair := range filterCohortPairs {
-			unionAndIntersectSQL = unionAndIntersectSQL +
-				"INTERSECT ( " +
-				"SELECT subject_id FROM " + resultsDataSource.Schema + ".cohort WHERE cohort_definition_id=? " +
-				"UNION " +
-				"SELECT subject_id FROM " + resultsDataSource.Schema + ".cohort WHERE cohort_definition_id=? " +
-				")"
-			idsList = append(idsList, filterCohortPair.CohortDefinitionId1, filterCohortPair.CohortDefinitionId2)
-		}
-		// EXCEPTs section:
-		for _, filterCohortPair := range filterCohortPairs {
-			unionAndIntersectSQL = unionAndIntersectSQL +
-				"EXCEPT ( " +
-				"SELECT subject_id FROM  " + resultsDataSource.Schema + ".cohort WHERE cohort_definition_id=? " +
-				"INTERSECT " +
-				"SELECT subject_id FROM  " + resultsDataSource.Schema + ".cohort WHERE cohort_definition_id=? " +
-				")"
-			idsList = append(idsList, filterCohortPair.CohortDefinitionId1, filterCohortPair.CohortDefinitionId2)
-		}
+	idsList = append(idsList, subjectsVars...)
+	// INTERSECT UNIONs section:
+	for _, filterCohortPair := range filterCohortPairs {
+		unionAndIntersectSQL = dialect.SetOperation(unionAndIntersectSQL, "INTERSECT", dialect.SetOperation(cohortSQL, "UNION", cohortSQL))
+		idsList = append(idsList, filterCohortPair.CohortDefinitionId1, filterCohortPair.CohortDefinitionId2)
+	}
+	// EXCEPTs section:
+	for _, filterCohortPair := range filterCohortPairs {
+		unionAndIntersectSQL = dialect.SetOperation(unionAndIntersectSQL, "EXCEPT", dialect.SetOperation(cohortSQL, "INTERSECT", cohortSQL))
+		idsList = append(idsList, filterCohortPair.CohortDefinitionId1, filterCohortPair.CohortDefinitionId2)
 	}
-	unionAndIntersectSQL = unionAndIntersectSQL + ") "
-	query := resultsDataSource.Db.Table(unionAndIntersectSQL+" as "+unionAndIntersectSQLAlias+" ", idsList...)
+	query := db.Table("("+unionAndIntersectSQL+") as "+unionAndIntersectSQLAlias+" ", idsList...)
 	return query
 }
 
+// Returns the SQL (and its parameters) that selects one row per subject of the cohort set expression, with the
+// subject_id and the cohort_start_date and cohort_end_date of the subject in the result. The dates of a subject in
+// a single cohort span all its cohort eras. A union spans the dates of the subject in both operands, an intersect
+// keeps the overlap of those dates (so subjects whose dates do not overlap are left out) and an except keeps the
+// dates of the left operand. The operands are nested as subqueries, so that the evaluation order does not depend
+// on the SQL operator precedence.
+func GetCohortSetExpressionSQL(expression *utils.CohortSetExpression, resultsDataSource *utils.DbAndSchema) (string, []interface{}) {
+	if expression.Operator == "" {
+		cohortSQL := "SELECT subject_id, min(cohort_start_date) as cohort_start_date, max(cohort_end_date) as cohort_end_date " +
+			"FROM " + resultsDataSource.Table("cohort") + " WHERE cohort_definition_id=? GROUP BY subject_id"
+		return cohortSQL, []interface{}{expression.CohortDefinitionId}
+	}
+	leftSQL, leftIds := GetCohortSetExpressionSQL(expression.Left, resultsDataSource)
+	rightSQL, rightIds := GetCohortSetExpressionSQL(expression.Right, resultsDataSource)
+	var sql string
+	switch expression.Operator {
+	case utils.CohortSetUnion:
+		sql = "SELECT subject_id, min(cohort_start_date) as cohort_start_date, max(cohort_end_date) as cohort_end_date " +
+			"FROM (" + resultsDataSource.Dialect().SetOperation(leftSQL, "UNION ALL", rightSQL) + ") as operands GROUP BY subject_id"
+	case utils.CohortSetIntersect:
+		sql = "SELECT left_operand.subject_id, " +
+			"CASE WHEN left_operand.cohort_start_date > right_operand.cohort_start_date THEN left_operand.cohort_start_date " +
+			"ELSE right_operand.cohort_start_date END as cohort_start_date, " +
+			"CASE WHEN left_operand.cohort_end_date < right_operand.cohort_end_date THEN left_operand.cohort_end_date " +
+			"ELSE right_operand.cohort_end_date END as cohort_end_date " +
+			"FROM (" + leftSQL + ") as left_operand JOIN (" + rightSQL + ") as right_operand " +
+			"ON left_operand.subject_id = right_operand.subject_id " +
+			"WHERE left_operand.cohort_start_date <= right_operand.cohort_end_date AND right_operand.cohort_start_date <= left_operand.cohort_end_date"
+	case utils.CohortSetExcept:
+		sql = "SELECT left_operand.subject_id, left_operand.cohort_start_date, left_operand.cohort_end_date " +
+			"FROM (" + leftSQL + ") as left_operand " +
+			"WHERE left_operand.subject_id NOT IN (SELECT right_operand.subject_id FROM (" + rightSQL + ") as right_operand)"
+	}
+	return sql, append(leftIds, rightIds...)
+}
+
 // This function will get the concept information for given conceptId, and
 // return the best SQL to use for doing a "not null" check on its value in the
 // observation table.
-func GetConceptValueNotNullCheckBasedOnConceptType(observationTableAlias string, sourceId int, conceptId int64) string {
+func GetConceptValueNotNullCheckBasedOnConceptType(ctx context.Context, observationTableAlias string, sourceId int, conceptId int64) (string, error) {
 	conceptModel := *new(Concept)
-	conceptInfo, error := conceptModel.RetrieveInfoBySourceIdAndConceptId(sourceId, conceptId)
-	if error != nil {
-		panic("error while trying to get information for conceptId, or conceptId not found")
+	conceptInfo, err := conceptModel.RetrieveInfoBySourceIdAndConceptId(ctx, sourceId, conceptId)
+	if err != nil {
+		return "", fmt.Errorf("error while trying to get information for conceptId %d, or conceptId not found: %w", conceptId, err)
 	} else if conceptInfo.ConceptType == "MVP Continuous" {
-		return observationTableAlias + ".value_as_number is not null"
+		return observationTableAlias + ".value_as_number is not null", nil
 	} else if conceptInfo.ConceptType == "MVP Nominal" {
-		return observationTableAlias + ".value_as_concept_id is not null and " + observationTableAlias + ".value_as_concept_id != 0"
+		return observationTableAlias + ".value_as_concept_id is not null and " + observationTableAlias + ".value_as_concept_id != 0", nil
 	} else {
-		panic(fmt.Sprintf("error: concept type not supported [%s]", conceptInfo.ConceptType))
+		return "", fmt.Errorf("%w [%s]", ErrConceptTypeNotSupported, conceptInfo.ConceptType)
 	}
 }
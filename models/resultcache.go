@@ -0,0 +1,389 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+	"github.com/uc-cdis/cohort-middleware/db"
+	"github.com/uc-cdis/cohort-middleware/utils"
+)
+
+// The statistics endpoints of which the results are cached, each with its own TTL (see result_cache.ttl_seconds in the config):
+type ResultCacheEndpoint string
+
+const (
+	BreakdownResults ResultCacheEndpoint = "breakdown"
+	OverlapResults   ResultCacheEndpoint = "overlap"
+	HistogramResults ResultCacheEndpoint = "histogram"
+	AttritionResults ResultCacheEndpoint = "attrition"
+)
+
+const defaultResultCacheTtlSeconds = 3600
+const defaultResultCacheMaxEntries = 1000
+
+// Caches the results of the statistics queries, which only change when a cohort is regenerated or the CDM is
+// refreshed. The key of a result includes the generation info of the cohorts it was computed from, so a result
+// is not found anymore once one of its cohorts is regenerated, and is then removed from the backend. The key also
+// includes the data schema version of the source, so the results computed before a CDM refresh that updates this
+// version are not found anymore either. These are left to expire in the backend.
+type StatsResultCache struct {
+	backend utils.ResultCacheBackend
+	mutex   sync.Mutex
+	// the last seen generation of each cohort, with the keys of the results computed from it:
+	generations map[resultCacheCohort]*resultCacheGeneration
+	// the expiry time of each key in generations, of which there are at most maxKeys:
+	keys    map[string]time.Time
+	maxKeys int
+	stats   StatsResultCacheStats
+}
+
+type resultCacheCohort struct {
+	sourceId           int
+	cohortDefinitionId int
+}
+
+type resultCacheGeneration struct {
+	startTime   time.Time
+	personCount int64
+	keys        map[string]bool
+}
+
+type StatsResultCacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// results removed because one of their cohorts was regenerated:
+	Invalidations int64 `json:"invalidations"`
+	// keys of the results that are removed when one of their cohorts is regenerated:
+	TrackedKeys int `json:"tracked_keys"`
+}
+
+// The backend should keep at most maxEntries results, which is also the number of keys that are kept to remove
+// the results of the cohorts that are regenerated.
+func NewStatsResultCache(backend utils.ResultCacheBackend, maxEntries int) *StatsResultCache {
+	return &StatsResultCache{backend: backend, generations: make(map[resultCacheCohort]*resultCacheGeneration),
+		keys: make(map[string]time.Time), maxKeys: maxEntries}
+}
+
+// Returns the cache with the backend configured in result_cache.backend: "lru" (keeping the results in memory)
+// or "disk" (storing the results in result_cache.directory), which keep at most result_cache.max_entries results.
+// Returns nil if no backend is configured, in which case nothing is cached.
+func NewStatsResultCacheFromConfig() (*StatsResultCache, error) {
+	conf := config.GetConfig()
+	maxEntries := conf.GetInt("result_cache.max_entries")
+	if maxEntries <= 0 {
+		maxEntries = defaultResultCacheMaxEntries
+	}
+	switch backend := conf.GetString("result_cache.backend"); backend {
+	case "", "none":
+		return nil, nil
+	case "lru":
+		return NewStatsResultCache(utils.NewLruResultCache(maxEntries), maxEntries), nil
+	case "disk":
+		directory := conf.GetString("result_cache.directory")
+		if directory == "" {
+			return nil, fmt.Errorf("result_cache.directory is required for the disk result cache")
+		}
+		diskCache, err := utils.NewDiskResultCache(directory, maxEntries)
+		if err != nil {
+			return nil, err
+		}
+		return NewStatsResultCache(diskCache, maxEntries), nil
+	default:
+		return nil, fmt.Errorf("invalid result cache backend '%s'", backend)
+	}
+}
+
+// Returns the TTL configured in result_cache.ttl_seconds.<endpoint>, or its default.
+func getResultCacheTtl(endpoint ResultCacheEndpoint) time.Duration {
+	seconds := config.GetConfig().GetInt("result_cache.ttl_seconds." + string(endpoint))
+	if seconds <= 0 {
+		seconds = defaultResultCacheTtlSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (c *StatsResultCache) Stats() StatsResultCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.TrackedKeys = len(c.keys)
+	return stats
+}
+
+// Records the current generation of each cohort, removing the results of the previous generation of the
+// cohorts that were regenerated. Cohorts without (valid) generation info have a zero generation.
+func (c *StatsResultCache) updateGenerations(sourceId int, cohortGenerations map[int]*resultCacheGeneration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for cohortDefinitionId, generation := range cohortGenerations {
+		cohort := resultCacheCohort{sourceId: sourceId, cohortDefinitionId: cohortDefinitionId}
+		previousGeneration, found := c.generations[cohort]
+		if found && previousGeneration.startTime.Equal(generation.startTime) && previousGeneration.personCount == generation.personCount {
+			continue
+		}
+		if found {
+			for key := range previousGeneration.keys {
+				// the key can already be removed, by the regeneration of another of its cohorts or because it expired:
+				if _, tracked := c.keys[key]; tracked {
+					c.backend.Delete(key)
+					delete(c.keys, key)
+					c.stats.Invalidations++
+				}
+			}
+		}
+		c.generations[cohort] = &resultCacheGeneration{startTime: generation.startTime, personCount: generation.personCount, keys: make(map[string]bool)}
+	}
+}
+
+func (c *StatsResultCache) addKey(sourceId int, cohortDefinitionIds []int, key string, expiresAt time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, cohortDefinitionId := range cohortDefinitionIds {
+		if generation, found := c.generations[resultCacheCohort{sourceId: sourceId, cohortDefinitionId: cohortDefinitionId}]; found {
+			generation.keys[key] = true
+			c.keys[key] = expiresAt
+		}
+	}
+	if len(c.keys) > c.maxKeys {
+		c.pruneKeys()
+	}
+}
+
+// Forgets the keys of the expired results, and the generations without keys, which are recorded again on the next
+// request for their cohort. If there are still more than maxKeys keys, e.g. because many results are requested within
+// their TTL, all keys are forgotten. Their results are then not removed when a cohort is regenerated, but they are not
+// returned anymore either, as the generation is part of the key, and they are removed by the backend eventually.
+func (c *StatsResultCache) pruneKeys() {
+	now := time.Now()
+	for key, expiresAt := range c.keys {
+		if now.After(expiresAt) {
+			delete(c.keys, key)
+		}
+	}
+	if len(c.keys) > c.maxKeys {
+		log.Printf("WARNING: more than %d results are cached, forgetting their keys", c.maxKeys)
+		c.keys = make(map[string]time.Time)
+	}
+	for cohort, generation := range c.generations {
+		for key := range generation.keys {
+			if _, tracked := c.keys[key]; !tracked {
+				delete(generation.keys, key)
+			}
+		}
+		if len(generation.keys) == 0 {
+			delete(c.generations, cohort)
+		}
+	}
+}
+
+func (c *StatsResultCache) countLookup(hit bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if hit {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+}
+
+// Returns the current generation of each of the given cohorts in the given source.
+func getCohortGenerations(ctx context.Context, sourceId int, cohortDefinitionIds []int) (map[int]*resultCacheGeneration, error) {
+	atlasDb := db.GetAtlasDB()
+	var cohortGenerationInfos []*CohortGenerationInfo
+	query := atlasDb.Db.Table(atlasDb.Table("cohort_generation_info")+" as cohort_generation_info").
+		Select("id, source_id, start_time, coalesce(person_count, 0) as person_count").
+		Where("id in (?)", cohortDefinitionIds).
+		Where("source_id = ?", sourceId).
+		Where("is_valid = true").
+		Where("is_canceled = false")
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
+	defer cancel()
+	if err := query.Scan(&cohortGenerationInfos).Error; err != nil {
+		return nil, err
+	}
+	cohortGenerations := make(map[int]*resultCacheGeneration)
+	for _, cohortDefinitionId := range cohortDefinitionIds {
+		cohortGenerations[cohortDefinitionId] = &resultCacheGeneration{}
+	}
+	for _, cohortGenerationInfo := range cohortGenerationInfos {
+		cohortGenerations[cohortGenerationInfo.Id] = &resultCacheGeneration{startTime: cohortGenerationInfo.StartTime, personCount: cohortGenerationInfo.PersonCount}
+	}
+	return cohortGenerations, nil
+}
+
+// Returns the cached result of the given request to the given endpoint, or calls load and caches its result if there is
+// none. The request must hold all parameters of the query besides the source, in a normalized form (e.g. sorted ids), and
+// the result must be serializable to JSON. Errors of load are not cached. Without cache, this just calls load.
+func getCachedResult[T any](ctx context.Context, cache *StatsResultCache, endpoint ResultCacheEndpoint, sourceId int,
+	cohortDefinitionIds []int, request interface{}, load func() (T, error)) (T, error) {
+
+	if cache == nil {
+		return load()
+	}
+	cohortDefinitionIds = utils.MakeUnique(cohortDefinitionIds)
+	slices.Sort(cohortDefinitionIds)
+	cohortGenerations, err := getCohortGenerations(ctx, sourceId, cohortDefinitionIds)
+	if err != nil {
+		var noResult T
+		return noResult, err
+	}
+	cache.updateGenerations(sourceId, cohortGenerations)
+	dataSchemaVersion, err := getDataSchemaVersion(ctx, sourceId)
+	if err != nil {
+		// a result that is cached without the data schema version would outlive a CDM refresh:
+		log.Printf("WARNING: not caching the %s result, as the data schema version of source %d is not available: %v", endpoint, sourceId, err)
+		return load()
+	}
+
+	serializedRequest, err := json.Marshal(request)
+	if err != nil {
+		var noResult T
+		return noResult, err
+	}
+	keyData := fmt.Sprintf("%s|%d|%d|%s", endpoint, sourceId, dataSchemaVersion, serializedRequest)
+	for _, cohortDefinitionId := range cohortDefinitionIds {
+		generation := cohortGenerations[cohortDefinitionId]
+		keyData += fmt.Sprintf("|%d:%d:%d", cohortDefinitionId, generation.startTime.UnixNano(), generation.personCount)
+	}
+	hash := sha256.Sum256([]byte(keyData))
+	key := hex.EncodeToString(hash[:])
+
+	var result T
+	if cachedResult, found := cache.backend.Get(key); found && json.Unmarshal(cachedResult, &result) == nil {
+		cache.countLookup(true)
+		return result, nil
+	}
+	cache.countLookup(false)
+	result, err = load()
+	if err != nil {
+		return result, err
+	}
+	ttl := getResultCacheTtl(endpoint)
+	serializedResult, err := json.Marshal(result)
+	if err == nil {
+		err = cache.backend.Set(key, serializedResult, ttl)
+	}
+	if err != nil {
+		log.Printf("WARNING: could not cache the %s result: %v", endpoint, err)
+	} else {
+		cache.addKey(sourceId, cohortDefinitionIds, key, time.Now().Add(ttl))
+	}
+	return result, nil
+}
+
+// The cohort filters of a request in a normalized form, as the order of the filters does not change the result:
+type resultCacheFilters struct {
+	ConceptIds  []int64  `json:"concept_ids"`
+	CohortPairs [][2]int `json:"cohort_pairs"`
+}
+
+func newResultCacheFilters(filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) resultCacheFilters {
+	filters := resultCacheFilters{ConceptIds: slices.Clone(filterConceptIds)}
+	slices.Sort(filters.ConceptIds)
+	for _, filterCohortPair := range filterCohortPairs {
+		filters.CohortPairs = append(filters.CohortPairs, [2]int{filterCohortPair.CohortDefinitionId1, filterCohortPair.CohortDefinitionId2})
+	}
+	slices.SortFunc(filters.CohortPairs, func(a, b [2]int) int {
+		if a[0] != b[0] {
+			return a[0] - b[0]
+		}
+		return a[1] - b[1]
+	})
+	return filters
+}
+
+// Returns the cohorts of the given filter cohort pairs, together with the given cohorts.
+func getFilterCohortIds(filterCohortPairs []utils.CustomDichotomousVariableDef, cohortDefinitionIds ...int) []int {
+	for _, filterCohortPair := range filterCohortPairs {
+		cohortDefinitionIds = append(cohortDefinitionIds, filterCohortPair.CohortDefinitionId1, filterCohortPair.CohortDefinitionId2)
+	}
+	return cohortDefinitionIds
+}
+
+// Caches the breakdown stats of the wrapped model in the given cache. The controllers check the
+// authorization of each request before calling the model, so cached results are only returned to
+// users that have access to the cohorts.
+type CachedConcept struct {
+	ConceptI
+	cache *StatsResultCache
+}
+
+func NewCachedConcept(conceptModel ConceptI, cache *StatsResultCache) CachedConcept {
+	return CachedConcept{ConceptI: conceptModel, cache: cache}
+}
+
+func (h CachedConcept) RetrieveBreakdownStatsBySourceIdAndCohortId(ctx context.Context, sourceId int, cohortDefinitionId int, breakdownConceptId int64) ([]*ConceptBreakdown, error) {
+	return h.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx, sourceId, cohortDefinitionId, []int64{}, []utils.CustomDichotomousVariableDef{}, breakdownConceptId)
+}
+
+func (h CachedConcept) RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortDefinitionId int,
+	filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, breakdownConceptId int64) ([]*ConceptBreakdown, error) {
+
+	request := struct {
+		CohortDefinitionId int                `json:"cohort_definition_id"`
+		Filters            resultCacheFilters `json:"filters"`
+		BreakdownConceptId int64              `json:"breakdown_concept_id"`
+	}{cohortDefinitionId, newResultCacheFilters(filterConceptIds, filterCohortPairs), breakdownConceptId}
+	return getCachedResult(ctx, h.cache, BreakdownResults, sourceId, getFilterCohortIds(filterCohortPairs, cohortDefinitionId), request,
+		func() ([]*ConceptBreakdown, error) {
+			return h.ConceptI.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx, sourceId, cohortDefinitionId, filterConceptIds, filterCohortPairs, breakdownConceptId)
+		})
+}
+
+// Caches the overlap stats, histograms and inclusion rule attrition of the wrapped model in the given
+// cache. As for CachedConcept, the authorization is checked by the controllers on each request.
+type CachedCohortData struct {
+	CohortDataI
+	cache *StatsResultCache
+}
+
+func NewCachedCohortData(cohortDataModel CohortDataI, cache *StatsResultCache) CachedCohortData {
+	return CachedCohortData{CohortDataI: cohortDataModel, cache: cache}
+}
+
+func (h CachedCohortData) RetrieveCohortOverlapStats(ctx context.Context, sourceId int, caseCohortId int, controlCohortId int,
+	filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) (CohortOverlapStats, error) {
+
+	request := struct {
+		CaseCohortId    int                `json:"case_cohort_id"`
+		ControlCohortId int                `json:"control_cohort_id"`
+		Filters         resultCacheFilters `json:"filters"`
+	}{caseCohortId, controlCohortId, newResultCacheFilters(filterConceptIds, filterCohortPairs)}
+	return getCachedResult(ctx, h.cache, OverlapResults, sourceId, getFilterCohortIds(filterCohortPairs, caseCohortId, controlCohortId), request,
+		func() (CohortOverlapStats, error) {
+			return h.CohortDataI.RetrieveCohortOverlapStats(ctx, sourceId, caseCohortId, controlCohortId, filterConceptIds, filterCohortPairs)
+		})
+}
+
+// Only the histogram bins are cached, as the values they are computed from are person level data.
+func (h CachedCohortData) RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortDefinitionId int,
+	histogramConceptId int64, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]utils.HistogramColumn, error) {
+
+	request := struct {
+		CohortDefinitionId int                `json:"cohort_definition_id"`
+		HistogramConceptId int64              `json:"histogram_concept_id"`
+		Filters            resultCacheFilters `json:"filters"`
+	}{cohortDefinitionId, histogramConceptId, newResultCacheFilters(filterConceptIds, filterCohortPairs)}
+	return getCachedResult(ctx, h.cache, HistogramResults, sourceId, getFilterCohortIds(filterCohortPairs, cohortDefinitionId), request,
+		func() ([]utils.HistogramColumn, error) {
+			return h.CohortDataI.RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx, sourceId, cohortDefinitionId, histogramConceptId, filterConceptIds, filterCohortPairs)
+		})
+}
+
+func (h CachedCohortData) RetrieveInclusionRuleAttrition(ctx context.Context, sourceId int, cohortDefinitionId int) (*CohortInclusionAttrition, error) {
+	request := struct {
+		CohortDefinitionId int `json:"cohort_definition_id"`
+	}{cohortDefinitionId}
+	return getCachedResult(ctx, h.cache, AttritionResults, sourceId, []int{cohortDefinitionId}, request,
+		func() (*CohortInclusionAttrition, error) {
+			return h.CohortDataI.RetrieveInclusionRuleAttrition(ctx, sourceId, cohortDefinitionId)
+		})
+}
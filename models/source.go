@@ -1,10 +1,22 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/uc-cdis/cohort-middleware/config"
 	"github.com/uc-cdis/cohort-middleware/db"
 	"github.com/uc-cdis/cohort-middleware/utils"
 )
 
+// The errors of GetDataSource, which are wrapped with the details of the source:
+var ErrSourceNotFound = errors.New("source not found")
+var ErrSourceDaimonNotConfigured = errors.New("source daimon not configured")
+var ErrSourceConnectionFailed = errors.New("could not connect to source")
+var ErrSourceSchemaInvalid = errors.New("invalid source schema")
+
 type Source struct {
 	SourceId         int    `json:"source_id"`
 	SourceName       string `json:"source_name"`
@@ -14,6 +26,7 @@ type Source struct {
 	Password         string `json:",omitempty"`
 }
 
+// Returns the source with the given id, or nil if there is no such source.
 func (h Source) GetSourceById(id int) (*Source, error) {
 	db2 := db.GetAtlasDB().Db
 	var dataSource *Source
@@ -22,10 +35,11 @@ func (h Source) GetSourceById(id int) (*Source, error) {
 		Where("source_id = ?", id)
 	query, cancel := utils.AddTimeoutToQuery(query)
 	defer cancel()
-	query.Scan(&dataSource)
-	return dataSource, nil
+	meta_result := query.Scan(&dataSource)
+	return dataSource, meta_result.Error
 }
 
+// Returns the source with the given id, including its connection details, or nil if there is no such source.
 func (h Source) GetSourceByIdWithConnection(id int) (*Source, error) {
 	db2 := db.GetAtlasDB().Db
 	var dataSource *Source
@@ -34,8 +48,8 @@ func (h Source) GetSourceByIdWithConnection(id int) (*Source, error) {
 		Where("source_id = ?", id)
 	query, cancel := utils.AddTimeoutToQuery(query)
 	defer cancel()
-	query.Scan(&dataSource)
-	return dataSource, nil
+	meta_result := query.Scan(&dataSource)
+	return dataSource, meta_result.Error
 }
 
 type SourceSchema struct {
@@ -58,13 +72,13 @@ func (h Source) GetSourceSchemaNameBySourceIdAndSourceType(id int, sourceType So
 	var sourceSchema *SourceSchema
 	query := db2.Model(&Source{}).
 		Select("source_daimon.table_qualifier as schema_name").
-		Joins("INNER JOIN "+atlasDb.Schema+".source_daimon ON source.source_id = source_daimon.source_id").
+		Joins("INNER JOIN "+atlasDb.Table("source_daimon")+" ON source.source_id = source_daimon.source_id").
 		Where("source.source_id = ?", id).
 		Where("source_daimon.daimon_type = ?", sourceType)
 	query, cancel := utils.AddTimeoutToQuery(query)
 	defer cancel()
-	query.Scan(&sourceSchema)
-	return sourceSchema, nil
+	meta_result := query.Scan(&sourceSchema)
+	return sourceSchema, meta_result.Error
 }
 
 type SourceType int64
@@ -78,15 +92,36 @@ const (
 )
 
 // Get the data source details for given source id and source type.
-// The source type can be one of the type SourceType.
-func (h Source) GetDataSource(sourceId int, sourceType SourceType) *utils.DbAndSchema {
-	dataSource, _ := h.GetSourceByIdWithConnection(sourceId)
-
-	sourceConnectionString := dataSource.SourceConnection
-	dbSchema, _ := h.GetSourceSchemaNameBySourceIdAndSourceType(sourceId, sourceType)
-	dbSchemaName := dbSchema.SchemaName
-	dbAndSchema := utils.GetDataSourceDB(sourceConnectionString, dbSchemaName)
-	return dbAndSchema
+// The source type can be one of the type SourceType. Returns ErrSourceNotFound if there is no source with the given id,
+// ErrSourceDaimonNotConfigured if the source has no schema for the source type, ErrSourceSchemaInvalid if one of
+// the schemas of the source is not a valid identifier and ErrSourceConnectionFailed if the source database cannot be reached.
+func (h Source) GetDataSource(sourceId int, sourceType SourceType) (*utils.DbAndSchema, error) {
+	metadata, err := getSourceMetadata(sourceId)
+	if err != nil {
+		return nil, err
+	}
+	schemaName := metadata.schemas[sourceType]
+	if schemaName == "" {
+		return nil, fmt.Errorf("%w: no daimon of type %d for source %d", ErrSourceDaimonNotConfigured, sourceType, sourceId)
+	}
+	poolConfig, err := getDataSourcePoolConfig(sourceId)
+	if err != nil {
+		return nil, err
+	}
+	dbAndSchema, err := utils.GetDataSourceDB(utils.DataSourceConnection{
+		SourceId:         sourceId,
+		ConnectionString: metadata.source.SourceConnection,
+		Username:         metadata.source.Username,
+		Password:         metadata.source.Password,
+		Schema:           schemaName,
+		PoolConfig:       poolConfig,
+	})
+	if err != nil {
+		// the connection details may have been changed in Atlas, so read them again on the next request:
+		sourceMetadataCache().Invalidate(sourceId)
+		return nil, fmt.Errorf("%w %d: %v", ErrSourceConnectionFailed, sourceId, err)
+	}
+	return dbAndSchema, nil
 }
 
 func (h Source) GetSourceByName(name string) (*Source, error) {
@@ -97,8 +132,8 @@ func (h Source) GetSourceByName(name string) (*Source, error) {
 		Where("source_name = ?", name)
 	query, cancel := utils.AddTimeoutToQuery(query)
 	defer cancel()
-	query.Scan(&dataSource)
-	return dataSource, nil
+	meta_result := query.Scan(&dataSource)
+	return dataSource, meta_result.Error
 }
 
 func (h Source) GetAllSources() ([]*Source, error) {
@@ -108,6 +143,160 @@ func (h Source) GetAllSources() ([]*Source, error) {
 		Select("source_id, source_name")
 	query, cancel := utils.AddTimeoutToQuery(query)
 	defer cancel()
-	query.Scan(&dataSource)
-	return dataSource, nil
+	meta_result := query.Scan(&dataSource)
+	return dataSource, meta_result.Error
+}
+
+// Returns the id of the only source, for the features that expect exactly one data source.
+func getSingleSourceId() (int, error) {
+	var source = new(Source)
+	sources, err := source.GetAllSources()
+	if err != nil {
+		return -1, err
+	}
+	if len(sources) < 1 {
+		return -1, fmt.Errorf("no data source found: %w", ErrSourceNotFound)
+	} else if len(sources) > 1 {
+		return -1, errors.New("more than one data source found")
+	}
+	return sources[0].SourceId, nil
+}
+
+// Closes the open connections to the given source, e.g. after its credentials were changed in the
+// source database, and forgets its cached metadata. They are reopened on the next request.
+// Returns the number of connections closed.
+func (h Source) EvictDataSource(sourceId int) int {
+	h.InvalidateSourceMetadata(sourceId)
+	return utils.EvictDataSourceDB(sourceId)
+}
+
+// The source, with its connection details, and the schema name of each of its daimon types:
+type sourceMetadata struct {
+	source  *Source
+	schemas map[SourceType]string
+}
+
+const defaultSourceMetadataCacheTtl = 5 * time.Minute
+
+var sourceMetadataCacheInstance *utils.TtlCache[int, *sourceMetadata]
+var sourceMetadataCacheOnce sync.Once
+
+// Returns the cache of the source metadata by source id, of which the entries expire
+// after source_metadata_cache_ttl_seconds (default 5 minutes).
+func sourceMetadataCache() *utils.TtlCache[int, *sourceMetadata] {
+	sourceMetadataCacheOnce.Do(func() {
+		ttl := defaultSourceMetadataCacheTtl
+		if seconds := config.GetConfig().GetInt("source_metadata_cache_ttl_seconds"); seconds > 0 {
+			ttl = time.Duration(seconds) * time.Second
+		}
+		sourceMetadataCacheInstance = utils.NewTtlCache[int, *sourceMetadata](ttl)
+	})
+	return sourceMetadataCacheInstance
+}
+
+// Returns the metadata of the source from the cache, or reads it from Atlas with one query for
+// the source and one for all of its daimons. Sources that are not found are not cached.
+func getSourceMetadata(sourceId int) (*sourceMetadata, error) {
+	return sourceMetadataCache().GetOrLoad(sourceId, func() (*sourceMetadata, error) {
+		source, err := Source{}.GetSourceByIdWithConnection(sourceId)
+		if err != nil {
+			return nil, err
+		} else if source == nil {
+			return nil, fmt.Errorf("%w: source %d", ErrSourceNotFound, sourceId)
+		}
+		atlasDb := db.GetAtlasDB()
+		var daimons []*struct {
+			DaimonType     SourceType
+			TableQualifier string
+		}
+		query := atlasDb.Db.Table(atlasDb.Table("source_daimon")+" as source_daimon").
+			Select("daimon_type, table_qualifier").
+			Where("source_id = ?", sourceId)
+		query, cancel := utils.AddTimeoutToQuery(query)
+		defer cancel()
+		meta_result := query.Scan(&daimons)
+		if meta_result.Error != nil {
+			return nil, meta_result.Error
+		}
+		metadata := sourceMetadata{source: source, schemas: make(map[SourceType]string)}
+		for _, daimon := range daimons {
+			// the schemas are used to build queries, so a misconfigured table_qualifier should not get that far:
+			if _, err := utils.ParseIdentifier(daimon.TableQualifier); err != nil {
+				return nil, fmt.Errorf("%w: daimon of type %d of source %d: %v", ErrSourceSchemaInvalid, daimon.DaimonType, sourceId, err)
+			}
+			metadata.schemas[daimon.DaimonType] = daimon.TableQualifier
+		}
+		// as in GetSourceSchemaNameBySourceIdAndSourceType, these are not stored in the source_daimon table:
+		metadata.schemas[Misc] = "MISC"
+		metadata.schemas[Dbo] = "DBO"
+		return &metadata, nil
+	})
+}
+
+// Forgets the cached metadata of the source, so that it is read from Atlas again on the next request.
+// Returns whether the source was cached.
+func (h Source) InvalidateSourceMetadata(sourceId int) bool {
+	return sourceMetadataCache().Invalidate(sourceId)
+}
+
+func (h Source) GetSourceMetadataCacheStats() utils.TtlCacheStats {
+	return sourceMetadataCache().Stats()
+}
+
+// The connection pool settings in data_source_pool, for all sources or for the source with source_id:
+type dataSourcePoolSettings struct {
+	SourceId               int `mapstructure:"source_id"`
+	MaxOpenConns           int `mapstructure:"max_open_conns"`
+	MaxIdleConns           int `mapstructure:"max_idle_conns"`
+	ConnMaxLifetimeSeconds int `mapstructure:"conn_max_lifetime_seconds"`
+}
+
+// Returns the connection pool settings of the source, i.e. the settings in data_source_pool
+// overridden by the non-zero settings of the source in data_source_pool.sources.
+func getDataSourcePoolConfig(sourceId int) (utils.DataSourcePoolConfig, error) {
+	var poolSettings struct {
+		dataSourcePoolSettings `mapstructure:",squash"`
+		Sources                []dataSourcePoolSettings `mapstructure:"sources"`
+	}
+	if err := config.GetConfig().UnmarshalKey("data_source_pool", &poolSettings); err != nil {
+		return utils.DataSourcePoolConfig{}, fmt.Errorf("invalid data_source_pool config: %w", err)
+	}
+	settings := poolSettings.dataSourcePoolSettings
+	for _, sourceSettings := range poolSettings.Sources {
+		if sourceSettings.SourceId != sourceId {
+			continue
+		}
+		if sourceSettings.MaxOpenConns > 0 {
+			settings.MaxOpenConns = sourceSettings.MaxOpenConns
+		}
+		if sourceSettings.MaxIdleConns > 0 {
+			settings.MaxIdleConns = sourceSettings.MaxIdleConns
+		}
+		if sourceSettings.ConnMaxLifetimeSeconds > 0 {
+			settings.ConnMaxLifetimeSeconds = sourceSettings.ConnMaxLifetimeSeconds
+		}
+	}
+	return utils.DataSourcePoolConfig{
+		MaxOpenConns:    settings.MaxOpenConns,
+		MaxIdleConns:    settings.MaxIdleConns,
+		ConnMaxLifetime: time.Duration(settings.ConnMaxLifetimeSeconds) * time.Second,
+	}, nil
+}
+
+// Sets how long a source connection that was evicted or replaced stays open for the requests that are still
+// using it, from data_source_pool.close_delay_seconds (default 600, the longest query timeout).
+func SetDataSourceCloseDelay() {
+	if seconds := config.GetConfig().GetInt("data_source_pool.close_delay_seconds"); seconds > 0 {
+		utils.SetDataSourceCloseDelay(time.Duration(seconds) * time.Second)
+	}
+}
+
+// Starts pinging the open source connections every data_source_pool.health_check_interval_seconds,
+// so that connections that stopped working are reopened. Health checks are off if the interval is not set.
+func StartDataSourceHealthChecks() {
+	interval := config.GetConfig().GetInt("data_source_pool.health_check_interval_seconds")
+	if interval <= 0 {
+		return
+	}
+	utils.StartDataSourceHealthChecks(time.Duration(interval) * time.Second)
 }
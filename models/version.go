@@ -1,6 +1,8 @@
 package models
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	"github.com/uc-cdis/cohort-middleware/db"
@@ -41,7 +43,7 @@ func (h Version) GetVersion() *Version {
 	return &Version{GitCommit: version.GitCommit, GitVersion: version.GitVersion}
 }
 
-func (h Version) GetSchemaVersion() *DbSchemaVersion {
+func (h Version) GetSchemaVersion(ctx context.Context) (*DbSchemaVersion, error) {
 	dbSchemaVersion := &DbSchemaVersion{"error", -1}
 
 	atlasDb := db.GetAtlasDB().Db
@@ -51,35 +53,46 @@ func (h Version) GetSchemaVersion() *DbSchemaVersion {
 		Select("version").
 		Order("installed_rank desc")
 
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
 	meta_result := query.Scan(&atlasSchemaVersion)
 	if meta_result.Error == nil {
 		dbSchemaVersion.AtlasSchemaVersion = atlasSchemaVersion.Version
 	}
 
-	var source = new(Source)
-	sources, _ := source.GetAllSources()
-	if len(sources) < 1 {
-		panic("Error: No data source found")
-	} else if len(sources) > 1 {
-		panic("More than one data source! Exiting")
+	sourceId, err := getSingleSourceId()
+	if err != nil {
+		return nil, err
 	}
+	dataSchemaVersion, err := getDataSchemaVersion(ctx, sourceId)
+	if err == nil {
+		dbSchemaVersion.DataSchemaVersion = dataSchemaVersion
+	}
+
+	return dbSchemaVersion, nil
+}
+
+// Returns the latest version in the dbo.VersionInfo table of the given source.
+func getDataSchemaVersion(ctx context.Context, sourceId int) (int, error) {
 	var dataSourceModel = new(Source)
-	dboDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, Dbo)
+	dboDataSource, err := dataSourceModel.GetDataSource(sourceId, Dbo)
+	if err != nil {
+		return 0, err
+	}
 
 	var versionInfo *VersionInfo
-	query = dboDataSource.Db.Table(dboDataSource.Schema + ".versioninfo").
+	query := dboDataSource.Db.Table(dboDataSource.Table("versioninfo") + " as versioninfo").
 		Limit(1).
 		Select("Version").
 		Order("Version Desc")
 
-	query, cancel = utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutToQueryWithContext(ctx, query)
 	defer cancel()
-	meta_result = query.Scan(&versionInfo)
-	if meta_result.Error == nil {
-		dbSchemaVersion.DataSchemaVersion = versionInfo.Version
+	meta_result := query.Scan(&versionInfo)
+	if meta_result.Error != nil {
+		return -1, meta_result.Error
+	} else if versionInfo == nil {
+		return -1, errors.New("no data schema version found")
 	}
-
-	return dbSchemaVersion
+	return versionInfo.Version, nil
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -23,47 +24,95 @@ func NewRouter() *gin.Engine {
 	authorized := r.Group("/")
 	authorized.Use(middlewares.AuthMiddleware())
 	{
+		// the endpoints are grouped by the query timeout they get (see query_timeout_seconds in the config):
+		metadataQueries := authorized.Group("/", middlewares.QueryTimeout(middlewares.MetadataQueries))
+		// the stats and export endpoints can materialize their filtered cohorts in temp tables (see cohort_filter_mode in the config):
+		statsQueries := authorized.Group("/", middlewares.QueryTimeout(middlewares.StatsQueries), middlewares.FilteredCohortSession())
+		exportQueries := authorized.Group("/", middlewares.QueryTimeout(middlewares.ExportQueries), middlewares.FilteredCohortSession())
+		// Person level data of a cohort, like the full data and members exports, is returned to the users whose team project has
+		// access to the cohort, as these users can already export the data of its members for their analyses. The endpoints that
+		// manage the service or return person level data of the whole source, which is not limited to the cohorts of a team project,
+		// are restricted to admins (see admin_resource_path in the config). Their queries, e.g. the refresh of a data dictionary
+		// concept, get the stats timeout:
+		adminOnly := authorized.Group("/", middlewares.AdminAuthMiddleware(&http.Client{}), middlewares.QueryTimeout(middlewares.StatsQueries))
+
+		// the results of the statistics endpoints are cached when a result_cache backend is configured:
+		statsResultCache, err := models.NewStatsResultCacheFromConfig()
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+
 		source := new(controllers.SourceController)
-		authorized.GET("/source/by-id/:id", source.RetriveById)
-		authorized.GET("/source/by-name/:name", source.RetriveByName)
-		authorized.GET("/sources", source.RetriveAll)
+		metadataQueries.GET("/source/by-id/:id", source.RetriveById)
+		metadataQueries.GET("/source/by-name/:name", source.RetriveByName)
+		metadataQueries.GET("/sources", source.RetriveAll)
+		adminOnly.DELETE("/source/by-id/:id/connections", source.EvictConnections)
+		adminOnly.GET("/source/metadata-cache/stats", source.RetrieveMetadataCacheStats)
 
 		cohortdefinitions := controllers.NewCohortDefinitionController(*new(models.CohortDefinition),
 			middlewares.NewTeamProjectAuthz(*new(models.CohortDefinition), &http.Client{}))
-		authorized.GET("/cohortdefinition/by-id/:id", cohortdefinitions.RetriveById)
+		metadataQueries.GET("/cohortdefinition/by-id/:id", cohortdefinitions.RetriveById)
+		metadataQueries.GET("/cohortdefinition/expression/by-id/:id", cohortdefinitions.RetrieveExpressionById)
+		metadataQueries.GET("/cohortdefinition/generation-info/by-id/:id", cohortdefinitions.RetrieveGenerationInfoById)
+		exportQueries.POST("/cohortdefinition/by-source-id/:sourceid/from-person-ids", cohortdefinitions.CreateCohortFromPersonIds)
+		exportQueries.POST("/cohortdefinition/by-source-id/:sourceid/from-set-expression", cohortdefinitions.CreateCohortFromSetExpression)
 
-		authorized.GET("/cohortdefinition-stats/by-source-id/:sourceid/by-team-project", cohortdefinitions.RetriveStatsBySourceIdAndTeamProject)
+		statsQueries.GET("/cohortdefinition-stats/by-source-id/:sourceid/by-team-project", cohortdefinitions.RetriveStatsBySourceIdAndTeamProject)
+		metadataQueries.GET("/cohortdefinition/by-source-id/:sourceid/by-team-project", cohortdefinitions.SearchCohortDefinitions)
 
 		// concept endpoints:
-		concepts := controllers.NewConceptController(*new(models.Concept), *new(models.CohortDefinition),
+		concepts := controllers.NewConceptController(models.NewCachedConcept(*new(models.Concept), statsResultCache), *new(models.CohortDefinition),
 			middlewares.NewTeamProjectAuthz(*new(models.CohortDefinition), &http.Client{}))
-		authorized.GET("/concept/by-source-id/:sourceid", concepts.RetriveAllBySourceId)
-		authorized.POST("/concept/by-source-id/:sourceid", concepts.RetrieveInfoBySourceIdAndConceptIds)
-		authorized.POST("/concept/by-source-id/:sourceid/by-type", concepts.RetrieveInfoBySourceIdAndConceptTypes)
+		metadataQueries.GET("/concept/by-source-id/:sourceid", concepts.RetriveAllBySourceId)
+		metadataQueries.POST("/concept/by-source-id/:sourceid", concepts.RetrieveInfoBySourceIdAndConceptIds)
+		metadataQueries.POST("/concept/by-source-id/:sourceid/by-type", concepts.RetrieveInfoBySourceIdAndConceptTypes)
 
-		authorized.GET("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid", concepts.RetrieveBreakdownStatsBySourceIdAndCohortId)
-		authorized.POST("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid", concepts.RetrieveBreakdownStatsBySourceIdAndCohortIdAndVariables)
-		authorized.POST("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid/csv", concepts.RetrieveAttritionTable)
+		statsQueries.GET("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid", concepts.RetrieveBreakdownStatsBySourceIdAndCohortId)
+		statsQueries.POST("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid", concepts.RetrieveBreakdownStatsBySourceIdAndCohortIdAndVariables)
+		statsQueries.POST("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid/csv", concepts.RetrieveAttritionTable)
 
 		// cohort stats and checks:
-		cohortData := controllers.NewCohortDataController(*new(models.CohortData), *new(models.DataDictionary), middlewares.NewTeamProjectAuthz(*new(models.CohortDefinition), &http.Client{}))
+		cohortData := controllers.NewCohortDataController(models.NewCachedCohortData(*new(models.CohortData), statsResultCache), *new(models.DataDictionary), middlewares.NewTeamProjectAuthz(*new(models.CohortDefinition), &http.Client{}))
 		// :casecohortid/:controlcohortid are just labels here and have no special meaning. Could also just be :cohortAId/:cohortBId here:
-		authorized.POST("/cohort-stats/check-overlap/by-source-id/:sourceid/by-cohort-definition-ids/:casecohortid/:controlcohortid", cohortData.RetrieveCohortOverlapStats)
+		statsQueries.POST("/cohort-stats/check-overlap/by-source-id/:sourceid/by-cohort-definition-ids/:casecohortid/:controlcohortid", cohortData.RetrieveCohortOverlapStats)
 
 		// full data endpoints:
-		authorized.POST("/cohort-data/by-source-id/:sourceid/by-cohort-definition-id/:cohortid", cohortData.RetrieveDataBySourceIdAndCohortIdAndVariables)
+		exportQueries.POST("/cohort-data/by-source-id/:sourceid/by-cohort-definition-id/:cohortid", cohortData.RetrieveDataBySourceIdAndCohortIdAndVariables)
+
+		// cohort membership export endpoint, person level data limited to a cohort of the team project, as the full data endpoint above:
+		exportQueries.GET("/cohort-members/by-source-id/:sourceid/by-cohort-definition-id/:cohortid", cohortData.RetrieveCohortMembers)
+		statsQueries.GET("/cohort-stats/inclusion-rule-attrition/by-source-id/:sourceid/by-cohort-definition-id/:cohortid", cohortData.RetrieveInclusionRuleAttrition)
+		statsQueries.GET("/cohort-stats/inclusion-rule-attrition/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/csv", cohortData.RetrieveInclusionRuleAttritionCSV)
 
 		// histogram endpoint
-		authorized.POST("/histogram/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/by-histogram-concept-id/:histogramid", cohortData.RetrieveHistogramForCohortIdAndConceptId)
+		statsQueries.POST("/histogram/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/by-histogram-concept-id/:histogramid", cohortData.RetrieveHistogramForCohortIdAndConceptId)
 
 		// Data Dictionary endpoint
-		authorized.GET("/data-dictionary/Retrieve", cohortData.RetrieveDataDictionary)
+		statsQueries.GET("/data-dictionary/Retrieve", cohortData.RetrieveDataDictionary)
 
-		// Data Dictionary endpoint
-		authorized.GET("/data-dictionary/Generate", cohortData.GenerateDataDictionary)
+		// Data Dictionary generation endpoint, admins only. A full generation is only started with POST:
+		adminOnly.GET("/data-dictionary/Generate", cohortData.GenerateDataDictionary)
+		adminOnly.POST("/data-dictionary/Generate", cohortData.GenerateDataDictionary)
+
+		// cohort-scoped Data Dictionary endpoint
+		statsQueries.GET("/data-dictionary/by-source-id/:sourceid/by-cohort-definition-id/:cohortid", cohortData.RetrieveCohortDataDictionary)
+
+		// Data Dictionary generation status endpoint
+		metadataQueries.GET("/data-dictionary/Status", cohortData.RetrieveDataDictionaryGenerationStatus)
+
+		// Data Dictionary per-concept refresh endpoint, admins only
+		adminOnly.POST("/data-dictionary/Refresh/by-concept-id/:conceptid", cohortData.RefreshDataDictionaryConcept)
+
+		// Data Dictionary snapshot endpoints
+		metadataQueries.GET("/data-dictionary/Snapshots", cohortData.RetrieveDataDictionarySnapshots)
+		statsQueries.GET("/data-dictionary/Snapshots/Diff/by-snapshot-ids/:fromsnapshotid/:tosnapshotid", cohortData.DiffDataDictionarySnapshots)
+
+		// data quality report endpoint, admins only as the report contains the person ids of the whole source:
+		dataQuality := controllers.NewDataQualityController(*new(models.DataQuality))
+		adminOnly.GET("/data-quality/report", dataQuality.RetrieveReport)
 
 		// Get Schema Version
-		authorized.GET("/_schema_version", version.RetrieveSchemaVersion)
+		metadataQueries.GET("/_schema_version", version.RetrieveSchemaVersion)
 	}
 
 	return r
@@ -1,6 +1,8 @@
 package controllers_tests
 
 import (
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,9 +12,11 @@ import (
 	"net/url"
 	"os"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/uc-cdis/cohort-middleware/config"
@@ -20,6 +24,7 @@ import (
 	"github.com/uc-cdis/cohort-middleware/models"
 	"github.com/uc-cdis/cohort-middleware/tests"
 	"github.com/uc-cdis/cohort-middleware/utils"
+	"github.com/xuri/excelize/v2"
 )
 
 var testSourceId = tests.GetTestSourceId()
@@ -67,7 +72,7 @@ var cohortDefinitionControllerWithFailingTeamProjectAuthz = controllers.NewCohor
 
 type dummyCohortDataModel struct{}
 
-func (h dummyCohortDataModel) RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId int, cohortDefinitionId int, conceptIds []int64) ([]*models.PersonConceptAndValue, error) {
+func (h dummyCohortDataModel) RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(ctx context.Context, sourceId int, cohortDefinitionId int, conceptIds []int64) ([]*models.PersonConceptAndValue, error) {
 	value := float32(0.0)
 	cohortData := []*models.PersonConceptAndValue{
 		{PersonId: 1, ConceptId: 10, ConceptClassId: "something", ObservationValueAsConceptName: "abc", ConceptValueAsNumber: &value},
@@ -75,30 +80,37 @@ func (h dummyCohortDataModel) RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrde
 	return cohortData, nil
 }
 
-func (h dummyCohortDataModel) RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]*models.PersonConceptAndValue, error) {
+func (h dummyCohortDataModel) RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]*models.PersonConceptAndValue, error) {
 
 	cohortData := []*models.PersonConceptAndValue{}
 	return cohortData, nil
 }
 
-func (h dummyCohortDataModel) RetrieveHistogramDataBySourceIdAndConceptId(sourceId int, histogramConceptId int64) ([]*models.PersonConceptAndValue, error) {
+func (h dummyCohortDataModel) RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]utils.HistogramColumn, error) {
+	return nil, nil
+}
+
+func (h dummyCohortDataModel) RetrieveHistogramDataBySourceIdAndConceptId(ctx context.Context, sourceId int, histogramConceptId int64) ([]*models.PersonConceptAndValue, error) {
 
 	cohortData := []*models.PersonConceptAndValue{}
 	return cohortData, nil
 }
 
-func (h dummyCohortDataModel) RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds(sourceId int, conceptId int64) ([]*models.NominalGroupData, error) {
+func (h dummyCohortDataModel) RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds(ctx context.Context, sourceId int, conceptId int64) ([]*models.NominalGroupData, error) {
 	cohortData := []*models.NominalGroupData{}
 	return cohortData, nil
 }
 
-func (h dummyCohortDataModel) RetrieveCohortOverlapStats(sourceId int, caseCohortId int, controlCohortId int,
+func (h dummyCohortDataModel) RetrieveCohortOverlapStats(ctx context.Context, sourceId int, caseCohortId int, controlCohortId int,
 	otherFilterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) (models.CohortOverlapStats, error) {
 	var zeroOverlap models.CohortOverlapStats
 	return zeroOverlap, nil
 }
 
-func (h dummyCohortDataModel) RetrieveDataByOriginalCohortAndNewCohort(sourceId int, originalCohortDefinitionId int, cohortDefinitionId int) ([]*models.PersonIdAndCohort, error) {
+func (h dummyCohortDataModel) RetrieveDataByOriginalCohortAndNewCohort(ctx context.Context, sourceId int, originalCohortDefinitionId int, cohortDefinitionId int) ([]*models.PersonIdAndCohort, error) {
+	if sourceId == dummyUnreachableSourceId {
+		return nil, fmt.Errorf("%w %d: connection refused", models.ErrSourceConnectionFailed, sourceId)
+	}
 	if cohortDefinitionId == 2 {
 		return []*models.PersonIdAndCohort{
 			{PersonId: 1, CohortId: int64(cohortDefinitionId)},
@@ -111,23 +123,128 @@ func (h dummyCohortDataModel) RetrieveDataByOriginalCohortAndNewCohort(sourceId
 	}, nil
 }
 
+func (h dummyCohortDataModel) StreamCohortMembers(ctx context.Context, sourceId int, cohortDefinitionId int, onMember func(member *models.CohortMember) error) error {
+	if dummyModelReturnError {
+		return errors.New("error streaming cohort members")
+	}
+	startDate := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, subjectId := range []int64{2, 3} {
+		if err := onMember(&models.CohortMember{SubjectId: subjectId, CohortStartDate: startDate, CohortEndDate: endDate}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h dummyCohortDataModel) RetrieveInclusionRuleAttrition(ctx context.Context, sourceId int, cohortDefinitionId int) (*models.CohortInclusionAttrition, error) {
+	if dummyModelReturnError {
+		return nil, errors.New("error retrieving inclusion rule attrition")
+	}
+	if cohortDefinitionId == 404 {
+		return nil, models.ErrCohortInclusionStatsNotFound
+	}
+	return &models.CohortInclusionAttrition{
+		CohortName: "test cohort",
+		BaseCount:  15,
+		FinalCount: 10,
+		InclusionRules: []*models.CohortInclusionRuleAttrition{
+			{RuleSequence: 0, RuleName: "adults", PersonCount: 12, PersonsRemoved: 3, RulePersonCount: 12},
+			{RuleSequence: 1, RuleName: "Inclusion rule 2", PersonCount: 10, PersonsRemoved: 2, RulePersonCount: 12},
+		},
+	}, nil
+}
+
 type dummyCohortDefinitionDataModel struct{}
 
 var dummyModelReturnError bool = false
 
-func (h dummyCohortDefinitionDataModel) GetCohortDefinitionIdsForTeamProject(teamProject string) ([]int, error) {
+// the cohorts of the team projects used in the tests, where dummyGlobalReaderRole is the global_reader_role of the mocktest config:
+var dummyTeamProjectCohortDefinitionIds = map[string][]int{
+	"teamprojectX":          {1, 2, 3, 4, 6},
+	"teamprojectY":          {5},
+	"dummyGlobalReaderRole": {7},
+}
+
+func (h dummyCohortDefinitionDataModel) GetCohortDefinitionIdsForTeamProject(ctx context.Context, teamProject string) ([]int, error) {
+	if cohortDefinitionIds, ok := dummyTeamProjectCohortDefinitionIds[teamProject]; ok {
+		return cohortDefinitionIds, nil
+	}
 	return []int{1}, nil
 }
 
-func (h dummyCohortDefinitionDataModel) GetTeamProjectsThatMatchAllCohortDefinitionIds(uniqueCohortDefinitionIdsList []int) ([]string, error) {
+func (h dummyCohortDefinitionDataModel) GetTeamProjectsThatMatchAllCohortDefinitionIds(ctx context.Context, uniqueCohortDefinitionIdsList []int) ([]string, error) {
 	return []string{"test"}, nil
 }
 
-func (h dummyCohortDefinitionDataModel) GetCohortName(cohortId int) (string, error) {
+func (h dummyCohortDefinitionDataModel) GetCohortGenerationInfo(ctx context.Context, cohortDefinitionId int, sourceId int) (*models.CohortGenerationInfo, error) {
+	return &models.CohortGenerationInfo{Id: cohortDefinitionId, SourceId: sourceId, PersonCount: 10, RecordCount: 10}, nil
+}
+
+func (h dummyCohortDefinitionDataModel) GetCohortGenerationDetails(ctx context.Context, cohortDefinitionId int) ([]*models.CohortGenerationDetails, error) {
+	if dummyModelReturnError {
+		return nil, errors.New("error retrieving cohort generation info")
+	}
+	return []*models.CohortGenerationDetails{
+		{SourceId: 1, ExecutionDuration: 1200, Status: 2, IsValid: true, PersonCount: 10, RecordCount: 10},
+		{SourceId: 2, Status: 2, IsValid: false, FailMessage: "generation failed"},
+	}, nil
+}
+
+func (h dummyCohortDefinitionDataModel) CreateCohortFromPersonIds(ctx context.Context, sourceId int, name string, description string, teamProject string, members []models.NewCohortMember) (*models.CohortDefinition, error) {
+	if dummyModelReturnError {
+		return nil, errors.New("error creating cohort")
+	}
+	switch {
+	case name == "existing cohort":
+		return nil, models.ErrCohortNameAlreadyExists
+	case len(members) == 0:
+		return nil, models.ErrEmptyCohort
+	case slices.ContainsFunc(members, func(member models.NewCohortMember) bool { return member.PersonId == -1 }):
+		return nil, fmt.Errorf("%w: [-1]", models.ErrPersonIdsNotFound)
+	case slices.ContainsFunc(members, func(member models.NewCohortMember) bool { return member.PersonId == -2 }):
+		return nil, fmt.Errorf("%w: [-2]", models.ErrObservationPeriodNotFound)
+	case slices.ContainsFunc(members, func(member models.NewCohortMember) bool { return member.CohortEndDate.Before(member.CohortStartDate) }):
+		return nil, fmt.Errorf("%w: person %d", models.ErrInvalidCohortDates, members[0].PersonId)
+	}
+	return &models.CohortDefinition{Id: 7, Name: name, Description: description}, nil
+}
+
+func (h dummyCohortDefinitionDataModel) CreateCohortFromSetExpression(ctx context.Context, sourceId int, name string, description string, teamProject string, expression *utils.CohortSetExpression) (*models.CohortDefinition, error) {
+	if dummyModelReturnError {
+		return nil, errors.New("error creating cohort")
+	}
+	if slices.Contains(expression.CohortDefinitionIds(), 6) {
+		return nil, fmt.Errorf("%w: cohort 6", models.ErrCohortNotGenerated)
+	}
+	return &models.CohortDefinition{Id: 8, Name: name, Description: description, Expression: expression.String()}, nil
+}
+
+func (h dummyCohortDefinitionDataModel) GetCohortName(ctx context.Context, cohortId int) (string, error) {
 	return "dummy cohort name", nil
 }
 
-func (h dummyCohortDefinitionDataModel) GetAllCohortDefinitionsAndStatsOrderBySizeDesc(sourceId int, teamProject string) ([]*models.CohortDefinitionStats, error) {
+func (h dummyCohortDefinitionDataModel) SearchCohortDefinitions(ctx context.Context, sourceId int, cohortDefinitionQuery models.CohortDefinitionQuery) (*models.CohortDefinitionPage, error) {
+	if dummyModelReturnError {
+		return nil, errors.New("error searching cohort definitions")
+	}
+	// return the query parameters in the entries, so we can assert on them in the tests:
+	cohortDefinitionPage := models.CohortDefinitionPage{TotalEntries: 1, Page: cohortDefinitionQuery.Page, PageSize: cohortDefinitionQuery.PageSize}
+	cohortDefinitionPage.Data = append(cohortDefinitionPage.Data, &models.CohortDefinitionListEntry{
+		Id:               1,
+		Name:             strings.Join(cohortDefinitionQuery.TeamProjects, ","),
+		Description:      fmt.Sprintf("%s %s %v", cohortDefinitionQuery.Search, cohortDefinitionQuery.SortBy, cohortDefinitionQuery.SortDescending),
+		GenerationStatus: models.CohortGenerationStatusComplete,
+	})
+	if cohortDefinitionQuery.IncludeUngenerated {
+		cohortDefinitionPage.TotalEntries = 2
+		cohortDefinitionPage.Data = append(cohortDefinitionPage.Data, &models.CohortDefinitionListEntry{
+			Id: 2, GenerationStatus: models.CohortGenerationStatusNotGenerated})
+	}
+	return &cohortDefinitionPage, nil
+}
+
+func (h dummyCohortDefinitionDataModel) GetAllCohortDefinitionsAndStatsOrderBySizeDesc(ctx context.Context, sourceId int, teamProject string) ([]*models.CohortDefinitionStats, error) {
 	conf := config.GetConfig()
 	globalReaderRole := conf.GetString("global_reader_role")
 	if teamProject == globalReaderRole {
@@ -146,22 +263,41 @@ func (h dummyCohortDefinitionDataModel) GetAllCohortDefinitionsAndStatsOrderBySi
 	} // when ordered by size descending, we get cohorts 5, 2, 3, 1, 4 (used in TestRetriveStatsBySourceIdAndTeamProject later on)
 }
 
-func (h dummyCohortDefinitionDataModel) GetCohortDefinitionById(id int) (*models.CohortDefinition, error) {
+// An Atlas cohort expression with an unknown "FutureAtlasField" field:
+const dummyCohortExpression = `{
+	"ConceptSets": [{"id": 0, "name": "diabetes", "expression": {"items": [
+		{"concept": {"CONCEPT_ID": 201826, "CONCEPT_NAME": "Type 2 diabetes mellitus", "STANDARD_CONCEPT": "S"}, "includeDescendants": true}]}}],
+	"PrimaryCriteria": {"CriteriaList": [{"ConditionOccurrence": {"CodesetId": 0, "ConditionTypeExclude": false}}],
+		"ObservationWindow": {"PriorDays": 365, "PostDays": 0}, "PrimaryCriteriaLimit": {"Type": "First"}},
+	"InclusionRules": [{"name": "adults", "expression": {"Type": "ALL", "CriteriaList": [],
+		"DemographicCriteriaList": [{"Age": {"Value": 18, "Op": "gte"}}], "Groups": []}}],
+	"EndStrategy": {"DateOffset": {"DateField": "StartDate", "Offset": 30}},
+	"FutureAtlasField": {"someSetting": 1}
+}`
+
+func (h dummyCohortDefinitionDataModel) GetCohortDefinitionById(ctx context.Context, id int) (*models.CohortDefinition, error) {
 	cohortDefinition := models.CohortDefinition{
 		Id:             1,
 		Name:           "test 1",
 		Description:    "test desc 1",
 		ExpressionType: "?",
+		Expression:     dummyCohortExpression,
 	}
 	if dummyModelReturnError {
 		return nil, fmt.Errorf("fake model error!")
 	}
+	if id == 404 {
+		return nil, nil
+	}
+	if id == 500 {
+		cohortDefinition.Expression = "{invalid"
+	}
 	return &cohortDefinition, nil
 }
-func (h dummyCohortDefinitionDataModel) GetCohortDefinitionByName(name string) (*models.CohortDefinition, error) {
+func (h dummyCohortDefinitionDataModel) GetCohortDefinitionByName(ctx context.Context, name string) (*models.CohortDefinition, error) {
 	return nil, nil
 }
-func (h dummyCohortDefinitionDataModel) GetAllCohortDefinitions() ([]*models.CohortDefinition, error) {
+func (h dummyCohortDefinitionDataModel) GetAllCohortDefinitions(ctx context.Context) ([]*models.CohortDefinition, error) {
 	return nil, nil
 }
 
@@ -218,11 +354,17 @@ var conceptControllerWithFailingTeamProjectAuthz = controllers.NewConceptControl
 
 type dummyConceptDataModel struct{}
 
-func (h dummyConceptDataModel) RetriveAllBySourceId(sourceId int) ([]*models.Concept, error) {
+// The source id for which the dummy models fail as if the source database is down:
+const dummyUnreachableSourceId = 503
+
+func (h dummyConceptDataModel) RetriveAllBySourceId(ctx context.Context, sourceId int) ([]*models.Concept, error) {
 	return nil, nil
 }
 
-func (h dummyConceptDataModel) RetrieveInfoBySourceIdAndConceptId(sourceId int, conceptId int64) (*models.ConceptSimple, error) {
+func (h dummyConceptDataModel) RetrieveInfoBySourceIdAndConceptId(ctx context.Context, sourceId int, conceptId int64) (*models.ConceptSimple, error) {
+	if sourceId == dummyUnreachableSourceId {
+		return nil, fmt.Errorf("%w %d: connection refused", models.ErrSourceConnectionFailed, sourceId)
+	}
 	conceptSimpleItems := []*models.ConceptSimple{
 		{ConceptId: 1234, ConceptName: "Concept A"},
 		{ConceptId: 5678, ConceptName: "Concept B"},
@@ -236,7 +378,7 @@ func (h dummyConceptDataModel) RetrieveInfoBySourceIdAndConceptId(sourceId int,
 	return nil, fmt.Errorf("concept id %d not found in mock data", conceptId)
 }
 
-func (h dummyConceptDataModel) RetrieveInfoBySourceIdAndConceptIds(sourceId int, conceptIds []int64) ([]*models.ConceptSimple, error) {
+func (h dummyConceptDataModel) RetrieveInfoBySourceIdAndConceptIds(ctx context.Context, sourceId int, conceptIds []int64) ([]*models.ConceptSimple, error) {
 	// dummy data with _some_ of the relevant fields:
 	conceptSimple := []*models.ConceptSimple{
 		{ConceptId: 1234, ConceptName: "Concept A"},
@@ -246,9 +388,12 @@ func (h dummyConceptDataModel) RetrieveInfoBySourceIdAndConceptIds(sourceId int,
 	if dummyModelReturnError {
 		return nil, fmt.Errorf("fake model error!")
 	}
+	if sourceId == dummyUnreachableSourceId {
+		return nil, fmt.Errorf("%w %d: connection refused", models.ErrSourceConnectionFailed, sourceId)
+	}
 	return conceptSimple, nil
 }
-func (h dummyConceptDataModel) RetrieveInfoBySourceIdAndConceptTypes(sourceId int, conceptTypes []string) ([]*models.ConceptSimple, error) {
+func (h dummyConceptDataModel) RetrieveInfoBySourceIdAndConceptTypes(ctx context.Context, sourceId int, conceptTypes []string) ([]*models.ConceptSimple, error) {
 	// dummy data with _some_ of the relevant fields:
 	conceptSimple := []*models.ConceptSimple{
 		{ConceptId: 1234, ConceptName: "Concept A"},
@@ -259,7 +404,7 @@ func (h dummyConceptDataModel) RetrieveInfoBySourceIdAndConceptTypes(sourceId in
 	}
 	return conceptSimple, nil
 }
-func (h dummyConceptDataModel) RetrieveBreakdownStatsBySourceIdAndCohortId(sourceId int, cohortDefinitionId int, breakdownConceptId int64) ([]*models.ConceptBreakdown, error) {
+func (h dummyConceptDataModel) RetrieveBreakdownStatsBySourceIdAndCohortId(ctx context.Context, sourceId int, cohortDefinitionId int, breakdownConceptId int64) ([]*models.ConceptBreakdown, error) {
 	conceptBreakdown := []*models.ConceptBreakdown{
 		{ConceptValue: "value1", NpersonsInCohortWithValue: 5, ValueName: "value1_name"},
 		{ConceptValue: "value2", NpersonsInCohortWithValue: 8, ValueName: "value2_name"},
@@ -269,7 +414,7 @@ func (h dummyConceptDataModel) RetrieveBreakdownStatsBySourceIdAndCohortId(sourc
 	}
 	return conceptBreakdown, nil
 }
-func (h dummyConceptDataModel) RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, breakdownConceptId int64) ([]*models.ConceptBreakdown, error) {
+func (h dummyConceptDataModel) RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, breakdownConceptId int64) ([]*models.ConceptBreakdown, error) {
 	conceptBreakdown := []*models.ConceptBreakdown{
 		{ConceptValue: "value1", NpersonsInCohortWithValue: 4 - len(filterCohortPairs)}, // simulate decreasing numbers as filter increases - the use of filterCohortPairs instead of filterConceptIds is otherwise meaningless here...
 		{ConceptValue: "value2", NpersonsInCohortWithValue: 7 - len(filterConceptIds)},  // simulate decreasing numbers as filter increases- the use of filterConceptIds instead of filterCohortPairs is otherwise meaningless here...
@@ -282,7 +427,7 @@ func (h dummyConceptDataModel) RetrieveBreakdownStatsBySourceIdAndCohortIdAndCon
 
 type dummyDataDictionaryModel struct{}
 
-func (h dummyDataDictionaryModel) GetDataDictionary() (*models.DataDictionaryModel, error) {
+func (h dummyDataDictionaryModel) GetDataDictionary(ctx context.Context) (*models.DataDictionaryModel, error) {
 	data := new(models.DataDictionaryModel)
 	data.Total = 2
 	entries := []*models.DataDictionaryEntry{
@@ -298,15 +443,157 @@ func (h dummyDataDictionaryModel) GetDataDictionary() (*models.DataDictionaryMod
 	return data, nil
 }
 
-func (h dummyDataDictionaryModel) GenerateDataDictionary() {}
+func (h dummyDataDictionaryModel) SearchDataDictionary(ctx context.Context, query models.DataDictionaryQuery) (*models.DataDictionaryPage, error) {
+	lastDataDictionaryQuery = query
+	return &models.DataDictionaryPage{Total: 2, TotalEntries: 2, Page: query.Page, PageSize: query.PageSize,
+		Data: []*models.DataDictionaryResult{
+			{VocabularyID: "Measurement", ConceptID: 2000006885, ConceptCode: "F", ConceptName: "F", ConceptClassId: "MVP Continuous", ValueStoredAs: "Number",
+				MinValue: 1.16, MaxValue: 9.52, ValueSummary: json.RawMessage(`[{"start":1.16,"end":4.72,"personCount":4},{"start":4.72,"end":8.28,"personCount":7}]`)},
+			{VocabularyID: "Person", ConceptID: 2000007027, ConceptCode: "HARE_CODE", ConceptName: "HARE", ConceptClassId: "MVP Ordinal", ValueStoredAs: "Concept Id",
+				ValueSummary: json.RawMessage(`[{"name":"non-Hispanic Black","personCount":4,"valueAsString":"AFR","valueAsConceptID":2000007030},` +
+					`{"name":"Hispanic, Latino","personCount":2,"valueAsString":"HIS","valueAsConceptID":2000007028},` +
+					`{"name":"","personCount":1,"valueAsString":"","valueAsConceptID":0}]`)},
+		}}, nil
+}
+
+func (h dummyDataDictionaryModel) GetCohortDataDictionary(ctx context.Context, sourceId int, cohortDefinitionId int) (*models.CohortDataDictionaryModel, error) {
+	return &models.CohortDataDictionaryModel{SourceId: sourceId, CohortDefinitionId: cohortDefinitionId, Total: 10,
+		Data: []*models.DataDictionaryResult{{ConceptID: 2000006885, NumberOfPeopleWithVariable: 8, ValueStoredAs: "Number"}}}, nil
+}
+
+// the last query passed to dummyDataDictionaryModel.SearchDataDictionary:
+var lastDataDictionaryQuery models.DataDictionaryQuery
+
+func (h dummyDataDictionaryModel) GenerateDataDictionary(mode models.DataDictionaryGenerationMode) error {
+	return nil
+}
+
+func (h dummyDataDictionaryModel) StartDataDictionaryGeneration(mode models.DataDictionaryGenerationMode) (*models.DataDictionaryGenerationRun, error) {
+	return &models.DataDictionaryGenerationRun{RunID: 1, Mode: mode, Status: models.DataDictionaryGenerationQueued}, nil
+}
+
+func (h dummyDataDictionaryModel) RefreshDataDictionaryConcept(ctx context.Context, conceptId int64) (*models.DataDictionaryResult, error) {
+	if conceptId != 2000006885 {
+		return nil, models.ErrConceptNotInDataDictionary
+	}
+	return &models.DataDictionaryResult{ConceptID: conceptId, ValueStoredAs: "Number"}, nil
+}
+
+func (h dummyDataDictionaryModel) GetDataDictionaryGenerationRun() *models.DataDictionaryGenerationRun {
+	return &models.DataDictionaryGenerationRun{RunID: 1, Status: models.DataDictionaryGenerationRunning, TotalConcepts: 2, ProcessedConcepts: 1}
+}
+
+func (h dummyDataDictionaryModel) GetDataDictionarySnapshots(ctx context.Context) ([]*models.DataDictionarySnapshot, error) {
+	return []*models.DataDictionarySnapshot{{SnapshotID: 2, NumberOfConcepts: 2}, {SnapshotID: 1, NumberOfConcepts: 1}}, nil
+}
+
+func (h dummyDataDictionaryModel) DiffDataDictionarySnapshots(ctx context.Context, fromSnapshotId int64, toSnapshotId int64, threshold float64) (*models.DataDictionarySnapshotDiff, error) {
+	if fromSnapshotId > 2 || toSnapshotId > 2 {
+		return nil, models.ErrDataDictionarySnapshotNotFound
+	}
+	return &models.DataDictionarySnapshotDiff{FromSnapshot: &models.DataDictionarySnapshot{SnapshotID: fromSnapshotId},
+		ToSnapshot: &models.DataDictionarySnapshot{SnapshotID: toSnapshotId}, Threshold: threshold,
+		AddedConcepts: []models.DataDictionarySnapshotConcept{{ConceptID: 2000007027}}}, nil
+}
 
 type dummyFailingDataDictionaryModel struct{}
 
-func (h dummyFailingDataDictionaryModel) GetDataDictionary() (*models.DataDictionaryModel, error) {
-	return nil, errors.New("data dictionary is not available yet")
+func (h dummyFailingDataDictionaryModel) GetDataDictionary(ctx context.Context) (*models.DataDictionaryModel, error) {
+	return nil, models.ErrDataDictionaryNotAvailable
 }
 
-func (h dummyFailingDataDictionaryModel) GenerateDataDictionary() {}
+func (h dummyFailingDataDictionaryModel) SearchDataDictionary(ctx context.Context, query models.DataDictionaryQuery) (*models.DataDictionaryPage, error) {
+	return nil, models.ErrDataDictionaryNotAvailable
+}
+
+func (h dummyFailingDataDictionaryModel) GenerateDataDictionary(mode models.DataDictionaryGenerationMode) error {
+	return models.ErrDataDictionaryGenerationInProgress
+}
+
+func (h dummyFailingDataDictionaryModel) StartDataDictionaryGeneration(mode models.DataDictionaryGenerationMode) (*models.DataDictionaryGenerationRun, error) {
+	return nil, models.ErrDataDictionaryGenerationInProgress
+}
+
+func (h dummyFailingDataDictionaryModel) RefreshDataDictionaryConcept(ctx context.Context, conceptId int64) (*models.DataDictionaryResult, error) {
+	return nil, models.ErrDataDictionaryGenerationInProgress
+}
+
+func (h dummyFailingDataDictionaryModel) GetDataDictionaryGenerationRun() *models.DataDictionaryGenerationRun {
+	return nil
+}
+
+func (h dummyFailingDataDictionaryModel) GetCohortDataDictionary(ctx context.Context, sourceId int, cohortDefinitionId int) (*models.CohortDataDictionaryModel, error) {
+	return nil, models.ErrCohortNotGenerated
+}
+
+func (h dummyFailingDataDictionaryModel) GetDataDictionarySnapshots(ctx context.Context) ([]*models.DataDictionarySnapshot, error) {
+	return nil, errors.New("data dictionary snapshots are not available")
+}
+
+func (h dummyFailingDataDictionaryModel) DiffDataDictionarySnapshots(ctx context.Context, fromSnapshotId int64, toSnapshotId int64, threshold float64) (*models.DataDictionarySnapshotDiff, error) {
+	return nil, errors.New("data dictionary snapshots are not available")
+}
+
+// Fails with the (wrapped) error of a data source that cannot be used:
+type dummyDataSourceErrorDataDictionaryModel struct {
+	dummyFailingDataDictionaryModel
+	err error
+}
+
+func (h dummyDataSourceErrorDataDictionaryModel) SearchDataDictionary(ctx context.Context, query models.DataDictionaryQuery) (*models.DataDictionaryPage, error) {
+	return nil, fmt.Errorf("searching data dictionary: %w", h.err)
+}
+
+func (h dummyDataSourceErrorDataDictionaryModel) GetDataDictionarySnapshots(ctx context.Context) ([]*models.DataDictionarySnapshot, error) {
+	return nil, fmt.Errorf("getting snapshots: %w", h.err)
+}
+
+func (h dummyDataSourceErrorDataDictionaryModel) DiffDataDictionarySnapshots(ctx context.Context, fromSnapshotId int64, toSnapshotId int64, threshold float64) (*models.DataDictionarySnapshotDiff, error) {
+	return nil, fmt.Errorf("getting snapshot %d: %w", fromSnapshotId, h.err)
+}
+
+func (h dummyDataSourceErrorDataDictionaryModel) RefreshDataDictionaryConcept(ctx context.Context, conceptId int64) (*models.DataDictionaryResult, error) {
+	return nil, fmt.Errorf("refreshing concept %d: %w", conceptId, h.err)
+}
+
+type dummyDataQualityModel struct{}
+
+func (h dummyDataQualityModel) RunDataQualityChecks(ctx context.Context, sourceId int) (*models.DataQualityReport, error) {
+	return h.GetDataQualityReport(ctx, sourceId)
+}
+
+func (h dummyDataQualityModel) GetDataQualityReport(ctx context.Context, sourceId int) (*models.DataQualityReport, error) {
+	if sourceId != tests.GetTestSourceId() {
+		return nil, models.ErrDataQualityReportNotFound
+	}
+	return &models.DataQualityReport{SourceId: sourceId, Results: []*models.DataQualityRuleResult{
+		{RuleName: "single_hare", RuleType: models.DataQualityRuleUniquePerPerson, ViolationCount: 2, SampleIds: []int64{1, 2}},
+		{RuleName: "cohort_subjects_in_person", RuleType: models.DataQualityRuleCohortSubjectInPerson, SampleIds: []int64{}},
+	}}, nil
+}
+
+// Fails with the error of a data source that cannot be opened:
+type dummyDataSourceErrorDataQualityModel struct {
+	err error
+}
+
+func (h dummyDataSourceErrorDataQualityModel) RunDataQualityChecks(ctx context.Context, sourceId int) (*models.DataQualityReport, error) {
+	return nil, h.err
+}
+
+func (h dummyDataSourceErrorDataQualityModel) GetDataQualityReport(ctx context.Context, sourceId int) (*models.DataQualityReport, error) {
+	return nil, fmt.Errorf("%w: source %d", h.err, sourceId)
+}
+
+type dummyFailingDataQualityModel struct{}
+
+func (h dummyFailingDataQualityModel) RunDataQualityChecks(ctx context.Context, sourceId int) (*models.DataQualityReport, error) {
+	return nil, errors.New("error running data quality checks")
+}
+
+func (h dummyFailingDataQualityModel) GetDataQualityReport(ctx context.Context, sourceId int) (*models.DataQualityReport, error) {
+	return nil, errors.New("error retrieving data quality report")
+}
 
 func TestRetrieveHistogramForCohortIdAndConceptIdWithWrongParams(t *testing.T) {
 	setUp(t)
@@ -491,6 +778,77 @@ func TestGenerateCSV(t *testing.T) {
 	}
 }
 
+func TestSearchCohortDefinitions(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "team-project=teamprojectX&search=diabetes&sort=name&page=2&page-size=10&include-ungenerated=true"
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	cohortDefinitionController.SearchCohortDefinitions(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var cohortDefinitionPage models.CohortDefinitionPage
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &cohortDefinitionPage)
+	if result.StatusCode != 200 || cohortDefinitionPage.Page != 2 || cohortDefinitionPage.PageSize != 10 ||
+		cohortDefinitionPage.TotalEntries != 2 || len(cohortDefinitionPage.Data) != 2 {
+		t.Errorf("Expected the second page of 10 entries with the ungenerated cohorts, found %v", result.CustomResponseWriterOut)
+	}
+	// the cohorts of the global reader role should be included:
+	globalReaderRole := config.GetConfig().GetString("global_reader_role")
+	if len(cohortDefinitionPage.Data) > 0 && (cohortDefinitionPage.Data[0].Name != "teamprojectX,"+globalReaderRole ||
+		cohortDefinitionPage.Data[0].Description != "diabetes name false") {
+		t.Errorf("Unexpected query %v", cohortDefinitionPage.Data[0])
+	}
+
+	// by default, the cohorts are sorted by size descending and the ungenerated ones are left out:
+	requestContext = new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "team-project=teamprojectX"
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	cohortDefinitionController.SearchCohortDefinitions(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	cohortDefinitionPage = models.CohortDefinitionPage{}
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &cohortDefinitionPage)
+	if result.StatusCode != 200 || cohortDefinitionPage.Page != 1 || cohortDefinitionPage.PageSize != 50 ||
+		len(cohortDefinitionPage.Data) != 1 || cohortDefinitionPage.Data[0].Description != " size true" {
+		t.Errorf("Expected the first page of 50 entries sorted by size, found %v", result.CustomResponseWriterOut)
+	}
+}
+
+func TestSearchCohortDefinitionsErrors(t *testing.T) {
+	setUp(t)
+	testCases := []struct {
+		controller     controllers.CohortDefinitionController
+		sourceId       string
+		rawQuery       string
+		modelError     bool
+		expectedStatus int
+	}{
+		{cohortDefinitionController, "a", "team-project=teamprojectX", false, 400},
+		{cohortDefinitionController, "1", "", false, 400},
+		{cohortDefinitionController, "1", "team-project=teamprojectX&sort=-id", false, 400},
+		{cohortDefinitionController, "1", "team-project=teamprojectX&page=0", false, 400},
+		{cohortDefinitionController, "1", "team-project=teamprojectX&page-size=1001", false, 400},
+		{cohortDefinitionController, "1", "team-project=teamprojectX&include-ungenerated=maybe", false, 400},
+		{cohortDefinitionControllerWithFailingTeamProjectAuthz, "1", "team-project=teamprojectX", false, 403},
+		{cohortDefinitionController, "1", "team-project=teamprojectX", true, 500},
+	}
+	for _, testCase := range testCases {
+		dummyModelReturnError = testCase.modelError
+		requestContext := new(gin.Context)
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: testCase.sourceId})
+		requestContext.Request = &http.Request{URL: &url.URL{}}
+		requestContext.Request.URL.RawQuery = testCase.rawQuery
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		testCase.controller.SearchCohortDefinitions(requestContext)
+		result := requestContext.Writer.(*tests.CustomResponseWriter)
+		if result.StatusCode != testCase.expectedStatus || !requestContext.IsAborted() {
+			t.Errorf("Expected query %s to fail with %d, found %v", testCase.rawQuery, testCase.expectedStatus, result.StatusCode)
+		}
+	}
+}
+
 func TestRetriveStatsBySourceIdAndTeamProjectWrongParams(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
@@ -614,6 +972,72 @@ func TestMakeUniqueListOfCohortStats(t *testing.T) {
 	}
 }
 
+func TestRetrieveExpressionById(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Request = new(http.Request)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "id", Value: "1"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	cohortDefinitionController.RetrieveExpressionById(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var response struct {
+		CohortExpression map[string]json.RawMessage `json:"cohort_expression"`
+		Summary          []string                   `json:"summary"`
+	}
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &response)
+	if result.StatusCode != 200 {
+		t.Fatalf("Expected the cohort expression, found %v", result.CustomResponseWriterOut)
+	}
+	expectedSummary := []string{
+		"Concept set 0 'diabetes': Type 2 diabetes mellitus (201826) and descendants",
+		"Entry events: ConditionOccurrence of concept set 'diabetes', with 365 days of observation before and 0 days after the event; " +
+			"limited to the earliest event per person",
+		"Inclusion rule 1: adults: all of demographic criteria on Age",
+		"Cohort exit: 30 days after the start date of the entry event",
+	}
+	if !reflect.DeepEqual(response.Summary, expectedSummary) {
+		t.Errorf("Expected summary %v, found %v", expectedSummary, response.Summary)
+	}
+	// the fields that are not part of the typed model should be kept as they were:
+	for _, expected := range []string{`"FutureAtlasField":{"someSetting":1}`, `"STANDARD_CONCEPT":"S"`, `"ConditionTypeExclude":false`,
+		`"DemographicCriteriaList":[{"Age":{"Value":18,"Op":"gte"}}]`} {
+		if !strings.Contains(result.CustomResponseWriterOut, expected) {
+			t.Errorf("Expected %s in %s", expected, result.CustomResponseWriterOut)
+		}
+	}
+	if string(response.CohortExpression["PrimaryCriteria"]) == "" || string(response.CohortExpression["FutureAtlasField"]) == "" {
+		t.Errorf("Expected the PrimaryCriteria and FutureAtlasField in the cohort expression")
+	}
+}
+
+func TestRetrieveExpressionByIdErrors(t *testing.T) {
+	setUp(t)
+	testCases := []struct {
+		controller     controllers.CohortDefinitionController
+		id             string
+		modelError     bool
+		expectedStatus int
+	}{
+		{cohortDefinitionController, "a", false, 400},
+		{cohortDefinitionControllerWithFailingTeamProjectAuthz, "1", false, 403},
+		{cohortDefinitionController, "404", false, 404},
+		{cohortDefinitionController, "500", false, 500},
+		{cohortDefinitionController, "1", true, 500},
+	}
+	for _, testCase := range testCases {
+		dummyModelReturnError = testCase.modelError
+		requestContext := new(gin.Context)
+		requestContext.Request = new(http.Request)
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "id", Value: testCase.id})
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		testCase.controller.RetrieveExpressionById(requestContext)
+		result := requestContext.Writer.(*tests.CustomResponseWriter)
+		if result.StatusCode != testCase.expectedStatus || !requestContext.IsAborted() {
+			t.Errorf("Expected id %s to fail with %d, found %v", testCase.id, testCase.expectedStatus, result.StatusCode)
+		}
+	}
+}
+
 func TestRetriveByIdWrongParam(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
@@ -629,6 +1053,7 @@ func TestRetriveByIdWrongParam(t *testing.T) {
 func TestRetriveById(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
+	requestContext.Request = new(http.Request)
 	requestContext.Params = append(requestContext.Params, gin.Param{Key: "id", Value: "1"})
 	requestContext.Writer = new(tests.CustomResponseWriter)
 	cohortDefinitionController.RetriveById(requestContext)
@@ -642,6 +1067,7 @@ func TestRetriveById(t *testing.T) {
 func TestRetriveByIdModelError(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
+	requestContext.Request = new(http.Request)
 	requestContext.Params = append(requestContext.Params, gin.Param{Key: "id", Value: "1"})
 	requestContext.Writer = new(tests.CustomResponseWriter)
 	// set flag to let mock model layer return error instead of mock data:
@@ -675,6 +1101,7 @@ func TestRetriveByIdAuthorizationError(t *testing.T) {
 func TestRetrieveBreakdownStatsBySourceIdAndCohortId(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
+	requestContext.Request = new(http.Request)
 	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: "1"})
 	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "1"})
 	requestContext.Params = append(requestContext.Params, gin.Param{Key: "breakdownconceptid", Value: "1"})
@@ -763,6 +1190,20 @@ func TestRetrieveInfoBySourceIdAndConceptIds(t *testing.T) {
 	}
 }
 
+func TestRetrieveInfoBySourceIdAndConceptIdsUnreachableSource(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(dummyUnreachableSourceId)})
+	requestContext.Request = new(http.Request)
+	requestContext.Request.Body = io.NopCloser(strings.NewReader("{\"ConceptIds\":[1234,5678]}"))
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	conceptController.RetrieveInfoBySourceIdAndConceptIds(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != http.StatusServiceUnavailable || !requestContext.IsAborted() {
+		t.Errorf("Expected 503 for an unreachable source, found %d", result.StatusCode)
+	}
+}
+
 func TestRetrieveInfoBySourceIdAndConceptTypes(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
@@ -920,7 +1361,7 @@ func TestGetAttritionRowForConceptIdsAndCohortPairs(t *testing.T) {
 			ProvidedName:        "testB34"},
 	}
 
-	result, _ := conceptController.GetAttritionRowForConceptIdsAndCohortPairs(sourceId, cohortId, conceptIdsAndCohortPairs, breakdownConceptId, sortedConceptValues)
+	result, _ := conceptController.GetAttritionRowForConceptIdsAndCohortPairs(context.Background(), sourceId, cohortId, conceptIdsAndCohortPairs, breakdownConceptId, sortedConceptValues)
 	if len(result) != len(conceptIdsAndCohortPairs) {
 		t.Errorf("Expected %d data lines, found %d lines in total",
 			len(conceptIdsAndCohortPairs),
@@ -944,6 +1385,16 @@ func TestGetAttritionRowForConceptIdsAndCohortPairs(t *testing.T) {
 	}
 }
 
+func TestGetAttritionRowForConceptIdOrCohortPairUnreachableSource(t *testing.T) {
+	setUp(t)
+	filterConceptIdsAndCohortPairs := []interface{}{int64(1234)}
+	_, err := conceptController.GetAttritionRowForConceptIdOrCohortPair(context.Background(), dummyUnreachableSourceId, 1, int64(1234),
+		filterConceptIdsAndCohortPairs, 1, []string{"value1"})
+	if !errors.Is(err, models.ErrSourceConnectionFailed) {
+		t.Errorf("Expected the error to wrap ErrSourceConnectionFailed, found %v", err)
+	}
+}
+
 func TestGenerateCompleteCSV(t *testing.T) {
 	setUp(t)
 
@@ -1020,7 +1471,7 @@ func TestRetrievePeopleIdAndCohort(t *testing.T) {
 		},
 	}
 
-	res, _ := cohortDataController.RetrievePeopleIdAndCohort(testSourceId, cohortId, cohortPairs, cohortData)
+	res, _ := cohortDataController.RetrievePeopleIdAndCohort(context.Background(), testSourceId, cohortId, cohortPairs, cohortData)
 	for expectedPersonId, headerToCSVValue := range expectedResults {
 		if res[expectedPersonId]["2_3"] != headerToCSVValue["2_3"] {
 			t.Errorf("expected %v for csv value but instead got %v", headerToCSVValue["2_3"], res[expectedPersonId]["2_3"])
@@ -1028,6 +1479,18 @@ func TestRetrievePeopleIdAndCohort(t *testing.T) {
 	}
 }
 
+func TestRetrievePeopleIdAndCohortUnreachableSource(t *testing.T) {
+	cohortPairs := []utils.CustomDichotomousVariableDef{
+		{CohortDefinitionId1: 2, CohortDefinitionId2: 3, ProvidedName: "test"},
+	}
+	cohortData := []*models.PersonConceptAndValue{{PersonId: 1}}
+
+	_, err := cohortDataController.RetrievePeopleIdAndCohort(context.Background(), dummyUnreachableSourceId, 1, cohortPairs, cohortData)
+	if !errors.Is(err, models.ErrSourceConnectionFailed) {
+		t.Errorf("Expected the error to wrap ErrSourceConnectionFailed, found %v", err)
+	}
+}
+
 func TestRetrievePeopleIdAndCohortNonExistingCohortPair(t *testing.T) {
 	cohortId := 1
 	cohortPairs := []utils.CustomDichotomousVariableDef{
@@ -1061,7 +1524,7 @@ func TestRetrievePeopleIdAndCohortNonExistingCohortPair(t *testing.T) {
 		},
 	}
 
-	res, _ := cohortDataController.RetrievePeopleIdAndCohort(testSourceId, cohortId, cohortPairs, cohortData)
+	res, _ := cohortDataController.RetrievePeopleIdAndCohort(context.Background(), testSourceId, cohortId, cohortPairs, cohortData)
 	for expectedPersonId, headerToCSVValue := range expectedResults {
 		if res[expectedPersonId]["4_5"] != headerToCSVValue["4_5"] {
 			t.Errorf("expected %v for csv value but instead got %v", headerToCSVValue["4_5"], res[expectedPersonId]["4_5"])
@@ -1102,7 +1565,7 @@ func TestRetrievePeopleIdAndCohortOverlappingCohortPair(t *testing.T) {
 		},
 	}
 
-	res, _ := cohortDataController.RetrievePeopleIdAndCohort(testSourceId, cohortId, cohortPairs, cohortData)
+	res, _ := cohortDataController.RetrievePeopleIdAndCohort(context.Background(), testSourceId, cohortId, cohortPairs, cohortData)
 	for expectedPersonId, headerToCSVValue := range expectedResults {
 		if res[expectedPersonId]["1_1"] != headerToCSVValue["1_1"] {
 			t.Errorf("expected %v for csv value but instead got %v", headerToCSVValue["1_1"], res[expectedPersonId]["1_1"])
@@ -1160,7 +1623,7 @@ func TestRetrieveDataDictionary(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
 	requestContext.Writer = new(tests.CustomResponseWriter)
-	requestContext.Request = new(http.Request)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
 	cohortDataController.RetrieveDataDictionary(requestContext)
 
 	result := requestContext.Writer.(*tests.CustomResponseWriter)
@@ -1175,7 +1638,7 @@ func TestFailingRetrieveDataDictionary(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
 	requestContext.Writer = new(tests.CustomResponseWriter)
-	requestContext.Request = new(http.Request)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
 	cohortDataControllerWithFailingDataDictionary.RetrieveDataDictionary(requestContext)
 
 	result := requestContext.Writer.(*tests.CustomResponseWriter)
@@ -1186,17 +1649,921 @@ func TestFailingRetrieveDataDictionary(t *testing.T) {
 
 }
 
-func TestGenerateDataDictionary(t *testing.T) {
+func TestRetrieveDataDictionaryWithoutSearchParamsReturnsFullDictionary(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
 	requestContext.Writer = new(tests.CustomResponseWriter)
-	requestContext.Request = new(http.Request)
-	cohortDataController.GenerateDataDictionary(requestContext)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	cohortDataController.RetrieveDataDictionary(requestContext)
 
 	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	expected, _ := dummyDataDictionaryModel{}.GetDataDictionary(context.Background())
+	var dataDictionary models.DataDictionaryModel
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &dataDictionary)
+	if result.StatusCode != 200 || dataDictionary.Total != expected.Total || string(dataDictionary.Data) != string(expected.Data) {
+		t.Errorf("Expected the full data dictionary, found %v", result.CustomResponseWriterOut)
+	}
+}
+
+func TestRetrieveDataDictionaryWithSearchParams(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "search=hare&vocabulary-id=Person,Measurement&concept-class-id=MVP+Ordinal" +
+		"&value-stored-as=Concept+Id&min-population=10&sort=-numberOfPeopleWithVariable&page=2&page-size=20"
+	cohortDataController.RetrieveDataDictionary(requestContext)
 
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
 	if result.StatusCode != 200 {
-		t.Errorf("Expected request to succeed")
+		t.Errorf("Expected request to succeed, found %v", result.StatusCode)
+	}
+	expectedQuery := models.DataDictionaryQuery{
+		Search:          "hare",
+		VocabularyIDs:   []string{"Person", "Measurement"},
+		ConceptClassIDs: []string{"MVP Ordinal"},
+		ValueStoredAs:   "Concept Id",
+		MinPopulation:   10,
+		SortBy:          "numberOfPeopleWithVariable",
+		SortDescending:  true,
+		Page:            2,
+		PageSize:        20,
+	}
+	if !reflect.DeepEqual(lastDataDictionaryQuery, expectedQuery) {
+		t.Errorf("Expected query %v, found %v", expectedQuery, lastDataDictionaryQuery)
+	}
+	var page models.DataDictionaryPage
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &page)
+	if page.TotalEntries != 2 || len(page.Data) != 2 || page.Page != 2 || page.PageSize != 20 {
+		t.Errorf("Expected a page of data dictionary entries, found %v", result.CustomResponseWriterOut)
+	}
+
+	// only pagination params, so the defaults should be used for the rest:
+	requestContext = new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "page=1"
+	cohortDataController.RetrieveDataDictionary(requestContext)
+	expectedQuery = models.DataDictionaryQuery{Page: 1, PageSize: 50}
+	if !reflect.DeepEqual(lastDataDictionaryQuery, expectedQuery) {
+		t.Errorf("Expected query %v, found %v", expectedQuery, lastDataDictionaryQuery)
+	}
+}
+
+func TestRetrieveDataDictionaryWithInvalidSearchParams(t *testing.T) {
+	setUp(t)
+	for _, rawQuery := range []string{"page=0", "page=a", "page-size=100000", "min-population=-1", "sort=valueSummary", "sort=-"} {
+		requestContext := new(gin.Context)
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		requestContext.Request = &http.Request{URL: &url.URL{}}
+		requestContext.Request.URL.RawQuery = rawQuery
+		cohortDataController.RetrieveDataDictionary(requestContext)
+		result := requestContext.Writer.(*tests.CustomResponseWriter)
+		if result.StatusCode != 400 || !requestContext.IsAborted() {
+			t.Errorf("Expected request with %s to fail with 400, found %v", rawQuery, result.StatusCode)
+		}
+	}
+
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "search=hare"
+	cohortDataControllerWithFailingDataDictionary.RetrieveDataDictionary(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 503 {
+		t.Errorf("Expected request to fail with 503, found %v", result.StatusCode)
+	}
+}
+
+func TestRetrieveDataDictionaryAsCsv(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "format=csv"
+	cohortDataController.RetrieveDataDictionary(requestContext)
+
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	rows, err := csv.NewReader(strings.NewReader(result.CustomResponseWriterOut)).ReadAll()
+	if result.StatusCode != 200 || err != nil || len(rows) != 3 {
+		t.Errorf("Expected a CSV with a header and 2 rows, found %v and error %v", result.CustomResponseWriterOut, err)
+	}
+	expectedHeader := []string{"vocabularyID", "conceptID", "conceptCode", "conceptName", "conceptClassID",
+		"numberOfPeopleWithVariable", "numberOfPeopleWhereValueIsFilled", "numberOfPeopleWhereValueIsNull", "valueStoredAs",
+		"minValue", "maxValue", "meanValue", "standardDeviation", "valueSummary"}
+	if !reflect.DeepEqual(rows[0], expectedHeader) {
+		t.Errorf("Expected header %v, found %v", expectedHeader, rows[0])
+	}
+	if rows[1][1] != "2000006885" || rows[1][9] != "1.16" || rows[2][8] != "Concept Id" {
+		t.Errorf("Unexpected data dictionary rows %v", rows[1:])
+	}
+}
+
+func TestRetrieveDataDictionaryAsXlsx(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "format=xlsx&page=1"
+	cohortDataController.RetrieveDataDictionary(requestContext)
+
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 200 {
+		t.Errorf("Expected request to succeed, found %v: %v", result.StatusCode, result.CustomResponseWriterOut)
+	}
+	workbook, err := excelize.OpenReader(strings.NewReader(result.CustomResponseWriterOut))
+	if err != nil {
+		t.Fatalf("Expected a valid workbook, found error %v", err)
+	}
+	if !reflect.DeepEqual(workbook.GetSheetList(), []string{"Variables", "Value Summaries"}) {
+		t.Errorf("Unexpected sheets %v", workbook.GetSheetList())
+	}
+	variables, _ := workbook.GetRows("Variables")
+	if len(variables) != 3 || variables[2][3] != "HARE" {
+		t.Errorf("Expected a header and 2 variables, found %v", variables)
+	}
+	// 2 histogram bins and 3 nominal values:
+	valueSummaries, _ := workbook.GetRows("Value Summaries")
+	if len(valueSummaries) != 6 || valueSummaries[1][5] != "1.16" || valueSummaries[3][3] != "non-Hispanic Black" {
+		t.Errorf("Expected a header and 5 value summary rows, found %v", valueSummaries)
+	}
+}
+
+func TestRetrieveDataDictionaryAsCodebook(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "format=codebook&page=1"
+	cohortDataController.RetrieveDataDictionary(requestContext)
+
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	rows, err := csv.NewReader(strings.NewReader(result.CustomResponseWriterOut)).ReadAll()
+	if result.StatusCode != 200 || err != nil || len(rows) != 3 {
+		t.Fatalf("Expected a codebook with a header and 2 rows, found %v and error %v", result.CustomResponseWriterOut, err)
 	}
+	expectedNumericRow := []string{"id_2000006885", "data_dictionary", "", "text", "F", "", "Measurement F (MVP Continuous)", "number", "1.16", "9.52"}
+	if !reflect.DeepEqual(rows[1], expectedNumericRow) {
+		t.Errorf("Expected %v, found %v", expectedNumericRow, rows[1])
+	}
+	expectedNominalRow := []string{"id_2000007027", "data_dictionary", "", "radio", "HARE",
+		"2000007030, non-Hispanic Black | 2000007028, Hispanic  Latino | 0, No value", "Person HARE_CODE (MVP Ordinal)", "", "", ""}
+	if !reflect.DeepEqual(rows[2], expectedNominalRow) {
+		t.Errorf("Expected %v, found %v", expectedNominalRow, rows[2])
+	}
+}
+
+func TestRetrieveDataDictionaryWithInvalidFormat(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "format=pdf"
+	cohortDataController.RetrieveDataDictionary(requestContext)
+
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 400 || !requestContext.IsAborted() {
+		t.Errorf("Expected request to fail with 400, found %v", result.StatusCode)
+	}
+}
 
+func TestRetrieveCohortDataDictionary(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "4"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	cohortDataController.RetrieveCohortDataDictionary(requestContext)
+
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var cohortDataDictionary models.CohortDataDictionaryModel
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &cohortDataDictionary)
+	if result.StatusCode != 200 || cohortDataDictionary.CohortDefinitionId != 4 || len(cohortDataDictionary.Data) != 1 {
+		t.Errorf("Expected the data dictionary of cohort 4, found %v", result.CustomResponseWriterOut)
+	}
+}
+
+func TestRetrieveCohortDataDictionaryErrors(t *testing.T) {
+	setUp(t)
+	// wrong params:
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: "a"})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "4"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	cohortDataController.RetrieveCohortDataDictionary(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 400 || !requestContext.IsAborted() {
+		t.Errorf("Expected request to fail with 400, found %v", result.StatusCode)
+	}
+
+	// no access to the cohort:
+	requestContext = new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "4"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	cohortDataControllerWithFailingTeamProjectAuthz.RetrieveCohortDataDictionary(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 403 || !requestContext.IsAborted() {
+		t.Errorf("Expected request to fail with 403, found %v", result.StatusCode)
+	}
+
+	// cohort not generated:
+	requestContext = new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "4"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	cohortDataControllerWithFailingDataDictionary.RetrieveCohortDataDictionary(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 404 || !requestContext.IsAborted() {
+		t.Errorf("Expected request to fail with 404, found %v", result.StatusCode)
+	}
+}
+
+func TestRetrieveDataDictionarySnapshots(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	cohortDataController.RetrieveDataDictionarySnapshots(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var response struct {
+		Snapshots []*models.DataDictionarySnapshot `json:"snapshots"`
+	}
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &response)
+	if result.StatusCode != 200 || len(response.Snapshots) != 2 || response.Snapshots[0].SnapshotID != 2 {
+		t.Errorf("Expected the two snapshots, found %v", result.CustomResponseWriterOut)
+	}
+
+	requestContext = new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	cohortDataControllerWithFailingDataDictionary.RetrieveDataDictionarySnapshots(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 500 || !requestContext.IsAborted() {
+		t.Errorf("Expected request to fail with 500, found %v", result.StatusCode)
+	}
+}
+
+func TestDiffDataDictionarySnapshots(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "fromsnapshotid", Value: "1"})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "tosnapshotid", Value: "2"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "threshold=0.25"
+	cohortDataController.DiffDataDictionarySnapshots(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var response struct {
+		Diff models.DataDictionarySnapshotDiff `json:"diff"`
+	}
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &response)
+	if result.StatusCode != 200 || response.Diff.Threshold != 0.25 || response.Diff.FromSnapshot.SnapshotID != 1 ||
+		response.Diff.ToSnapshot.SnapshotID != 2 || len(response.Diff.AddedConcepts) != 1 {
+		t.Errorf("Expected the diff of snapshots 1 and 2, found %v", result.CustomResponseWriterOut)
+	}
+
+	// default threshold:
+	requestContext = new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "fromsnapshotid", Value: "1"})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "tosnapshotid", Value: "2"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	cohortDataController.DiffDataDictionarySnapshots(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &response)
+	if result.StatusCode != 200 || response.Diff.Threshold != 0.1 {
+		t.Errorf("Expected the default threshold of 0.1, found %v", result.CustomResponseWriterOut)
+	}
+}
+
+func TestDiffDataDictionarySnapshotsErrors(t *testing.T) {
+	setUp(t)
+	testCases := []struct {
+		fromSnapshotId string
+		toSnapshotId   string
+		rawQuery       string
+		expectedStatus int
+	}{
+		{"a", "2", "", 400},
+		{"1", "", "", 400},
+		{"1", "2", "threshold=abc", 400},
+		{"1", "2", "threshold=-1", 400},
+		{"1", "3", "", 404},
+	}
+	for _, testCase := range testCases {
+		requestContext := new(gin.Context)
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "fromsnapshotid", Value: testCase.fromSnapshotId})
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "tosnapshotid", Value: testCase.toSnapshotId})
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		requestContext.Request = &http.Request{URL: &url.URL{}}
+		requestContext.Request.URL.RawQuery = testCase.rawQuery
+		cohortDataController.DiffDataDictionarySnapshots(requestContext)
+		result := requestContext.Writer.(*tests.CustomResponseWriter)
+		if result.StatusCode != testCase.expectedStatus || !requestContext.IsAborted() {
+			t.Errorf("Expected request %v to fail with %d, found %v", testCase, testCase.expectedStatus, result.StatusCode)
+		}
+	}
+
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "fromsnapshotid", Value: "1"})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "tosnapshotid", Value: "2"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	cohortDataControllerWithFailingDataDictionary.DiffDataDictionarySnapshots(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 500 || !requestContext.IsAborted() {
+		t.Errorf("Expected request to fail with 500, found %v", result.StatusCode)
+	}
+}
+
+func TestDataDictionaryDataSourceErrors(t *testing.T) {
+	setUp(t)
+	testCases := []struct {
+		err            error
+		expectedStatus int
+	}{
+		{models.ErrSourceNotFound, 404},
+		{models.ErrSourceDaimonNotConfigured, 404},
+		{models.ErrSourceConnectionFailed, 503},
+	}
+	for _, testCase := range testCases {
+		controller := controllers.NewCohortDataController(*new(dummyCohortDataModel), dummyDataSourceErrorDataDictionaryModel{err: testCase.err}, *new(dummyTeamProjectAuthz))
+		endpoints := map[string]func(c *gin.Context){
+			"search":    controller.RetrieveDataDictionary,
+			"snapshots": controller.RetrieveDataDictionarySnapshots,
+			"diff":      controller.DiffDataDictionarySnapshots,
+			"refresh":   controller.RefreshDataDictionaryConcept,
+		}
+		for name, endpoint := range endpoints {
+			requestContext := new(gin.Context)
+			requestContext.Params = append(requestContext.Params, gin.Param{Key: "fromsnapshotid", Value: "1"})
+			requestContext.Params = append(requestContext.Params, gin.Param{Key: "tosnapshotid", Value: "2"})
+			requestContext.Params = append(requestContext.Params, gin.Param{Key: "conceptid", Value: "2000006885"})
+			requestContext.Writer = new(tests.CustomResponseWriter)
+			requestContext.Request = &http.Request{URL: &url.URL{RawQuery: "search=hare"}}
+			endpoint(requestContext)
+			result := requestContext.Writer.(*tests.CustomResponseWriter)
+			if result.StatusCode != testCase.expectedStatus || !requestContext.IsAborted() {
+				t.Errorf("Expected %s to fail with %d for error %v, found %v", name, testCase.expectedStatus, testCase.err, result.StatusCode)
+			}
+		}
+	}
+}
+
+func TestRetrieveInclusionRuleAttrition(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Request = new(http.Request)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "1"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	cohortDataController.RetrieveInclusionRuleAttrition(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var response struct {
+		InclusionRuleAttrition models.CohortInclusionAttrition `json:"inclusion_rule_attrition"`
+	}
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &response)
+	if result.StatusCode != 200 || response.InclusionRuleAttrition.BaseCount != 15 || len(response.InclusionRuleAttrition.InclusionRules) != 2 {
+		t.Errorf("Expected the inclusion rule attrition, found %v", result.CustomResponseWriterOut)
+	}
+}
+
+func TestRetrieveInclusionRuleAttritionCSV(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Request = new(http.Request)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "1"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	cohortDataController.RetrieveInclusionRuleAttritionCSV(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	rows, _ := csv.NewReader(strings.NewReader(result.CustomResponseWriterOut)).ReadAll()
+	expectedRows := [][]string{
+		{"Cohort", "Size"},
+		{"test cohort", "15"},
+		{"adults", "12"},
+		{"Inclusion rule 2", "10"},
+	}
+	if result.StatusCode != 200 || !reflect.DeepEqual(rows, expectedRows) {
+		t.Errorf("Expected %v, found %v", expectedRows, result.CustomResponseWriterOut)
+	}
+}
+
+func TestRetrieveInclusionRuleAttritionErrors(t *testing.T) {
+	setUp(t)
+	testCases := []struct {
+		controller     controllers.CohortDataController
+		cohortId       string
+		modelError     bool
+		expectedStatus int
+	}{
+		{cohortDataController, "a", false, 400},
+		{cohortDataControllerWithFailingTeamProjectAuthz, "1", false, 403},
+		{cohortDataController, "404", false, 404},
+		{cohortDataController, "1", true, 500},
+	}
+	for _, testCase := range testCases {
+		for _, retrieve := range []func(controllers.CohortDataController, *gin.Context){
+			controllers.CohortDataController.RetrieveInclusionRuleAttrition,
+			controllers.CohortDataController.RetrieveInclusionRuleAttritionCSV,
+		} {
+			dummyModelReturnError = testCase.modelError
+			requestContext := new(gin.Context)
+			requestContext.Request = new(http.Request)
+			requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: "1"})
+			requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: testCase.cohortId})
+			requestContext.Writer = new(tests.CustomResponseWriter)
+			retrieve(testCase.controller, requestContext)
+			result := requestContext.Writer.(*tests.CustomResponseWriter)
+			if result.StatusCode != testCase.expectedStatus || !requestContext.IsAborted() {
+				t.Errorf("Expected cohort %s to fail with %d, found %v", testCase.cohortId, testCase.expectedStatus, result.StatusCode)
+			}
+		}
+	}
+}
+
+func TestGenerateDataDictionary(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	cohortDataController.GenerateDataDictionary(requestContext)
+
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+
+	if result.StatusCode != 200 {
+		t.Errorf("Expected request to succeed")
+	}
+
+}
+
+func TestGenerateDataDictionaryAlreadyInProgress(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	cohortDataControllerWithFailingDataDictionary.GenerateDataDictionary(requestContext)
+
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+
+	if result.StatusCode != 409 {
+		t.Errorf("Expected request to Fail with 409")
+	}
+	if !requestContext.IsAborted() {
+		t.Errorf("Expected request to be aborted")
+	}
+}
+
+func TestRetrieveDataDictionaryGenerationStatus(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	cohortDataController.RetrieveDataDictionaryGenerationStatus(requestContext)
+
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+
+	if result.StatusCode != 200 {
+		t.Errorf("Expected request to succeed")
+	}
+	if !strings.Contains(result.CustomResponseWriterOut, "\"status\":\"running\"") ||
+		!strings.Contains(result.CustomResponseWriterOut, "\"processedConcepts\":1") {
+		t.Errorf("Expected generation run details in response, found %s", result.CustomResponseWriterOut)
+	}
+}
+
+func TestRetrieveDataDictionaryGenerationStatusNoRun(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	cohortDataControllerWithFailingDataDictionary.RetrieveDataDictionaryGenerationStatus(requestContext)
+
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+
+	if result.StatusCode != 404 {
+		t.Errorf("Expected request to Fail with 404")
+	}
+}
+
+func TestGenerateDataDictionaryWithMode(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "mode=incremental"
+	cohortDataController.GenerateDataDictionary(requestContext)
+
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 200 {
+		t.Errorf("Expected request to succeed")
+	}
+	if !strings.Contains(result.CustomResponseWriterOut, "\"mode\":\"incremental\"") {
+		t.Errorf("Expected incremental generation run, found %s", result.CustomResponseWriterOut)
+	}
+
+	// an unknown mode should be rejected:
+	requestContext = new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "mode=abc"
+	cohortDataController.GenerateDataDictionary(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 400 || !requestContext.IsAborted() {
+		t.Errorf("Expected request to fail with 400")
+	}
+
+	// a full generation is only started with POST:
+	for method, expectedStatusCode := range map[string]int{http.MethodGet: 405, http.MethodPost: 200} {
+		requestContext = new(gin.Context)
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		requestContext.Request = &http.Request{Method: method, URL: &url.URL{RawQuery: "mode=full"}}
+		cohortDataController.GenerateDataDictionary(requestContext)
+		result = requestContext.Writer.(*tests.CustomResponseWriter)
+		if result.StatusCode != expectedStatusCode {
+			t.Errorf("Expected %d for a full generation requested with %s, found %d", expectedStatusCode, method, result.StatusCode)
+		}
+	}
+}
+
+func TestRefreshDataDictionaryConcept(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "conceptid", Value: "2000006885"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	cohortDataController.RefreshDataDictionaryConcept(requestContext)
+
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 200 {
+		t.Errorf("Expected request to succeed")
+	}
+	if !strings.Contains(result.CustomResponseWriterOut, "\"conceptID\":2000006885") {
+		t.Errorf("Expected refreshed entry in response, found %s", result.CustomResponseWriterOut)
+	}
+}
+
+func TestRefreshDataDictionaryConceptErrors(t *testing.T) {
+	setUp(t)
+	testCases := []struct {
+		controller         controllers.CohortDataController
+		conceptId          string
+		expectedStatusCode int
+	}{
+		{cohortDataController, "abc", 400},
+		{cohortDataController, "123", 404},
+		{cohortDataControllerWithFailingDataDictionary, "2000006885", 409},
+	}
+	for _, testCase := range testCases {
+		requestContext := new(gin.Context)
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "conceptid", Value: testCase.conceptId})
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		requestContext.Request = new(http.Request)
+		testCase.controller.RefreshDataDictionaryConcept(requestContext)
+
+		result := requestContext.Writer.(*tests.CustomResponseWriter)
+		if result.StatusCode != testCase.expectedStatusCode || !requestContext.IsAborted() {
+			t.Errorf("Expected request for concept %s to fail with %d, found %d",
+				testCase.conceptId, testCase.expectedStatusCode, result.StatusCode)
+		}
+	}
+}
+
+func TestRetrieveDataQualityReport(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "source=" + strconv.Itoa(tests.GetTestSourceId())
+	controllers.NewDataQualityController(*new(dummyDataQualityModel)).RetrieveReport(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var response struct {
+		Report models.DataQualityReport `json:"report"`
+	}
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &response)
+	if result.StatusCode != 200 || len(response.Report.Results) != 2 || response.Report.Results[0].ViolationCount != 2 ||
+		len(response.Report.Results[0].SampleIds) != 2 {
+		t.Errorf("Expected the data quality report, found %v", result.CustomResponseWriterOut)
+	}
+}
+
+func TestRetrieveDataQualityReportErrors(t *testing.T) {
+	setUp(t)
+	testCases := []struct {
+		dataQualityModel models.DataQualityI
+		rawQuery         string
+		expectedStatus   int
+	}{
+		{*new(dummyDataQualityModel), "", 400},
+		{*new(dummyDataQualityModel), "source=abc", 400},
+		{*new(dummyDataQualityModel), "source=" + strconv.Itoa(tests.GetTestSourceId()+1), 404},
+		{*new(dummyFailingDataQualityModel), "source=" + strconv.Itoa(tests.GetTestSourceId()), 500},
+		{dummyDataSourceErrorDataQualityModel{models.ErrSourceNotFound}, "source=" + strconv.Itoa(tests.GetTestSourceId()), 404},
+		{dummyDataSourceErrorDataQualityModel{models.ErrSourceDaimonNotConfigured}, "source=" + strconv.Itoa(tests.GetTestSourceId()), 404},
+		{dummyDataSourceErrorDataQualityModel{models.ErrSourceConnectionFailed}, "source=" + strconv.Itoa(tests.GetTestSourceId()), 503},
+		{dummyDataSourceErrorDataQualityModel{models.ErrSourceSchemaInvalid}, "source=" + strconv.Itoa(tests.GetTestSourceId()), 503},
+		// a wrapped "not found" is still a 404:
+		{dummyDataSourceErrorDataQualityModel{models.ErrDataQualityReportNotFound}, "source=" + strconv.Itoa(tests.GetTestSourceId()), 404},
+	}
+	for _, testCase := range testCases {
+		requestContext := new(gin.Context)
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		requestContext.Request = &http.Request{URL: &url.URL{}}
+		requestContext.Request.URL.RawQuery = testCase.rawQuery
+		controllers.NewDataQualityController(testCase.dataQualityModel).RetrieveReport(requestContext)
+		result := requestContext.Writer.(*tests.CustomResponseWriter)
+		if result.StatusCode != testCase.expectedStatus || !requestContext.IsAborted() {
+			t.Errorf("Expected request with '%s' to fail with %d, found %v", testCase.rawQuery, testCase.expectedStatus, result.StatusCode)
+		}
+	}
+}
+
+func TestRetrieveCohortMembers(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "2"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	cohortDataController.RetrieveCohortMembers(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var response struct {
+		CohortMembers []*models.CohortMember `json:"cohort_members"`
+	}
+	err := json.Unmarshal([]byte(result.CustomResponseWriterOut), &response)
+	if err != nil || result.StatusCode != 200 || len(response.CohortMembers) != 2 || response.CohortMembers[1].SubjectId != 3 {
+		t.Errorf("Expected the 2 cohort members as JSON, found %v and error %v", result.CustomResponseWriterOut, err)
+	}
+
+	requestContext = new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "2"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestContext.Request.URL.RawQuery = "format=csv"
+	cohortDataController.RetrieveCohortMembers(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	expectedCSV := "subject_id,cohort_start_date,cohort_end_date\n2,2020-01-01,2099-01-01\n3,2020-01-01,2099-01-01\n"
+	if result.StatusCode != 200 || result.CustomResponseWriterOut != expectedCSV {
+		t.Errorf("Expected the 2 cohort members as CSV, found %v", result.CustomResponseWriterOut)
+	}
+}
+
+func TestRetrieveCohortMembersErrors(t *testing.T) {
+	setUp(t)
+	testCases := []struct {
+		controller     controllers.CohortDataController
+		sourceId       string
+		rawQuery       string
+		modelError     bool
+		expectedStatus int
+	}{
+		{cohortDataController, "a", "", false, 400},
+		{cohortDataController, strconv.Itoa(tests.GetTestSourceId()), "format=xlsx", false, 400},
+		{cohortDataControllerWithFailingTeamProjectAuthz, strconv.Itoa(tests.GetTestSourceId()), "", false, 403},
+		{cohortDataController, strconv.Itoa(tests.GetTestSourceId()), "format=csv", true, 500},
+	}
+	for _, testCase := range testCases {
+		dummyModelReturnError = testCase.modelError
+		requestContext := new(gin.Context)
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: testCase.sourceId})
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "2"})
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		requestContext.Request = &http.Request{URL: &url.URL{}}
+		requestContext.Request.URL.RawQuery = testCase.rawQuery
+		testCase.controller.RetrieveCohortMembers(requestContext)
+		result := requestContext.Writer.(*tests.CustomResponseWriter)
+		if result.StatusCode != testCase.expectedStatus || !requestContext.IsAborted() {
+			t.Errorf("Expected request %v to fail with %d, found %v", testCase, testCase.expectedStatus, result.StatusCode)
+		}
+	}
+}
+
+func TestRetrieveGenerationInfoById(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Request = new(http.Request)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "id", Value: "1"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	cohortDefinitionController.RetrieveGenerationInfoById(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var response struct {
+		CohortGenerationInfo []*models.CohortGenerationDetails `json:"cohort_generation_info"`
+	}
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &response)
+	if result.StatusCode != 200 || len(response.CohortGenerationInfo) != 2 || response.CohortGenerationInfo[0].ExecutionDuration != 1200 {
+		t.Errorf("Expected the generation info of 2 sources, found %v", result.CustomResponseWriterOut)
+	}
+}
+
+func TestRetrieveGenerationInfoByIdErrors(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Request = new(http.Request)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "id", Value: "abc"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	cohortDefinitionController.RetrieveGenerationInfoById(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 400 || !requestContext.IsAborted() {
+		t.Errorf("Expected request to fail with 400, found %v", result.StatusCode)
+	}
+
+	requestContext = new(gin.Context)
+	requestContext.Request = new(http.Request)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "id", Value: "1"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	cohortDefinitionControllerWithFailingTeamProjectAuthz.RetrieveGenerationInfoById(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 403 || !requestContext.IsAborted() {
+		t.Errorf("Expected request to fail with 403, found %v", result.StatusCode)
+	}
+
+	dummyModelReturnError = true
+	requestContext = new(gin.Context)
+	requestContext.Request = new(http.Request)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "id", Value: "1"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	cohortDefinitionController.RetrieveGenerationInfoById(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 500 || !requestContext.IsAborted() {
+		t.Errorf("Expected request to fail with 500, found %v", result.StatusCode)
+	}
+}
+
+func TestCreateCohortFromPersonIds(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	requestBody := `{"name": "uploaded cohort", "description": "curated list", "team_project": "teamprojectX", "person_ids": [1, 2, 3]}`
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	cohortDefinitionController.CreateCohortFromPersonIds(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var response struct {
+		CohortDefinition models.CohortDefinition `json:"cohort_definition"`
+	}
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &response)
+	if result.StatusCode != 201 || response.CohortDefinition.Id != 7 || response.CohortDefinition.Name != "uploaded cohort" {
+		t.Errorf("Expected the new cohort definition, found %v", result.CustomResponseWriterOut)
+	}
+
+	// the members can also be given with their cohort dates:
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestBody = `{"name": "uploaded cohort", "team_project": "teamprojectX", "members": [{"person_id": 1, "cohort_start_date": "2020-01-01", "cohort_end_date": "2020-12-31"}, {"person_id": 2}]}`
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	cohortDefinitionController.CreateCohortFromPersonIds(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 201 {
+		t.Errorf("Expected the new cohort definition, found %v", result.CustomResponseWriterOut)
+	}
+}
+
+func TestCreateCohortFromPersonIdsErrors(t *testing.T) {
+	setUp(t)
+	testCases := []struct {
+		controller     controllers.CohortDefinitionController
+		sourceId       string
+		requestBody    string
+		modelError     bool
+		expectedStatus int
+	}{
+		{cohortDefinitionController, "a", `{"name": "c", "team_project": "teamprojectX", "person_ids": [1]}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "person_ids": [1]`, false, 400},
+		{cohortDefinitionController, "1", `{"team_project": "teamprojectX", "person_ids": [1]}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "c", "person_ids": [1]}`, false, 400},
+		{cohortDefinitionControllerWithFailingTeamProjectAuthz, "1", `{"name": "c", "team_project": "teamprojectX", "person_ids": [1]}`, false, 403},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "person_ids": []}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "person_ids": [1, -1]}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "person_ids": [1, -2]}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "members": [{"person_id": 1, "cohort_start_date": "01/01/2020"}]}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "members": [{"person_id": 1, "cohort_start_date": "2020-01-01", "cohort_end_date": "2019-01-01"}]}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "existing cohort", "team_project": "teamprojectX", "person_ids": [1]}`, false, 409},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "person_ids": [1]}`, true, 500},
+	}
+	for _, testCase := range testCases {
+		dummyModelReturnError = testCase.modelError
+		requestContext := new(gin.Context)
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: testCase.sourceId})
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		requestContext.Request = new(http.Request)
+		requestContext.Request.Body = io.NopCloser(strings.NewReader(testCase.requestBody))
+		testCase.controller.CreateCohortFromPersonIds(requestContext)
+		result := requestContext.Writer.(*tests.CustomResponseWriter)
+		if result.StatusCode != testCase.expectedStatus || !requestContext.IsAborted() {
+			t.Errorf("Expected request %s to fail with %d, found %v", testCase.requestBody, testCase.expectedStatus, result.StatusCode)
+		}
+	}
+}
+
+func TestCreateCohortFromSetExpression(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	requestBody := `{"name": "combined cohort", "team_project": "teamprojectX", "expression": "1 & 2 | 3 - 4"}`
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	cohortDefinitionController.CreateCohortFromSetExpression(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var response struct {
+		CohortDefinition models.CohortDefinition `json:"cohort_definition"`
+	}
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &response)
+	if result.StatusCode != 201 || response.CohortDefinition.Id != 8 || response.CohortDefinition.Name != "combined cohort" {
+		t.Errorf("Expected the new cohort definition, found %v", result.CustomResponseWriterOut)
+	}
+	// the dummy model returns the parsed expression, which shows the operator precedence:
+	if response.CohortDefinition.Expression != "(((1 & 2) | 3) - 4)" {
+		t.Errorf("Unexpected parsed expression %s", response.CohortDefinition.Expression)
+	}
+
+	// the cohorts shared with the global reader role can be used by any team project:
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(`{"name": "combined cohort", "team_project": "teamprojectY", "expression": "5 - 7"}`))
+	cohortDefinitionController.CreateCohortFromSetExpression(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != 201 {
+		t.Errorf("Expected a cohort of teamprojectY and a global cohort to be combined, found %v", result.CustomResponseWriterOut)
+	}
+}
+
+func TestCreateCohortFromSetExpressionErrors(t *testing.T) {
+	setUp(t)
+	testCases := []struct {
+		controller     controllers.CohortDefinitionController
+		sourceId       string
+		requestBody    string
+		modelError     bool
+		expectedStatus int
+	}{
+		{cohortDefinitionController, "a", `{"name": "c", "team_project": "teamprojectX", "expression": "1 & 2"}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "expression": "1 & 2"`, false, 400},
+		{cohortDefinitionController, "1", `{"team_project": "teamprojectX", "expression": "1 & 2"}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "c", "expression": "1 & 2"}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX"}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "expression": "(1 & 2"}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "expression": "1 + 2"}`, false, 400},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "expression": "` + strings.Repeat("(", 1000) + `1` + strings.Repeat(")", 1000) + `"}`, false, 400},
+		{cohortDefinitionControllerWithFailingTeamProjectAuthz, "1", `{"name": "c", "team_project": "teamprojectX", "expression": "1 & 2"}`, false, 403},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "expression": "1 - 6"}`, false, 400},
+		// a user with access to both team projects cannot copy the members of teamprojectX cohorts into a teamprojectY cohort:
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectY", "expression": "5 | 2"}`, false, 403},
+		{cohortDefinitionController, "1", `{"name": "c", "team_project": "teamprojectX", "expression": "1 & 2"}`, true, 500},
+	}
+	for _, testCase := range testCases {
+		dummyModelReturnError = testCase.modelError
+		requestContext := new(gin.Context)
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: testCase.sourceId})
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		requestContext.Request = new(http.Request)
+		requestContext.Request.Body = io.NopCloser(strings.NewReader(testCase.requestBody))
+		testCase.controller.CreateCohortFromSetExpression(requestContext)
+		result := requestContext.Writer.(*tests.CustomResponseWriter)
+		if result.StatusCode != testCase.expectedStatus || !requestContext.IsAborted() {
+			t.Errorf("Expected request %s to fail with %d, found %v", testCase.requestBody, testCase.expectedStatus, result.StatusCode)
+		}
+	}
+}
+
+func TestEvictSourceConnections(t *testing.T) {
+	setUp(t)
+	sourceController := new(controllers.SourceController)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "id", Value: "abc"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	sourceController.EvictConnections(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != http.StatusBadRequest || !requestContext.IsAborted() {
+		t.Errorf("Expected 400 for an invalid source id, found %d", result.StatusCode)
+	}
+
+	requestContext = new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "id", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	sourceController.EvictConnections(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != http.StatusOK || !strings.Contains(result.CustomResponseWriterOut, "\"evicted_connections\":0") {
+		t.Errorf("Expected no evicted connections, found %d %v", result.StatusCode, result.CustomResponseWriterOut)
+	}
+}
+
+func TestRetrieveSourceMetadataCacheStats(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	new(controllers.SourceController).RetrieveMetadataCacheStats(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var response struct {
+		Stats *utils.TtlCacheStats `json:"source_metadata_cache"`
+	}
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &response)
+	if result.StatusCode != http.StatusOK || response.Stats == nil {
+		t.Errorf("Expected the cache stats, found %d %v", result.StatusCode, result.CustomResponseWriterOut)
+	}
 }
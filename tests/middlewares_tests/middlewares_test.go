@@ -1,17 +1,21 @@
 package middlewares_tests
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/uc-cdis/cohort-middleware/config"
 	"github.com/uc-cdis/cohort-middleware/middlewares"
 	"github.com/uc-cdis/cohort-middleware/models"
 	"github.com/uc-cdis/cohort-middleware/tests"
+	"github.com/uc-cdis/cohort-middleware/utils"
 )
 
 func TestMain(m *testing.M) {
@@ -94,11 +98,11 @@ type dummyCohortDefinitionDataModel struct {
 	returnForGetCohortDefinitionIdsForTeamProject []int
 }
 
-func (h dummyCohortDefinitionDataModel) GetCohortDefinitionIdsForTeamProject(teamProject string) ([]int, error) {
+func (h dummyCohortDefinitionDataModel) GetCohortDefinitionIdsForTeamProject(ctx context.Context, teamProject string) ([]int, error) {
 	return h.returnForGetCohortDefinitionIdsForTeamProject, nil
 }
 
-func (h dummyCohortDefinitionDataModel) GetTeamProjectsThatMatchAllCohortDefinitionIds(uniqueCohortDefinitionIdsList []int) ([]string, error) {
+func (h dummyCohortDefinitionDataModel) GetTeamProjectsThatMatchAllCohortDefinitionIds(ctx context.Context, uniqueCohortDefinitionIdsList []int) ([]string, error) {
 	// dummy switch just to support three test scenarios:
 	if len(uniqueCohortDefinitionIdsList) == 0 {
 		return []string{}, nil
@@ -111,20 +115,40 @@ func (h dummyCohortDefinitionDataModel) GetTeamProjectsThatMatchAllCohortDefinit
 	}
 }
 
-func (h dummyCohortDefinitionDataModel) GetCohortName(cohortId int) (string, error) {
+func (h dummyCohortDefinitionDataModel) GetCohortGenerationInfo(ctx context.Context, cohortDefinitionId int, sourceId int) (*models.CohortGenerationInfo, error) {
+	return &models.CohortGenerationInfo{Id: cohortDefinitionId, SourceId: sourceId, PersonCount: 10, RecordCount: 10}, nil
+}
+
+func (h dummyCohortDefinitionDataModel) GetCohortGenerationDetails(ctx context.Context, cohortDefinitionId int) ([]*models.CohortGenerationDetails, error) {
+	return []*models.CohortGenerationDetails{}, nil
+}
+
+func (h dummyCohortDefinitionDataModel) CreateCohortFromPersonIds(ctx context.Context, sourceId int, name string, description string, teamProject string, members []models.NewCohortMember) (*models.CohortDefinition, error) {
+	return nil, nil
+}
+
+func (h dummyCohortDefinitionDataModel) CreateCohortFromSetExpression(ctx context.Context, sourceId int, name string, description string, teamProject string, expression *utils.CohortSetExpression) (*models.CohortDefinition, error) {
+	return nil, nil
+}
+
+func (h dummyCohortDefinitionDataModel) GetCohortName(ctx context.Context, cohortId int) (string, error) {
 	return "dummy cohort name", nil
 }
 
-func (h dummyCohortDefinitionDataModel) GetAllCohortDefinitionsAndStatsOrderBySizeDesc(sourceId int, teamProject string) ([]*models.CohortDefinitionStats, error) {
+func (h dummyCohortDefinitionDataModel) SearchCohortDefinitions(ctx context.Context, sourceId int, cohortDefinitionQuery models.CohortDefinitionQuery) (*models.CohortDefinitionPage, error) {
 	return nil, nil
 }
-func (h dummyCohortDefinitionDataModel) GetCohortDefinitionById(id int) (*models.CohortDefinition, error) {
+
+func (h dummyCohortDefinitionDataModel) GetAllCohortDefinitionsAndStatsOrderBySizeDesc(ctx context.Context, sourceId int, teamProject string) ([]*models.CohortDefinitionStats, error) {
 	return nil, nil
 }
-func (h dummyCohortDefinitionDataModel) GetCohortDefinitionByName(name string) (*models.CohortDefinition, error) {
+func (h dummyCohortDefinitionDataModel) GetCohortDefinitionById(ctx context.Context, id int) (*models.CohortDefinition, error) {
 	return nil, nil
 }
-func (h dummyCohortDefinitionDataModel) GetAllCohortDefinitions() ([]*models.CohortDefinition, error) {
+func (h dummyCohortDefinitionDataModel) GetCohortDefinitionByName(ctx context.Context, name string) (*models.CohortDefinition, error) {
+	return nil, nil
+}
+func (h dummyCohortDefinitionDataModel) GetAllCohortDefinitions(ctx context.Context) ([]*models.CohortDefinition, error) {
 	return nil, nil
 }
 
@@ -353,3 +377,47 @@ func TestHasAccessToTeamProjectAbortOnArboristPrepError(t *testing.T) {
 	teamProjectAuthz.HasAccessToTeamProject(requestContext, "dummyTeam")
 	t.Errorf("Expected error")
 }
+
+func TestQueryTimeout(t *testing.T) {
+	setUp(t)
+	config.Init("mocktest")
+	if middlewares.GetQueryTimeout(middlewares.ExportQueries) != 600*time.Second {
+		t.Errorf("Expected the default export query timeout of 600 seconds")
+	}
+	config.GetConfig().Set("query_timeout_seconds.stats", 5)
+	defer config.GetConfig().Set("query_timeout_seconds.stats", nil)
+
+	var deadline time.Time
+	var hasDeadline bool
+	router := gin.New()
+	router.GET("/stats", middlewares.QueryTimeout(middlewares.StatsQueries), func(ctx *gin.Context) {
+		deadline, hasDeadline = ctx.Request.Context().Deadline()
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if !hasDeadline || time.Until(deadline) > 5*time.Second || time.Until(deadline) < 4*time.Second {
+		t.Errorf("Expected the request context to have the configured deadline of 5 seconds, found %v", deadline)
+	}
+}
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	setUp(t)
+	config.Init("mocktest")
+	for _, arboristStatus := range []int{200, 403} {
+		dummyHttpClient := &dummyHttpClient{statusCode: arboristStatus}
+		handled := false
+		router := gin.New()
+		router.GET("/admin", middlewares.AdminAuthMiddleware(dummyHttpClient), func(ctx *gin.Context) {
+			handled = true
+		})
+		request := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		request.Header.Set("Authorization", "dummy_token_value")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if handled != (arboristStatus == 200) || dummyHttpClient.nrCalls != 1 {
+			t.Errorf("Expected the request to be handled only if Arborist grants access, found %v for status %d", handled, arboristStatus)
+		}
+		if arboristStatus != 200 && response.Code != 403 {
+			t.Errorf("Expected status 403, found %d", response.Code)
+		}
+	}
+}
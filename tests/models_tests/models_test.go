@@ -1,10 +1,17 @@
 package models_tests
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -39,7 +46,7 @@ func TestMain(m *testing.M) {
 func setupSuite() {
 	log.Println("setup for suite")
 	// connect to test db:
-	config.Init("development")
+	config.Init(tests.GetTestConfigEnvironment())
 	db.Init()
 	// ensure we start w/ empty db:
 	tearDownSuite()
@@ -48,13 +55,13 @@ func setupSuite() {
 
 	// initialize some handy variables to use in tests below:
 	// (see also tests/setup_local_db/test_data_results_and_cdm.sql for these test cohort details)
-	allCohortDefinitions, _ = cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(testSourceId, defaultTeamProject)
+	allCohortDefinitions, _ = cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(context.Background(), testSourceId, defaultTeamProject)
 	largestCohort = allCohortDefinitions[0]
 	secondLargestCohort = allCohortDefinitions[2]
 	extendedCopyOfSecondLargestCohort = allCohortDefinitions[1]
 	thirdLargestCohort = allCohortDefinitions[3]
 	smallestCohort = allCohortDefinitions[len(allCohortDefinitions)-1]
-	concepts, _ := conceptModel.RetriveAllBySourceId(testSourceId)
+	concepts, _ := conceptModel.RetriveAllBySourceId(context.Background(), testSourceId)
 	allConceptIds = tests.MapIntAttr(concepts, "ConceptId")
 }
 
@@ -113,40 +120,43 @@ func TestGetPrefixedConceptId(t *testing.T) {
 
 func TestGetConceptValueNotNullCheckBasedOnConceptTypeError(t *testing.T) {
 	setUp(t)
-	// the call below should result in panic/error:
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic")
-		}
-	}()
-	models.GetConceptValueNotNullCheckBasedOnConceptType("observation", testSourceId, -1)
+	// the call below should result in an error:
+	_, err := models.GetConceptValueNotNullCheckBasedOnConceptType(context.Background(), "observation", testSourceId, -1)
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
 }
 
 func TestGetConceptValueNotNullCheckBasedOnConceptTypeError2(t *testing.T) {
 	setUp(t)
 	// add dummy concept:
 	conceptId := tests.AddInvalidTypeConcept(models.Omop)
+	defer tests.RemoveConcept(models.Omop, conceptId)
 
-	// the call below should result in a specific panic/error on the concept type not being supported:
-	defer func() {
-		r := recover()
-		if r == nil || !strings.HasPrefix(r.(string), "error: concept type not supported") {
-			t.Errorf("The code did not panic with expected error")
-		}
-		// cleanup:
-		tests.RemoveConcept(models.Omop, conceptId)
-	}()
-	models.GetConceptValueNotNullCheckBasedOnConceptType("observation", testSourceId, conceptId)
+	// the call below should result in a specific error on the concept type not being supported:
+	_, err := models.GetConceptValueNotNullCheckBasedOnConceptType(context.Background(), "observation", testSourceId, conceptId)
+	if !errors.Is(err, models.ErrConceptTypeNotSupported) {
+		t.Errorf("Expected ErrConceptTypeNotSupported, found %v", err)
+	}
+	// and the queries that filter on the concept should fail with it instead of panicking:
+	_, err = conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(context.Background(), testSourceId, largestCohort.Id, conceptId)
+	if !errors.Is(err, models.ErrConceptTypeNotSupported) {
+		t.Errorf("Expected ErrConceptTypeNotSupported, found %v", err)
+	}
+	_, err = cohortDataModel.RetrieveCohortOverlapStats(context.Background(), testSourceId, largestCohort.Id, largestCohort.Id, []int64{conceptId}, nil)
+	if !errors.Is(err, models.ErrConceptTypeNotSupported) {
+		t.Errorf("Expected ErrConceptTypeNotSupported, found %v", err)
+	}
 }
 
 func TestGetConceptValueNotNullCheckBasedOnConceptTypeSuccess(t *testing.T) {
 	setUp(t)
 	// check success scenarios:
-	result := models.GetConceptValueNotNullCheckBasedOnConceptType("observation", testSourceId, hareConceptId)
+	result, _ := models.GetConceptValueNotNullCheckBasedOnConceptType(context.Background(), "observation", testSourceId, hareConceptId)
 	if result != "observation.value_as_concept_id is not null and observation.value_as_concept_id != 0" {
 		t.Errorf("Unexpected result. Found %s", result)
 	}
-	result = models.GetConceptValueNotNullCheckBasedOnConceptType("observation", testSourceId, histogramConceptId)
+	result, _ = models.GetConceptValueNotNullCheckBasedOnConceptType(context.Background(), "observation", testSourceId, histogramConceptId)
 	if result != "observation.value_as_number is not null" {
 		t.Errorf("Unexpected result. Found %s", result)
 	}
@@ -154,15 +164,25 @@ func TestGetConceptValueNotNullCheckBasedOnConceptTypeSuccess(t *testing.T) {
 
 func TestRetriveAllBySourceId(t *testing.T) {
 	setUp(t)
-	concepts, _ := conceptModel.RetriveAllBySourceId(testSourceId)
+	concepts, _ := conceptModel.RetriveAllBySourceId(context.Background(), testSourceId)
 	if len(concepts) != 10 {
 		t.Errorf("Found %d", len(concepts))
 	}
 }
 
+func TestRetriveAllBySourceIdCancelledContext(t *testing.T) {
+	setUp(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := conceptModel.RetriveAllBySourceId(ctx, testSourceId)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the query to be cancelled, found %v", err)
+	}
+}
+
 func TestRetrieveInfoBySourceIdAndConceptIds(t *testing.T) {
 	setUp(t)
-	conceptsInfo, _ := conceptModel.RetrieveInfoBySourceIdAndConceptIds(testSourceId,
+	conceptsInfo, _ := conceptModel.RetrieveInfoBySourceIdAndConceptIds(context.Background(), testSourceId,
 		allConceptIds)
 	// simple test: we expect info for each valid conceptId, therefore the lists are
 	//  expected to have the same lenght here:
@@ -174,13 +194,13 @@ func TestRetrieveInfoBySourceIdAndConceptIds(t *testing.T) {
 func TestRetrieveInfoBySourceIdAndConceptTypes(t *testing.T) {
 	setUp(t)
 	// get all concepts:
-	conceptsInfo, _ := conceptModel.RetrieveInfoBySourceIdAndConceptIds(testSourceId,
+	conceptsInfo, _ := conceptModel.RetrieveInfoBySourceIdAndConceptIds(context.Background(), testSourceId,
 		allConceptIds)
 	// simple test: we know that not all concepts have the same type in our test db, so
 	// if we query on the type of a single concept, the result should
 	// be a list where 1 =< size < len(allConceptIds):
 	conceptTypes := []string{conceptsInfo[0].ConceptType}
-	conceptsInfo, _ = conceptModel.RetrieveInfoBySourceIdAndConceptTypes(testSourceId,
+	conceptsInfo, _ = conceptModel.RetrieveInfoBySourceIdAndConceptTypes(context.Background(), testSourceId,
 		conceptTypes)
 	if !(1 <= len(conceptsInfo) && len(conceptsInfo) < len(allConceptIds)) {
 		t.Errorf("Found %d", len(conceptsInfo))
@@ -190,7 +210,7 @@ func TestRetrieveInfoBySourceIdAndConceptTypes(t *testing.T) {
 func TestRetrieveInfoBySourceIdAndConceptIdNotFound(t *testing.T) {
 	setUp(t)
 	// get all concepts:
-	conceptInfo, error := conceptModel.RetrieveInfoBySourceIdAndConceptId(testSourceId,
+	conceptInfo, error := conceptModel.RetrieveInfoBySourceIdAndConceptId(context.Background(), testSourceId,
 		-1)
 	if conceptInfo != nil {
 		t.Errorf("Did not expect to find data")
@@ -203,7 +223,7 @@ func TestRetrieveInfoBySourceIdAndConceptIdNotFound(t *testing.T) {
 func TestRetrieveInfoBySourceIdAndConceptId(t *testing.T) {
 	setUp(t)
 	// get all concepts:
-	conceptInfo, _ := conceptModel.RetrieveInfoBySourceIdAndConceptId(testSourceId,
+	conceptInfo, _ := conceptModel.RetrieveInfoBySourceIdAndConceptId(context.Background(), testSourceId,
 		hareConceptId)
 	if conceptInfo == nil {
 		t.Errorf("Expected to find data")
@@ -214,7 +234,7 @@ func TestRetrieveInfoBySourceIdAndConceptTypesWrongType(t *testing.T) {
 	setUp(t)
 	// simple test: invalid/non-existing type should return an empty list:
 	conceptTypes := []string{"invalid type"}
-	conceptsInfo, _ := conceptModel.RetrieveInfoBySourceIdAndConceptTypes(testSourceId,
+	conceptsInfo, _ := conceptModel.RetrieveInfoBySourceIdAndConceptTypes(context.Background(), testSourceId,
 		conceptTypes)
 	if len(conceptsInfo) != 0 {
 		t.Errorf("Found %d", len(conceptsInfo))
@@ -225,7 +245,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsN
 	setUp(t)
 	// empty:
 	filterCohortPairs := []utils.CustomDichotomousVariableDef{}
-	stats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
+	stats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
 		smallestCohort.Id,
 		allConceptIds, filterCohortPairs, allConceptIds[0])
 	// none of the subjects has a value in all the concepts, so we expect len==0 here:
@@ -423,7 +443,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndTwoCohortPai
 			ProvidedName:        "test"},
 	}
 	breakdownConceptId := hareConceptId // not normally the case...but we'll use the same here just for the test...
-	stats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
+	stats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
 		populationCohort.Id, filterIds, filterCohortPairs, breakdownConceptId)
 	// we expect results, and we expect the total of persons to be 6, since only 6 of the persons
 	// in largestCohort have a HARE value (and smallestCohort does not overlap with largest):
@@ -448,7 +468,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndTwoCohortPai
 			CohortDefinitionId2: extendedCopyOfSecondLargestCohort.Id,
 			ProvidedName:        "test2"},
 	}
-	stats, _ = conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
+	stats, _ = conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
 		populationCohort.Id, filterIds, filterCohortPairs, breakdownConceptId)
 	countPersons = 0
 	for _, stat := range stats {
@@ -470,7 +490,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsW
 			ProvidedName:        "test"},
 	}
 	breakdownConceptId := hareConceptId // not normally the case...but we'll use the same here just for the test...
-	stats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
+	stats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
 		extendedCopyOfSecondLargestCohort.Id, filterIds, filterCohortPairs, breakdownConceptId)
 	// we expect values since secondLargestCohort has multiple subjects with hare info:
 	if len(stats) < 4 {
@@ -490,7 +510,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsW
 	}
 	// test without the filterCohortPairs, should return the same result:
 	filterCohortPairs = []utils.CustomDichotomousVariableDef{}
-	stats2, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
+	stats2, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
 		extendedCopyOfSecondLargestCohort.Id, filterIds, filterCohortPairs, breakdownConceptId)
 	// very rough check (ideally we would check the individual stats as well...TODO?):
 	if len(stats) > len(stats2) {
@@ -506,7 +526,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsW
 			CohortDefinitionId2: largestCohort.Id,
 			ProvidedName:        "test"},
 	}
-	stats3, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
+	stats3, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
 		secondLargestCohort.Id, filterIds, filterCohortPairs, breakdownConceptId)
 	if len(stats3) != 2 {
 		t.Errorf("Expected only two items in resultset, found %d", len(stats3))
@@ -520,10 +540,185 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsW
 	}
 }
 
+func TestRetrieveBreakdownStatsWithFilteredCohortSession(t *testing.T) {
+	setUp(t)
+	ctx, session := models.NewFilteredCohortSession(context.Background())
+	defer session.Close()
+	filterIds := []int64{hareConceptId}
+	filterCohortPairs := []utils.CustomDichotomousVariableDef{
+		{
+			CohortDefinitionId1: smallestCohort.Id,
+			CohortDefinitionId2: largestCohort.Id,
+			ProvidedName:        "test"},
+	}
+	resultsDB, _ := tests.GetResultsDataSource().Db.DB()
+	// same checks as in TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndTwoCohortPairsWithResults, where
+	// the second query adds a cohort pair, so that its temp table is built from the held temp table of the first query:
+	release := models.HoldFilteredCohortTables(ctx)
+	for _, expectedCount := range []int{6, 4} {
+		stats, err := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx, testSourceId,
+			largestCohort.Id, filterIds, filterCohortPairs, hareConceptId)
+		if err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		inlineStats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
+			largestCohort.Id, filterIds, filterCohortPairs, hareConceptId)
+		countPersons := 0
+		for _, stat := range stats {
+			countPersons += stat.NpersonsInCohortWithValue
+		}
+		if countPersons != expectedCount || !reflect.DeepEqual(stats, inlineStats) {
+			t.Errorf("Expected %d persons and the same stats as without temp tables, found %d", expectedCount, countPersons)
+		}
+		if resultsDB.Stats().InUse != 1 {
+			t.Errorf("Expected the connection with the temp tables to be kept while they are held, found %d connections in use", resultsDB.Stats().InUse)
+		}
+		filterCohortPairs = append(filterCohortPairs, utils.CustomDichotomousVariableDef{
+			CohortDefinitionId1: secondLargestCohort.Id,
+			CohortDefinitionId2: extendedCopyOfSecondLargestCohort.Id,
+			ProvidedName:        "test2"})
+	}
+	release()
+	if resultsDB.Stats().InUse != 0 {
+		t.Errorf("Expected the connection to be released with the temp tables, found %d connections in use", resultsDB.Stats().InUse)
+	}
+}
+
+func TestConcurrentQueriesWithFilteredCohortSession(t *testing.T) {
+	setUp(t)
+	ctx, session := models.NewFilteredCohortSession(context.Background())
+	defer session.Close()
+	filterCohortPairs := []utils.CustomDichotomousVariableDef{
+		{CohortDefinitionId1: smallestCohort.Id, CohortDefinitionId2: largestCohort.Id, ProvidedName: "test"},
+	}
+	inlineStats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
+		largestCohort.Id, []int64{hareConceptId}, filterCohortPairs, hareConceptId)
+	resultsDB, _ := tests.GetResultsDataSource().Db.DB()
+	// the queries that need the same temp table wait for the one that creates it:
+	release := models.HoldFilteredCohortTables(ctx)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats, err := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx, testSourceId,
+				largestCohort.Id, []int64{hareConceptId}, filterCohortPairs, hareConceptId)
+			if err != nil || !reflect.DeepEqual(stats, inlineStats) {
+				t.Errorf("Expected the same stats as without temp tables, found %v and error %v", stats, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if resultsDB.Stats().InUse != 1 {
+		t.Errorf("Expected a single connection with the temp table, found %d connections in use", resultsDB.Stats().InUse)
+	}
+	release()
+	if resultsDB.Stats().InUse != 0 {
+		t.Errorf("Expected the connection to be released with the temp table, found %d connections in use", resultsDB.Stats().InUse)
+	}
+}
+
+func TestCachedConceptBreakdownStats(t *testing.T) {
+	setUp(t)
+	cache := models.NewStatsResultCache(utils.NewLruResultCache(10), 10)
+	cachedConceptModel := models.NewCachedConcept(conceptModel, cache)
+	filterCohortPairs := []utils.CustomDichotomousVariableDef{
+		{CohortDefinitionId1: smallestCohort.Id, CohortDefinitionId2: largestCohort.Id, ProvidedName: "test"},
+		{CohortDefinitionId1: secondLargestCohort.Id, CohortDefinitionId2: extendedCopyOfSecondLargestCohort.Id, ProvidedName: "test2"},
+	}
+	stats, err := cachedConceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
+		largestCohort.Id, []int64{hareConceptId}, filterCohortPairs, hareConceptId)
+	if err != nil || len(stats) == 0 {
+		t.Fatalf("Expected breakdown stats, found %v and error %v", stats, err)
+	}
+	// the same request with the cohort pairs in another order is served from the cache:
+	slices.Reverse(filterCohortPairs)
+	cachedStats, _ := cachedConceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
+		largestCohort.Id, []int64{hareConceptId}, filterCohortPairs, hareConceptId)
+	expectedStats := models.StatsResultCacheStats{Hits: 1, Misses: 1, TrackedKeys: 1}
+	if !reflect.DeepEqual(stats, cachedStats) || cache.Stats() != expectedStats {
+		t.Errorf("Expected the cached breakdown stats and cache stats %v, found %v", expectedStats, cache.Stats())
+	}
+
+	// until one of the cohorts of the request is regenerated:
+	tests.ExecAtlasSQLString(fmt.Sprintf("UPDATE %s.cohort_generation_info SET start_time = start_time + interval '1 day' "+
+		"WHERE id = %d and source_id = %d", db.GetAtlasDB().Schema, extendedCopyOfSecondLargestCohort.Id, testSourceId))
+	regeneratedStats, _ := cachedConceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
+		largestCohort.Id, []int64{hareConceptId}, filterCohortPairs, hareConceptId)
+	expectedStats = models.StatsResultCacheStats{Hits: 1, Misses: 2, Invalidations: 1, TrackedKeys: 1}
+	if !reflect.DeepEqual(stats, regeneratedStats) || cache.Stats() != expectedStats {
+		t.Errorf("Expected the breakdown stats to be computed again with cache stats %v, found %v", expectedStats, cache.Stats())
+	}
+
+	// or the CDM is refreshed, with a new data schema version:
+	dboSchema := tests.GetSchemaNameForType(models.Dbo)
+	tests.ExecSQLStringOrFail(fmt.Sprintf("INSERT INTO %s.VersionInfo (Version, Description) VALUES (2, 'CDM refresh')", dboSchema), testSourceId)
+	defer tests.ExecSQLStringOrFail(fmt.Sprintf("DELETE FROM %s.VersionInfo WHERE Version = 2", dboSchema), testSourceId)
+	cachedConceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
+		largestCohort.Id, []int64{hareConceptId}, filterCohortPairs, hareConceptId)
+	if cache.Stats().Misses != 3 {
+		t.Errorf("Expected the breakdown stats to be computed again after a CDM refresh, found cache stats %v", cache.Stats())
+	}
+}
+
+func TestStatsResultCacheBoundsTrackedKeys(t *testing.T) {
+	setUp(t)
+	cache := models.NewStatsResultCache(utils.NewLruResultCache(1), 1)
+	cachedConceptModel := models.NewCachedConcept(conceptModel, cache)
+	for _, cohort := range []*models.CohortDefinitionStats{largestCohort, secondLargestCohort, largestCohort} {
+		if _, err := cachedConceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(context.Background(), testSourceId, cohort.Id, hareConceptId); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		// the keys of the results that do not fit in the backend are not kept either:
+		if cache.Stats().TrackedKeys > 1 {
+			t.Errorf("Expected at most 1 tracked key, found %d", cache.Stats().TrackedKeys)
+		}
+	}
+	// the first result was evicted by the second one:
+	if stats := cache.Stats(); stats.Hits != 0 || stats.Misses != 3 {
+		t.Errorf("Expected 3 cache misses, found %v", stats)
+	}
+}
+
+// A result cache backend that keeps the results it stores, to check what is cached.
+type recordingResultCache struct {
+	*utils.LruResultCache
+	values [][]byte
+}
+
+func (c *recordingResultCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.values = append(c.values, value)
+	return c.LruResultCache.Set(key, value, ttl)
+}
+
+func TestCachedCohortDataHistogram(t *testing.T) {
+	setUp(t)
+	backend := &recordingResultCache{LruResultCache: utils.NewLruResultCache(10)}
+	cache := models.NewStatsResultCache(backend, 10)
+	cachedCohortDataModel := models.NewCachedCohortData(cohortDataModel, cache)
+	histogram, err := cachedCohortDataModel.RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
+		largestCohort.Id, histogramConceptId, []int64{}, nil)
+	expectedHistogram, _ := cohortDataModel.RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
+		largestCohort.Id, histogramConceptId, []int64{}, nil)
+	if err != nil || len(histogram) == 0 || !reflect.DeepEqual(histogram, expectedHistogram) {
+		t.Fatalf("Expected histogram %v, found %v and error %v", expectedHistogram, histogram, err)
+	}
+	cachedHistogram, _ := cachedCohortDataModel.RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId,
+		largestCohort.Id, histogramConceptId, []int64{}, nil)
+	expectedStats := models.StatsResultCacheStats{Hits: 1, Misses: 1, TrackedKeys: 1}
+	if !reflect.DeepEqual(histogram, cachedHistogram) || cache.Stats() != expectedStats {
+		t.Errorf("Expected the cached histogram and cache stats %v, found %v", expectedStats, cache.Stats())
+	}
+	// only the bins are cached, not the values of the persons:
+	if len(backend.values) != 1 || strings.Contains(string(backend.values[0]), "PersonId") {
+		t.Errorf("Expected only the histogram bins to be cached, found %s", backend.values)
+	}
+}
+
 func TestRetrieveBreakdownStatsBySourceIdAndCohortIdWithResults(t *testing.T) {
 	setUp(t)
 	breakdownConceptId := hareConceptId
-	stats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(testSourceId,
+	stats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(context.Background(), testSourceId,
 		secondLargestCohort.Id,
 		breakdownConceptId)
 	// we expect 5-1 rows since the largest test cohort has all HARE values represented in its population, but has NULL in the "OTH" entry:
@@ -544,7 +739,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdWithResults(t *testing.T) {
 func TestRetrieveBreakdownStatsBySourceIdAndCohortIdWithResultsWithOnePersonTwoHare(t *testing.T) {
 	setUp(t)
 	breakdownConceptId := hareConceptId
-	statsthirdLargestCohort, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(testSourceId,
+	statsthirdLargestCohort, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(context.Background(), testSourceId,
 		thirdLargestCohort.Id,
 		breakdownConceptId)
 
@@ -558,7 +753,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdWithResultsWithOnePersonTwoH
 		t.Errorf("Expected total peope in return data to be 1 larger than cohort size, but total people was %d and cohort size is %d", totalPersonInthirdLargestCohortWithValue, thirdLargestCohort.CohortSize)
 	}
 
-	statssecondLargestCohort, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(testSourceId,
+	statssecondLargestCohort, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(context.Background(), testSourceId,
 		secondLargestCohort.Id,
 		breakdownConceptId)
 
@@ -587,7 +782,7 @@ func TestGetTeamProjectsThatMatchAllCohortDefinitionIdsOnlyDefaultMatch(t *testi
 	if len(uniqueCohortDefinitionIdsList) != 3 {
 		t.Errorf("Expected uniqueCohortDefinitionIdsList length to be 3")
 	}
-	teamProjects, _ := cohortDefinitionModel.GetTeamProjectsThatMatchAllCohortDefinitionIds(uniqueCohortDefinitionIdsList)
+	teamProjects, _ := cohortDefinitionModel.GetTeamProjectsThatMatchAllCohortDefinitionIds(context.Background(), uniqueCohortDefinitionIdsList)
 	if len(teamProjects) != 1 || teamProjects[0] != "defaultteamproject" {
 		t.Errorf("Expected to find only defaultteamproject")
 	}
@@ -604,7 +799,7 @@ func TestGetTeamProjectsThatMatchAllCohortDefinitionIdsOnlyDefaultMatch(t *testi
 	if len(uniqueCohortDefinitionIdsList) != 2 {
 		t.Errorf("Expected uniqueCohortDefinitionIdsList length to be 2")
 	}
-	teamProjects, _ = cohortDefinitionModel.GetTeamProjectsThatMatchAllCohortDefinitionIds(uniqueCohortDefinitionIdsList)
+	teamProjects, _ = cohortDefinitionModel.GetTeamProjectsThatMatchAllCohortDefinitionIds(context.Background(), uniqueCohortDefinitionIdsList)
 	if len(teamProjects) != 1 || teamProjects[0] != "defaultteamproject" {
 		t.Errorf("Expected to find only defaultteamproject")
 	}
@@ -623,7 +818,7 @@ func TestGetTeamProjectsThatMatchAllCohortDefinitionIds(t *testing.T) {
 	if len(uniqueCohortDefinitionIdsList) != 2 {
 		t.Errorf("Expected uniqueCohortDefinitionIdsList length to be 2")
 	}
-	teamProjects, _ := cohortDefinitionModel.GetTeamProjectsThatMatchAllCohortDefinitionIds(uniqueCohortDefinitionIdsList)
+	teamProjects, _ := cohortDefinitionModel.GetTeamProjectsThatMatchAllCohortDefinitionIds(context.Background(), uniqueCohortDefinitionIdsList)
 	if len(teamProjects) != 2 {
 		t.Errorf("Expected to find two 'team projects' matching the cohort list, found %s", teamProjects)
 	}
@@ -638,7 +833,7 @@ func TestGetTeamProjectsThatMatchAllCohortDefinitionIds(t *testing.T) {
 func TestGetCohortDefinitionIdsForTeamProject(t *testing.T) {
 	setUp(t)
 	testTeamProject := "teamprojectY"
-	allowedCohortDefinitionIds, _ := cohortDefinitionModel.GetCohortDefinitionIdsForTeamProject(testTeamProject)
+	allowedCohortDefinitionIds, _ := cohortDefinitionModel.GetCohortDefinitionIdsForTeamProject(context.Background(), testTeamProject)
 	if len(allowedCohortDefinitionIds) != 1 {
 		t.Errorf("Expected teamProject '%s' to have one cohort, but found %d",
 			testTeamProject, len(allowedCohortDefinitionIds))
@@ -646,8 +841,8 @@ func TestGetCohortDefinitionIdsForTeamProject(t *testing.T) {
 	// test data is crafted in such a way that the default "team project" has access to all
 	// the cohorts. Check if this is indeed the case:
 	testTeamProject = defaultTeamProject
-	allowedCohortDefinitionIds, _ = cohortDefinitionModel.GetCohortDefinitionIdsForTeamProject(testTeamProject)
-	allCohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitions()
+	allowedCohortDefinitionIds, _ = cohortDefinitionModel.GetCohortDefinitionIdsForTeamProject(context.Background(), testTeamProject)
+	allCohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitions(context.Background())
 	if len(allCohortDefinitions) != len(allowedCohortDefinitionIds) && len(allCohortDefinitions) > 1 {
 		t.Errorf("Found %d, expected %d", len(allowedCohortDefinitionIds), len(allCohortDefinitions))
 	}
@@ -655,7 +850,7 @@ func TestGetCohortDefinitionIdsForTeamProject(t *testing.T) {
 
 func TestGetAllCohortDefinitionsAndStatsOrderBySizeDesc(t *testing.T) {
 	setUp(t)
-	cohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(testSourceId, defaultTeamProject)
+	cohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(context.Background(), testSourceId, defaultTeamProject)
 	if len(cohortDefinitions) != len(allCohortDefinitions) {
 		t.Errorf("Found %d, expected %d", len(cohortDefinitions), len(allCohortDefinitions))
 	}
@@ -673,13 +868,13 @@ func TestGetAllCohortDefinitionsAndStatsOrderBySizeDesc(t *testing.T) {
 
 	// some extra tests to cover also the teamProject option for this method:
 	testTeamProject := "teamprojectY"
-	allowedCohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(testSourceId, testTeamProject)
+	allowedCohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(context.Background(), testSourceId, testTeamProject)
 	if len(allowedCohortDefinitions) != 1 {
 		t.Errorf("Expected teamProject '%s' to have one cohort, but found %d",
 			testTeamProject, len(allowedCohortDefinitions))
 	}
 	testTeamProject = "teamprojectX"
-	allowedCohortDefinitions, _ = cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(testSourceId, testTeamProject)
+	allowedCohortDefinitions, _ = cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(context.Background(), testSourceId, testTeamProject)
 	if len(allowedCohortDefinitions) != 2 {
 		t.Errorf("Expected teamProject '%s' to have 2 cohorts, but found %d",
 			testTeamProject, len(allowedCohortDefinitions))
@@ -689,7 +884,7 @@ func TestGetAllCohortDefinitionsAndStatsOrderBySizeDesc(t *testing.T) {
 			defaultTeamProject, testTeamProject)
 	}
 	testTeamProject = "teamprojectNonExisting"
-	allowedCohortDefinitions, _ = cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(testSourceId, testTeamProject)
+	allowedCohortDefinitions, _ = cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(context.Background(), testSourceId, testTeamProject)
 	if len(allowedCohortDefinitions) != 0 {
 		t.Errorf("Expected teamProject '%s' to have NO cohort, but found %d",
 			testTeamProject, len(allowedCohortDefinitions))
@@ -699,9 +894,76 @@ func TestGetAllCohortDefinitionsAndStatsOrderBySizeDesc(t *testing.T) {
 // Tests whether the code deals correctly with the (error) situation where
 // the `cohort_definition` and `cohort` tables are not in sync (more specifically
 // the situation where a cohort still exists in `cohort` table but not in `cohort_definition`).
+func TestSearchCohortDefinitions(t *testing.T) {
+	setUp(t)
+	cohortDefinitionQuery := models.CohortDefinitionQuery{
+		TeamProjects:   []string{defaultTeamProject},
+		SortBy:         "size",
+		SortDescending: true,
+		Page:           1,
+		PageSize:       100,
+	}
+	// by default, the same cohorts as GetAllCohortDefinitionsAndStatsOrderBySizeDesc are returned:
+	cohortDefinitionStats, _ := cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(context.Background(), testSourceId, defaultTeamProject)
+	cohortDefinitionPage, err := cohortDefinitionModel.SearchCohortDefinitions(context.Background(), testSourceId, cohortDefinitionQuery)
+	if err != nil || int(cohortDefinitionPage.TotalEntries) != len(cohortDefinitionStats) || len(cohortDefinitionPage.Data) != len(cohortDefinitionStats) {
+		t.Fatalf("Expected %d cohorts, found %v and error %v", len(cohortDefinitionStats), cohortDefinitionPage, err)
+	}
+	for i, entry := range cohortDefinitionPage.Data {
+		if entry.CohortSize != int64(cohortDefinitionStats[i].CohortSize) || entry.GenerationStatus != models.CohortGenerationStatusComplete {
+			t.Errorf("Unexpected entry %v, expected size %d", entry, cohortDefinitionStats[i].CohortSize)
+		}
+	}
+
+	// the ungenerated cohorts (like cohort 5) are only returned on request:
+	cohortDefinitionQuery.IncludeUngenerated = true
+	allCohortDefinitionsPage, _ := cohortDefinitionModel.SearchCohortDefinitions(context.Background(), testSourceId, cohortDefinitionQuery)
+	if allCohortDefinitionsPage.TotalEntries <= cohortDefinitionPage.TotalEntries {
+		t.Errorf("Expected more than %d cohorts, found %d", cohortDefinitionPage.TotalEntries, allCohortDefinitionsPage.TotalEntries)
+	}
+	for _, entry := range allCohortDefinitionsPage.Data {
+		if entry.CohortSize == 0 && entry.GenerationStatus == models.CohortGenerationStatusComplete {
+			t.Errorf("Expected a status other than %s for empty cohort %d", entry.GenerationStatus, entry.Id)
+		}
+	}
+
+	// search, sort on name and paginate:
+	cohortDefinitionQuery.SortBy = "name"
+	cohortDefinitionQuery.SortDescending = false
+	cohortDefinitionQuery.PageSize = 1
+	cohortDefinitionQuery.Page = 2
+	secondCohortDefinitionPage, _ := cohortDefinitionModel.SearchCohortDefinitions(context.Background(), testSourceId, cohortDefinitionQuery)
+	if len(secondCohortDefinitionPage.Data) != 1 || secondCohortDefinitionPage.TotalEntries != allCohortDefinitionsPage.TotalEntries {
+		t.Errorf("Expected 1 entry of %d, found %v", allCohortDefinitionsPage.TotalEntries, secondCohortDefinitionPage)
+	}
+	cohortDefinitionQuery.Page = 1
+	firstCohortDefinitionPage, _ := cohortDefinitionModel.SearchCohortDefinitions(context.Background(), testSourceId, cohortDefinitionQuery)
+	if len(firstCohortDefinitionPage.Data) != 1 || firstCohortDefinitionPage.Data[0].Name > secondCohortDefinitionPage.Data[0].Name {
+		t.Errorf("Expected the cohorts to be ordered by name, found %v and %v", firstCohortDefinitionPage.Data, secondCohortDefinitionPage.Data)
+	}
+	cohortDefinitionQuery.Search = strings.ToUpper(firstCohortDefinitionPage.Data[0].Name)
+	searchPage, _ := cohortDefinitionModel.SearchCohortDefinitions(context.Background(), testSourceId, cohortDefinitionQuery)
+	if searchPage.TotalEntries < 1 || !strings.EqualFold(searchPage.Data[0].Name, firstCohortDefinitionPage.Data[0].Name) {
+		t.Errorf("Expected to find cohort %s, found %v", firstCohortDefinitionPage.Data[0].Name, searchPage.Data)
+	}
+	// the LIKE wildcards in the search text only match themselves, so "cohort_" does not match e.g. "Test cohort1":
+	cohortDefinitionQuery.Search = "cohort_"
+	searchPage, _ = cohortDefinitionModel.SearchCohortDefinitions(context.Background(), testSourceId, cohortDefinitionQuery)
+	if searchPage.TotalEntries != 0 {
+		t.Errorf("Expected no cohorts with 'cohort_' in their name or description, found %v", searchPage.Data)
+	}
+
+	// other team projects only see their own cohorts:
+	cohortDefinitionQuery = models.CohortDefinitionQuery{TeamProjects: []string{"teamprojectY"}, Page: 1, PageSize: 10}
+	teamProjectPage, _ := cohortDefinitionModel.SearchCohortDefinitions(context.Background(), testSourceId, cohortDefinitionQuery)
+	if teamProjectPage.TotalEntries != 1 {
+		t.Errorf("Expected teamProject 'teamprojectY' to have one cohort, but found %d", teamProjectPage.TotalEntries)
+	}
+}
+
 func TestGetAllCohortDefinitionsAndStatsOrderBySizeDescWhenCohortDefinitionIsMissing(t *testing.T) {
 	setUp(t)
-	cohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(testSourceId, defaultTeamProject)
+	cohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(context.Background(), testSourceId, defaultTeamProject)
 	if len(cohortDefinitions) != len(allCohortDefinitions) {
 		t.Errorf("Found %d", len(cohortDefinitions))
 	}
@@ -710,7 +972,7 @@ func TestGetAllCohortDefinitionsAndStatsOrderBySizeDescWhenCohortDefinitionIsMis
 	firstCohort := cohortDefinitions[0]
 	tests.ExecAtlasSQLString(fmt.Sprintf("delete from %s.cohort_definition where id = %d",
 		db.GetAtlasDB().Schema, firstCohort.Id))
-	cohortDefinitions, _ = cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(testSourceId, defaultTeamProject)
+	cohortDefinitions, _ = cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(context.Background(), testSourceId, defaultTeamProject)
 	if len(cohortDefinitions) != len(allCohortDefinitions)-1 {
 		t.Errorf("Number of cohor_definition records expected to be %d, found %d",
 			len(allCohortDefinitions)-1, len(cohortDefinitions))
@@ -733,15 +995,15 @@ func TestGetAllCohortDefinitionsAndStatsOrderBySizeDescWhenCohortDefinitionIsMis
 
 func TestGetCohortName(t *testing.T) {
 	setUp(t)
-	allCohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitions()
+	allCohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitions(context.Background())
 	firstCohortId := allCohortDefinitions[0].Id
-	cohortName, _ := cohortDefinitionModel.GetCohortName(firstCohortId)
+	cohortName, _ := cohortDefinitionModel.GetCohortName(context.Background(), firstCohortId)
 	if cohortName != allCohortDefinitions[0].Name {
 		t.Errorf("Expected %s", allCohortDefinitions[0].Name)
 	}
 
 	// try non-existing cohort id...should result in error:
-	_, err := cohortDefinitionModel.GetCohortName(-123)
+	_, err := cohortDefinitionModel.GetCohortName(context.Background(), -123)
 	if err == nil {
 		t.Errorf("Expected error")
 	}
@@ -750,7 +1012,7 @@ func TestGetCohortName(t *testing.T) {
 
 func TestGetCohortDefinitionByName(t *testing.T) {
 	setUp(t)
-	cohortDefinition, _ := cohortDefinitionModel.GetCohortDefinitionByName(smallestCohort.Name)
+	cohortDefinition, _ := cohortDefinitionModel.GetCohortDefinitionByName(context.Background(), smallestCohort.Name)
 	if cohortDefinition == nil || cohortDefinition.Name != smallestCohort.Name {
 		t.Errorf("Expected %s", smallestCohort.Name)
 	}
@@ -760,7 +1022,7 @@ func TestRetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(t
 	setUp(t)
 	filterConceptIds := []int64{}
 	filterCohortPairs := []utils.CustomDichotomousVariableDef{}
-	data, _ := cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, largestCohort.Id, histogramConceptId, filterConceptIds, filterCohortPairs)
+	data, _ := cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId, largestCohort.Id, histogramConceptId, filterConceptIds, filterCohortPairs)
 	// everyone in the largestCohort has the histogramConceptId, but one person has NULL in the value_as_number:
 	if len(data) != largestCohort.CohortSize-1 {
 		t.Errorf("expected %d histogram data but got %d", largestCohort.CohortSize, len(data))
@@ -774,16 +1036,40 @@ func TestRetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(t
 			ProvidedName:        "test"},
 	}
 	// then we expect histogram data for the overlapping population only (which is 5 for extendedCopyOfSecondLargestCohort and largestCohort):
-	data, _ = cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, largestCohort.Id, histogramConceptId, filterConceptIds, filterCohortPairs)
+	data, _ = cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(context.Background(), testSourceId, largestCohort.Id, histogramConceptId, filterConceptIds, filterCohortPairs)
 	if len(data) != 5 {
 		t.Errorf("expected 5 histogram data but got %d", len(data))
 	}
 
 }
 
+func TestRetrieveHistogramDataWithFilteredCohortSession(t *testing.T) {
+	setUp(t)
+	ctx, session := models.NewFilteredCohortSession(context.Background())
+	defer session.Close()
+	filterCohortPairs := []utils.CustomDichotomousVariableDef{
+		{
+			CohortDefinitionId1: smallestCohort.Id,
+			CohortDefinitionId2: extendedCopyOfSecondLargestCohort.Id,
+			ProvidedName:        "test"},
+	}
+	resultsDB, _ := tests.GetResultsDataSource().Db.DB()
+	// same check as in TestRetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs, twice, where each
+	// query materializes its own temp table, which is dropped and its connection released when the query is done:
+	for i := 0; i < 2; i++ {
+		data, err := cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(ctx, testSourceId, largestCohort.Id, histogramConceptId, []int64{}, filterCohortPairs)
+		if err != nil || len(data) != 5 {
+			t.Errorf("expected 5 histogram data but got %d, error %v", len(data), err)
+		}
+		if resultsDB.Stats().InUse != 0 {
+			t.Errorf("Expected no connection to be kept after the query, found %d connections in use", resultsDB.Stats().InUse)
+		}
+	}
+}
+
 func TestRetrieveHistogramDataBySourceIdAndConceptId(t *testing.T) {
 	setUp(t)
-	data, _ := cohortDataModel.RetrieveHistogramDataBySourceIdAndConceptId(testSourceId, histogramConceptId)
+	data, _ := cohortDataModel.RetrieveHistogramDataBySourceIdAndConceptId(context.Background(), testSourceId, histogramConceptId)
 	// everyone in the largestCohort has the histogramConceptId, but one person has NULL in the value_as_number:
 	if len(data) != 16 {
 		t.Errorf("expected %d histogram data but got %d", 16, len(data))
@@ -803,17 +1089,17 @@ func TestQueryFilterByConceptIdsHelper(t *testing.T) {
 	}
 
 	// Subtest1: correct alias "observation":
-	query := omopDataSource.Db.Table(omopDataSource.Schema + ".observation_continuous as observation" + omopDataSource.GetViewDirective()).
+	query := omopDataSource.Db.Table(omopDataSource.Table("observation_continuous") + " as observation" + omopDataSource.Dialect().ViewHint()).
 		Select("observation.person_id")
-	query = models.QueryFilterByConceptIdsHelper(query, testSourceId, filterConceptIds, omopDataSource, "", "observation.person_id")
+	query, _ = models.QueryFilterByConceptIdsHelper(context.Background(), query, testSourceId, filterConceptIds, omopDataSource, "", "observation.person_id")
 	meta_result := query.Scan(&personIds)
 	if meta_result.Error != nil {
 		t.Errorf("Did NOT expect an error")
 	}
 	// Subtest2: incorrect alias "observation"...should fail:
-	query = omopDataSource.Db.Table(omopDataSource.Schema + ".observation_continuous as observationWRONG").
+	query = omopDataSource.Db.Table(omopDataSource.Table("observation_continuous") + " as observationWRONG").
 		Select("*")
-	query = models.QueryFilterByConceptIdsHelper(query, testSourceId, filterConceptIds, omopDataSource, "", "observation.person_id")
+	query, _ = models.QueryFilterByConceptIdsHelper(context.Background(), query, testSourceId, filterConceptIds, omopDataSource, "", "observation.person_id")
 	meta_result = query.Scan(&personIds)
 	if meta_result.Error == nil {
 		t.Errorf("Expected an error")
@@ -822,14 +1108,14 @@ func TestQueryFilterByConceptIdsHelper(t *testing.T) {
 
 func TestRetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(t *testing.T) {
 	setUp(t)
-	cohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(testSourceId, defaultTeamProject)
+	cohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(context.Background(), testSourceId, defaultTeamProject)
 	var sumNumeric float32 = 0
 	textConcat := ""
 	classIdConcat := ""
 	foundConceptValueAsNumberAsNil := false
 	for _, cohortDefinition := range cohortDefinitions {
 
-		cohortData, _ := cohortDataModel.RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(
+		cohortData, _ := cohortDataModel.RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(context.Background(),
 			testSourceId, cohortDefinition.Id, allConceptIds)
 
 		// count nr observation records for cohort through an independent simpler query:
@@ -904,13 +1190,13 @@ func TestRetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(t *test
 func TestErrorForRetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(t *testing.T) {
 	// Tests if the method returns an error when query fails.
 
-	cohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(testSourceId, defaultTeamProject)
+	cohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(context.Background(), testSourceId, defaultTeamProject)
 
 	// break something in the Results schema to cause a query failure in the next method:
 	tests.BreakSomething(models.Results, "cohort", "cohort_definition_id")
 	// set last action to restore back:
 	// run test:
-	_, error := cohortDataModel.RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(
+	_, error := cohortDataModel.RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(context.Background(),
 		testSourceId, cohortDefinitions[0].Id, allConceptIds)
 	if error == nil {
 		t.Errorf("Expected error")
@@ -926,7 +1212,7 @@ func TestRetrieveCohortOverlapStats(t *testing.T) {
 	controlCohortId := secondLargestCohort.Id // to ensure we get some overlap, just repeat the same here...
 	otherFilterConceptIds := []int64{}
 	filterCohortPairs := []utils.CustomDichotomousVariableDef{}
-	stats, _ := cohortDataModel.RetrieveCohortOverlapStats(testSourceId, caseCohortId, controlCohortId,
+	stats, _ := cohortDataModel.RetrieveCohortOverlapStats(context.Background(), testSourceId, caseCohortId, controlCohortId,
 		otherFilterConceptIds, filterCohortPairs)
 	// basic test:
 	if stats.CaseControlOverlap != int64(secondLargestCohort.CohortSize) {
@@ -943,7 +1229,7 @@ func TestRetrieveCohortOverlapStats(t *testing.T) {
 			ProvidedName:        "test"},
 	}
 	// then we expect overlap of 6 for extendedCopyOfSecondLargestCohort and largestCohort:
-	stats, _ = cohortDataModel.RetrieveCohortOverlapStats(testSourceId, caseCohortId, controlCohortId,
+	stats, _ = cohortDataModel.RetrieveCohortOverlapStats(context.Background(), testSourceId, caseCohortId, controlCohortId,
 		otherFilterConceptIds, filterCohortPairs)
 	if stats.CaseControlOverlap != 6 {
 		t.Errorf("Expected nr persons to be %d, found %d", 6, stats.CaseControlOverlap)
@@ -956,7 +1242,7 @@ func TestRetrieveCohortOverlapStats(t *testing.T) {
 	otherFilterConceptIds = []int64{histogramConceptId} // extra filter, to cover this part of the code...
 	// then we expect overlap of 5 for extendedCopyOfSecondLargestCohort and largestCohort (the filter on histogramConceptId should not matter
 	// since all in largestCohort have an observation for this concept id except one person who has it but has value_as_number as NULL):
-	stats2, _ := cohortDataModel.RetrieveCohortOverlapStats(testSourceId, caseCohortId, controlCohortId,
+	stats2, _ := cohortDataModel.RetrieveCohortOverlapStats(context.Background(), testSourceId, caseCohortId, controlCohortId,
 		otherFilterConceptIds, filterCohortPairs)
 	if stats2.CaseControlOverlap != stats.CaseControlOverlap-1 {
 		t.Errorf("Expected nr persons to be %d, found %d", stats.CaseControlOverlap, stats2.CaseControlOverlap)
@@ -967,7 +1253,7 @@ func TestRetrieveCohortOverlapStats(t *testing.T) {
 	otherFilterConceptIds = []int64{histogramConceptId, dummyContinuousConceptId}
 	// all other arguments are the same as test above, and we expect overlap of 0, showing the otherFilterConceptIds
 	// had the expected effect:
-	stats3, _ := cohortDataModel.RetrieveCohortOverlapStats(testSourceId, caseCohortId, controlCohortId,
+	stats3, _ := cohortDataModel.RetrieveCohortOverlapStats(context.Background(), testSourceId, caseCohortId, controlCohortId,
 		otherFilterConceptIds, filterCohortPairs)
 	if stats3.CaseControlOverlap != 0 {
 		t.Errorf("Expected nr persons to be 0, found %d", stats3.CaseControlOverlap)
@@ -1004,6 +1290,77 @@ func TestValidateObservationData(t *testing.T) {
 	}
 }
 
+func TestGetDataQualityRules(t *testing.T) {
+	setUp(t)
+	rules, err := models.GetDataQualityRules()
+	if err != nil {
+		t.Errorf("Did not expect an error, but got %v", err)
+	}
+	// the configured rules plus the rule for validate.single_observation_for_concept_ids:
+	ruleTypes := make(map[models.DataQualityRuleType]bool)
+	for _, rule := range rules {
+		ruleTypes[rule.Type] = true
+	}
+	if !ruleTypes[models.DataQualityRuleUniquePerPerson] || !ruleTypes[models.DataQualityRuleAllowedValues] {
+		t.Errorf("Expected the configured rules, found %v", rules)
+	}
+
+	config.GetConfig().Set("data_quality.rules", []map[string]interface{}{{"name": "range", "type": "value_range", "concept_ids": []int64{histogramConceptId}}})
+	defer config.GetConfig().Set("data_quality.rules", nil)
+	_, err = models.GetDataQualityRules()
+	if err == nil {
+		t.Errorf("Expected an error for a value_range rule without min and max")
+	}
+}
+
+func TestRunDataQualityChecks(t *testing.T) {
+	setUp(t)
+	var dataQualityModel = new(models.DataQuality)
+	_, err := dataQualityModel.GetDataQualityReport(context.Background(), testSourceId)
+	if err != models.ErrDataQualityReportNotFound {
+		t.Errorf("Expected ErrDataQualityReportNotFound before the first check, found %v", err)
+	}
+
+	maxValue := 5.0
+	config.GetConfig().Set("data_quality.rules", []map[string]interface{}{
+		{"name": "histogram_range", "type": "value_range", "concept_ids": []int64{histogramConceptId}, "max": maxValue},
+		{"name": "subjects_in_person", "type": "cohort_subject_in_person"},
+		{"name": "concepts_in_concept", "type": "observation_concept_in_concept"},
+	})
+	defer config.GetConfig().Set("data_quality.rules", nil)
+	report, err := dataQualityModel.RunDataQualityChecks(context.Background(), testSourceId)
+	if err != nil {
+		t.Errorf("Did not expect an error, but got %v", err)
+	}
+	resultsByRule := make(map[string]*models.DataQualityRuleResult)
+	for _, result := range report.Results {
+		if result.Error != "" {
+			t.Errorf("Expected rule %s to be checked, found error %s", result.RuleName, result.Error)
+		}
+		resultsByRule[result.RuleName] = result
+	}
+	// the test data has histogram values above 5 and at least one patient with more than one HARE:
+	if resultsByRule["histogram_range"].ViolationCount == 0 || len(resultsByRule["histogram_range"].SampleIds) == 0 ||
+		resultsByRule["single_observation_for_concept_ids"].ViolationCount == 0 {
+		t.Errorf("Expected violations, found %v", report.Results)
+	}
+	// all cohort subjects in the test data are persons:
+	if resultsByRule["subjects_in_person"].ViolationCount != 0 || resultsByRule["concepts_in_concept"] == nil {
+		t.Errorf("Expected no violations, found %v", report.Results)
+	}
+
+	storedReport, err := dataQualityModel.GetDataQualityReport(context.Background(), testSourceId)
+	if err != nil || len(storedReport.Results) != len(report.Results) {
+		t.Errorf("Expected the stored report, found %v and error %v", storedReport, err)
+	}
+	for _, result := range storedReport.Results {
+		if result.ViolationCount != resultsByRule[result.RuleName].ViolationCount ||
+			len(result.SampleIds) != len(resultsByRule[result.RuleName].SampleIds) {
+			t.Errorf("Expected stored result %v to match %v", result, resultsByRule[result.RuleName])
+		}
+	}
+}
+
 func TestGetVersion(t *testing.T) {
 	// mock values (in reality these are set at build time - see Dockerfile "go build" "-ldflags" argument):
 	version.GitCommit = "abc"
@@ -1015,7 +1372,10 @@ func TestGetVersion(t *testing.T) {
 }
 
 func TestGetSchemaVersion(t *testing.T) {
-	v := versionModel.GetSchemaVersion()
+	v, err := versionModel.GetSchemaVersion(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
 	if v.AtlasSchemaVersion != "1.0.1" || v.DataSchemaVersion != 1 {
 		t.Errorf("Wrong value")
 	}
@@ -1037,9 +1397,61 @@ func TestGetSourceById(t *testing.T) {
 	}
 }
 
+func TestGetDataSource(t *testing.T) {
+	dataSource, err := sourceModel.GetDataSource(testSourceId, models.Omop)
+	if err != nil || dataSource == nil || dataSource.Schema == "" {
+		t.Errorf("Expected the omop data source, found %v and error %v", dataSource, err)
+	}
+	dataSource, err = sourceModel.GetDataSource(-1, models.Omop)
+	if !errors.Is(err, models.ErrSourceNotFound) || dataSource != nil {
+		t.Errorf("Expected ErrSourceNotFound for an unknown source, found %v", err)
+	}
+	foundSource, err := sourceModel.GetSourceById(-1)
+	if err != nil || foundSource != nil {
+		t.Errorf("Expected no source and no error, found %v and %v", foundSource, err)
+	}
+}
+
+func TestGetDataSourceRejectsInvalidSchema(t *testing.T) {
+	tests.ExecAtlasSQLString(fmt.Sprintf("INSERT INTO %s.source (source_id, source_name, source_connection, source_dialect, username, password) "+
+		"SELECT 2, 'invalid schema', source_connection, source_dialect, username, password FROM %s.source WHERE source_id = %d",
+		db.GetAtlasDB().Schema, db.GetAtlasDB().Schema, testSourceId))
+	tests.ExecAtlasSQLString(fmt.Sprintf("INSERT INTO %s.source_daimon (source_daimon_id, source_id, daimon_type, table_qualifier, priority) "+
+		"VALUES (20, 2, 0, 'OMOP; DROP TABLE x', 1), (21, 2, 2, 'RESULTS', 1)", db.GetAtlasDB().Schema))
+	defer tests.ExecAtlasSQLString(fmt.Sprintf("DELETE FROM %s.source WHERE source_id = 2", db.GetAtlasDB().Schema))
+	defer tests.ExecAtlasSQLString(fmt.Sprintf("DELETE FROM %s.source_daimon WHERE source_id = 2", db.GetAtlasDB().Schema))
+
+	// the whole source is rejected, not only the daimon with the invalid schema:
+	for _, sourceType := range []models.SourceType{models.Omop, models.Results} {
+		dataSource, err := sourceModel.GetDataSource(2, sourceType)
+		if !errors.Is(err, models.ErrSourceSchemaInvalid) || dataSource != nil {
+			t.Errorf("Expected ErrSourceSchemaInvalid, found %v and error %v", dataSource, err)
+		}
+	}
+}
+
+func TestGetDataSourceCachesSourceMetadata(t *testing.T) {
+	sourceModel.InvalidateSourceMetadata(testSourceId)
+	statsBefore := sourceModel.GetSourceMetadataCacheStats()
+	for _, sourceType := range []models.SourceType{models.Omop, models.Results, models.Misc, models.Omop} {
+		if _, err := sourceModel.GetDataSource(testSourceId, sourceType); err != nil {
+			t.Errorf("Expected the data source of type %d, found error %v", sourceType, err)
+		}
+	}
+	stats := sourceModel.GetSourceMetadataCacheStats()
+	if stats.Misses != statsBefore.Misses+1 || stats.Hits != statsBefore.Hits+3 {
+		t.Errorf("Expected the source metadata to be read once, found %v", stats)
+	}
+	// unknown sources are not cached:
+	sourceModel.GetDataSource(-1, models.Omop)
+	if sourceModel.InvalidateSourceMetadata(-1) || !sourceModel.InvalidateSourceMetadata(testSourceId) {
+		t.Errorf("Expected only the test source to be cached")
+	}
+}
+
 func TestGetCohortDefinitionById(t *testing.T) {
-	allCohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitions()
-	foundCohortDefinition, _ := cohortDefinitionModel.GetCohortDefinitionById(allCohortDefinitions[0].Id)
+	allCohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitions(context.Background())
+	foundCohortDefinition, _ := cohortDefinitionModel.GetCohortDefinitionById(context.Background(), allCohortDefinitions[0].Id)
 	if allCohortDefinitions[0].Id != foundCohortDefinition.Id {
 		t.Errorf("Expected data not found")
 	}
@@ -1054,7 +1466,7 @@ func TestRetrieveDataByOriginalCohortAndNewCohort(t *testing.T) {
 	originalCohortId := thirdLargestCohort.Id
 	cohortDefinitionId := secondLargestCohort.Id
 
-	personIdAndCohortList, _ := cohortDataModel.RetrieveDataByOriginalCohortAndNewCohort(testSourceId, originalCohortId, cohortDefinitionId)
+	personIdAndCohortList, _ := cohortDataModel.RetrieveDataByOriginalCohortAndNewCohort(context.Background(), testSourceId, originalCohortId, cohortDefinitionId)
 	if len(personIdAndCohortList) != originalCohortSize {
 		t.Errorf("length of return data does not match number of people in cohort")
 	}
@@ -1069,6 +1481,30 @@ func TestRetrieveDataByOriginalCohortAndNewCohort(t *testing.T) {
 	}
 }
 
+func TestRetrieveCohortOverlapStatsWithFilteredCohortSession(t *testing.T) {
+	setUp(t)
+	ctx, session := models.NewFilteredCohortSession(context.Background())
+	defer session.Close()
+	filterCohortPairs := []utils.CustomDichotomousVariableDef{
+		{CohortDefinitionId1: smallestCohort.Id, CohortDefinitionId2: extendedCopyOfSecondLargestCohort.Id, ProvidedName: "test"},
+	}
+	resultsDB, _ := tests.GetResultsDataSource().Db.DB()
+	// same check as in TestRetrieveCohortOverlapStats, with the filtered case cohort read from a temp table of the session:
+	release := models.HoldFilteredCohortTables(ctx)
+	stats, err := cohortDataModel.RetrieveCohortOverlapStats(ctx, testSourceId, largestCohort.Id, largestCohort.Id, []int64{histogramConceptId}, filterCohortPairs)
+	inlineStats, _ := cohortDataModel.RetrieveCohortOverlapStats(context.Background(), testSourceId, largestCohort.Id, largestCohort.Id, []int64{histogramConceptId}, filterCohortPairs)
+	if err != nil || stats.CaseControlOverlap == 0 || stats != inlineStats {
+		t.Errorf("Expected the same overlap as without temp tables (%d), found %d and error %v", inlineStats.CaseControlOverlap, stats.CaseControlOverlap, err)
+	}
+	if resultsDB.Stats().InUse != 1 {
+		t.Errorf("Expected the connection with the temp table to be kept while it is held, found %d connections in use", resultsDB.Stats().InUse)
+	}
+	release()
+	if resultsDB.Stats().InUse != 0 {
+		t.Errorf("Expected the connection to be released with the temp table, found %d connections in use", resultsDB.Stats().InUse)
+	}
+}
+
 func TestAddTimeoutToQuery(t *testing.T) {
 	setUp(t)
 
@@ -1111,7 +1547,7 @@ func TestPersonConceptAndCountString(t *testing.T) {
 func TestGetDataDictionaryFail(t *testing.T) {
 	setUp(t)
 
-	data, _ := dataDictionaryModel.GetDataDictionary()
+	data, _ := dataDictionaryModel.GetDataDictionary(context.Background())
 	//Pre generation cache should be empty
 	if data != nil {
 		t.Errorf("Get Data Dictionary should have failed.")
@@ -1123,14 +1559,14 @@ func TestCheckIfDataDictionaryIsFilled(t *testing.T) {
 	var source = new(models.Source)
 	sources, _ := source.GetAllSources()
 	var dataSourceModel = new(models.Source)
-	miscDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, models.Misc)
+	miscDataSource, _ := dataSourceModel.GetDataSource(sources[0].SourceId, models.Misc)
 
-	filled := dataDictionaryModel.CheckIfDataDictionaryIsFilled(miscDataSource)
+	filled, _ := dataDictionaryModel.CheckIfDataDictionaryIsFilled(context.Background(), miscDataSource)
 	if filled != false {
 		t.Errorf("Flag should be false")
 	}
-	dataDictionaryModel.GenerateDataDictionary()
-	filled = dataDictionaryModel.CheckIfDataDictionaryIsFilled(miscDataSource)
+	dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeFillEmpty)
+	filled, _ = dataDictionaryModel.CheckIfDataDictionaryIsFilled(context.Background(), miscDataSource)
 	if filled != true {
 		t.Errorf("Flag should be true")
 	}
@@ -1138,9 +1574,9 @@ func TestCheckIfDataDictionaryIsFilled(t *testing.T) {
 
 func TestGenerateDataDictionary(t *testing.T) {
 	setUp(t)
-	dataDictionaryModel.GenerateDataDictionary()
+	dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeFillEmpty)
 	//Update this with read
-	data, _ := dataDictionaryModel.GetDataDictionary()
+	data, _ := dataDictionaryModel.GetDataDictionary(context.Background())
 	if data == nil || data.Total != 18 || data.Data == nil {
 		t.Errorf("Get Data Dictionary should have succeeded.")
 	}
@@ -1151,12 +1587,870 @@ func TestWriteToDB(t *testing.T) {
 	var source = new(models.Source)
 	sources, _ := source.GetAllSources()
 	var dataSourceModel = new(models.Source)
-	miscDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, models.Misc)
+	miscDataSource, _ := dataSourceModel.GetDataSource(sources[0].SourceId, models.Misc)
 
 	resultList := append([]*models.DataDictionaryResult{}, &models.DataDictionaryResult{ConceptID: 123})
-	success := dataDictionaryModel.WriteResultToDB(miscDataSource, resultList)
-	//Write succeeded without panicking
-	if success != true {
-		t.Errorf("Write failed")
+	err := dataDictionaryModel.WriteResultToDB(miscDataSource, resultList)
+	if err != nil {
+		t.Errorf("Write failed: %v", err)
+	}
+	// writing the same concept again violates the primary key, which
+	// should be returned as an error instead of a panic:
+	err = dataDictionaryModel.WriteResultToDB(miscDataSource, resultList)
+	if err == nil {
+		t.Errorf("Expected write of duplicate concept to fail")
+	}
+}
+
+func TestGenerateDataDictionaryRunStatus(t *testing.T) {
+	setUp(t)
+	err := dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeFillEmpty)
+	if err != nil {
+		t.Errorf("Expected generation to succeed, found error %v", err)
+	}
+	run := dataDictionaryModel.GetDataDictionaryGenerationRun()
+	if run == nil || run.Status != models.DataDictionaryGenerationCompleted ||
+		run.StartedAt == nil || run.FinishedAt == nil {
+		t.Errorf("Expected a completed generation run, found %v", run)
+	}
+	if run.ProcessedConcepts != run.TotalConcepts {
+		t.Errorf("Expected all %d concepts to be processed, found %d", run.TotalConcepts, run.ProcessedConcepts)
+	}
+}
+
+func TestStartDataDictionaryGenerationRefusesConcurrentRuns(t *testing.T) {
+	setUp(t)
+	run, err := dataDictionaryModel.StartDataDictionaryGeneration(models.DataDictionaryGenerationModeFillEmpty)
+	if err != nil || run == nil {
+		t.Errorf("Expected generation to be started, found error %v", err)
+	}
+	_, err = dataDictionaryModel.StartDataDictionaryGeneration(models.DataDictionaryGenerationModeFillEmpty)
+	if err != models.ErrDataDictionaryGenerationInProgress {
+		t.Errorf("Expected second generation request to be refused, found %v", err)
+	}
+	run = waitForDataDictionaryGenerationRun()
+	if run.Status != models.DataDictionaryGenerationCompleted {
+		t.Errorf("Expected generation run to complete, found status %s", run.Status)
+	}
+}
+
+// Waits for the background data dictionary generation run to finish and returns it.
+func waitForDataDictionaryGenerationRun() *models.DataDictionaryGenerationRun {
+	var run *models.DataDictionaryGenerationRun
+	for i := 0; i < 100; i++ {
+		run = dataDictionaryModel.GetDataDictionaryGenerationRun()
+		if run.Status != models.DataDictionaryGenerationQueued && run.Status != models.DataDictionaryGenerationRunning {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return run
+}
+
+func TestGenerateDataDictionaryIncremental(t *testing.T) {
+	setUp(t)
+	var dataSourceModel = new(models.Source)
+	miscDataSource, _ := dataSourceModel.GetDataSource(testSourceId, models.Misc)
+	err := dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeFull)
+	if err != nil {
+		t.Errorf("Expected full generation to succeed, found error %v", err)
+	}
+	countAfterFullGeneration := tests.GetCount(miscDataSource, "data_dictionary_result")
+	if countAfterFullGeneration == 0 || countAfterFullGeneration != tests.GetCount(miscDataSource, "data_dictionary_concept_fingerprint") {
+		t.Errorf("Expected one result and one fingerprint per concept")
+	}
+
+	// nothing changed, so an incremental run should not regenerate any concept:
+	err = dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeIncremental)
+	run := dataDictionaryModel.GetDataDictionaryGenerationRun()
+	if err != nil || run.TotalConcepts != 0 {
+		t.Errorf("Expected incremental generation without changes, found error %v and %d concepts", err, run.TotalConcepts)
+	}
+
+	// add an observation for the histogram concept, so only that concept should be regenerated:
+	personId := tests.GetLastPersonId(testSourceId)
+	observationId := tests.GetLastObservationId(testSourceId) + 1
+	tests.ExecSQLStringOrFail(fmt.Sprintf("INSERT into %s.observation (observation_id,person_id,observation_concept_id,value_as_number) "+
+		"values (%d, %d, %d, 1.23)", tests.GetSchemaNameForType(models.Omop), observationId, personId, histogramConceptId), testSourceId)
+	defer tests.ExecSQLStringOrFail(fmt.Sprintf("DELETE FROM %s.observation WHERE observation_id=%d",
+		tests.GetSchemaNameForType(models.Omop), observationId), testSourceId)
+
+	err = dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeIncremental)
+	run = dataDictionaryModel.GetDataDictionaryGenerationRun()
+	if err != nil || run.TotalConcepts != 1 {
+		t.Errorf("Expected incremental generation of 1 concept, found error %v and %d concepts", err, run.TotalConcepts)
+	}
+	if tests.GetCount(miscDataSource, "data_dictionary_result") != countAfterFullGeneration {
+		t.Errorf("Expected the number of data dictionary results to stay the same")
+	}
+}
+
+func TestDataDictionarySnapshots(t *testing.T) {
+	setUp(t)
+	err := dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeFull)
+	fromSnapshotId := dataDictionaryModel.GetDataDictionaryGenerationRun().SnapshotID
+	if err != nil || fromSnapshotId == 0 {
+		t.Errorf("Expected full generation to create a snapshot, found error %v", err)
+	}
+
+	// add an observation for the histogram concept, so the incremental run creates a second snapshot:
+	personId := tests.GetLastPersonId(testSourceId)
+	observationId := tests.GetLastObservationId(testSourceId) + 1
+	tests.ExecSQLStringOrFail(fmt.Sprintf("INSERT into %s.observation (observation_id,person_id,observation_concept_id,value_as_number) "+
+		"values (%d, %d, %d, 1.23)", tests.GetSchemaNameForType(models.Omop), observationId, personId, histogramConceptId), testSourceId)
+	defer tests.ExecSQLStringOrFail(fmt.Sprintf("DELETE FROM %s.observation WHERE observation_id=%d",
+		tests.GetSchemaNameForType(models.Omop), observationId), testSourceId)
+	// the test data_dictionary is a table instead of a view, so it is updated by hand to reflect the new observation:
+	tests.ExecSQLStringOrFail(fmt.Sprintf("UPDATE %s.data_dictionary SET number_of_people_where_value_is_filled = number_of_people_where_value_is_filled + 1 "+
+		"WHERE concept_id = %d", tests.GetSchemaNameForType(models.Misc), histogramConceptId), testSourceId)
+	defer tests.ExecSQLStringOrFail(fmt.Sprintf("UPDATE %s.data_dictionary SET number_of_people_where_value_is_filled = number_of_people_where_value_is_filled - 1 "+
+		"WHERE concept_id = %d", tests.GetSchemaNameForType(models.Misc), histogramConceptId), testSourceId)
+	err = dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeIncremental)
+	toSnapshotId := dataDictionaryModel.GetDataDictionaryGenerationRun().SnapshotID
+	if err != nil || toSnapshotId <= fromSnapshotId {
+		t.Errorf("Expected incremental generation to create a new snapshot, found error %v and snapshot %d", err, toSnapshotId)
+	}
+
+	snapshots, err := dataDictionaryModel.GetDataDictionarySnapshots(context.Background())
+	if err != nil || len(snapshots) < 2 || snapshots[0].SnapshotID != toSnapshotId ||
+		snapshots[0].GenerationMode != models.DataDictionaryGenerationModeIncremental || snapshots[0].NumberOfConcepts == 0 {
+		t.Errorf("Expected the most recent snapshot first, found %v and error %v", snapshots, err)
+	}
+
+	// with a threshold of 0, any change in the mean of the histogram concept is reported:
+	diff, err := dataDictionaryModel.DiffDataDictionarySnapshots(context.Background(), fromSnapshotId, toSnapshotId, 0)
+	if err != nil || len(diff.AddedConcepts) != 0 || len(diff.RemovedConcepts) != 0 {
+		t.Errorf("Expected no added or removed concepts, found %v and error %v", diff, err)
+	}
+	changedConceptIds := make(map[int64]bool)
+	for _, change := range append(diff.PeopleCountChanges, diff.DistributionShifts...) {
+		changedConceptIds[change.ConceptID] = true
+	}
+	if len(changedConceptIds) != 1 || !changedConceptIds[histogramConceptId] {
+		t.Errorf("Expected only changes for concept %d, found %v", histogramConceptId, diff)
+	}
+	// comparing a snapshot with itself should not report any change:
+	diff, _ = dataDictionaryModel.DiffDataDictionarySnapshots(context.Background(), toSnapshotId, toSnapshotId, 0)
+	if len(diff.PeopleCountChanges) != 0 || len(diff.DistributionShifts) != 0 {
+		t.Errorf("Expected no changes, found %v", diff)
+	}
+
+	_, err = dataDictionaryModel.DiffDataDictionarySnapshots(context.Background(), fromSnapshotId, -1, 0.1)
+	if err != models.ErrDataDictionarySnapshotNotFound {
+		t.Errorf("Expected ErrDataDictionarySnapshotNotFound, found %v", err)
+	}
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dataDictionaryModel.DiffDataDictionarySnapshots(cancelledCtx, fromSnapshotId, toSnapshotId, 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the diff to be cancelled, found error %v", err)
+	}
+}
+
+func TestDataDictionarySnapshotDiffOfSmallValues(t *testing.T) {
+	setUp(t)
+	var snapshotIds []int64
+	for i := 0; i < 2; i++ {
+		if err := dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeFull); err != nil {
+			t.Fatalf("Expected full generation to succeed, found error %v", err)
+		}
+		snapshotIds = append(snapshotIds, dataDictionaryModel.GetDataDictionaryGenerationRun().SnapshotID)
+	}
+	// a mean going from 0.02 to 0.2 is a 10x change, and a standard deviation going from 0 to 0.1 has no relative size:
+	miscDataSource, _ := sourceModel.GetDataSource(testSourceId, models.Misc)
+	setSnapshotValues := func(snapshotId int64, meanValue float64, standardDeviation float64) {
+		tests.ExecSQLStringOrFail(fmt.Sprintf("UPDATE %s SET mean_value = %v, standard_deviation = %v WHERE snapshot_id = %d AND concept_id = %d",
+			miscDataSource.Table("data_dictionary_snapshot_result"), meanValue, standardDeviation, snapshotId, histogramConceptId), testSourceId)
+	}
+	setSnapshotValues(snapshotIds[0], 0.02, 0)
+	setSnapshotValues(snapshotIds[1], 0.2, 0.1)
+
+	diff, err := dataDictionaryModel.DiffDataDictionarySnapshots(context.Background(), snapshotIds[0], snapshotIds[1], 0.5)
+	if err != nil || len(diff.DistributionShifts) != 2 {
+		t.Fatalf("Expected 2 distribution shifts, found %v and error %v", diff, err)
+	}
+	for _, shift := range diff.DistributionShifts {
+		if shift.ConceptID != histogramConceptId {
+			t.Errorf("Expected only shifts for concept %d, found %v", histogramConceptId, shift)
+		} else if shift.Field == "meanValue" && (shift.RelativeChange == nil || math.Abs(*shift.RelativeChange-9) > 1e-9) {
+			t.Errorf("Expected a relative change of 9 for the mean, found %v", shift.RelativeChange)
+		} else if shift.Field == "standardDeviation" && shift.RelativeChange != nil {
+			t.Errorf("Expected no relative change for the standard deviation, found %v", *shift.RelativeChange)
+		}
+	}
+}
+
+func TestDataDictionarySnapshotRetention(t *testing.T) {
+	setUp(t)
+	config.GetConfig().Set("data_dictionary_snapshot_retention", 2)
+	defer config.GetConfig().Set("data_dictionary_snapshot_retention", nil)
+	var snapshotIds []int64
+	for i := 0; i < 3; i++ {
+		if err := dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeFull); err != nil {
+			t.Fatalf("Expected full generation to succeed, found error %v", err)
+		}
+		snapshotIds = append(snapshotIds, dataDictionaryModel.GetDataDictionaryGenerationRun().SnapshotID)
+	}
+	// only the 2 most recent snapshots, and their results, are kept:
+	snapshots, err := dataDictionaryModel.GetDataDictionarySnapshots(context.Background())
+	if err != nil || len(snapshots) != 2 || snapshots[0].SnapshotID != snapshotIds[2] || snapshots[1].SnapshotID != snapshotIds[1] {
+		t.Errorf("Expected snapshots %v, found %v and error %v", snapshotIds[1:], snapshots, err)
+	}
+	miscDataSource, _ := sourceModel.GetDataSource(testSourceId, models.Misc)
+	if count := tests.GetCountWhere(miscDataSource, "data_dictionary_snapshot_result", fmt.Sprintf("snapshot_id = %d", snapshotIds[0])); count != 0 {
+		t.Errorf("Expected the results of the removed snapshot to be removed, found %d", count)
+	}
+	if count := tests.GetCountWhere(miscDataSource, "data_dictionary_snapshot_result", fmt.Sprintf("snapshot_id = %d", snapshotIds[2])); count != int64(snapshots[0].NumberOfConcepts) {
+		t.Errorf("Expected %d results in the most recent snapshot, found %d", snapshots[0].NumberOfConcepts, count)
+	}
+}
+
+func TestRefreshDataDictionaryConcept(t *testing.T) {
+	setUp(t)
+	dataDictionary, _ := dataDictionaryModel.GetDataDictionary(context.Background())
+	result, err := dataDictionaryModel.RefreshDataDictionaryConcept(context.Background(), histogramConceptId)
+	if err != nil || result == nil || result.ConceptID != histogramConceptId || result.ValueSummary == nil {
+		t.Errorf("Expected refreshed entry for concept %d, found %v and error %v", histogramConceptId, result, err)
+	}
+	// the refresh is tracked as a generation run:
+	run := dataDictionaryModel.GetDataDictionaryGenerationRun()
+	if run.Mode != models.DataDictionaryGenerationModeConcept || run.Status != models.DataDictionaryGenerationCompleted || run.ProcessedConcepts != 1 {
+		t.Errorf("Expected a completed concept run, found %v", run)
+	}
+	// and the cached data dictionary is read again:
+	if refreshedDataDictionary, _ := dataDictionaryModel.GetDataDictionary(context.Background()); refreshedDataDictionary == dataDictionary {
+		t.Errorf("Expected the cached data dictionary to be replaced after the refresh")
+	}
+	// a refresh is refused while another run is active:
+	if _, err := dataDictionaryModel.StartDataDictionaryGeneration(models.DataDictionaryGenerationModeIncremental); err != nil {
+		t.Fatalf("Expected generation to be started, found error %v", err)
+	}
+	_, err = dataDictionaryModel.RefreshDataDictionaryConcept(context.Background(), histogramConceptId)
+	waitForDataDictionaryGenerationRun()
+	if err != models.ErrDataDictionaryGenerationInProgress {
+		t.Errorf("Expected ErrDataDictionaryGenerationInProgress, found %v", err)
+	}
+	_, err = dataDictionaryModel.RefreshDataDictionaryConcept(context.Background(), -1)
+	if err != models.ErrConceptNotInDataDictionary {
+		t.Errorf("Expected ErrConceptNotInDataDictionary, found %v", err)
+	}
+	// a failed generation is returned as an error:
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failedResult, err := dataDictionaryModel.RefreshDataDictionaryConcept(cancelledCtx, histogramConceptId)
+	if !errors.Is(err, context.Canceled) || failedResult != nil {
+		t.Errorf("Expected the generation error, found %v and error %v", failedResult, err)
+	}
+}
+
+func TestGenerateDataWithSqlAggregation(t *testing.T) {
+	setUp(t)
+	entry := &models.DataDictionaryEntry{ConceptID: histogramConceptId, ValueStoredAs: "Number"}
+	inMemoryResult, err := models.GenerateData(context.Background(), entry, testSourceId)
+	if err != nil {
+		t.Errorf("Expected in-memory generation to succeed, found error %v", err)
+	}
+	sqlResult, err := models.GenerateDataWithSqlAggregation(context.Background(), entry, testSourceId)
+	if err != nil {
+		t.Fatalf("Expected sql generation to succeed, found error %v", err)
+	}
+	var inMemoryHistogram, sqlHistogram []utils.HistogramColumn
+	json.Unmarshal(inMemoryResult.ValueSummary, &inMemoryHistogram)
+	json.Unmarshal(sqlResult.ValueSummary, &sqlHistogram)
+	// the in-memory generator reads the values as float32:
+	if len(sqlHistogram) == 0 || float32(sqlHistogram[0].Start) != float32(inMemoryHistogram[0].Start) {
+		t.Errorf("Expected the sql histogram to start at %v, found %v", inMemoryHistogram, sqlHistogram)
+	}
+	// both histograms should be built from the same values, even if the bin widths differ slightly:
+	countPeople := func(histogram []utils.HistogramColumn) int {
+		total := 0
+		for _, column := range histogram {
+			total += column.NumberOfPeople
+		}
+		return total
+	}
+	if countPeople(sqlHistogram) != countPeople(inMemoryHistogram) {
+		t.Errorf("Expected %d people in the sql histogram, found %d", countPeople(inMemoryHistogram), countPeople(sqlHistogram))
+	}
+	if float32(sqlResult.MinValue) != float32(inMemoryHistogram[0].Start) || sqlResult.MaxValue < sqlResult.MinValue {
+		t.Errorf("Expected min and max values to be computed, found %v and %v", sqlResult.MinValue, sqlResult.MaxValue)
+	}
+	if sqlResult.NumberOfPeopleWhereValueIsFilled == 0 || sqlResult.NumberOfPeopleWithVariable < sqlResult.NumberOfPeopleWhereValueIsFilled {
+		t.Errorf("Expected the person counts to be computed, found %v with variable and %v with value",
+			sqlResult.NumberOfPeopleWithVariable, sqlResult.NumberOfPeopleWhereValueIsFilled)
+	}
+
+	// concept id concepts get the same bar graph as the in-memory generator:
+	entry = &models.DataDictionaryEntry{ConceptID: histogramConceptId, ValueStoredAs: "Concept Id"}
+	inMemoryResult, _ = models.GenerateData(context.Background(), entry, testSourceId)
+	sqlResult, _ = models.GenerateDataWithSqlAggregation(context.Background(), entry, testSourceId)
+	if string(sqlResult.ValueSummary) != string(inMemoryResult.ValueSummary) {
+		t.Errorf("Expected bar graph %s, found %s", inMemoryResult.ValueSummary, sqlResult.ValueSummary)
+	}
+}
+
+func TestGenerateDataDictionaryWithSqlGenerator(t *testing.T) {
+	setUp(t)
+	config.GetConfig().Set("data_dictionary_generator", string(models.DataDictionaryGeneratorSql))
+	defer config.GetConfig().Set("data_dictionary_generator", string(models.DataDictionaryGeneratorInMemory))
+
+	err := dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeFull)
+	run := dataDictionaryModel.GetDataDictionaryGenerationRun()
+	if err != nil || run.Generator != models.DataDictionaryGeneratorSql || len(run.ConceptErrors) > 0 {
+		t.Errorf("Expected generation with the sql generator to succeed, found error %v and run %v", err, run)
+	}
+	data, _ := dataDictionaryModel.GetDataDictionary(context.Background())
+	if data == nil || data.Total != 18 {
+		t.Errorf("Expected all data dictionary entries to be generated")
+	}
+}
+
+func TestSearchDataDictionary(t *testing.T) {
+	setUp(t)
+	dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeFull)
+
+	// the test data has 3 data dictionary entries, for a total of 18 persons:
+	page, err := dataDictionaryModel.SearchDataDictionary(context.Background(), models.DataDictionaryQuery{Page: 1, PageSize: 2})
+	if err != nil || page.Total != 18 || page.TotalEntries != 3 || len(page.Data) != 2 {
+		t.Errorf("Expected first page of 2 out of 3 entries, found %v and error %v", page, err)
+	}
+	lastPage, _ := dataDictionaryModel.SearchDataDictionary(context.Background(), models.DataDictionaryQuery{Page: 2, PageSize: 2})
+	if len(lastPage.Data) != 1 || lastPage.Data[0].ConceptID == page.Data[0].ConceptID || lastPage.Data[0].ConceptID == page.Data[1].ConceptID {
+		t.Errorf("Expected last page with the remaining entry, found %v", lastPage.Data)
+	}
+
+	page, _ = dataDictionaryModel.SearchDataDictionary(context.Background(), models.DataDictionaryQuery{ValueStoredAs: "Number", Page: 1, PageSize: 50,
+		SortBy: "numberOfPeopleWithVariable", SortDescending: true})
+	for i, entry := range page.Data {
+		if entry.ValueStoredAs != "Number" {
+			t.Errorf("Expected only numeric entries, found %v", entry)
+		}
+		if i > 0 && entry.NumberOfPeopleWithVariable > page.Data[i-1].NumberOfPeopleWithVariable {
+			t.Errorf("Expected entries sorted on number of people in descending order")
+		}
+	}
+
+	// search on (part of) the name of the histogram concept, ignoring case:
+	histogramEntries, _ := dataDictionaryModel.SearchDataDictionary(context.Background(), models.DataDictionaryQuery{Page: 1, PageSize: 50})
+	var conceptName string
+	for _, entry := range histogramEntries.Data {
+		if entry.ConceptID == histogramConceptId {
+			conceptName = entry.ConceptName
+		}
+	}
+	page, _ = dataDictionaryModel.SearchDataDictionary(context.Background(), models.DataDictionaryQuery{Search: strings.ToUpper(conceptName), Page: 1, PageSize: 50,
+		MinPopulation: 1})
+	if page.TotalEntries < 1 || page.Data[0].ConceptName != conceptName {
+		t.Errorf("Expected to find concept '%s', found %v", conceptName, page.Data)
+	}
+	// the LIKE wildcards in the search text only match themselves:
+	page, _ = dataDictionaryModel.SearchDataDictionary(context.Background(), models.DataDictionaryQuery{Search: "_", Page: 1, PageSize: 50})
+	if page.TotalEntries == 0 || page.TotalEntries == histogramEntries.TotalEntries {
+		t.Errorf("Expected only the entries with a '_' in their name or code, found %v", page.Data)
+	}
+	for _, entry := range page.Data {
+		if !strings.Contains(entry.ConceptName+entry.ConceptCode, "_") {
+			t.Errorf("Expected only entries with a '_' in their name or code, found '%s' (%s)", entry.ConceptName, entry.ConceptCode)
+		}
+	}
+
+	page, _ = dataDictionaryModel.SearchDataDictionary(context.Background(), models.DataDictionaryQuery{VocabularyIDs: []string{"nonexisting"}, Page: 1, PageSize: 50})
+	if page.TotalEntries != 0 || len(page.Data) != 0 {
+		t.Errorf("Expected no entries, found %v", page.Data)
+	}
+	// the queries are cancelled together with the request:
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dataDictionaryModel.SearchDataDictionary(cancelledCtx, models.DataDictionaryQuery{Page: 1, PageSize: 2})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the search to be cancelled, found error %v", err)
+	}
+}
+
+func TestGetCohortGenerationInfo(t *testing.T) {
+	setUp(t)
+	cohortGenerationInfo, err := cohortDefinitionModel.GetCohortGenerationInfo(context.Background(), 2, testSourceId)
+	if err != nil || cohortGenerationInfo == nil || cohortGenerationInfo.PersonCount != 2 || cohortGenerationInfo.StartTime.IsZero() {
+		t.Errorf("Expected generation info of cohort 2, found %v and error %v", cohortGenerationInfo, err)
+	}
+	// cohort 5 has a canceled and cohort 6 an invalid generation:
+	for _, cohortDefinitionId := range []int{5, 6} {
+		cohortGenerationInfo, err = cohortDefinitionModel.GetCohortGenerationInfo(context.Background(), cohortDefinitionId, testSourceId)
+		if err != nil || cohortGenerationInfo != nil {
+			t.Errorf("Expected no generation info for cohort %d, found %v and error %v", cohortDefinitionId, cohortGenerationInfo, err)
+		}
+	}
+}
+
+func TestGetCohortGenerationDetails(t *testing.T) {
+	setUp(t)
+	cohortGenerationDetails, err := cohortDefinitionModel.GetCohortGenerationDetails(context.Background(), 2)
+	if err != nil || len(cohortGenerationDetails) == 0 || cohortGenerationDetails[0].SourceId != testSourceId ||
+		!cohortGenerationDetails[0].IsValid || cohortGenerationDetails[0].PersonCount != 2 {
+		t.Errorf("Expected generation info of cohort 2, found %v and error %v", cohortGenerationDetails, err)
+	}
+	// unlike GetCohortGenerationInfo, the canceled generation of cohort 5 is also returned:
+	cohortGenerationDetails, err = cohortDefinitionModel.GetCohortGenerationDetails(context.Background(), 5)
+	if err != nil || len(cohortGenerationDetails) == 0 || !cohortGenerationDetails[0].IsCanceled {
+		t.Errorf("Expected the canceled generation of cohort 5, found %v and error %v", cohortGenerationDetails, err)
+	}
+	cohortGenerationDetails, _ = cohortDefinitionModel.GetCohortGenerationDetails(context.Background(), -1)
+	if len(cohortGenerationDetails) != 0 {
+		t.Errorf("Expected no generation info, found %v", cohortGenerationDetails)
+	}
+}
+
+func TestStreamCohortMembers(t *testing.T) {
+	setUp(t)
+	var members []*models.CohortMember
+	err := cohortDataModel.StreamCohortMembers(context.Background(), testSourceId, largestCohort.Id, func(member *models.CohortMember) error {
+		members = append(members, member)
+		return nil
+	})
+	if err != nil || len(members) != largestCohort.CohortSize || members[0].CohortStartDate.IsZero() || members[0].CohortEndDate.IsZero() {
+		t.Errorf("Expected %d members, found %d and error %v", largestCohort.CohortSize, len(members), err)
+	}
+	for i := 1; i < len(members); i++ {
+		if members[i-1].SubjectId > members[i].SubjectId {
+			t.Errorf("Expected members ordered by subject id")
+		}
+	}
+
+	// an error returned by the callback stops the streaming:
+	count := 0
+	err = cohortDataModel.StreamCohortMembers(context.Background(), testSourceId, largestCohort.Id, func(member *models.CohortMember) error {
+		count++
+		return errors.New("stop")
+	})
+	if err == nil || count != 1 {
+		t.Errorf("Expected streaming to stop after the first member, found %d members and error %v", count, err)
+	}
+}
+
+func newCohortMembers(personIds ...int64) []models.NewCohortMember {
+	var members []models.NewCohortMember
+	for _, personId := range personIds {
+		members = append(members, models.NewCohortMember{PersonId: personId})
+	}
+	return members
+}
+
+func TestCreateCohortFromPersonIds(t *testing.T) {
+	setUp(t)
+	teamProject := "someotherrole"
+	members := append(newCohortMembers(1, 2, 2), models.NewCohortMember{PersonId: 3,
+		CohortStartDate: time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC), CohortEndDate: time.Date(2016, 5, 31, 0, 0, 0, 0, time.UTC)})
+	cohortDefinition, err := cohortDefinitionModel.CreateCohortFromPersonIds(context.Background(), testSourceId, "uploaded cohort", "curated list", teamProject, members)
+	if err != nil || cohortDefinition == nil {
+		t.Fatalf("Expected the cohort to be created, found error %v", err)
+	}
+	defer deleteTestCohort(cohortDefinition.Id)
+
+	// the cohort should be usable right away:
+	cohortDefinitionIds, _ := cohortDefinitionModel.GetCohortDefinitionIdsForTeamProject(context.Background(), teamProject)
+	if !slices.Contains(cohortDefinitionIds, cohortDefinition.Id) {
+		t.Errorf("Expected cohort %d to be part of %s, found %v", cohortDefinition.Id, teamProject, cohortDefinitionIds)
+	}
+	cohortGenerationInfo, _ := cohortDefinitionModel.GetCohortGenerationInfo(context.Background(), cohortDefinition.Id, testSourceId)
+	if cohortGenerationInfo == nil || cohortGenerationInfo.PersonCount != 3 {
+		t.Errorf("Expected a valid generation of 3 persons, found %v", cohortGenerationInfo)
+	}
+	storedCohortDefinition, _ := cohortDefinitionModel.GetCohortDefinitionById(context.Background(), cohortDefinition.Id)
+	if storedCohortDefinition == nil || storedCohortDefinition.Name != "uploaded cohort" {
+		t.Errorf("Expected the stored cohort definition, found %v", storedCohortDefinition)
+	}
+	var cohortMembers []string
+	cohortDataModel.StreamCohortMembers(context.Background(), testSourceId, cohortDefinition.Id, func(member *models.CohortMember) error {
+		cohortMembers = append(cohortMembers, fmt.Sprintf("%d %s %s", member.SubjectId,
+			member.CohortStartDate.Format(time.DateOnly), member.CohortEndDate.Format(time.DateOnly)))
+		return nil
+	})
+	// persons 1 and 2 get the bounds of their observation periods, and person 3 the uploaded dates:
+	expectedCohortMembers := []string{"1 2005-03-01 2020-12-31", "2 2011-02-01 2021-01-31", "3 2015-06-01 2016-05-31"}
+	if !slices.Equal(cohortMembers, expectedCohortMembers) {
+		t.Errorf("Expected members %v, found %v", expectedCohortMembers, cohortMembers)
+	}
+
+	_, err = cohortDefinitionModel.CreateCohortFromPersonIds(context.Background(), testSourceId, "uploaded cohort", "", teamProject, newCohortMembers(1))
+	if err != models.ErrCohortNameAlreadyExists {
+		t.Errorf("Expected ErrCohortNameAlreadyExists, found %v", err)
+	}
+	_, err = cohortDefinitionModel.CreateCohortFromPersonIds(context.Background(), testSourceId, "other cohort", "", teamProject, newCohortMembers(1, 999999))
+	if !errors.Is(err, models.ErrPersonIdsNotFound) {
+		t.Errorf("Expected ErrPersonIdsNotFound, found %v", err)
+	}
+	// person 18 has no observation period:
+	_, err = cohortDefinitionModel.CreateCohortFromPersonIds(context.Background(), testSourceId, "other cohort", "", teamProject, newCohortMembers(1, 18))
+	if !errors.Is(err, models.ErrObservationPeriodNotFound) {
+		t.Errorf("Expected ErrObservationPeriodNotFound, found %v", err)
+	}
+	_, err = cohortDefinitionModel.CreateCohortFromPersonIds(context.Background(), testSourceId, "other cohort", "", teamProject,
+		[]models.NewCohortMember{{PersonId: 1, CohortStartDate: time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)}})
+	if !errors.Is(err, models.ErrInvalidCohortDates) {
+		t.Errorf("Expected ErrInvalidCohortDates, found %v", err)
+	}
+	_, err = cohortDefinitionModel.CreateCohortFromPersonIds(context.Background(), testSourceId, "other cohort", "", "unknownteamproject", newCohortMembers(1))
+	if err != models.ErrTeamProjectNotFound {
+		t.Errorf("Expected ErrTeamProjectNotFound, found %v", err)
+	}
+	otherCohortDefinition, _ := cohortDefinitionModel.GetCohortDefinitionByName(context.Background(), "other cohort")
+	if otherCohortDefinition != nil {
+		t.Errorf("Expected no cohort definition to be left after the failed uploads")
+	}
+}
+
+func TestConcurrentCreateCohortFromPersonIdsWithSameName(t *testing.T) {
+	setUp(t)
+	var wg sync.WaitGroup
+	createdCohortDefinitions := make([]*models.CohortDefinition, 4)
+	for i := range createdCohortDefinitions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			createdCohortDefinitions[i], _ = cohortDefinitionModel.CreateCohortFromPersonIds(context.Background(), testSourceId,
+				"concurrently uploaded cohort", "", "someotherrole", newCohortMembers(1, 2))
+		}()
+	}
+	wg.Wait()
+	var createdCohortDefinitionIds []int
+	for _, cohortDefinition := range createdCohortDefinitions {
+		if cohortDefinition != nil {
+			createdCohortDefinitionIds = append(createdCohortDefinitionIds, cohortDefinition.Id)
+			defer deleteTestCohort(cohortDefinition.Id)
+		}
+	}
+	if len(createdCohortDefinitionIds) != 1 {
+		t.Errorf("Expected a single cohort definition to be created, found %v", createdCohortDefinitionIds)
+	}
+}
+
+func TestCreateCohortFromPersonIdsWithoutResultsDaimon(t *testing.T) {
+	setUp(t)
+	// a source with the omop schema of the test source, but without results schema:
+	tests.ExecAtlasSQLString(fmt.Sprintf("INSERT INTO %s.source (source_id, source_name, source_connection, source_dialect, username, password) "+
+		"SELECT 2, 'no results', source_connection, source_dialect, username, password FROM %s.source WHERE source_id = %d",
+		db.GetAtlasDB().Schema, db.GetAtlasDB().Schema, testSourceId))
+	tests.ExecAtlasSQLString(fmt.Sprintf("INSERT INTO %s.source_daimon (source_daimon_id, source_id, daimon_type, table_qualifier, priority) "+
+		"SELECT 20, 2, daimon_type, table_qualifier, priority FROM %s.source_daimon WHERE source_id = %d and daimon_type = 0",
+		db.GetAtlasDB().Schema, db.GetAtlasDB().Schema, testSourceId))
+	defer sourceModel.InvalidateSourceMetadata(2)
+	defer tests.ExecAtlasSQLString(fmt.Sprintf("DELETE FROM %s.source WHERE source_id = 2", db.GetAtlasDB().Schema))
+	defer tests.ExecAtlasSQLString(fmt.Sprintf("DELETE FROM %s.source_daimon WHERE source_id = 2", db.GetAtlasDB().Schema))
+	sourceModel.InvalidateSourceMetadata(2)
+
+	_, err := cohortDefinitionModel.CreateCohortFromPersonIds(context.Background(), 2, "cohort without results", "", "someotherrole", newCohortMembers(1))
+	if !errors.Is(err, models.ErrSourceDaimonNotConfigured) {
+		t.Errorf("Expected ErrSourceDaimonNotConfigured, found %v", err)
+	}
+	// no cohort definition is created when the members cannot be written:
+	if cohortDefinition, _ := cohortDefinitionModel.GetCohortDefinitionByName(context.Background(), "cohort without results"); cohortDefinition != nil {
+		t.Errorf("Expected no cohort definition to be created, found %v", cohortDefinition)
+	}
+}
+
+func TestCreateCohortFromSetExpression(t *testing.T) {
+	setUp(t)
+	teamProject := "someotherrole"
+	// cohorts 3 and 32 have persons 1 to 6, and cohort 2 has persons 2 and 3:
+	expression, _ := utils.ParseCohortSetExpression("(3 & 32) - 2")
+	cohortDefinition, err := cohortDefinitionModel.CreateCohortFromSetExpression(context.Background(), testSourceId, "combined cohort", "", teamProject, expression)
+	if err != nil || cohortDefinition == nil {
+		t.Fatalf("Expected the cohort to be created, found error %v", err)
+	}
+	defer deleteTestCohort(cohortDefinition.Id)
+
+	var subjectIds []int64
+	cohortDataModel.StreamCohortMembers(context.Background(), testSourceId, cohortDefinition.Id, func(member *models.CohortMember) error {
+		subjectIds = append(subjectIds, member.SubjectId)
+		return nil
+	})
+	if !slices.Equal(subjectIds, []int64{1, 4, 5, 6}) {
+		t.Errorf("Expected members 1, 4, 5 and 6, found %v", subjectIds)
+	}
+	cohortGenerationInfo, _ := cohortDefinitionModel.GetCohortGenerationInfo(context.Background(), cohortDefinition.Id, testSourceId)
+	if cohortGenerationInfo == nil || cohortGenerationInfo.PersonCount != 4 {
+		t.Errorf("Expected a valid generation of 4 persons, found %v", cohortGenerationInfo)
+	}
+
+	// the dates of the members are taken from the cohorts of the expression:
+	resultsDataSource, _ := sourceModel.GetDataSource(testSourceId, models.Results)
+	tests.ExecSQLStringOrFail(fmt.Sprintf("INSERT INTO %s (cohort_definition_id, subject_id, cohort_start_date, cohort_end_date) "+
+		"VALUES (3, 2, '2000-01-01', '2010-12-31'), (2, 4, '2000-01-01', '2001-01-01')", resultsDataSource.Table("cohort")), testSourceId)
+	defer tests.ExecSQLStringOrFail(fmt.Sprintf("DELETE FROM %s WHERE cohort_start_date = '2000-01-01'", resultsDataSource.Table("cohort")), testSourceId)
+	getCohortMemberDates := func(cohortDefinitionId int) map[int64]string {
+		memberDates := make(map[int64]string)
+		cohortDataModel.StreamCohortMembers(context.Background(), testSourceId, cohortDefinitionId, func(member *models.CohortMember) error {
+			memberDates[member.SubjectId] = member.CohortStartDate.Format(time.DateOnly) + " " + member.CohortEndDate.Format(time.DateOnly)
+			return nil
+		})
+		return memberDates
+	}
+	originalDates := getCohortMemberDates(2)[2]
+	// a union spans the dates of both cohorts:
+	expression, _ = utils.ParseCohortSetExpression("2 | 3")
+	unionCohortDefinition, err := cohortDefinitionModel.CreateCohortFromSetExpression(context.Background(), testSourceId, "union cohort", "", teamProject, expression)
+	if err != nil {
+		t.Fatalf("Expected the union cohort to be created, found error %v", err)
+	}
+	defer deleteTestCohort(unionCohortDefinition.Id)
+	unionDates := getCohortMemberDates(unionCohortDefinition.Id)
+	if len(unionDates) != 6 || unionDates[2] != "2000-01-01 "+originalDates[11:] || unionDates[4] != "2000-01-01 "+originalDates[11:] {
+		t.Errorf("Expected the dates of persons 2 and 4 to span both cohorts, found %v", unionDates)
+	}
+	// an intersect keeps the overlapping dates, and leaves out person 4 as its dates in the two cohorts do not overlap:
+	expression, _ = utils.ParseCohortSetExpression("2 & 3")
+	intersectCohortDefinition, err := cohortDefinitionModel.CreateCohortFromSetExpression(context.Background(), testSourceId, "intersect cohort", "", teamProject, expression)
+	if err != nil {
+		t.Fatalf("Expected the intersect cohort to be created, found error %v", err)
+	}
+	defer deleteTestCohort(intersectCohortDefinition.Id)
+	intersectDates := getCohortMemberDates(intersectCohortDefinition.Id)
+	if len(intersectDates) != 2 || intersectDates[2] != originalDates || intersectDates[3] != originalDates {
+		t.Errorf("Expected persons 2 and 3 with dates %s, found %v", originalDates, intersectDates)
+	}
+
+	// cohort 5 has no generation:
+	expression, _ = utils.ParseCohortSetExpression("3 | 5")
+	_, err = cohortDefinitionModel.CreateCohortFromSetExpression(context.Background(), testSourceId, "other cohort", "", teamProject, expression)
+	if !errors.Is(err, models.ErrCohortNotGenerated) {
+		t.Errorf("Expected ErrCohortNotGenerated, found %v", err)
+	}
+	// an empty result is not stored:
+	expression, _ = utils.ParseCohortSetExpression("2 - 3")
+	_, err = cohortDefinitionModel.CreateCohortFromSetExpression(context.Background(), testSourceId, "other cohort", "", teamProject, expression)
+	if err != models.ErrEmptyCohort {
+		t.Errorf("Expected ErrEmptyCohort, found %v", err)
+	}
+}
+
+func TestGetCohortSetExpressionSQL(t *testing.T) {
+	setUp(t)
+	expression, _ := utils.ParseCohortSetExpression("1 | 2 & 3")
+	sql, params := models.GetCohortSetExpressionSQL(expression, &utils.DbAndSchema{Schema: "results"})
+	leaf := `SELECT subject_id, min(cohort_start_date) as cohort_start_date, max(cohort_end_date) as cohort_end_date ` +
+		`FROM "results"."cohort" WHERE cohort_definition_id=? GROUP BY subject_id`
+	intersect := "SELECT left_operand.subject_id, " +
+		"CASE WHEN left_operand.cohort_start_date > right_operand.cohort_start_date THEN left_operand.cohort_start_date " +
+		"ELSE right_operand.cohort_start_date END as cohort_start_date, " +
+		"CASE WHEN left_operand.cohort_end_date < right_operand.cohort_end_date THEN left_operand.cohort_end_date " +
+		"ELSE right_operand.cohort_end_date END as cohort_end_date " +
+		"FROM (" + leaf + ") as left_operand JOIN (" + leaf + ") as right_operand " +
+		"ON left_operand.subject_id = right_operand.subject_id " +
+		"WHERE left_operand.cohort_start_date <= right_operand.cohort_end_date AND right_operand.cohort_start_date <= left_operand.cohort_end_date"
+	expectedSQL := "SELECT subject_id, min(cohort_start_date) as cohort_start_date, max(cohort_end_date) as cohort_end_date " +
+		"FROM ((" + leaf + ") UNION ALL (" + intersect + ")) as operands GROUP BY subject_id"
+	if sql != expectedSQL || !reflect.DeepEqual(params, []interface{}{1, 2, 3}) {
+		t.Errorf("Unexpected SQL %s with params %v", sql, params)
+	}
+}
+
+func TestParseCohortExpression(t *testing.T) {
+	setUp(t)
+	// the test cohorts have no real Atlas expression, which should be kept as unknown field:
+	cohortDefinition, _ := cohortDefinitionModel.GetCohortDefinitionById(context.Background(), largestCohort.Id)
+	cohortExpression, err := models.ParseCohortExpression(cohortDefinition.Expression)
+	if err != nil || cohortExpression.UnknownFields["expression"] == nil || len(cohortExpression.Summary()) != 1 {
+		t.Errorf("Expected the expression to be kept as unknown field, found %v and error %v", cohortExpression, err)
+	}
+
+	expression := `{"ConceptSets":[{"id":1,"name":"metformin","expression":{"items":[{"concept":{"CONCEPT_ID":1503297,"CONCEPT_NAME":"metformin"},` +
+		`"isExcluded":false,"includeDescendants":true,"includeMapped":false}]}}],` +
+		`"PrimaryCriteria":{"CriteriaList":[{"DrugExposure":{"CodesetId":1,"First":true}}],"ObservationWindow":{"PriorDays":0,"PostDays":0},` +
+		`"PrimaryCriteriaLimit":{"Type":"All"}},"InclusionRules":[{"name":"no prior metformin","expression":{"Type":"AT_MOST","Count":0,` +
+		`"CriteriaList":[{"Criteria":{"DrugExposure":{"CodesetId":1}},"StartWindow":{"Start":{"Coeff":-1},"End":{"Days":1,"Coeff":-1}},` +
+		`"Occurrence":{"Type":1,"Count":0}}]}}],"EndStrategy":{"CustomEra":{"DrugCodesetId":1,"GapDays":30,"Offset":0}},` +
+		`"CollapseSettings":{"CollapseType":"ERA","EraPad":0},"cdmVersionRange":">=5.0.0"}`
+	cohortExpression, err = models.ParseCohortExpression(expression)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expectedSummary := []string{
+		"Concept set 1 'metformin': metformin (1503297) and descendants",
+		"Entry events: DrugExposure of concept set 'metformin', with 0 days of observation before and 0 days after the event; " +
+			"limited to all events per person",
+		"Inclusion rule 1: no prior metformin: at most 0 of at most 0 of DrugExposure of concept set 'metformin'",
+		"Cohort exit: end of continuous drug exposure, allowing 30 days between exposures of concept set 'metformin', plus 0 days",
+	}
+	if !slices.Equal(cohortExpression.Summary(), expectedSummary) {
+		t.Errorf("Expected summary %v, found %v", expectedSummary, cohortExpression.Summary())
+	}
+	// marshaling the parsed expression should give back the same JSON, including the unknown fields:
+	marshaledExpression, _ := json.Marshal(cohortExpression)
+	var expected, found interface{}
+	json.Unmarshal([]byte(expression), &expected)
+	json.Unmarshal(marshaledExpression, &found)
+	if !reflect.DeepEqual(expected, found) {
+		t.Errorf("Expected %s, found %s", expression, marshaledExpression)
+	}
+
+	_, err = models.ParseCohortExpression(`{"PrimaryCriteria":{"CriteriaList":[{"DrugExposure":{},"ConditionOccurrence":{}}]}}`)
+	if err == nil {
+		t.Errorf("Expected an error for a criteria on two domains")
+	}
+}
+
+// An expression as exported by Atlas, which writes the fields that are not set as empty or null:
+const atlasCohortExpression = `{
+  "Title": "",
+  "ConceptSets": [],
+  "PrimaryCriteria": {
+    "CriteriaList": [
+      {
+        "VisitOccurrence": {
+          "CodesetId": null,
+          "First": null,
+          "OccurrenceStartDate": null,
+          "VisitTypeExclude": false
+        }
+      }
+    ],
+    "ObservationWindow": {"PriorDays": 0, "PostDays": 0},
+    "PrimaryCriteriaLimit": {"Type": "First"}
+  },
+  "AdditionalCriteria": null,
+  "QualifiedLimit": {"Type": "First"},
+  "ExpressionLimit": {"Type": "First"},
+  "InclusionRules": [
+    {
+      "name": "adults",
+      "description": null,
+      "expression": {
+        "Type": "ALL",
+        "Count": null,
+        "CriteriaList": [],
+        "DemographicCriteriaList": [{"Age": {"Value": 18, "Extent": null, "Op": "gte"}}],
+        "Groups": []
+      }
+    }
+  ],
+  "EndStrategy": null,
+  "CensoringCriteria": [],
+  "CollapseSettings": {"CollapseType": "ERA", "EraPad": 0},
+  "CensorWindow": {"StartDate": null, "EndDate": null},
+  "cdmVersionRange": ">=5.0.0"
+}`
+
+func TestCohortExpressionRoundTrip(t *testing.T) {
+	setUp(t)
+	for _, expression := range []string{atlasCohortExpression, `{"expression" : "1" }`, `{"InclusionRules":[{"name":"adults"}]}`} {
+		cohortExpression, err := models.ParseCohortExpression(expression)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		marshaledExpression, _ := json.Marshal(cohortExpression)
+		var expected, found interface{}
+		json.Unmarshal([]byte(expression), &expected)
+		json.Unmarshal(marshaledExpression, &found)
+		if !reflect.DeepEqual(expected, found) {
+			t.Errorf("Expected %s, found %s", expression, marshaledExpression)
+		}
+	}
+}
+
+func TestRetrieveInclusionRuleAttrition(t *testing.T) {
+	setUp(t)
+	// see the inclusion rule statistics in tests/setup_local_db/test_data_results_and_cdm.sql:
+	attrition, err := cohortDataModel.RetrieveInclusionRuleAttrition(context.Background(), testSourceId, extendedCopyOfSecondLargestCohort.Id)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expectedAttrition := models.CohortInclusionAttrition{
+		CohortName: extendedCopyOfSecondLargestCohort.Name,
+		BaseCount:  15,
+		FinalCount: 10,
+		InclusionRules: []*models.CohortInclusionRuleAttrition{
+			{RuleSequence: 0, RuleName: "adults", PersonCount: 12, PersonsRemoved: 3, RulePersonCount: 12},
+			// the second rule has no name in the cohort expression:
+			{RuleSequence: 1, RuleName: "Inclusion rule 2", PersonCount: 10, PersonsRemoved: 2, RulePersonCount: 12},
+		},
+	}
+	if !reflect.DeepEqual(*attrition, expectedAttrition) {
+		t.Errorf("Expected %v, found %v", expectedAttrition, *attrition)
+	}
+	// the final count should match the last rule:
+	if attrition.InclusionRules[1].PersonCount != attrition.FinalCount {
+		t.Errorf("Expected the last rule to leave %d persons", attrition.FinalCount)
+	}
+
+	_, err = cohortDataModel.RetrieveInclusionRuleAttrition(context.Background(), testSourceId, smallestCohort.Id)
+	if err != models.ErrCohortInclusionStatsNotFound {
+		t.Errorf("Expected ErrCohortInclusionStatsNotFound, found %v", err)
+	}
+}
+
+func deleteTestCohort(cohortDefinitionId int) {
+	tests.ExecSQLStringOrFail(fmt.Sprintf("DELETE FROM %s.cohort WHERE cohort_definition_id = %d",
+		tests.GetSchemaNameForType(models.Results), cohortDefinitionId), testSourceId)
+	tests.ExecAtlasSQLString(fmt.Sprintf("DELETE FROM %s.sec_role_permission WHERE permission_id in "+
+		"(SELECT id FROM %s.sec_permission WHERE value like 'cohortdefinition:%d:%%')", db.GetAtlasDB().Schema, db.GetAtlasDB().Schema, cohortDefinitionId))
+	tests.ExecAtlasSQLString(fmt.Sprintf("DELETE FROM %s.sec_permission WHERE value like 'cohortdefinition:%d:%%'", db.GetAtlasDB().Schema, cohortDefinitionId))
+	tests.ExecAtlasSQLString(fmt.Sprintf("DELETE FROM %s.cohort_definition WHERE id = %d", db.GetAtlasDB().Schema, cohortDefinitionId))
+}
+
+func TestGetCohortDataDictionary(t *testing.T) {
+	setUp(t)
+	dataDictionaryModel.GenerateDataDictionary(models.DataDictionaryGenerationModeFull)
+	populationEntries, _ := dataDictionaryModel.SearchDataDictionary(context.Background(), models.DataDictionaryQuery{Page: 1, PageSize: 50})
+	populationCounts := make(map[int64]int64)
+	for _, entry := range populationEntries.Data {
+		populationCounts[entry.ConceptID] = entry.NumberOfPeopleWithVariable
+	}
+
+	// (the generation info of largestCohort is removed by TestGetAllCohortDefinitionsAndStatsOrderBySizeDescWhenCohortDefinitionIsMissing)
+	cohortDataDictionary, err := dataDictionaryModel.GetCohortDataDictionary(context.Background(), testSourceId, secondLargestCohort.Id)
+	if err != nil || cohortDataDictionary.Total != int64(secondLargestCohort.CohortSize) || len(cohortDataDictionary.Data) == 0 {
+		t.Fatalf("Expected the data dictionary of cohort %d, found %v and error %v", secondLargestCohort.Id, cohortDataDictionary, err)
+	}
+	for _, entry := range cohortDataDictionary.Data {
+		if entry.NumberOfPeopleWithVariable < 1 || entry.NumberOfPeopleWithVariable > populationCounts[entry.ConceptID] ||
+			entry.NumberOfPeopleWithVariable > cohortDataDictionary.Total || entry.ValueSummary == nil {
+			t.Errorf("Unexpected cohort data dictionary entry %v", entry)
+		}
+	}
+
+	// the second call should be served from the cache:
+	cachedCohortDataDictionary, _ := dataDictionaryModel.GetCohortDataDictionary(context.Background(), testSourceId, secondLargestCohort.Id)
+	if cachedCohortDataDictionary != cohortDataDictionary {
+		t.Errorf("Expected the cohort data dictionary to be cached")
+	}
+	// until the cohort is regenerated:
+	tests.ExecAtlasSQLString(fmt.Sprintf("UPDATE %s.cohort_generation_info SET start_time = start_time + interval '1 day' "+
+		"WHERE id = %d and source_id = %d", db.GetAtlasDB().Schema, secondLargestCohort.Id, testSourceId))
+	regeneratedCohortDataDictionary, _ := dataDictionaryModel.GetCohortDataDictionary(context.Background(), testSourceId, secondLargestCohort.Id)
+	if regeneratedCohortDataDictionary == cohortDataDictionary ||
+		!regeneratedCohortDataDictionary.CohortGeneratedAt.After(cohortDataDictionary.CohortGeneratedAt) {
+		t.Errorf("Expected the cohort data dictionary to be regenerated")
+	}
+
+	// concurrent requests for a new cohort generation share the same generation:
+	tests.ExecAtlasSQLString(fmt.Sprintf("UPDATE %s.cohort_generation_info SET start_time = start_time + interval '1 day' "+
+		"WHERE id = %d and source_id = %d", db.GetAtlasDB().Schema, secondLargestCohort.Id, testSourceId))
+	concurrentCohortDataDictionaries := make([]*models.CohortDataDictionaryModel, 4)
+	var waitGroup sync.WaitGroup
+	for i := range concurrentCohortDataDictionaries {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			concurrentCohortDataDictionaries[i], _ = dataDictionaryModel.GetCohortDataDictionary(context.Background(), testSourceId, secondLargestCohort.Id)
+		}(i)
+	}
+	waitGroup.Wait()
+	for _, concurrentCohortDataDictionary := range concurrentCohortDataDictionaries {
+		if concurrentCohortDataDictionary == nil || concurrentCohortDataDictionary != concurrentCohortDataDictionaries[0] ||
+			concurrentCohortDataDictionary == regeneratedCohortDataDictionary {
+			t.Errorf("Expected all concurrent requests to get the same new cohort data dictionary")
+		}
+	}
+
+	_, err = dataDictionaryModel.GetCohortDataDictionary(context.Background(), testSourceId, 6)
+	if err != models.ErrCohortNotGenerated {
+		t.Errorf("Expected ErrCohortNotGenerated, found %v", err)
+	}
+	// the queries are cancelled with the request:
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dataDictionaryModel.GetCohortDataDictionary(cancelledCtx, testSourceId, secondLargestCohort.Id)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a context.Canceled error, found %v", err)
 	}
 }
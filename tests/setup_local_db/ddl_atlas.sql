@@ -119,6 +119,11 @@ CREATE TABLE atlas.schema_version
     CONSTRAINT pk_schema_version PRIMARY KEY (installed_rank)
 );
 
+-- the sequences that Atlas uses for the ids of these tables, starting after the ids in test_data_atlas.sql:
+CREATE SEQUENCE atlas.cohort_definition_sequence START WITH 100;
+CREATE SEQUENCE atlas.sec_permission_id_seq START WITH 10000;
+CREATE SEQUENCE atlas.sec_role_permission_sequence START WITH 10000;
+
 
 CREATE VIEW atlas.COHORT_DEFINITION_SEC_ROLE AS
   select
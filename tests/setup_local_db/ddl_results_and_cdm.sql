@@ -12,6 +12,34 @@ CREATE TABLE results.COHORT
     cohort_end_date date NOT NULL DEFAULT DATE('2099-01-01')
 );
 
+-- The inclusion rule statistics Atlas writes when generating a cohort with inclusion rules, where mode_id 0
+-- has the counts per entry event and mode_id 1 the counts per person:
+CREATE TABLE results.COHORT_INCLUSION_RESULT
+(
+    cohort_definition_id integer NOT NULL,
+    inclusion_rule_mask bigint NOT NULL,
+    person_count bigint NOT NULL,
+    mode_id integer NOT NULL DEFAULT 0
+);
+
+CREATE TABLE results.COHORT_INCLUSION_STATS
+(
+    cohort_definition_id integer NOT NULL,
+    rule_sequence integer NOT NULL,
+    person_count bigint NOT NULL,
+    gain_count bigint NOT NULL,
+    person_total bigint NOT NULL,
+    mode_id integer NOT NULL DEFAULT 0
+);
+
+CREATE TABLE results.COHORT_SUMMARY_STATS
+(
+    cohort_definition_id integer NOT NULL,
+    base_count bigint NOT NULL,
+    final_count bigint NOT NULL,
+    mode_id integer NOT NULL DEFAULT 0
+);
+
 -- This table can be present in future CDM schemas. Currently it is not filled by Atlas (per conversation with Andrew),
 -- but might be used in the future, instead of atlas.cohort_definition table above.
 -- CREATE TABLE results.COHORT_DEFINITION
@@ -53,6 +81,15 @@ CREATE TABLE omop.person
     ethnicity_source_concept_id integer NOT NULL DEFAULT 0
 );
 
+CREATE TABLE omop.observation_period
+(
+    observation_period_id bigint NOT NULL,
+    person_id bigint NOT NULL,
+    observation_period_start_date date NOT NULL,
+    observation_period_end_date date NOT NULL,
+    period_type_concept_id integer NOT NULL DEFAULT 32817
+);
+
 CREATE TABLE omop.observation
 (
     observation_id bigint NOT NULL,
@@ -125,6 +162,60 @@ CREATE TABLE misc.DATA_DICTIONARY_RESULT
 );
 ALTER TABLE misc.DATA_DICTIONARY_RESULT  ADD CONSTRAINT xpk_DATA_DICTIONARY_RESULT PRIMARY KEY ( concept_id ) ;
 
+-- row count and value checksum of each concept at the time its data dictionary entry was generated,
+-- used to detect which concepts changed in incremental generation mode:
+CREATE TABLE misc.DATA_DICTIONARY_CONCEPT_FINGERPRINT
+(
+    concept_id integer not null,
+    row_count bigint,
+    person_count bigint,
+    value_checksum float
+);
+ALTER TABLE misc.DATA_DICTIONARY_CONCEPT_FINGERPRINT  ADD CONSTRAINT xpk_DATA_DICTIONARY_CONCEPT_FINGERPRINT PRIMARY KEY ( concept_id ) ;
+
+-- results of the last check of each data quality rule:
+CREATE TABLE misc.DATA_QUALITY_RESULT
+(
+    rule_name character varying(255) not null,
+    rule_type character varying(50),
+    violation_count bigint,
+    sample_ids character varying(4000),
+    error character varying(4000),
+    checked_at timestamp
+);
+ALTER TABLE misc.DATA_QUALITY_RESULT  ADD CONSTRAINT xpk_DATA_QUALITY_RESULT PRIMARY KEY ( rule_name ) ;
+
+-- snapshot of data_dictionary_result, taken after each data dictionary generation run:
+CREATE TABLE misc.DATA_DICTIONARY_SNAPSHOT
+(
+    snapshot_id serial not null, --For sql server use int identity(1,1)
+    generated_at timestamp not null,
+    data_schema_version integer,
+    generation_mode character varying(20),
+    number_of_concepts integer
+);
+ALTER TABLE misc.DATA_DICTIONARY_SNAPSHOT  ADD CONSTRAINT xpk_DATA_DICTIONARY_SNAPSHOT PRIMARY KEY ( snapshot_id ) ;
+
+CREATE TABLE misc.DATA_DICTIONARY_SNAPSHOT_RESULT
+(
+    snapshot_id integer not null,
+    vocabulary_id character varying(20),
+    concept_id integer not null,
+    concept_code character varying(50),
+    concept_name character varying(255),
+    concept_class_id character varying(20),
+    number_of_people_with_variable integer,
+    number_of_people_where_value_is_filled integer,
+    number_of_people_where_value_is_null integer,
+    value_stored_as character varying(20),
+    min_value float,
+    max_value float,
+    mean_value float,
+    standard_deviation float,
+    value_summary JSON --For sql server use varbinary(max)
+);
+ALTER TABLE misc.DATA_DICTIONARY_SNAPSHOT_RESULT  ADD CONSTRAINT xpk_DATA_DICTIONARY_SNAPSHOT_RESULT PRIMARY KEY ( snapshot_id, concept_id ) ;
+
 -- ========================================================
 DROP SCHEMA IF EXISTS dbo CASCADE;
 CREATE SCHEMA dbo;
@@ -36,7 +36,7 @@ values
     (2,'{"expression" : "2" }',1234567890),
     (3,'{"expression" : "3" }', 33333445),
     (4,'{"expression" : "4" }', 555444),
-    (32,'{"expression" : "32" }', 323232)
+    (32,'{"expression" : "32", "InclusionRules" : [{"name" : "adults"}]}', 323232)
 ;
 
 insert into atlas.sec_role
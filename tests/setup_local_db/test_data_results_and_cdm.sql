@@ -43,6 +43,29 @@ values
     (18,2000000324,1972,11,11,'1972-11-11 00:00:00',NULL,8515,0,NULL,NULL,NULL,'e6b6627f-4e38-dfc8-078c-11406151c594','F',0,'asian',0,'',0)
 ;
 
+-- the observation periods of the persons (person 1 has two periods, and persons 17 and 18 have none):
+insert into omop.observation_period
+(observation_period_id,person_id,observation_period_start_date,observation_period_end_date)
+values
+    (1,1,'2005-03-01','2008-06-30'),
+    (2,1,'2010-01-01','2020-12-31'),
+    (3,2,'2011-02-01','2021-01-31'),
+    (4,3,'2012-03-01','2022-02-28'),
+    (5,4,'2010-01-01','2020-12-31'),
+    (6,5,'2010-01-01','2020-12-31'),
+    (7,6,'2010-01-01','2020-12-31'),
+    (8,7,'2010-01-01','2020-12-31'),
+    (9,8,'2010-01-01','2020-12-31'),
+    (10,9,'2010-01-01','2020-12-31'),
+    (11,10,'2010-01-01','2020-12-31'),
+    (12,11,'2010-01-01','2020-12-31'),
+    (13,12,'2010-01-01','2020-12-31'),
+    (14,13,'2010-01-01','2020-12-31'),
+    (15,14,'2010-01-01','2020-12-31'),
+    (16,15,'2010-01-01','2020-12-31'),
+    (17,16,'2010-01-01','2020-12-31')
+;
+
 -- add a mix of:
 --  - good observation records with a real `observation_concept_id` and a real value in `value_as_string` or `value_as_number`
 --  - bad observation records, where `observation_concept_id` is missing or the `value_as_string` or `value_as_number` are both NULL:
@@ -173,6 +196,35 @@ values
     (4,18)
 ;
 
+-- inclusion rule statistics of "extendedCopyOfSecondLargestCohort": 15 persons with an entry event, of which
+-- 12 satisfy the first rule and 10 satisfy both rules (rules are bits in the mask: 1 = first rule, 2 = second rule):
+insert into results.COHORT_INCLUSION_RESULT
+(cohort_definition_id,inclusion_rule_mask,person_count,mode_id)
+values
+    (32,3,10,1),
+    (32,1,2,1),
+    (32,2,2,1),
+    (32,0,1,1),
+    (32,3,20,0),
+    (32,0,5,0)
+;
+
+insert into results.COHORT_INCLUSION_STATS
+(cohort_definition_id,rule_sequence,person_count,gain_count,person_total,mode_id)
+values
+    (32,0,12,2,15,1),
+    (32,1,12,2,15,1),
+    (32,0,20,5,25,0),
+    (32,1,20,0,25,0)
+;
+
+insert into results.COHORT_SUMMARY_STATS
+(cohort_definition_id,base_count,final_count,mode_id)
+values
+    (32,15,10,1),
+    (32,25,20,0)
+;
+
 INSERT INTO dbo.VersionInfo
 (Version, AppliedOn, Description)
 Values(0, '20240101 09:30:00 AM', 'Initial Version'),
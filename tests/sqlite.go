@@ -0,0 +1,224 @@
+package tests
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/uc-cdis/cohort-middleware/utils"
+	"gorm.io/gorm"
+)
+
+// The test DDL and data scripts are written for postgres. When the test DBs are embedded sqlite DBs
+// (see config/sqlite.yaml), the scripts are split into statements and translated to sqlite here,
+// which covers the postgres features used by the scripts in ../setup_local_db and by the tests.
+
+var (
+	dropSchemaPattern         = regexp.MustCompile(`(?is)^DROP\s+SCHEMA\s+(?:IF\s+EXISTS\s+)?(\w+)(?:\s+CASCADE)?$`)
+	createSchemaPattern       = regexp.MustCompile(`(?is)^CREATE\s+SCHEMA\s+(?:IF\s+NOT\s+EXISTS\s+)?(\w+)$`)
+	dropSequencePattern       = regexp.MustCompile(`(?is)^DROP\s+SEQUENCE\s+`)
+	createSequencePattern     = regexp.MustCompile(`(?is)^CREATE\s+SEQUENCE\s+([\w.]+)(?:\s+START\s+WITH\s+(\d+))?$`)
+	nextvalPattern            = regexp.MustCompile(`(?i)nextval\('([\w.]+)'\)`)
+	addPrimaryKeyPattern      = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+(\w+)\.(\w+)\s+ADD\s+CONSTRAINT\s+(\w+)\s+PRIMARY\s+KEY\s*(\(.*\))$`)
+	createViewPattern         = regexp.MustCompile(`(?is)^CREATE\s+VIEW\s+(\w+)\.(\w+)\s+AS\s+(.*)$`)
+	selectIntoPattern         = regexp.MustCompile(`(?is)^((?:WITH|SELECT)\s.*?)\s+INTO\s+([\w.]+)\s+(FROM\s.*)$`)
+	collatePattern            = regexp.MustCompile(`(?i)\s+COLLATE\s+pg_catalog\."default"`)
+	timestampPrecisionPattern = regexp.MustCompile(`(?i)\btimestamp\s*\(\d+\)`)
+	withoutTimeZonePattern    = regexp.MustCompile(`(?i)\s+without\s+time\s+zone`)
+	defaultNowPattern         = regexp.MustCompile(`(?i)DEFAULT\s+now\(\)`)
+	defaultFunctionPattern    = regexp.MustCompile(`(?i)DEFAULT\s+(\w+\([^()]*\))`)
+	serialPattern             = regexp.MustCompile(`(?i)\bserial(\s+not\s+null)?\b`)
+	qualifiedReferencePattern = regexp.MustCompile(`(?i)\bREFERENCES\s+\w+\.(\w+)`)
+	regexpMatchPattern        = regexp.MustCompile(`\s~\s`)
+	intervalPattern           = regexp.MustCompile(`(?i)([\w.]+)\s*\+\s*interval\s+'([^']+)'`)
+	stddevPattern             = regexp.MustCompile(`(?i)\bstddev\(([^()]+)\)`)
+	postgresConnectionPattern = regexp.MustCompile(`'jdbc:postgresql:[^']*'`)
+	renameColumnPattern       = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+(?:IF\s+EXISTS\s+)?([\w.]+)\s+RENAME\s+(?:COLUMN\s+)?(\w+)\s+TO\s+(\w+)$`)
+)
+
+// The current values of the sequences created by the scripts, as sqlite has no sequences:
+var sqliteSequences = map[string]int64{}
+
+// Executes the postgres SQL script on the given sqlite DB, one statement at a time on a single connection,
+// so that the schemas attached by "CREATE SCHEMA" statements are available to the statements that follow.
+func execSqliteScript(dataSource *utils.DbAndSchema, sqlString string) (tx *gorm.DB) {
+	var attachedSchemas bool
+	err := dataSource.Db.Connection(func(conn *gorm.DB) error {
+		mainFile, err := getSqliteMainFile(conn)
+		if err != nil {
+			return err
+		}
+		for _, statement := range SplitSQLStatements(sqlString) {
+			if match := dropSchemaPattern.FindStringSubmatch(statement); match != nil {
+				if err := attachSqliteSchema(conn, mainFile, match[1]); err != nil {
+					return err
+				}
+				if err := dropSqliteSchemaObjects(conn, match[1]); err != nil {
+					return err
+				}
+				attachedSchemas = true
+				continue
+			}
+			if match := createSchemaPattern.FindStringSubmatch(statement); match != nil {
+				if err := attachSqliteSchema(conn, mainFile, match[1]); err != nil {
+					return err
+				}
+				attachedSchemas = true
+				continue
+			}
+			statement = TranslatePostgresToSqlite(statement, mainFile)
+			if statement == "" {
+				continue
+			}
+			if err := conn.Exec(statement).Error; err != nil {
+				return fmt.Errorf("%w, in statement: %s", err, statement)
+			}
+		}
+		return nil
+	})
+	if attachedSchemas {
+		// the other connections of the pool attach the new schema files when they are reopened:
+		if sqlDb, err := dataSource.Db.DB(); err == nil {
+			sqlDb.SetMaxIdleConns(0)
+			sqlDb.SetMaxIdleConns(2)
+		}
+	}
+	tx = dataSource.Db.Session(&gorm.Session{})
+	tx.Error = err
+	return tx
+}
+
+// Translates a single postgres statement to sqlite. Returns "" for statements that have no sqlite equivalent
+// and can be skipped. Connection strings of postgres sources are replaced by the given sqlite file.
+func TranslatePostgresToSqlite(statement string, mainFile string) string {
+	if dropSequencePattern.MatchString(statement) {
+		return ""
+	}
+	if match := createSequencePattern.FindStringSubmatch(statement); match != nil {
+		start := int64(1)
+		if match[2] != "" {
+			start, _ = strconv.ParseInt(match[2], 10, 64)
+		}
+		sqliteSequences[strings.ToLower(match[1])] = start - 1
+		return ""
+	}
+	statement = nextvalPattern.ReplaceAllStringFunc(statement, func(nextval string) string {
+		sequence := strings.ToLower(nextvalPattern.FindStringSubmatch(nextval)[1])
+		sqliteSequences[sequence]++
+		return strconv.FormatInt(sqliteSequences[sequence], 10)
+	})
+	if match := renameColumnPattern.FindStringSubmatch(statement); match != nil {
+		return fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", match[1], match[2], match[3])
+	}
+	if match := addPrimaryKeyPattern.FindStringSubmatch(statement); match != nil {
+		return fmt.Sprintf("CREATE UNIQUE INDEX %s.%s ON %s %s", match[1], match[3], match[2], match[4])
+	}
+	if match := createViewPattern.FindStringSubmatch(statement); match != nil {
+		// the views of a sqlite schema can only reference the tables of that schema, without qualifying them:
+		body := regexp.MustCompile(`(?i)\b`+match[1]+`\.`).ReplaceAllString(match[3], "")
+		statement = fmt.Sprintf("CREATE VIEW %s.%s AS %s", match[1], match[2], body)
+	}
+	if match := selectIntoPattern.FindStringSubmatch(statement); match != nil {
+		statement = fmt.Sprintf("CREATE TABLE %s AS %s %s", match[2], match[1], match[3])
+	}
+	statement = collatePattern.ReplaceAllString(statement, "")
+	statement = withoutTimeZonePattern.ReplaceAllString(statement, "")
+	// the driver only parses the values of columns declared exactly as date, datetime or timestamp:
+	statement = timestampPrecisionPattern.ReplaceAllString(statement, "timestamp")
+	statement = defaultNowPattern.ReplaceAllString(statement, "DEFAULT CURRENT_TIMESTAMP")
+	statement = defaultFunctionPattern.ReplaceAllString(statement, "DEFAULT ($1)")
+	statement = serialPattern.ReplaceAllString(statement, "integer primary key")
+	statement = qualifiedReferencePattern.ReplaceAllString(statement, "REFERENCES $1")
+	statement = regexpMatchPattern.ReplaceAllString(statement, " REGEXP ")
+	statement = intervalPattern.ReplaceAllString(statement, "datetime($1, '+$2')")
+	// sqlite has no stddev aggregate:
+	statement = stddevPattern.ReplaceAllString(statement, utils.GetDialect(utils.VendorSqlite).StandardDeviation("${1}"))
+	statement = postgresConnectionPattern.ReplaceAllString(statement, "'jdbc:sqlite:"+strings.ReplaceAll(mainFile, "'", "''")+"'")
+	return statement
+}
+
+// Splits a SQL script into its statements, leaving out the comments and empty statements.
+func SplitSQLStatements(sqlString string) []string {
+	var statements []string
+	var statement strings.Builder
+	addStatement := func() {
+		if trimmed := strings.TrimSpace(statement.String()); trimmed != "" {
+			statements = append(statements, trimmed)
+		}
+		statement.Reset()
+	}
+	for i := 0; i < len(sqlString); i++ {
+		switch {
+		case sqlString[i] == '\'' || sqlString[i] == '"':
+			end := strings.IndexByte(sqlString[i+1:], sqlString[i])
+			if end == -1 {
+				// unterminated, up to the end of the script:
+				end = len(sqlString) - i - 2
+			}
+			statement.WriteString(sqlString[i : i+end+2])
+			i += end + 1
+		case strings.HasPrefix(sqlString[i:], "--"):
+			end := strings.IndexByte(sqlString[i:], '\n')
+			if end == -1 {
+				end = len(sqlString) - i
+			}
+			i += end - 1
+		case strings.HasPrefix(sqlString[i:], "/*"):
+			end := strings.Index(sqlString[i:], "*/")
+			if end == -1 {
+				end = len(sqlString) - i
+			}
+			statement.WriteByte(' ')
+			i += end + 1
+		case sqlString[i] == ';':
+			addStatement()
+		default:
+			statement.WriteByte(sqlString[i])
+		}
+	}
+	addStatement()
+	return statements
+}
+
+func getSqliteMainFile(conn *gorm.DB) (string, error) {
+	var mainFile string
+	err := conn.Raw("SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&mainFile).Error
+	return mainFile, err
+}
+
+func attachSqliteSchema(conn *gorm.DB, mainFile string, schema string) error {
+	var attached int64
+	err := conn.Raw("SELECT count(*) FROM pragma_database_list WHERE name = ?", strings.ToLower(schema)).Scan(&attached).Error
+	if err != nil || attached > 0 {
+		return err
+	}
+	schemaFile, err := utils.SqliteSchemaFile(mainFile, strings.ToLower(schema))
+	if err != nil {
+		return err
+	}
+	return conn.Exec("ATTACH DATABASE ? AS "+strings.ToLower(schema), schemaFile).Error
+}
+
+func dropSqliteSchemaObjects(conn *gorm.DB, schema string) error {
+	var objects []struct {
+		Type string
+		Name string
+	}
+	// views first, as they depend on the tables (indexes are dropped with their tables):
+	err := conn.Raw(fmt.Sprintf("SELECT type, name FROM %s.sqlite_master WHERE type IN ('view', 'table') "+
+		"AND name NOT LIKE 'sqlite_%%' ORDER BY type DESC", schema)).Scan(&objects).Error
+	if err != nil {
+		return err
+	}
+	if err := conn.Exec("PRAGMA foreign_keys = OFF").Error; err != nil {
+		return err
+	}
+	defer conn.Exec("PRAGMA foreign_keys = ON")
+	for _, object := range objects {
+		if err := conn.Exec(fmt.Sprintf(`DROP %s %s."%s"`, object.Type, schema, object.Name)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -17,6 +17,15 @@ import (
 	"gorm.io/gorm"
 )
 
+// Returns the config environment of the integration tests, which is "development" (the postgres
+// DBs of setup_local_db), unless overridden in COHORT_MIDDLEWARE_TEST_ENV, e.g. with "sqlite".
+func GetTestConfigEnvironment() string {
+	if environment := os.Getenv("COHORT_MIDDLEWARE_TEST_ENV"); environment != "" {
+		return environment
+	}
+	return "development"
+}
+
 func GetTestSourceId() int {
 	return 1 // TODO - ideally this should also be used when populating "source" tables in test Atlas DB in the first place...
 }
@@ -56,18 +65,18 @@ func ExecAtlasSQLString(sqlString string) {
 }
 
 func ExecSQLString(sqlString string, sourceId int) (tx *gorm.DB) {
-	// just take a random model:
-	var dataSourceModel = new(models.Source)
+	var dataSource *utils.DbAndSchema
 	if sourceId == -1 {
 		// assume Atlas DB:
-		var atlasDB = db.GetAtlasDB()
-		return atlasDB.Db.Model(models.Source{}).Exec(sqlString)
-
+		dataSource = db.GetAtlasDB()
 	} else {
 		// look up the data source in source table:
-		omopDataSource := dataSourceModel.GetDataSource(sourceId, models.Omop)
-		return omopDataSource.Db.Model(models.Source{}).Exec(sqlString)
+		dataSource = getDataSourceOrFail(sourceId, models.Omop)
+	}
+	if dataSource.Vendor == utils.VendorSqlite {
+		return execSqliteScript(dataSource, sqlString)
 	}
+	return dataSource.Db.Model(models.Source{}).Exec(sqlString)
 }
 
 // Same as ExecSQLString above, but panics if the SQL statement fails
@@ -130,9 +139,7 @@ func GetOmopDataSource() *utils.DbAndSchema {
 }
 
 func GetOmopDataSourceForSourceId(sourceId int) *utils.DbAndSchema {
-	var dataSourceModel = new(models.Source)
-	omopDataSource := dataSourceModel.GetDataSource(sourceId, models.Omop)
-	return omopDataSource
+	return getDataSourceOrFail(sourceId, models.Omop)
 }
 
 func GetResultsDataSource() *utils.DbAndSchema {
@@ -140,8 +147,16 @@ func GetResultsDataSource() *utils.DbAndSchema {
 }
 
 func GetResultsDataSourceForSourceId(sourceId int) *utils.DbAndSchema {
+	return getDataSourceOrFail(sourceId, models.Results)
+}
+
+// Same as Source.GetDataSource, but panics if the data source cannot be opened
+func getDataSourceOrFail(sourceId int, sourceType models.SourceType) *utils.DbAndSchema {
 	var dataSourceModel = new(models.Source)
-	dataSource := dataSourceModel.GetDataSource(sourceId, models.Results)
+	dataSource, err := dataSourceModel.GetDataSource(sourceId, sourceType)
+	if err != nil {
+		panic(fmt.Sprintf("Error while getting the data source: %v", err))
+	}
 	return dataSource
 }
 
@@ -233,9 +248,9 @@ func (w *CustomResponseWriter) Header() http.Header {
 }
 
 func (w *CustomResponseWriter) Write(b []byte) (int, error) {
-
-	w.CustomResponseWriterOut = string(b)
-	return 0, nil
+	// append, so that streamed responses are captured completely:
+	w.CustomResponseWriterOut += string(b)
+	return len(b), nil
 }
 
 func (w *CustomResponseWriter) WriteHeader(statusCode int) {
@@ -270,7 +285,7 @@ func (w *CustomResponseWriter) WriteHeaderNow() {
 	//do nothing
 }
 func (w *CustomResponseWriter) WriteString(s string) (n int, err error) {
-	return 0, nil
+	return w.Write([]byte(s))
 }
 func (w *CustomResponseWriter) Written() bool {
 	return true
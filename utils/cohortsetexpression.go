@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type CohortSetOperator string
+
+const (
+	CohortSetIntersect CohortSetOperator = "&"
+	CohortSetUnion     CohortSetOperator = "|"
+	CohortSetExcept    CohortSetOperator = "-"
+)
+
+// A set expression over cohorts, e.g. "(1 & 2) - 3". It is either a single cohort (Operator is empty)
+// or an operator applied to a Left and Right expression. As in SQL, & (INTERSECT) takes precedence
+// over | (UNION) and - (EXCEPT), which are evaluated from left to right.
+type CohortSetExpression struct {
+	Operator           CohortSetOperator
+	CohortDefinitionId int
+	Left               *CohortSetExpression
+	Right              *CohortSetExpression
+}
+
+// The limits of a cohort set expression, so that parsing it and the SQL built from it stay bounded:
+const (
+	MaxCohortSetExpressionDepth    = 32
+	MaxCohortSetExpressionOperands = 50
+)
+
+type cohortSetExpressionParser struct {
+	tokens   []string
+	position int
+	depth    int
+	operands int
+}
+
+func ParseCohortSetExpression(expression string) (*CohortSetExpression, error) {
+	tokens, err := tokenizeCohortSetExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty cohort set expression")
+	}
+	parser := cohortSetExpressionParser{tokens: tokens}
+	result, err := parser.parseUnionOrExcept()
+	if err != nil {
+		return nil, err
+	}
+	if parser.position < len(tokens) {
+		return nil, fmt.Errorf("unexpected '%s' in cohort set expression", tokens[parser.position])
+	}
+	return result, nil
+}
+
+// Returns the unique cohort definition ids used in the expression, in order of appearance.
+func (e *CohortSetExpression) CohortDefinitionIds() []int {
+	if e.Operator == "" {
+		return []int{e.CohortDefinitionId}
+	}
+	return MakeUnique(append(e.Left.CohortDefinitionIds(), e.Right.CohortDefinitionIds()...))
+}
+
+// Returns the expression with all operations between parentheses, e.g. "((1 & 2) - 3)".
+func (e *CohortSetExpression) String() string {
+	if e.Operator == "" {
+		return strconv.Itoa(e.CohortDefinitionId)
+	}
+	return fmt.Sprintf("(%s %s %s)", e.Left.String(), e.Operator, e.Right.String())
+}
+
+func tokenizeCohortSetExpression(expression string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expression); {
+		char := rune(expression[i])
+		switch {
+		case unicode.IsSpace(char):
+			i++
+		case strings.ContainsRune("()&|-", char):
+			tokens = append(tokens, string(char))
+			i++
+		case unicode.IsDigit(char):
+			start := i
+			for i < len(expression) && unicode.IsDigit(rune(expression[i])) {
+				i++
+			}
+			tokens = append(tokens, expression[start:i])
+		default:
+			return nil, fmt.Errorf("invalid character '%c' in cohort set expression", char)
+		}
+	}
+	return tokens, nil
+}
+
+func (p *cohortSetExpressionParser) peek() string {
+	if p.position < len(p.tokens) {
+		return p.tokens[p.position]
+	}
+	return ""
+}
+
+func (p *cohortSetExpressionParser) parseUnionOrExcept() (*CohortSetExpression, error) {
+	left, err := p.parseIntersect()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == string(CohortSetUnion) || p.peek() == string(CohortSetExcept) {
+		operator := CohortSetOperator(p.peek())
+		p.position++
+		right, err := p.parseIntersect()
+		if err != nil {
+			return nil, err
+		}
+		left = &CohortSetExpression{Operator: operator, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *cohortSetExpressionParser) parseIntersect() (*CohortSetExpression, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == string(CohortSetIntersect) {
+		p.position++
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = &CohortSetExpression{Operator: CohortSetIntersect, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *cohortSetExpressionParser) parseOperand() (*CohortSetExpression, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of cohort set expression")
+	case token == "(":
+		p.position++
+		p.depth++
+		if p.depth > MaxCohortSetExpressionDepth {
+			return nil, fmt.Errorf("cohort set expression is nested deeper than %d parentheses", MaxCohortSetExpressionDepth)
+		}
+		result, err := p.parseUnionOrExcept()
+		if err != nil {
+			return nil, err
+		}
+		p.depth--
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ')' in cohort set expression")
+		}
+		p.position++
+		return result, nil
+	case unicode.IsDigit(rune(token[0])):
+		p.position++
+		p.operands++
+		if p.operands > MaxCohortSetExpressionOperands {
+			return nil, fmt.Errorf("cohort set expression has more than %d cohorts", MaxCohortSetExpressionOperands)
+		}
+		cohortDefinitionId, err := strconv.Atoi(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cohort id '%s' in cohort set expression", token)
+		}
+		return &CohortSetExpression{CohortDefinitionId: cohortDefinitionId}, nil
+	}
+	return nil, fmt.Errorf("unexpected '%s' in cohort set expression", token)
+}
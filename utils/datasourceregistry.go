@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// By default, a DB that is dropped from the registry is closed after the longest query timeout (the export
+// timeout), so that the requests that got it before it was dropped can finish.
+const defaultDataSourceCloseDelay = 600 * time.Second
+
+// The connection pool settings of a data source. Zero values keep the defaults of database/sql.
+type DataSourcePoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// Everything needed to open the DB of a data source. If any of it changes, e.g. because the
+// credentials were rotated in Atlas, the cached DB is replaced by a new one.
+type DataSourceConnection struct {
+	SourceId         int
+	ConnectionString string
+	Username         string
+	Password         string
+	Schema           string
+	PoolConfig       DataSourcePoolConfig
+}
+
+// Keeps one open DB per data source and schema, which is safe to use from concurrent requests.
+// A DB is opened only once, even if it is requested concurrently, and is dropped again when opening it
+// failed, when it is evicted or when it fails a health check, so that it is reopened on the next request.
+// A dropped DB is only closed after the close delay, as requests that got it before may still be using it.
+type DataSourceRegistry struct {
+	mutex      sync.Mutex
+	entries    map[dataSourceKey]*dataSourceEntry
+	open       func(connection DataSourceConnection) (*DbAndSchema, error)
+	ping       func(ctx context.Context, dataSource *DbAndSchema) error
+	closeDelay atomic.Int64
+}
+
+type dataSourceKey struct {
+	sourceId int
+	schema   string
+}
+
+type dataSourceEntry struct {
+	connection DataSourceConnection
+	// closed when opening the DB is done:
+	ready      chan struct{}
+	dataSource *DbAndSchema
+	err        error
+}
+
+func NewDataSourceRegistry(open func(connection DataSourceConnection) (*DbAndSchema, error),
+	ping func(ctx context.Context, dataSource *DbAndSchema) error) *DataSourceRegistry {
+	registry := &DataSourceRegistry{entries: make(map[dataSourceKey]*dataSourceEntry), open: open, ping: ping}
+	registry.SetCloseDelay(defaultDataSourceCloseDelay)
+	return registry
+}
+
+var dataSourceRegistry = NewDataSourceRegistry(openDataSourceDB, pingDataSourceDB)
+
+// Returns the DB of the given data source connection, opening it if it is not open yet.
+func GetDataSourceDB(connection DataSourceConnection) (*DbAndSchema, error) {
+	return dataSourceRegistry.Get(connection)
+}
+
+// Closes the DBs of the given data source, so that they are reopened on the next request. Returns the number of DBs closed.
+func EvictDataSourceDB(sourceId int) int {
+	return dataSourceRegistry.Evict(sourceId)
+}
+
+// Sets how long a DB that was dropped from the registry stays open for the requests that are still using it.
+func SetDataSourceCloseDelay(delay time.Duration) {
+	dataSourceRegistry.SetCloseDelay(delay)
+}
+
+// Pings the open DBs every interval, closing the ones that do not respond. Returns a function to stop the health checks.
+func StartDataSourceHealthChecks(interval time.Duration) func() {
+	return dataSourceRegistry.StartHealthChecks(interval)
+}
+
+func (r *DataSourceRegistry) Get(connection DataSourceConnection) (*DbAndSchema, error) {
+	key := dataSourceKey{sourceId: connection.SourceId, schema: connection.Schema}
+	r.mutex.Lock()
+	entry := r.entries[key]
+	if entry != nil && entry.connection != connection {
+		log.Printf("INFO: the connection details of data source %d changed, reconnecting...", connection.SourceId)
+		delete(r.entries, key)
+		r.closeLater(entry)
+		entry = nil
+	}
+	if entry != nil {
+		r.mutex.Unlock()
+		// wait for the request that is opening the DB, if any:
+		<-entry.ready
+		return entry.dataSource, entry.err
+	}
+	entry = &dataSourceEntry{connection: connection, ready: make(chan struct{})}
+	r.entries[key] = entry
+	r.mutex.Unlock()
+
+	entry.dataSource, entry.err = r.open(connection)
+	close(entry.ready)
+	if entry.err != nil {
+		// only successful connections are kept, so that a failed one is retried on the next request:
+		r.remove(key, entry)
+	}
+	return entry.dataSource, entry.err
+}
+
+func (r *DataSourceRegistry) Evict(sourceId int) int {
+	r.mutex.Lock()
+	var evicted []*dataSourceEntry
+	for key, entry := range r.entries {
+		if key.sourceId == sourceId {
+			delete(r.entries, key)
+			evicted = append(evicted, entry)
+		}
+	}
+	r.mutex.Unlock()
+	for _, entry := range evicted {
+		r.closeLater(entry)
+	}
+	return len(evicted)
+}
+
+func (r *DataSourceRegistry) SetCloseDelay(delay time.Duration) {
+	r.closeDelay.Store(int64(delay))
+}
+
+// Pings each open DB and closes the ones that fail, so that they are reopened on the next request.
+func (r *DataSourceRegistry) CheckHealth(timeout time.Duration) {
+	r.mutex.Lock()
+	entries := make(map[dataSourceKey]*dataSourceEntry, len(r.entries))
+	for key, entry := range r.entries {
+		entries[key] = entry
+	}
+	r.mutex.Unlock()
+	for key, entry := range entries {
+		select {
+		case <-entry.ready:
+		default:
+			// still being opened:
+			continue
+		}
+		if entry.err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := r.ping(ctx, entry.dataSource)
+		cancel()
+		if err != nil {
+			log.Printf("WARNING: health check of data source %d failed, reconnecting on the next request: %v", key.sourceId, err)
+			if r.remove(key, entry) {
+				r.closeLater(entry)
+			}
+		}
+	}
+}
+
+func (r *DataSourceRegistry) StartHealthChecks(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				r.CheckHealth(interval)
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
+
+// Removes the entry, unless it was already replaced by another one. Returns whether it was removed.
+func (r *DataSourceRegistry) remove(key dataSourceKey, entry *dataSourceEntry) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.entries[key] != entry {
+		return false
+	}
+	delete(r.entries, key)
+	return true
+}
+
+// Closes the DB of the dropped entry after the close delay, so that the requests that got it before it was
+// dropped do not fail on a closed DB.
+func (r *DataSourceRegistry) closeLater(entry *dataSourceEntry) {
+	delay := time.Duration(r.closeDelay.Load())
+	if delay <= 0 {
+		go entry.close()
+		return
+	}
+	time.AfterFunc(delay, entry.close)
+}
+
+// Closes the DB once it is opened. Queries that already started are allowed to finish.
+func (e *dataSourceEntry) close() {
+	<-e.ready
+	if e.dataSource == nil || e.dataSource.Db == nil {
+		return
+	}
+	sqlDb, err := e.dataSource.Db.DB()
+	if err == nil {
+		err = sqlDb.Close()
+	}
+	if err != nil {
+		log.Printf("WARNING: failed to close the db of data source %d: %v", e.connection.SourceId, err)
+	}
+}
@@ -2,7 +2,9 @@ package utils
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"slices"
 	"strings"
 	"time"
 
@@ -14,48 +16,95 @@ import (
 
 type DbAndSchema struct {
 	Db     *gorm.DB
-	Schema string
+	Schema Identifier
 	Vendor string
 }
 
-var dataSourceDbMap = make(map[string]*DbAndSchema)
-
-func GetDataSourceDB(sourceConnectionString string, dbSchema string) *DbAndSchema {
-	sourceAndSchemaKey := "source:" + sourceConnectionString + ",schema:" + dbSchema
-	if dataSourceDbMap[sourceAndSchemaKey] != nil {
-		// return the already initialized object:
-		return dataSourceDbMap[sourceAndSchemaKey]
+// Opens the DB of the given data source, of which the connection string is a JDBC URL. The username
+// and password are used if the connection string has no credentials of its own.
+func openDataSourceDB(connection DataSourceConnection) (*DbAndSchema, error) {
+	jdbcConnection, err := ParseJdbcConnectionString(connection.ConnectionString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source connection string: %w", err)
+	}
+	dbSchema, err := ParseIdentifier(connection.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source schema: %w", err)
 	}
-	// otherwise, open a new connection:
-	dsn := GenerateDsn(sourceConnectionString)
+	dsn := jdbcConnection.Dsn(connection.Username, connection.Password)
 	dataSourceDb := new(DbAndSchema)
-	if strings.Contains(sourceConnectionString, "postgresql") {
+	var dialector gorm.Dialector
+	if jdbcConnection.Vendor == VendorPostgresql {
 		log.Printf("connecting to cohorts 'postgresql' db...")
-		// workaround for schema names in postgres (can't be uppercase):
-		dbSchema = strings.ToLower(dbSchema)
-		dataSource, _ := gorm.Open(postgres.Open(dsn),
-			&gorm.Config{
-				NamingStrategy: schema.NamingStrategy{
-					TablePrefix:   dbSchema + ".",
-					SingularTable: true,
-				}})
-		dataSourceDb.Db = dataSource
+		dialector = postgres.Open(dsn)
 		dataSourceDb.Vendor = "postgresql"
+	} else if jdbcConnection.Vendor == VendorSqlite {
+		log.Printf("connecting to cohorts 'sqlite' db...")
+		dialector = OpenSqlite(jdbcConnection.Database)
+		dataSourceDb.Vendor = "sqlite"
 	} else {
 		log.Printf("connecting to cohorts 'sqlserver' db...")
-		dataSource, _ := gorm.Open(sqlserver.Open(dsn),
-			&gorm.Config{
-				NamingStrategy: schema.NamingStrategy{
-					TablePrefix:   dbSchema + ".",
-					SingularTable: true,
-				}})
-		// TODO - should throw error if db connection fails! Currently fails "silently" by printing error to log and then just returning ...
-		dataSourceDb.Db = dataSource
+		dialector = sqlserver.Open(dsn)
 		dataSourceDb.Vendor = "sqlserver"
 	}
+	// gorm pings the db when opening it, so this also fails if the db cannot be reached:
+	dataSource, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		log.Printf("ERROR: failed to connect to the '%s' db: %v", dataSourceDb.Vendor, err)
+		return nil, err
+	}
+	dbSchema = ResolveSchemaName(dataSource, dataSourceDb.Vendor, dbSchema)
+	dataSource.NamingStrategy = schema.NamingStrategy{
+		TablePrefix:   string(dbSchema) + ".",
+		SingularTable: true,
+	}
+	sqlDb, err := dataSource.DB()
+	if err != nil {
+		return nil, err
+	}
+	if connection.PoolConfig.MaxOpenConns > 0 {
+		sqlDb.SetMaxOpenConns(connection.PoolConfig.MaxOpenConns)
+	}
+	if connection.PoolConfig.MaxIdleConns > 0 {
+		sqlDb.SetMaxIdleConns(connection.PoolConfig.MaxIdleConns)
+	}
+	if connection.PoolConfig.ConnMaxLifetime > 0 {
+		sqlDb.SetConnMaxLifetime(connection.PoolConfig.ConnMaxLifetime)
+	}
+	dataSourceDb.Db = dataSource
 	dataSourceDb.Schema = dbSchema
-	dataSourceDbMap[sourceAndSchemaKey] = dataSourceDb
-	return dataSourceDb
+	return dataSourceDb, nil
+}
+
+// Returns the name of the schema as it is stored by the database (see Dialect.NormalizeSchemaName). In postgres, the
+// schema names used to be unquoted in queries, which folds them to lowercase. So an existing configuration with an
+// uppercase schema name may refer to a lowercase schema, which is used if no schema with the exact name exists.
+func ResolveSchemaName(db *gorm.DB, vendor string, dbSchema Identifier) Identifier {
+	dbSchema = Identifier(GetDialect(vendor).NormalizeSchemaName(string(dbSchema)))
+	lowercaseSchema := Identifier(strings.ToLower(string(dbSchema)))
+	if _, ok := GetDialect(vendor).(postgresDialect); !ok || lowercaseSchema == dbSchema {
+		return dbSchema
+	}
+	var schemaNames []string
+	err := db.Raw("SELECT nspname FROM pg_catalog.pg_namespace WHERE nspname in (?, ?)", string(dbSchema), string(lowercaseSchema)).
+		Scan(&schemaNames).Error
+	if err != nil {
+		log.Printf("WARNING: could not look up schema %s, using it as is: %v", dbSchema, err)
+		return dbSchema
+	}
+	if !slices.Contains(schemaNames, string(dbSchema)) && slices.Contains(schemaNames, string(lowercaseSchema)) {
+		log.Printf("WARNING: schema %s does not exist, using schema %s instead", dbSchema, lowercaseSchema)
+		return lowercaseSchema
+	}
+	return dbSchema
+}
+
+func pingDataSourceDB(ctx context.Context, dataSource *DbAndSchema) error {
+	sqlDb, err := dataSource.Db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDb.PingContext(ctx)
 }
 
 // Adds a default timeout to a query
@@ -65,18 +114,35 @@ func AddTimeoutToQuery(query *gorm.DB) (*gorm.DB, context.CancelFunc) {
 	return query, cancel
 }
 
+// Adds the default timeout to a query, which is also cancelled when the given parent context is done.
+// When the parent context already has a deadline (e.g. the query timeout set for the endpoint class of
+// the request), that deadline is used instead of the default timeout.
+func AddTimeoutToQueryWithContext(parentCtx context.Context, query *gorm.DB) (*gorm.DB, context.CancelFunc) {
+	if _, ok := parentCtx.Deadline(); ok {
+		ctx, cancel := context.WithCancel(parentCtx)
+		return query.WithContext(ctx), cancel
+	}
+	return AddSpecificTimeoutToQueryWithContext(parentCtx, query, 180*time.Second)
+}
+
 // Adds a specific timeout to a query
 func AddSpecificTimeoutToQuery(query *gorm.DB, timeout time.Duration) (*gorm.DB, context.CancelFunc) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return AddSpecificTimeoutToQueryWithContext(context.Background(), query, timeout)
+}
+
+// Adds a specific timeout to a query, which is also cancelled when the given parent context is done
+func AddSpecificTimeoutToQueryWithContext(parentCtx context.Context, query *gorm.DB, timeout time.Duration) (*gorm.DB, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
 	query = query.WithContext(ctx)
 	return query, cancel
 }
 
-// Returns extra DB dialect specific directives to optimize performance when using views:
-func (h DbAndSchema) GetViewDirective() string {
-	if h.Vendor == "sqlserver" {
-		return " WITH (NOEXPAND) "
-	} else {
-		return ""
-	}
+// The ESCAPE clause to add after each LIKE with a pattern of ContainsLikePattern:
+const LikeEscapeClause = " escape '!'"
+
+// Returns the (lowercase) LIKE pattern that matches the values that contain the given text. The wildcards in
+// the text are escaped, including the [ of sql server, so that they match themselves.
+func ContainsLikePattern(text string) string {
+	escaper := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_", "[", "![")
+	return "%" + escaper.Replace(strings.ToLower(text)) + "%"
 }
@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The SQL that differs between the database vendors. Each query in models that is not fully
+// built by gorm should get its vendor specific parts from the Dialect of its DbAndSchema.
+type Dialect interface {
+	// Returns the schema name as it is stored by the database, e.g. lowercase in sqlite. See also ResolveSchemaName.
+	NormalizeSchemaName(schema string) string
+	// Quotes a table, column or schema name, so that it is used as is.
+	QuoteIdentifier(name string) string
+	// Combines two SELECT queries with INTERSECT, UNION or EXCEPT. The result can be an operand again.
+	SetOperation(left string, operator string, right string) string
+	// Returns a query over the values of column in the given subquery (which can be "?") that selects their
+	// count as value_count, their min and max as min_value and max_value (0 if there are no values), and each
+	// of the percentiles, interpolated as in percentile_cont, under its name. The query always returns one row, and
+	// it is a complete statement, which cannot be used as a subquery.
+	PercentilesQuery(subquery string, column string, percentiles []NamedPercentile) string
+	// Returns the aggregate that computes the sample standard deviation of the expression.
+	StandardDeviation(expression string) string
+	// Returns the column type in which JSON values, like the data dictionary value summaries, are stored.
+	JsonColumnType() string
+	// Limits the number of rows returned by the SELECT query.
+	LimitQuery(selectQuery string, limit int) string
+	// Returns the name under which a temp table is referenced, e.g. "#name" on sql server.
+	TempTableName(name string) string
+	// Returns the statement that creates a temp table, visible to the current connection only, from a SELECT query.
+	CreateTempTableAs(name string, selectQuery string) string
+	// Returns the hints to add after a view in a FROM or JOIN clause, e.g. to use the view index.
+	ViewHint() string
+	// Returns the query that takes the next value of the given (quoted) sequence, or "" if the database has no sequences.
+	NextSequenceValueQuery(sequence string) string
+	// Returns the statement that takes an exclusive lock, held until the end of the transaction, on the key given as
+	// its parameter, or "" if the database already serializes the transactions that write (sqlite).
+	TransactionLockQuery() string
+}
+
+type NamedPercentile struct {
+	Name     string
+	Fraction float64
+}
+
+// Returns the dialect of the given vendor, which is one of the Vendor* constants or the name of a gorm dialector.
+func GetDialect(vendor string) Dialect {
+	switch vendor {
+	case VendorSqlserver:
+		return sqlserverDialect{}
+	case VendorSqlite:
+		return sqliteDialect{}
+	default:
+		return postgresDialect{}
+	}
+}
+
+func (h DbAndSchema) Dialect() Dialect {
+	return GetDialect(h.Vendor)
+}
+
+type postgresDialect struct{}
+
+func (d postgresDialect) NormalizeSchemaName(schema string) string {
+	// quoted names keep their case, so that schemas with uppercase names can be used:
+	return schema
+}
+
+func (d postgresDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (d postgresDialect) SetOperation(left string, operator string, right string) string {
+	return "(" + left + ") " + operator + " (" + right + ")"
+}
+
+func (d postgresDialect) PercentilesQuery(subquery string, column string, percentiles []NamedPercentile) string {
+	columns := []string{"count(*) as value_count",
+		"coalesce(min(percentile_values." + column + "), 0) as min_value",
+		"coalesce(max(percentile_values." + column + "), 0) as max_value"}
+	for _, percentile := range percentiles {
+		columns = append(columns, fmt.Sprintf("coalesce(percentile_cont(%v) within group (order by percentile_values.%s), 0) as %s",
+			percentile.Fraction, column, percentile.Name))
+	}
+	return "SELECT " + strings.Join(columns, ", ") + " FROM (" + subquery + ") as percentile_values"
+}
+
+func (d postgresDialect) StandardDeviation(expression string) string {
+	return "stddev(" + expression + ")"
+}
+
+func (d postgresDialect) JsonColumnType() string {
+	return "json"
+}
+
+func (d postgresDialect) LimitQuery(selectQuery string, limit int) string {
+	return fmt.Sprintf("%s LIMIT %d", selectQuery, limit)
+}
+
+func (d postgresDialect) TempTableName(name string) string {
+	return name
+}
+
+func (d postgresDialect) CreateTempTableAs(name string, selectQuery string) string {
+	return "CREATE TEMP TABLE " + d.TempTableName(name) + " AS " + selectQuery
+}
+
+func (d postgresDialect) ViewHint() string {
+	return ""
+}
+
+func (d postgresDialect) NextSequenceValueQuery(sequence string) string {
+	return "SELECT nextval('" + sequence + "')"
+}
+
+func (d postgresDialect) TransactionLockQuery() string {
+	return "SELECT pg_advisory_xact_lock(hashtext(?))"
+}
+
+type sqlserverDialect struct{}
+
+func (d sqlserverDialect) NormalizeSchemaName(schema string) string {
+	return schema
+}
+
+func (d sqlserverDialect) QuoteIdentifier(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+func (d sqlserverDialect) SetOperation(left string, operator string, right string) string {
+	return "(" + left + ") " + operator + " (" + right + ")"
+}
+
+func (d sqlserverDialect) PercentilesQuery(subquery string, column string, percentiles []NamedPercentile) string {
+	// percentile_cont is only available as a window function in sql server, which gives no row without values,
+	// so the percentiles are joined onto the aggregates, which always give one row:
+	var percentileColumns []string
+	var selectedPercentiles []string
+	for _, percentile := range percentiles {
+		percentileColumns = append(percentileColumns, fmt.Sprintf("percentile_cont(%v) within group (order by percentile_values.%s) over () as %s",
+			percentile.Fraction, column, percentile.Name))
+		selectedPercentiles = append(selectedPercentiles, fmt.Sprintf("coalesce(value_percentiles.%[1]s, 0) as %[1]s", percentile.Name))
+	}
+	// the subquery (which can be a single parameter) is only given once, in a common table expression:
+	return "WITH percentile_values AS (SELECT * FROM (" + subquery + ") as subquery_values) " +
+		"SELECT " + strings.Join(append([]string{"value_stats.value_count", "value_stats.min_value", "value_stats.max_value"}, selectedPercentiles...), ", ") +
+		" FROM (SELECT count(*) as value_count, coalesce(min(percentile_values." + column + "), 0) as min_value, " +
+		"coalesce(max(percentile_values." + column + "), 0) as max_value FROM percentile_values) as value_stats " +
+		"LEFT JOIN (" + d.LimitQuery("SELECT "+strings.Join(percentileColumns, ", ")+" FROM percentile_values", 1) + ") as value_percentiles ON 1 = 1"
+}
+
+func (d sqlserverDialect) StandardDeviation(expression string) string {
+	return "stdev(" + expression + ")"
+}
+
+func (d sqlserverDialect) JsonColumnType() string {
+	return "varbinary(max)"
+}
+
+func (d sqlserverDialect) LimitQuery(selectQuery string, limit int) string {
+	if len(selectQuery) > 7 && strings.EqualFold(selectQuery[:7], "SELECT ") && !strings.HasPrefix(strings.ToUpper(selectQuery[7:]), "DISTINCT ") {
+		return fmt.Sprintf("SELECT TOP %d %s", limit, selectQuery[7:])
+	}
+	return fmt.Sprintf("SELECT TOP %d * FROM (%s) as limited_values", limit, selectQuery)
+}
+
+func (d sqlserverDialect) TempTableName(name string) string {
+	return "#" + name
+}
+
+func (d sqlserverDialect) CreateTempTableAs(name string, selectQuery string) string {
+	return "SELECT * INTO " + d.TempTableName(name) + " FROM (" + selectQuery + ") as temp_table_values"
+}
+
+func (d sqlserverDialect) ViewHint() string {
+	return " WITH (NOEXPAND) "
+}
+
+func (d sqlserverDialect) NextSequenceValueQuery(sequence string) string {
+	return "SELECT NEXT VALUE FOR " + sequence
+}
+
+func (d sqlserverDialect) TransactionLockQuery() string {
+	// sp_getapplock reports a lock that is not granted in its return value instead of as an error:
+	return "DECLARE @lock_result int; " +
+		"EXEC @lock_result = sp_getapplock @Resource = ?, @LockMode = 'Exclusive', @LockOwner = 'Transaction'; " +
+		"IF @lock_result < 0 THROW 50000, 'failed to acquire the transaction lock', 1;"
+}
+
+type sqliteDialect struct{}
+
+func (d sqliteDialect) NormalizeSchemaName(schema string) string {
+	// the schemas are the names of the attached database files (see sqlite.go):
+	return strings.ToLower(schema)
+}
+
+func (d sqliteDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (d sqliteDialect) SetOperation(left string, operator string, right string) string {
+	// sqlite does not allow parentheses around the operands of a compound select:
+	return "SELECT * FROM (" + left + ") " + operator + " SELECT * FROM (" + right + ")"
+}
+
+func (d sqliteDialect) PercentilesQuery(subquery string, column string, percentiles []NamedPercentile) string {
+	// sqlite has no percentile functions, so the values are numbered to interpolate between the two
+	// values around each percentile, as percentile_cont does:
+	columns := []string{"count(*) as value_count",
+		"coalesce(min(percentile_values." + column + "), 0) as min_value",
+		"coalesce(max(percentile_values." + column + "), 0) as max_value"}
+	for _, percentile := range percentiles {
+		position := fmt.Sprintf("((percentile_values.value_total - 1) * %v)", percentile.Fraction)
+		lowerIndex := "cast(" + position + " as integer)"
+		fraction := "(" + position + " - " + lowerIndex + ")"
+		columns = append(columns, fmt.Sprintf("coalesce(sum(case when percentile_values.value_index = %s then percentile_values.%s * (1 - %s) "+
+			"when percentile_values.value_index = %s + 1 then percentile_values.%s * %s end), 0) as %s",
+			lowerIndex, column, fraction, lowerIndex, column, fraction, percentile.Name))
+	}
+	return "SELECT " + strings.Join(columns, ", ") + " FROM (SELECT ordered_values." + column + ", " +
+		"row_number() over (order by ordered_values." + column + ") - 1 as value_index, count(*) over () as value_total " +
+		"FROM (" + subquery + ") as ordered_values) as percentile_values"
+}
+
+func (d sqliteDialect) StandardDeviation(expression string) string {
+	return fmt.Sprintf("sqrt((sum(1.0 * (%[1]s) * (%[1]s)) - 1.0 * sum(%[1]s) * sum(%[1]s) / count(%[1]s)) / nullif(count(%[1]s) - 1, 0))", expression)
+}
+
+func (d sqliteDialect) JsonColumnType() string {
+	return "text"
+}
+
+func (d sqliteDialect) LimitQuery(selectQuery string, limit int) string {
+	return fmt.Sprintf("%s LIMIT %d", selectQuery, limit)
+}
+
+func (d sqliteDialect) TempTableName(name string) string {
+	return "temp." + name
+}
+
+func (d sqliteDialect) CreateTempTableAs(name string, selectQuery string) string {
+	return "CREATE TEMP TABLE " + name + " AS " + selectQuery
+}
+
+func (d sqliteDialect) ViewHint() string {
+	return ""
+}
+
+func (d sqliteDialect) NextSequenceValueQuery(sequence string) string {
+	return ""
+}
+
+func (d sqliteDialect) TransactionLockQuery() string {
+	// sqlite allows one writer at a time, and a transaction that read before another one wrote fails with SQLITE_BUSY when it writes:
+	return ""
+}
@@ -3,28 +3,368 @@ package utils
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
-func GenerateDsn(sourceConnectionString string) string {
-	sourceConnectionParts := strings.FieldsFunc(sourceConnectionString, func(r rune) bool {
-		separators := ":/;="
-		return strings.ContainsRune(separators, r)
-	})
-	dbVendor := sourceConnectionParts[1]
-	log.Printf("Found db vendor %s", dbVendor)
-	host := sourceConnectionParts[2]
-	port := sourceConnectionParts[3]
-	dbname := sourceConnectionParts[5]
-	username := sourceConnectionParts[7]
-	password := sourceConnectionParts[9]
-
-	dsn := fmt.Sprintf(dbVendor+"://%s:%s@%s:%s?database=%s",
-		username,
-		url.QueryEscape(password),
-		host,
-		port,
-		dbname)
-	return dsn
+const (
+	VendorPostgresql = "postgresql"
+	VendorSqlserver  = "sqlserver"
+	VendorSqlite     = "sqlite"
+)
+
+// The parts of an Atlas source_connection, which is a JDBC URL like
+// "jdbc:postgresql://host:5432/dbname?user=name&password=secret&ssl=true",
+// "jdbc:sqlserver://host\instance:1433;databaseName=dbname;user=name;password={se;cret};encrypt=true" or
+// "jdbc:sqlite:/path/to/file.db", where Database is the path of the file.
+type JdbcConnection struct {
+	Vendor string
+	Host   string
+	Port   string
+	// only used for sqlserver:
+	Instance string
+	Database string
+	Username string
+	Password string
+	// the other properties, with lower case names:
+	Properties map[string]string
+}
+
+// The JDBC properties that are carried into the driver DSN, mapped to their name in the DSN of each vendor.
+// The names of the JDBC properties are in lower case, as they are matched case insensitively.
+var jdbcPropertiesToDsnParameters = map[string]map[string]string{
+	VendorPostgresql: {
+		"sslmode":         "sslmode",
+		"sslrootcert":     "sslrootcert",
+		"sslcert":         "sslcert",
+		"sslkey":          "sslkey",
+		"connecttimeout":  "connect_timeout",
+		"logintimeout":    "connect_timeout",
+		"applicationname": "application_name",
+		"currentschema":   "search_path",
+	},
+	VendorSqlserver: {
+		"encrypt":                "encrypt",
+		"trustservercertificate": "TrustServerCertificate",
+		"hostnameincertificate":  "hostNameInCertificate",
+		"logintimeout":           "connection timeout",
+		"applicationname":        "app name",
+		"applicationintent":      "ApplicationIntent",
+		"multisubnetfailover":    "MultiSubnetFailover",
+		"packetsize":             "packet size",
+	},
+}
+
+var jdbcDatabaseProperties = []string{"databasename", "database", "dbname"}
+var jdbcUserProperties = []string{"user", "username"}
+
+// Parses the JDBC URL of a postgresql or sqlserver source. Errors never contain the password.
+func ParseJdbcConnectionString(sourceConnectionString string) (*JdbcConnection, error) {
+	connectionString := strings.TrimSpace(sourceConnectionString)
+	if len(connectionString) < 5 || !strings.EqualFold(connectionString[:5], "jdbc:") {
+		return nil, fmt.Errorf("connection string should start with 'jdbc:'")
+	}
+	if len(connectionString) > 12 && strings.EqualFold(connectionString[5:12], VendorSqlite+":") {
+		// the file of an embedded database, as in the sqlite JDBC driver:
+		path := strings.TrimPrefix(connectionString[12:], "file:")
+		if path == "" || strings.ContainsAny(path, "?;") {
+			return nil, fmt.Errorf("sqlite connection string should be like 'jdbc:sqlite:/path/to/file.db'")
+		}
+		return &JdbcConnection{Vendor: VendorSqlite, Database: path, Properties: map[string]string{}}, nil
+	}
+	vendor, rest, found := strings.Cut(connectionString[5:], "://")
+	if !found {
+		return nil, fmt.Errorf("connection string should be like 'jdbc:<vendor>://...'")
+	}
+	connection := &JdbcConnection{Vendor: strings.ToLower(vendor), Properties: map[string]string{}}
+	var err error
+	switch connection.Vendor {
+	case VendorPostgresql:
+		err = connection.parsePostgresql(rest)
+	case VendorSqlserver:
+		err = connection.parseSqlserver(rest)
+	default:
+		return nil, fmt.Errorf("unsupported database vendor '%s'", vendor)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if connection.Host == "" {
+		return nil, fmt.Errorf("connection string has no host")
+	}
+	if connection.Port != "" {
+		if port, err := strconv.Atoi(connection.Port); err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port '%s'", connection.Port)
+		}
+	}
+	return connection, nil
+}
+
+// Parses "host[:port][/database][?properties]", where the properties are URL encoded and separated
+// by "&". The sqlserver style ";name=value" properties, as used by some Atlas sources, are also supported.
+func (c *JdbcConnection) parsePostgresql(rest string) error {
+	authorityEnd := indexOutsideBrackets(rest, "/?;")
+	authority, rest := rest[:authorityEnd], rest[authorityEnd:]
+	if err := c.parseAuthority(authority); err != nil {
+		return err
+	}
+	if strings.HasPrefix(rest, "/") {
+		pathEnd := strings.IndexAny(rest, "?;")
+		if pathEnd == -1 {
+			pathEnd = len(rest)
+		}
+		database, err := url.PathUnescape(rest[1:pathEnd])
+		if err != nil {
+			return fmt.Errorf("invalid database name")
+		}
+		c.Database, rest = database, rest[pathEnd:]
+	}
+	var properties map[string]string
+	var err error
+	switch {
+	case strings.HasPrefix(rest, "?"):
+		properties, err = parseUrlProperties(rest[1:])
+	case strings.HasPrefix(rest, ";"):
+		properties, err = parseSemicolonProperties(rest[1:])
+	}
+	if err != nil {
+		return err
+	}
+	c.setProperties(properties)
+	return nil
+}
+
+// Parses "[host[\instance][:port]][;name=value]...", where values can be enclosed in braces to
+// contain ";", and where the host, instance and port can also be given as properties.
+func (c *JdbcConnection) parseSqlserver(rest string) error {
+	authorityEnd := indexOutsideBrackets(rest, ";")
+	authority, rest := rest[:authorityEnd], strings.TrimPrefix(rest[authorityEnd:], ";")
+	if err := c.parseAuthority(authority); err != nil {
+		return err
+	}
+	properties, err := parseSemicolonProperties(rest)
+	if err != nil {
+		return err
+	}
+	if serverName, ok := properties["servername"]; ok {
+		delete(properties, "servername")
+		if err := c.parseAuthority(serverName); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{"instancename", "portnumber", "port"} {
+		if value, ok := properties[name]; ok {
+			delete(properties, name)
+			if name == "instancename" {
+				c.Instance = value
+			} else {
+				c.Port = value
+			}
+		}
+	}
+	c.setProperties(properties)
+	return nil
+}
+
+// Parses "[user[:password]@]host[\instance][:port]", where host can be an IPv6 address between brackets.
+func (c *JdbcConnection) parseAuthority(authority string) error {
+	if at := strings.LastIndex(authority, "@"); at != -1 {
+		user, password, _ := strings.Cut(authority[:at], ":")
+		var err error
+		if c.Username, err = url.PathUnescape(user); err != nil {
+			return fmt.Errorf("invalid user name")
+		}
+		if c.Password, err = url.PathUnescape(password); err != nil {
+			return fmt.Errorf("invalid password")
+		}
+		authority = authority[at+1:]
+	}
+	if authority == "" {
+		return nil
+	}
+	if strings.Contains(authority, ",") {
+		return fmt.Errorf("multiple hosts are not supported")
+	}
+	hostAndInstance, port := authority, ""
+	if strings.HasPrefix(authority, "[") {
+		closingBracket := strings.Index(authority, "]")
+		if closingBracket == -1 {
+			return fmt.Errorf("missing ']' in IPv6 host")
+		}
+		hostAndInstance, port = authority[1:closingBracket], authority[closingBracket+1:]
+		if port != "" && !strings.HasPrefix(port, ":") {
+			return fmt.Errorf("unexpected '%s' after IPv6 host", port)
+		}
+		port = strings.TrimPrefix(port, ":")
+	} else if strings.Count(authority, ":") > 1 {
+		return fmt.Errorf("IPv6 hosts should be enclosed in brackets")
+	} else if host, hostPort, found := strings.Cut(authority, ":"); found {
+		hostAndInstance, port = host, hostPort
+	}
+	host, instance, _ := strings.Cut(hostAndInstance, `\`)
+	if instance != "" && c.Vendor != VendorSqlserver {
+		return fmt.Errorf("instance names are only supported for sqlserver")
+	}
+	c.Host, c.Instance = host, instance
+	if port != "" {
+		c.Port = port
+	}
+	return nil
+}
+
+// Takes the database, user and password from the properties and keeps the other properties.
+func (c *JdbcConnection) setProperties(properties map[string]string) {
+	for _, name := range jdbcDatabaseProperties {
+		if value, ok := properties[name]; ok {
+			c.Database = value
+			delete(properties, name)
+		}
+	}
+	for _, name := range jdbcUserProperties {
+		if value, ok := properties[name]; ok {
+			c.Username = value
+			delete(properties, name)
+		}
+	}
+	if value, ok := properties["password"]; ok {
+		c.Password = value
+		delete(properties, "password")
+	}
+	for name, value := range properties {
+		c.Properties[name] = value
+	}
+}
+
+// Returns the DSN for the gorm driver of the vendor. The username and password are
+// only used if the connection string has no credentials of its own.
+func (c *JdbcConnection) Dsn(username string, password string) string {
+	if c.Vendor == VendorSqlite {
+		return sqliteDsn(c.Database)
+	}
+	if c.Username != "" {
+		username = c.Username
+	}
+	if c.Password != "" {
+		password = c.Password
+	}
+	dsn := url.URL{Scheme: c.Vendor, Host: c.Host}
+	if strings.Contains(c.Host, ":") {
+		dsn.Host = "[" + c.Host + "]"
+	}
+	if c.Port != "" {
+		dsn.Host = net.JoinHostPort(c.Host, c.Port)
+	}
+	if username != "" {
+		dsn.User = url.UserPassword(username, password)
+	}
+	parameters := url.Values{}
+	if c.Vendor == VendorPostgresql {
+		if c.Database != "" {
+			dsn.Path = "/" + c.Database
+		}
+		// as in the postgresql JDBC driver, ssl=true without sslmode verifies the server certificate:
+		if ssl, ok := c.Properties["ssl"]; ok && c.Properties["sslmode"] == "" {
+			if strings.EqualFold(ssl, "false") {
+				parameters.Set("sslmode", "disable")
+			} else {
+				parameters.Set("sslmode", "verify-full")
+			}
+		}
+	} else {
+		if c.Instance != "" {
+			dsn.Path = "/" + c.Instance
+		}
+		if c.Database != "" {
+			parameters.Set("database", c.Database)
+		}
+	}
+	for name, value := range c.Properties {
+		if parameter, ok := jdbcPropertiesToDsnParameters[c.Vendor][name]; ok {
+			// e.g. connectTimeout takes precedence over its alternative loginTimeout:
+			if parameters.Get(parameter) == "" || name != "logintimeout" {
+				parameters.Set(parameter, value)
+			}
+		} else if name != "ssl" {
+			log.Printf("WARNING: ignoring unsupported connection property '%s'", name)
+		}
+	}
+	dsn.RawQuery = parameters.Encode()
+	return dsn.String()
+}
+
+// Parses "name=value&name=value", where names and values are URL encoded.
+func parseUrlProperties(query string) (map[string]string, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection properties")
+	}
+	properties := map[string]string{}
+	for name, value := range values {
+		properties[strings.ToLower(name)] = value[len(value)-1]
+	}
+	return properties, nil
+}
+
+// Parses "name=value;name={value}", where a value between braces can contain ";" and "}}" stands for "}".
+func parseSemicolonProperties(propertiesString string) (map[string]string, error) {
+	properties := map[string]string{}
+	for len(propertiesString) > 0 {
+		if propertiesString[0] == ';' {
+			propertiesString = propertiesString[1:]
+			continue
+		}
+		name, rest, found := strings.Cut(propertiesString, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !found || name == "" || strings.Contains(name, ";") {
+			// the property is not part of the error, as it could be a mistyped password:
+			return nil, fmt.Errorf("invalid connection property, expected name=value")
+		}
+		var value string
+		if strings.HasPrefix(rest, "{") {
+			var builder strings.Builder
+			i := 1
+			for ; i < len(rest); i++ {
+				if rest[i] == '}' {
+					if i+1 < len(rest) && rest[i+1] == '}' {
+						builder.WriteByte('}')
+						i++
+						continue
+					}
+					break
+				}
+				builder.WriteByte(rest[i])
+			}
+			if i >= len(rest) {
+				return nil, fmt.Errorf("missing '}' in the value of connection property '%s'", name)
+			}
+			value, rest = builder.String(), rest[i+1:]
+			if rest != "" && rest[0] != ';' {
+				return nil, fmt.Errorf("unexpected text after the value of connection property '%s'", name)
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ";")
+			value = strings.TrimSpace(value)
+		}
+		properties[name] = value
+		propertiesString = rest
+	}
+	return properties, nil
+}
+
+// Returns the index of the first of the chars that is not between "[" and "]", or len(s) if there is none.
+func indexOutsideBrackets(s string, chars string) int {
+	inBrackets := false
+	for i, char := range s {
+		switch {
+		case char == '[':
+			inBrackets = true
+		case char == ']':
+			inBrackets = false
+		case !inBrackets && strings.ContainsRune(chars, char):
+			return i
+		}
+	}
+	return len(s)
 }
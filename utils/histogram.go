@@ -23,41 +23,52 @@ func GenerateHistogramData(conceptValues []float64) []HistogramColumn {
 	}
 	numBins, width := GetBinsAndWidthAndSortValues(conceptValues) //conceptValues will get sorted as a side-effect, which is useful in this case
 	startValue := conceptValues[0]
-	binIndexToHistogramColumn := make(map[int]HistogramColumn)
-
-	for binIndex := 0; binIndex < numBins; binIndex++ {
-		binStart := (float64(binIndex) * width) + startValue
-		binEnd := binStart + width
-		binIndexToHistogramColumn[binIndex] = HistogramColumn{
-			Start:          binStart,
-			End:            binEnd,
-			NumberOfPeople: 0,
-		}
-	}
-
+	binIndexToPersonCount := make(map[int]int)
 	for _, value := range conceptValues {
 		valueBinIndex := int((value - startValue) / width)
-		if histogramColumn, ok := binIndexToHistogramColumn[valueBinIndex]; ok {
-			histogramColumn.NumberOfPeople += 1
-			binIndexToHistogramColumn[valueBinIndex] = histogramColumn
-		}
+		binIndexToPersonCount[valueBinIndex] += 1
 	}
 
+	return GenerateHistogramDataFromBinCounts(startValue, width, numBins, binIndexToPersonCount)
+}
+
+// Builds the histogram columns from the number of people per bin index, where a value
+// falls in bin index floor((value - startValue) / width). Bin indexes outside [0, numBins) are ignored.
+func GenerateHistogramDataFromBinCounts(startValue float64, width float64, numBins int, binIndexToPersonCount map[int]int) []HistogramColumn {
 	histogram := []HistogramColumn{}
 	for binIndex := 0; binIndex < numBins; binIndex++ {
-		histogram = append(histogram, binIndexToHistogramColumn[binIndex])
+		binStart := (float64(binIndex) * width) + startValue
+		binEnd := binStart + width
+		histogram = append(histogram, HistogramColumn{
+			Start:          binStart,
+			End:            binEnd,
+			NumberOfPeople: binIndexToPersonCount[binIndex],
+		})
 	}
-
 	return histogram
 }
 
 // Sorts the given values, and returns the number of bins, the width of the bins using FreedmanDiaconis
 func GetBinsAndWidthAndSortValues(values []float64) (int, float64) {
 
-	width := FreedmanDiaconis(values) // values will get sorted as a side-effect, which is useful in this case
+	width := FreedmanDiaconis(values) // values will get sorted as a side-effect, which is useful in this case
 	startValue := values[0]
 	endValue := values[len(values)-1]
 
+	return GetBinsForWidth(width, startValue, endValue)
+}
+
+// Returns the number of bins and the width of the bins for a set of numberOfValues values between
+// startValue and endValue with the given inter quartile range, using FreedmanDiaconis. Useful when
+// the values themselves are not available, e.g. when these statistics were computed by the database.
+func GetBinsAndWidth(numberOfValues int, startValue float64, endValue float64, interQuartileRange float64) (int, float64) {
+	width := (2 * interQuartileRange) / math.Cbrt(float64(numberOfValues))
+	return GetBinsForWidth(width, startValue, endValue)
+}
+
+// Returns the number of bins for the given width, correcting the width if it is 0 or
+// if it results in more than MAX_NUM_BINS bins.
+func GetBinsForWidth(width float64, startValue float64, endValue float64) (int, float64) {
 	numBins := 0
 	if width > 0 {
 		numBins = int((endValue-startValue)/width) + 1
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// A schema or table name that is safe to use in SQL, as it only has letters, digits and underscores.
+// Schema names come from the configuration and from the table_qualifier of the Atlas source daimons,
+// so they are validated with ParseIdentifier before they are used to build queries.
+type Identifier string
+
+var ErrInvalidIdentifier = errors.New("invalid SQL identifier")
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// the longest identifier allowed by SQL Server (postgres truncates identifiers after 63 characters):
+const maxIdentifierLength = 128
+
+func ParseIdentifier(name string) (Identifier, error) {
+	if len(name) > maxIdentifierLength || !identifierPattern.MatchString(name) {
+		return "", fmt.Errorf("%w '%s'", ErrInvalidIdentifier, name)
+	}
+	return Identifier(name), nil
+}
+
+// Returns the identifier quoted for the given dialect.
+func (i Identifier) Quote(dialect Dialect) string {
+	return dialect.QuoteIdentifier(string(i))
+}
+
+// Returns the quoted name of the given table in the schema of the data source, to build queries with,
+// e.g. Db.Table(dataSource.Table("cohort") + " as cohort") or "DELETE FROM " + dataSource.Table("cohort").
+func (h DbAndSchema) Table(table Identifier) string {
+	dialect := h.Dialect()
+	return h.Schema.Quote(dialect) + "." + table.Quote(dialect)
+}
+
+// Returns the unquoted name of the given table in the schema of the data source, for the gorm methods
+// that quote the table name themselves, like Db.Table(dataSource.UnquotedTable("cohort")).Create(...).
+func (h DbAndSchema) UnquotedTable(table Identifier) string {
+	return string(h.Schema) + "." + string(table)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -34,6 +35,39 @@ func ParseBigNumericArg(c *gin.Context, paramName string) (int64, error) {
 	}
 }
 
+// Parses the optional "page" (1-based) and "page-size" query parameters, using
+// defaultPageSize if no page size is given and rejecting page sizes above maxPageSize.
+func ParsePaginationArgs(c *gin.Context, defaultPageSize int, maxPageSize int) (int, int, error) {
+	page := 1
+	pageSize := defaultPageSize
+	if pageArg := c.Query("page"); pageArg != "" {
+		var err error
+		if page, err = strconv.Atoi(pageArg); err != nil || page < 1 {
+			return -1, -1, errors.New("bad request - page should be a positive number")
+		}
+	}
+	if pageSizeArg := c.Query("page-size"); pageSizeArg != "" {
+		var err error
+		if pageSize, err = strconv.Atoi(pageSizeArg); err != nil || pageSize < 1 || pageSize > maxPageSize {
+			return -1, -1, fmt.Errorf("bad request - page-size should be a number between 1 and %d", maxPageSize)
+		}
+	}
+	return page, pageSize, nil
+}
+
+// Returns the values of a query parameter that can be repeated and/or contain comma separated values.
+func ParseListQueryArg(c *gin.Context, paramName string) []string {
+	var values []string
+	for _, arg := range c.QueryArray(paramName) {
+		for _, value := range strings.Split(arg, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
 func Pos(value int64, list []int64) int {
 	for p, v := range list {
 		if v == value {
@@ -108,6 +142,11 @@ type CustomDichotomousVariableDef struct {
 	ProvidedName        string
 }
 
+// Returns true if both variables are defined on the same pair of cohorts.
+func (u CustomDichotomousVariableDef) SameCohorts(other CustomDichotomousVariableDef) bool {
+	return u.CohortDefinitionId1 == other.CohortDefinitionId1 && u.CohortDefinitionId2 == other.CohortDefinitionId2
+}
+
 func GetCohortPairKey(firstCohortDefinitionId int, secondCohortDefinitionId int) string {
 	return fmt.Sprintf("ID_%v_%v", firstCohortDefinitionId, secondCohortDefinitionId)
 }
@@ -285,9 +324,9 @@ func ParseSourceIdAndCohortIdAndVariablesAsSingleList(c *gin.Context) (int, int,
 	return sourceId, cohortId, conceptIdsAndCohortPairs, nil
 }
 
-func MakeUnique(input []int) []int {
-	uniqueMap := make(map[int]bool)
-	var uniqueList []int
+func MakeUnique[T comparable](input []T) []T {
+	uniqueMap := make(map[T]bool)
+	var uniqueList []T
 
 	for _, num := range input {
 		if !uniqueMap[num] {
@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stores serialized query results under a key until they expire. Implementations are safe for concurrent use.
+type ResultCacheBackend interface {
+	// Returns the value of the key, if it is found and not expired.
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string)
+}
+
+// In-process backend that keeps at most maxEntries results, evicting the least recently used result when it is full.
+type LruResultCache struct {
+	mutex      sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	// the most recently used entry is at the front:
+	usage *list.List
+}
+
+type lruResultCacheEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func NewLruResultCache(maxEntries int) *LruResultCache {
+	return &LruResultCache{maxEntries: maxEntries, entries: make(map[string]*list.Element), usage: list.New()}
+}
+
+func (c *LruResultCache) Get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	entry := element.Value.(*lruResultCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.removeElement(element)
+		return nil, false
+	}
+	c.usage.MoveToFront(element)
+	return entry.value, true
+}
+
+func (c *LruResultCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := &lruResultCacheEntry{key: key, value: value, expiresAt: time.Now().Add(ttl)}
+	if element, found := c.entries[key]; found {
+		element.Value = entry
+		c.usage.MoveToFront(element)
+		return nil
+	}
+	c.entries[key] = c.usage.PushFront(entry)
+	for c.usage.Len() > c.maxEntries {
+		c.removeElement(c.usage.Back())
+	}
+	return nil
+}
+
+func (c *LruResultCache) Delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, found := c.entries[key]; found {
+		c.removeElement(element)
+	}
+}
+
+func (c *LruResultCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.usage.Len()
+}
+
+func (c *LruResultCache) removeElement(element *list.Element) {
+	c.usage.Remove(element)
+	delete(c.entries, element.Value.(*lruResultCacheEntry).key)
+}
+
+// Backend that stores each result in a file of the given directory, so that the results survive restarts.
+// A file starts with the expiry time of the result, followed by the result itself. The expired results are
+// removed every diskResultCacheCleanupInterval, and the results that expire first are removed when there
+// are more than maxEntries results.
+type DiskResultCache struct {
+	directory  string
+	maxEntries int
+	mutex      sync.Mutex
+	// the number of results, which is only approximate between two cleanups when results are set concurrently:
+	entries     int
+	lastCleanup time.Time
+}
+
+const diskResultCacheCleanupInterval = time.Minute
+
+// Creates the directory if it does not exist yet, and removes the expired results found in it.
+func NewDiskResultCache(directory string, maxEntries int) (*DiskResultCache, error) {
+	if err := os.MkdirAll(directory, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create the result cache directory: %w", err)
+	}
+	c := &DiskResultCache{directory: directory, maxEntries: maxEntries}
+	if err := c.cleanup(); err != nil {
+		return nil, fmt.Errorf("could not read the result cache directory: %w", err)
+	}
+	return c, nil
+}
+
+var errResultExpired = errors.New("result expired")
+
+// the keys can be long and contain any character, so the file names are their hashes:
+func (c *DiskResultCache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(c.directory, hex.EncodeToString(hash[:]))
+}
+
+func (c *DiskResultCache) readFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	} else if len(content) < 8 {
+		return nil, fmt.Errorf("invalid result cache file %s", path)
+	} else if time.Now().UnixNano() > int64(binary.BigEndian.Uint64(content[:8])) {
+		return nil, errResultExpired
+	}
+	return content[8:], nil
+}
+
+// Returns the expiry time of the result in the given file, without reading the result.
+func (c *DiskResultCache) readExpiry(path string) (time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+	content := make([]byte, 8)
+	if _, err := io.ReadFull(file, content); err != nil {
+		return time.Time{}, fmt.Errorf("invalid result cache file %s", path)
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(content))), nil
+}
+
+func (c *DiskResultCache) Get(key string) ([]byte, bool) {
+	path := c.path(key)
+	value, err := c.readFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			c.remove(path)
+		}
+		return nil, false
+	}
+	return value, true
+}
+
+func (c *DiskResultCache) Set(key string, value []byte, ttl time.Duration) error {
+	// write to a temporary file first, so that a concurrent Get never reads a partially written result:
+	file, err := os.CreateTemp(c.directory, ".result-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	content := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Add(ttl).UnixNano()))
+	if _, err := file.Write(append(content, value...)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	_, err = os.Stat(c.path(key))
+	isNew := errors.Is(err, fs.ErrNotExist)
+	if err := os.Rename(file.Name(), c.path(key)); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if isNew {
+		c.entries++
+	}
+	if c.entries > c.maxEntries || time.Since(c.lastCleanup) > diskResultCacheCleanupInterval {
+		if err := c.cleanup(); err != nil {
+			log.Printf("WARNING: could not clean up the result cache directory: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *DiskResultCache) Delete(key string) {
+	c.remove(c.path(key))
+}
+
+func (c *DiskResultCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.entries
+}
+
+func (c *DiskResultCache) remove(path string) {
+	err := os.Remove(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("WARNING: could not remove result cache file: %v", err)
+		}
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries--
+}
+
+// Removes the expired and invalid results and, if there are still more than maxEntries results, the results
+// that expire first. Recounts the results. Must be called with the mutex locked, or before the cache is used.
+func (c *DiskResultCache) cleanup() error {
+	files, err := os.ReadDir(c.directory)
+	if err != nil {
+		return err
+	}
+	type result struct {
+		path      string
+		expiresAt time.Time
+	}
+	var results []result
+	now := time.Now()
+	for _, file := range files {
+		// the temporary files of the results that are being set:
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(c.directory, file.Name())
+		expiresAt, err := c.readExpiry(path)
+		if err != nil || now.After(expiresAt) {
+			os.Remove(path)
+			continue
+		}
+		results = append(results, result{path: path, expiresAt: expiresAt})
+	}
+	if len(results) > c.maxEntries {
+		slices.SortFunc(results, func(a, b result) int {
+			return a.expiresAt.Compare(b.expiresAt)
+		})
+		for _, result := range results[:len(results)-c.maxEntries] {
+			os.Remove(result.path)
+		}
+		results = results[len(results)-c.maxEntries:]
+	}
+	c.entries = len(results)
+	c.lastCleanup = now
+	return nil
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	sqlitedriver "github.com/glebarez/go-sqlite"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// SQLite has no schemas, so each schema of an embedded database is a separate file next to the main
+// database file, named "<schema>.db", which is attached under the schema name on every connection.
+// This way the queries can keep referencing tables as "<schema>.<table>".
+const sqliteSchemaFileExtension = ".db"
+
+func init() {
+	// the functions used by the queries and fixtures, which sqlite does not have built in:
+	sqlitedriver.MustRegisterDeterministicScalarFunction("regexp", 2, sqliteRegexp)
+	sqlitedriver.MustRegisterDeterministicScalarFunction("regexp_replace", 3, sqliteRegexpReplace)
+}
+
+func sqliteDsn(path string) string {
+	return "file:" + path + "?_pragma=busy_timeout(10000)&_pragma=foreign_keys(1)"
+}
+
+// Returns the file of the given schema of the embedded database of which path is the main file.
+func SqliteSchemaFile(path string, schema string) (string, error) {
+	if _, err := ParseIdentifier(schema); err != nil {
+		return "", fmt.Errorf("invalid sqlite schema name: %w", err)
+	}
+	return filepath.Join(filepath.Dir(path), schema+sqliteSchemaFileExtension), nil
+}
+
+// Returns a gorm dialector for the embedded database of which path is the main file.
+func OpenSqlite(path string) gorm.Dialector {
+	return sqlite.Dialector{Conn: sql.OpenDB(sqliteConnector{path: path})}
+}
+
+type sqliteConnector struct {
+	path string
+}
+
+func (c sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return nil, err
+	}
+	conn, err := c.Driver().Open(sqliteDsn(c.path))
+	if err != nil {
+		return nil, err
+	}
+	schemaFiles, err := filepath.Glob(filepath.Join(filepath.Dir(c.path), "*"+sqliteSchemaFileExtension))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	mainFile, _ := filepath.Abs(c.path)
+	for _, schemaFile := range schemaFiles {
+		schema := strings.TrimSuffix(filepath.Base(schemaFile), sqliteSchemaFileExtension)
+		if absSchemaFile, _ := filepath.Abs(schemaFile); absSchemaFile == mainFile || !identifierPattern.MatchString(schema) {
+			continue
+		}
+		_, err = conn.(driver.ExecerContext).ExecContext(ctx, "ATTACH DATABASE ? AS "+schema,
+			[]driver.NamedValue{{Ordinal: 1, Value: schemaFile}})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not attach sqlite schema '%s': %w", schema, err)
+		}
+	}
+	return conn, nil
+}
+
+func (c sqliteConnector) Driver() driver.Driver {
+	// the registered driver, which has the functions registered below (opening it does not connect yet):
+	db, _ := sql.Open(sqlite.DriverName, "")
+	return db.Driver()
+}
+
+// Implements "x REGEXP pattern", which sqlite translates to regexp(pattern, x).
+func sqliteRegexp(ctx *sqlitedriver.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if args[0] == nil || args[1] == nil {
+		return nil, nil
+	}
+	matched, err := regexp.MatchString(fmt.Sprint(args[0]), fmt.Sprint(args[1]))
+	if err != nil {
+		return nil, err
+	}
+	return matched, nil
+}
+
+// Implements regexp_replace(value, pattern, replacement) as in postgres, replacing the first match only,
+// where the replacement can reference the groups of the pattern as \1, \2, etc.
+func sqliteRegexpReplace(ctx *sqlitedriver.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if args[0] == nil || args[1] == nil || args[2] == nil {
+		return nil, nil
+	}
+	pattern, err := regexp.Compile(fmt.Sprint(args[1]))
+	if err != nil {
+		return nil, err
+	}
+	value := fmt.Sprint(args[0])
+	replacement := regexp.MustCompile(`\\(\d)`).ReplaceAllString(fmt.Sprint(args[2]), "$${$1}")
+	match := pattern.FindStringSubmatchIndex(value)
+	if match == nil {
+		return value, nil
+	}
+	return value[:match[0]] + string(pattern.ExpandString(nil, replacement, value, match)) + value[match[1]:], nil
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// A map of which the entries expire ttl after they were stored. It is safe for concurrent use.
+type TtlCache[K comparable, V any] struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[K]ttlCacheEntry[V]
+	stats   TtlCacheStats
+}
+
+type ttlCacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+type TtlCacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// entries found expired on lookup, which are counted as misses as well:
+	Expirations   int64 `json:"expirations"`
+	Invalidations int64 `json:"invalidations"`
+	Entries       int   `json:"entries"`
+}
+
+func NewTtlCache[K comparable, V any](ttl time.Duration) *TtlCache[K, V] {
+	return &TtlCache[K, V]{ttl: ttl, entries: make(map[K]ttlCacheEntry[V])}
+}
+
+// Returns the value of the key, if it is found and not expired.
+func (c *TtlCache[K, V]) Get(key K) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, found := c.entries[key]
+	if found && time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		c.stats.Expirations++
+		found = false
+	}
+	if !found {
+		c.stats.Misses++
+		var noValue V
+		return noValue, false
+	}
+	c.stats.Hits++
+	return entry.value, true
+}
+
+// Stores the value of the key. The expired entries are removed as well, so that the
+// entries that are not looked up anymore do not stay in the cache.
+func (c *TtlCache[K, V]) Set(key K, value V) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	for existingKey, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, existingKey)
+			c.stats.Expirations++
+		}
+	}
+	c.entries[key] = ttlCacheEntry[V]{value: value, expiresAt: now.Add(c.ttl)}
+}
+
+// Returns the cached value of the key, or calls load and caches its value if there is none.
+// Errors of load are not cached. The lock is not held while loading, so concurrent
+// misses of the same key can load it more than once.
+func (c *TtlCache[K, V]) GetOrLoad(key K, load func() (V, error)) (V, error) {
+	if value, found := c.Get(key); found {
+		return value, nil
+	}
+	value, err := load()
+	if err != nil {
+		return value, err
+	}
+	c.Set(key, value)
+	return value, nil
+}
+
+// Removes the key from the cache. Returns whether it was cached.
+func (c *TtlCache[K, V]) Invalidate(key K) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, found := c.entries[key]; !found {
+		return false
+	}
+	delete(c.entries, key)
+	c.stats.Invalidations++
+	return true
+}
+
+// Removes all keys from the cache. Returns the number of keys removed.
+func (c *TtlCache[K, V]) InvalidateAll() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	invalidated := len(c.entries)
+	c.entries = make(map[K]ttlCacheEntry[V])
+	c.stats.Invalidations += int64(invalidated)
+	return invalidated
+}
+
+func (c *TtlCache[K, V]) Stats() TtlCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return stats
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+type WorkerPoolConfig struct {
+	// number of items processed concurrently:
+	Workers int
+	// number of successful results passed to each onBatch call:
+	BatchSize int
+	// maximum duration of a single attempt to process an item (0 means no timeout):
+	Timeout time.Duration
+	// number of extra attempts for an item after the first attempt failed:
+	MaxRetries int
+}
+
+type workerPoolResult[T any, R any] struct {
+	item   T
+	result R
+	err    error
+}
+
+// Processes the given items with a bounded pool of poolConfig.Workers goroutines. The results are
+// collected in the calling goroutine: onItemDone is called once for every item (with the error of its
+// last attempt, if all attempts failed) and the successful results are passed on to onBatch in batches
+// of poolConfig.BatchSize. If onBatch returns an error, the remaining items are skipped and that error is returned.
+// The work of all items is done with a context derived from parentCtx, so when parentCtx is done the remaining
+// items fail with its error.
+func RunWorkerPool[T any, R any](parentCtx context.Context, items []T, poolConfig WorkerPoolConfig, work func(ctx context.Context, item T) (R, error),
+	onItemDone func(item T, err error), onBatch func(results []R) error) error {
+
+	workers := max(1, poolConfig.Workers)
+	batchSize := max(1, poolConfig.BatchSize)
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+	// closed when onBatch fails, to stop feeding the remaining items:
+	stopFeeding := make(chan struct{})
+
+	jobs := make(chan T)
+	results := make(chan workerPoolResult[T, R], workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				result, err := runWithRetries(ctx, item, poolConfig, work)
+				results <- workerPoolResult[T, R]{item: item, result: result, err: err}
+			}
+		}()
+	}
+	// feed the items to the workers:
+	go func() {
+		defer close(jobs)
+		for _, item := range items {
+			select {
+			case jobs <- item:
+			case <-stopFeeding:
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var batch []R
+	var batchErr error
+	for workerResult := range results {
+		if batchErr != nil {
+			// just drain the results of the items that were already being processed:
+			continue
+		}
+		onItemDone(workerResult.item, workerResult.err)
+		if workerResult.err != nil {
+			continue
+		}
+		batch = append(batch, workerResult.result)
+		if len(batch) >= batchSize {
+			if err := onBatch(batch); err != nil {
+				batchErr = err
+				close(stopFeeding)
+				cancel()
+				continue
+			}
+			batch = nil
+		}
+	}
+	if batchErr != nil {
+		return batchErr
+	}
+	if len(batch) > 0 {
+		return onBatch(batch)
+	}
+	return nil
+}
+
+func runWithRetries[T any, R any](ctx context.Context, item T, poolConfig WorkerPoolConfig, work func(ctx context.Context, item T) (R, error)) (R, error) {
+	var result R
+	var err error
+	for attempt := 0; attempt <= poolConfig.MaxRetries; attempt++ {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if poolConfig.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, poolConfig.Timeout)
+		}
+		result, err = work(attemptCtx, item)
+		cancel()
+		if err == nil {
+			return result, nil
+		}
+		log.Printf("WARNING: attempt %d of %d failed: %v", attempt+1, poolConfig.MaxRetries+1, err)
+	}
+	return result, err
+}